@@ -34,35 +34,90 @@ import (
 
 	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/client"
+	// Register the docker-container:// connection helper.
+	_ "github.com/moby/buildkit/client/connhelper/dockercontainer"
 	"github.com/moby/buildkit/client/llb"
 
 	"github.com/immutos/debco/internal/buildkit/exptypes"
+	"github.com/immutos/debco/internal/constants"
+	"github.com/immutos/debco/internal/oci"
 	gateway "github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/session"
-	"github.com/moby/buildkit/util/progress/progresswriter"
+	"github.com/moby/buildkit/session/auth/authprovider"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // BuildKit is a wrapper around BuildKit that provides a simplified interface
-// for building OCI images using BuildKit running in a Docker container.
+// for building OCI images using BuildKit running in a Docker container (or
+// an existing BuildKit daemon).
 type BuildKit struct {
 	certsDir      string
 	containerName string
 	address       string
+	// external is set when using an existing BuildKit daemon, that is not
+	// managed by debco.
+	external   bool
+	tlsOpts    *TLSOptions
+	daemonOpts DaemonOptions
+}
+
+// TLSOptions are the TLS credentials used to connect to an existing BuildKit
+// daemon over tcp://.
+type TLSOptions struct {
+	// ServerName is the name of the BuildKit server, used to verify its
+	// certificate. Defaults to the host of the address.
+	ServerName string
+	// CACertPath is the path to the CA certificate used to verify the server.
+	CACertPath string
+	// CertPath is the optional path to the client certificate.
+	CertPath string
+	// KeyPath is the optional path to the client key.
+	KeyPath string
 }
 
 // New creates a new BuildKit instance.
-func New(name, certsDir string) *BuildKit {
+func New(name, certsDir string, daemonOpts DaemonOptions) *BuildKit {
 	return &BuildKit{
 		containerName: fmt.Sprintf("%s-buildkitd", name),
 		certsDir:      certsDir,
+		daemonOpts:    daemonOpts,
+	}
+}
+
+// NewWithAddress creates a new BuildKit instance that uses an existing
+// BuildKit daemon (eg. unix:///run/buildkit/buildkitd.sock, tcp://host:1234
+// or docker-container://buildkitd). The daemon is not started or stopped by
+// debco. tlsOpts is optional, and is only supported for tcp:// addresses.
+func NewWithAddress(address string, tlsOpts *TLSOptions) (*BuildKit, error) {
+	addressURL, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse buildkit address: %w", err)
+	}
+
+	switch addressURL.Scheme {
+	case "unix", "docker-container":
+		if tlsOpts != nil {
+			return nil, fmt.Errorf("TLS is not supported for %s:// buildkit addresses", addressURL.Scheme)
+		}
+	case "tcp":
+		if tlsOpts != nil && tlsOpts.ServerName == "" {
+			tlsOpts.ServerName = addressURL.Hostname()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported buildkit address scheme: %s", addressURL.Scheme)
 	}
+
+	return &BuildKit{
+		address:  address,
+		external: true,
+		tlsOpts:  tlsOpts,
+	}, nil
 }
 
 type BuildOptions struct {
-	// OCIArchivePath is the path to the output OCI image tarball.
-	OCIArchivePath string
+	// Output is the output of the build (eg. an OCI image tarball).
+	Output Output
 	// RecipePath is the path to the debco recipe file.
 	RecipePath string
 	// SourceDateEpoch is the source date epoch for the image.
@@ -75,6 +130,12 @@ type BuildOptions struct {
 	ImageConf ocispecs.ImageConfig
 	// Tags is a list of tags to apply to the image.
 	Tags []string
+	// Layering is the strategy used to split the image into layers.
+	Layering LayeringStrategy
+	// CacheExports is a list of caches to export the build cache to.
+	CacheExports []client.CacheOptionsEntry
+	// CacheImports is a list of caches to import the build cache from.
+	CacheImports []client.CacheOptionsEntry
 	// PlatformOpts is a list of platform build options.
 	PlatformOpts []PlatformBuildOptions
 }
@@ -90,12 +151,218 @@ type PlatformBuildOptions struct {
 	// DataArchivePaths is a list of paths to package data archives.
 	// The paths must be relative to the build context directory.
 	DataArchivePaths []string
+	// RootFSArchivePath is the optional path to a single archive containing
+	// the merged dpkg database and data archives (see unpack.MergeArchives).
+	// If set, it is used instead of the dpkg database and data archives.
+	// The path must be relative to the build context directory.
+	RootFSArchivePath string
+	// PreinstPackages are the packages (in the form name:arch) whose preinst
+	// scripts are run before the packages are configured, in order.
+	PreinstPackages []string
+	// BaseLayer optionally describes the packages that make up the base layer
+	// of the image (when using the packages layering strategy).
+	BaseLayer *LayerOptions
+	// DiskTools describes the packages used to build a disk image from the
+	// root filesystem (required for disk outputs). They are installed into a
+	// separate root filesystem, and are not part of the image.
+	DiskTools *LayerOptions
+}
+
+// LayerOptions are the package archives that make up a layer.
+type LayerOptions struct {
+	// DpkgDatabaseArchivePath is the path to the dpkg configuration archive.
+	DpkgDatabaseArchivePath string
+	// DataArchivePaths is a list of paths to package data archives.
+	DataArchivePaths []string
+	// RootFSArchivePath is the optional path to a single archive containing
+	// the merged dpkg database and data archives.
+	RootFSArchivePath string
+	// PreinstPackages are the packages (in the form name:arch) whose preinst
+	// scripts are run before the packages are configured, in order.
+	PreinstPackages []string
+	// SecondStageArchivePath is the optional path to the data archive of the
+	// debco package, for layers whose packages don't include it (eg. the base
+	// layer). The second-stage binary is copied from it while the layer is
+	// installed, and then removed.
+	SecondStageArchivePath string
+}
+
+// LayeringStrategy determines how the image is split into layers.
+type LayeringStrategy string
+
+const (
+	// LayeringSquash squashes the image into a single layer (the default).
+	LayeringSquash LayeringStrategy = "squash"
+	// LayeringPackages puts the configured base packages (eg. those of
+	// priority required) into their own layer, followed by a layer containing
+	// the additions made by the recipe. The base layer is shared between
+	// images built from the same base packages.
+	LayeringPackages LayeringStrategy = "packages"
+)
+
+// ParseLayeringStrategy parses a layering strategy, an empty string is
+// treated as the default strategy.
+func ParseLayeringStrategy(s string) (LayeringStrategy, error) {
+	switch strategy := LayeringStrategy(s); strategy {
+	case "":
+		return LayeringSquash, nil
+	case LayeringSquash, LayeringPackages:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unsupported layering strategy: %s", s)
+	}
+}
+
+// Where the final root filesystem and the debco binary are mounted when
+// synchronizing the final root filesystem on top of the base layer. Both
+// directories already exist in a Debian root filesystem.
+const (
+	syncSourceDir = "/mnt"
+	syncToolsDir  = "/tmp"
+)
+
+// Where the root filesystem is mounted, and where the disk image is written
+// when building a disk image.
+const (
+	diskRootFSDir = "/mnt"
+	diskOutputDir = "/srv"
+)
+
+// installPackages returns the state of a root filesystem with the given
+// package archives unpacked and configured.
+func installPackages(opts BuildOptions, platformOpt PlatformBuildOptions, buildContextKey string, layer LayerOptions) (llb.State, error) {
+	archivePaths := append([]string{layer.DpkgDatabaseArchivePath}, layer.DataArchivePaths...)
+	if layer.RootFSArchivePath != "" {
+		archivePaths = []string{layer.RootFSArchivePath}
+	}
+
+	// Create an LLB definition for the build.
+	state := llb.Scratch().
+		Platform(platforms.Normalize(platformOpt.Platform)).
+		AddEnv("DEBIAN_FRONTEND", "noninteractive").
+		AddEnv("DEBCONF_NONINTERACTIVE_SEEN", "true").
+		AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+
+	for _, archivePath := range archivePaths {
+		archiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, archivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to archive: %w", err)
+		}
+
+		state = state.File(llb.Copy(llb.Local(buildContextKey), archiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+	}
+
+	if opts.DownloadOnly {
+		return state, nil
+	}
+
+	if opts.SecondStageBinaryPath != "" {
+		// Copy the debco binary into the root filesystem.
+		state = state.File(llb.Copy(llb.Local("second-stage-bin"), filepath.Base(opts.SecondStageBinaryPath), "/usr/bin/debco", &llb.CopyInfo{}))
+	} else if layer.SecondStageArchivePath != "" {
+		secondStageArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, layer.SecondStageArchivePath)
+		if err != nil {
+			return llb.State{}, fmt.Errorf("failed to get relative path to archive: %w", err)
+		}
+
+		// Copy the debco binary out of its package, without installing it.
+		secondStage := llb.Scratch().
+			File(llb.Copy(llb.Local(buildContextKey), secondStageArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+
+		state = state.File(llb.Copy(secondStage, "/usr/bin/debco", "/usr/bin/debco", &llb.CopyInfo{}))
+	}
+
+	// Merge the /usr directory into the root filesystem.
+	state = state.Run(llb.Shlex("debco second-stage merge-usr")).Root()
+
+	// Run the preinst scripts (eg. base-passwd creates the /etc/group and
+	// /etc/passwd files needed by dpkg). Unlike dpkg, this happens after all
+	// the data archives have been unpacked.
+	if len(layer.PreinstPackages) > 0 {
+		args := []string{"debco", "second-stage", "preinst"}
+		for _, pkg := range layer.PreinstPackages {
+			args = append(args, "--package", pkg)
+		}
+
+		state = state.Run(llb.Args(args)).Root()
+	}
+
+	return state.
+		Run(llb.Shlex("dpkg --configure -a")). // Configure the packages.
+		// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
+		// These files are no longer needed and will lead to irreproducible builds.
+		File(llb.Rm("/var/log/dpkg.log")).
+		File(llb.Rm("/var/log/alternatives.log")).
+		File(llb.Rm("/var/cache/ldconfig/aux-cache")), nil
+}
+
+// removeSecondStage removes the no longer needed debco binary.
+func removeSecondStage(opts BuildOptions, layer LayerOptions, state llb.State) llb.State {
+	if opts.DownloadOnly {
+		return state
+	}
+
+	if opts.SecondStageBinaryPath != "" || layer.SecondStageArchivePath != "" {
+		return state.File(llb.Rm("/usr/bin/debco"))
+	}
+
+	// dpkg logs the removal (with the current time), so the log files need to
+	// be removed again.
+	return state.Run(llb.Shlex("dpkg -r debco")).
+		Root().
+		File(llb.Rm("/var/log/dpkg.log", llb.WithAllowNotFound(true))).
+		File(llb.Rm("/var/log/alternatives.log", llb.WithAllowNotFound(true)))
+}
+
+// baseLayerState returns the state of a layer containing only the base
+// packages. It doesn't depend on the rest of the image, so that images
+// built from the same base packages share the layer.
+func baseLayerState(opts BuildOptions, platformOpt PlatformBuildOptions, buildContextKey string) (llb.State, error) {
+	baseState, err := installPackages(opts, platformOpt, buildContextKey, *platformOpt.BaseLayer)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	return llb.Scratch().
+		File(llb.Copy(removeSecondStage(opts, *platformOpt.BaseLayer, baseState), "/", "/", &llb.CopyInfo{})), nil
+}
+
+// buildDisk returns the state of a directory containing a bootable disk
+// image built from the root filesystem. The disk is built in a separate
+// root filesystem containing the disk build tools.
+func buildDisk(opts BuildOptions, platformOpt PlatformBuildOptions, buildContextKey string, rootFS llb.State) (llb.State, error) {
+	if platformOpt.DiskTools == nil {
+		return llb.State{}, fmt.Errorf("no disk build tools for platform %s", platforms.Format(platformOpt.Platform))
+	}
+
+	toolsState, err := installPackages(opts, platformOpt, buildContextKey, *platformOpt.DiskTools)
+	if err != nil {
+		return llb.State{}, err
+	}
+
+	// The root filesystem mount is writable, but any changes made to it (eg.
+	// writing the fstab) are only seen by the disk image.
+	run := toolsState.
+		File(llb.Copy(llb.Local("conf"), filepath.Base(opts.RecipePath), "/etc/debco/config.yaml", &llb.CopyInfo{CreateDestPath: true})).
+		Run(llb.Args([]string{"debco", "second-stage", "build-disk",
+			"-f", "/etc/debco/config.yaml",
+			"--arch", platformOpt.Platform.Architecture,
+			"--rootfs", diskRootFSDir,
+			"--output", filepath.Join(diskOutputDir, "disk.img")}),
+			llb.AddMount(diskRootFSDir, rootFS))
+
+	return run.AddMount(diskOutputDir, llb.Scratch()), nil
 }
 
 // Build builds an OCI image tarball using BuildKit.
 func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 	isMultiPlatform := len(opts.PlatformOpts) > 1
 
+	cacheImports, err := gatewayCacheImports(opts.CacheImports)
+	if err != nil {
+		return fmt.Errorf("failed to resolve cache imports: %w", err)
+	}
+
 	buildFunc := func(ctx context.Context, c gateway.Client) (*gateway.Result, error) {
 		res := gateway.NewResult()
 
@@ -104,63 +371,58 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 
 			buildContextKey := fmt.Sprintf("build-context-%s", strings.ReplaceAll(platformStr, "/", "-"))
 
-			dpkgDatabaseArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, platformOpt.DpkgDatabaseArchivePath)
-			if err != nil {
-				return nil, fmt.Errorf("failed to get relative path to dpkg configuration archive: %w", err)
+			layer := LayerOptions{
+				DpkgDatabaseArchivePath: platformOpt.DpkgDatabaseArchivePath,
+				DataArchivePaths:        platformOpt.DataArchivePaths,
+				RootFSArchivePath:       platformOpt.RootFSArchivePath,
+				PreinstPackages:         platformOpt.PreinstPackages,
 			}
 
-			// Create an LLB definition for the build.
-			state := llb.Scratch().
-				Platform(platforms.Normalize(platformOpt.Platform)).
-				AddEnv("DEBIAN_FRONTEND", "noninteractive").
-				AddEnv("DEBCONF_NONINTERACTIVE_SEEN", "true").
-				AddEnv("PATH", "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin").
-				File(llb.Copy(llb.Local(buildContextKey), dpkgDatabaseArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
-
-			for _, dataArchivePath := range platformOpt.DataArchivePaths {
-				dataArchiveRelPath, err := filepath.Rel(platformOpt.BuildContextDir, dataArchivePath)
-				if err != nil {
-					return nil, fmt.Errorf("failed to get relative path to data archive: %w", err)
-				}
-
-				state = state.File(llb.Copy(llb.Local(buildContextKey), dataArchiveRelPath, "/", &llb.CopyInfo{AttemptUnpack: true}))
+			state, err := installPackages(opts, platformOpt, buildContextKey, layer)
+			if err != nil {
+				return nil, err
 			}
 
 			if !opts.DownloadOnly {
-				if opts.SecondStageBinaryPath != "" {
-					// Copy the debco binary into the root filesystem.
-					state = state.File(llb.Copy(llb.Local("second-stage-bin"), filepath.Base(opts.SecondStageBinaryPath), "/usr/bin/debco", &llb.CopyInfo{}))
-				}
-
-				state = state.
-					Run(llb.Shlex("debco second-stage merge-usr")).                   // Merge the /usr directory into the root filesystem.
-					Run(llb.Shlex("/var/lib/dpkg/info/base-passwd.preinst install")). // Create the /etc/group and /etc/passwd files (needed by dpkg).
-					Run(llb.Shlex("dpkg --configure -a")).                            // Configure the packages.
-					// Remove the dpkg log file, alternatives log file, and ldconfig cache file.
-					// These files are no longer needed and will lead to irreproducible builds.
-					File(llb.Rm("/var/log/dpkg.log")).
-					File(llb.Rm("/var/log/alternatives.log")).
-					File(llb.Rm("/var/cache/ldconfig/aux-cache"))
-
 				// Provision image (eg. create users/groups etc).
 				state = state.
 					File(llb.Copy(llb.Local("conf"), filepath.Base(opts.RecipePath), "/etc/debco/config.yaml", &llb.CopyInfo{CreateDestPath: true})).
 					Run(llb.Shlex("debco second-stage provision -f /etc/debco/config.yaml")).
 					Root().
 					File(llb.Rm("/etc/debco"))
+			}
 
-				// Remove the no longer needed debco binary.
-				if opts.SecondStageBinaryPath != "" {
-					state = state.File(llb.Rm("/usr/bin/debco"))
-				} else {
-					state = state.Run(llb.Shlex("dpkg -r debco")).
-						Root()
+			provisioned := state
+			state = removeSecondStage(opts, layer, state)
+			rootFS := state
+
+			if opts.Layering == LayeringPackages && platformOpt.BaseLayer != nil && !opts.DownloadOnly {
+				// The base packages in their own layer.
+				baseLayer, err := baseLayerState(opts, platformOpt, buildContextKey)
+				if err != nil {
+					return nil, err
 				}
+
+				// Followed by a layer containing the differences between the base
+				// layer and the final root filesystem.
+				state = baseLayer.
+					Run(llb.Args([]string{filepath.Join(syncToolsDir, "usr/bin/debco"), "second-stage", "sync-rootfs",
+						"--source", syncSourceDir, "--exclude", syncSourceDir, "--exclude", syncToolsDir}),
+						llb.AddMount(syncSourceDir, state, llb.Readonly),
+						llb.AddMount(syncToolsDir, provisioned, llb.Readonly)).
+					Root()
+			} else {
+				// Squash everything into a single final layer.
+				state = llb.Scratch().
+					File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
 			}
 
-			// Squash everything into a single final layer.
-			state = llb.Scratch().
-				File(llb.Copy(state, "/", "/", &llb.CopyInfo{}))
+			if opts.Output.Type == OutputDisk {
+				state, err = buildDisk(opts, platformOpt, buildContextKey, rootFS)
+				if err != nil {
+					return nil, err
+				}
+			}
 
 			// Marshal the LLB definition.
 			def, err := state.Marshal(ctx, llb.Platform(platformOpt.Platform))
@@ -169,7 +431,8 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 			}
 
 			r, err := c.Solve(ctx, gateway.SolveRequest{
-				Definition: def.ToPB(),
+				Definition:   def.ToPB(),
+				CacheImports: cacheImports,
 			})
 			if err != nil {
 				return nil, err
@@ -204,17 +467,7 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 		return res, nil
 	}
 
-	buildkitURL, err := url.Parse(b.address)
-	if err != nil {
-		return fmt.Errorf("failed to parse buildkit address: %w", err)
-	}
-
-	c, err := client.New(ctx, "buildkitd", client.WithCredentials("buildkitd",
-		filepath.Join(b.certsDir, "ca.pem"), filepath.Join(b.certsDir, "debco.pem"), filepath.Join(b.certsDir, "debco-key.pem")),
-		client.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
-			var d net.Dialer
-			return d.DialContext(ctx, "tcp", buildkitURL.Host)
-		}))
+	c, err := b.newClient(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create buildkit client: %w", err)
 	}
@@ -227,15 +480,10 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 	}
 	defer sess.Close()
 
-	mode := "auto"
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
-		mode = "plain"
-	}
-
 	printerCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	pw, err := progresswriter.NewPrinter(printerCtx, os.Stdout, mode)
+	pw, err := newProgressWriter(printerCtx)
 	if err != nil {
 		return fmt.Errorf("failed to create progress writer: %w", err)
 	}
@@ -263,25 +511,12 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 	}
 
 	_, err = c.Build(ctx, client.SolveOpt{
-		LocalDirs: localDirs,
-		Exports: []client.ExportEntry{
-			{
-				Type: client.ExporterOCI,
-				Output: func(_ map[string]string) (io.WriteCloser, error) {
-					ociArchiveFile, err := os.Create(opts.OCIArchivePath)
-					if err != nil {
-						return nil, fmt.Errorf("failed to create output oci tarball: %w", err)
-					}
-
-					return ociArchiveFile, nil
-				},
-				Attrs: map[string]string{
-					"name":                          strings.Join(opts.Tags, ","),
-					exptypes.OptKeySourceDateEpoch:  strconv.Itoa(int(opts.SourceDateEpoch.UTC().Unix())),
-					exptypes.OptKeyRewriteTimestamp: "true",
-				},
-			},
-		},
+		LocalDirs:    localDirs,
+		Exports:      []client.ExportEntry{exportEntry(opts)},
+		CacheExports: opts.CacheExports,
+		CacheImports: opts.CacheImports,
+		// Registry credentials are read from the docker config file.
+		Session: []session.Attachable{authprovider.NewDockerAuthProvider(os.Stderr)},
 	}, "", buildFunc, pw.Status())
 	if err != nil {
 		return fmt.Errorf("failed to build image: %w", err)
@@ -290,6 +525,121 @@ func (b *BuildKit) Build(ctx context.Context, opts BuildOptions) error {
 	return nil
 }
 
+// UnknownVersion is the version reported for an existing BuildKit daemon.
+const UnknownVersion = "unknown"
+
+// Version returns the version of the BuildKit daemon started by debco. The
+// BuildKit API doesn't report the version of the daemon, so UnknownVersion is
+// returned when using an existing BuildKit daemon.
+func (b *BuildKit) Version() string {
+	if b.external {
+		return UnknownVersion
+	}
+
+	return constants.BuildKitImage[strings.LastIndex(constants.BuildKitImage, ":")+1:]
+}
+
+// newClient connects to the BuildKit daemon.
+func (b *BuildKit) newClient(ctx context.Context) (*client.Client, error) {
+	if b.external {
+		var opts []client.ClientOpt
+		if b.tlsOpts != nil {
+			opts = append(opts, client.WithCredentials(b.tlsOpts.ServerName,
+				b.tlsOpts.CACertPath, b.tlsOpts.CertPath, b.tlsOpts.KeyPath))
+		}
+
+		return client.New(ctx, b.address, opts...)
+	}
+
+	buildkitURL, err := url.Parse(b.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse buildkit address: %w", err)
+	}
+
+	// The daemon started by debco uses the self-signed certificates in the
+	// certs directory.
+	return client.New(ctx, "buildkitd", client.WithCredentials("buildkitd",
+		filepath.Join(b.certsDir, "ca.pem"), filepath.Join(b.certsDir, "debco.pem"), filepath.Join(b.certsDir, "debco-key.pem")),
+		client.WithContextDialer(func(_ context.Context, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", buildkitURL.Host)
+		}))
+}
+
+// exportEntry returns the BuildKit exporter for the image, BuildKit only
+// supports a single exporter per build.
+func exportEntry(opts BuildOptions) client.ExportEntry {
+	attrs := map[string]string{
+		exptypes.OptKeySourceDateEpoch: strconv.Itoa(int(opts.SourceDateEpoch.UTC().Unix())),
+	}
+
+	isMultiPlatform := len(opts.PlatformOpts) > 1
+
+	switch {
+	case opts.Output.Type == OutputLocal:
+		// Multi-platform builds are exported to a subdirectory per platform.
+		return client.ExportEntry{
+			Type:      client.ExporterLocal,
+			OutputDir: opts.Output.Dest,
+			Attrs:     attrs,
+		}
+	case opts.Output.Type == OutputDisk:
+		return client.ExportEntry{
+			Type: client.ExporterTar,
+			Output: func(_ map[string]string) (io.WriteCloser, error) {
+				dests := map[string]string{"": opts.Output.Dest}
+				if isMultiPlatform {
+					dests = make(map[string]string)
+					for _, platformOpt := range opts.PlatformOpts {
+						dests[platformID(platformOpt.Platform)] = opts.Output.PlatformDest(platformOpt.Platform, true)
+					}
+				}
+
+				return extractDiskImages(dests), nil
+			},
+			Attrs: attrs,
+		}
+	case opts.Output.Type == OutputTar:
+		return client.ExportEntry{
+			Type: client.ExporterTar,
+			Output: func(_ map[string]string) (io.WriteCloser, error) {
+				if isMultiPlatform {
+					dests := make(map[string]string)
+					for _, platformOpt := range opts.PlatformOpts {
+						dests[platformID(platformOpt.Platform)] = opts.Output.PlatformDest(platformOpt.Platform, true)
+					}
+
+					return splitPlatformArchives(dests), nil
+				}
+
+				rootFSArchiveFile, err := os.Create(opts.Output.Dest)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create output rootfs tarball: %w", err)
+				}
+
+				return rootFSArchiveFile, nil
+			},
+			Attrs: attrs,
+		}
+	default:
+		attrs["name"] = strings.Join(opts.Tags, ",")
+		attrs[exptypes.OptKeyRewriteTimestamp] = "true"
+
+		return client.ExportEntry{
+			Type: client.ExporterOCI,
+			Output: func(_ map[string]string) (io.WriteCloser, error) {
+				ociArchiveFile, err := os.Create(opts.Output.Dest)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create output oci tarball: %w", err)
+				}
+
+				return ociArchiveFile, nil
+			},
+			Attrs: attrs,
+		}
+	}
+}
+
 func exporterPlatforms(platformOpts ...PlatformBuildOptions) []byte {
 	exporterPlatforms := exptypes.Platforms{
 		Platforms: make([]exptypes.Platform, len(platformOpts)),
@@ -311,20 +661,7 @@ func exporterPlatforms(platformOpts ...PlatformBuildOptions) []byte {
 }
 
 func exporterImageConfig(imageConf ocispecs.ImageConfig, platformOpt PlatformBuildOptions) ([]byte, error) {
-	defaultEnv := []string{
-		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"TERM=xterm",
-	}
-
-	imageConf.Env = append(defaultEnv, imageConf.Env...)
-
-	img := ocispecs.Image{
-		Platform: platformOpt.Platform,
-		Config:   imageConf,
-		RootFS: ocispecs.RootFS{
-			Type: "layers",
-		},
-	}
+	img := oci.NewImage(imageConf, platformOpt.Platform)
 
 	data, err := json.Marshal(img)
 	if err != nil {
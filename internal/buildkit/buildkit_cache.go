@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moby/buildkit/client"
+	gateway "github.com/moby/buildkit/frontend/gateway/client"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Supported BuildKit cache types.
+const (
+	// CacheLocal is a cache stored in a local directory (an OCI image layout).
+	CacheLocal = "local"
+	// CacheRegistry is a cache stored in a registry as a separate image.
+	CacheRegistry = "registry"
+	// CacheInline is a cache embedded in the pushed image (export only, to
+	// import it use a registry cache with the image reference).
+	CacheInline = "inline"
+)
+
+// ParseCacheExports parses cache exports in the form
+// type=<type>,<key>=<value>,... (eg. type=local,dest=/tmp/cache or
+// type=registry,ref=example.com/cache,mode=max). A plain value is treated as
+// a registry reference.
+func ParseCacheExports(specs []string) ([]client.CacheOptionsEntry, error) {
+	var entries []client.CacheOptionsEntry
+	for _, spec := range specs {
+		entry, err := parseCacheOptions(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache export %q: %w", spec, err)
+		}
+
+		switch entry.Type {
+		case CacheLocal:
+			if entry.Attrs["dest"] == "" {
+				return nil, fmt.Errorf("invalid cache export %q: local cache requires dest", spec)
+			}
+		case CacheRegistry:
+			if entry.Attrs["ref"] == "" {
+				return nil, fmt.Errorf("invalid cache export %q: registry cache requires ref", spec)
+			}
+		case CacheInline:
+		default:
+			return nil, fmt.Errorf("invalid cache export %q: unsupported cache type: %s", spec, entry.Type)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// ParseCacheImports parses cache imports in the form
+// type=<type>,<key>=<value>,... (eg. type=local,src=/tmp/cache or
+// type=registry,ref=example.com/cache). A plain value is treated as a
+// registry reference.
+func ParseCacheImports(specs []string) ([]client.CacheOptionsEntry, error) {
+	var entries []client.CacheOptionsEntry
+	for _, spec := range specs {
+		entry, err := parseCacheOptions(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache import %q: %w", spec, err)
+		}
+
+		switch entry.Type {
+		case CacheLocal:
+			if entry.Attrs["src"] == "" {
+				return nil, fmt.Errorf("invalid cache import %q: local cache requires src", spec)
+			}
+		case CacheRegistry:
+			if entry.Attrs["ref"] == "" {
+				return nil, fmt.Errorf("invalid cache import %q: registry cache requires ref", spec)
+			}
+		default:
+			return nil, fmt.Errorf("invalid cache import %q: unsupported cache type: %s", spec, entry.Type)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func parseCacheOptions(spec string) (client.CacheOptionsEntry, error) {
+	if !strings.Contains(spec, "=") {
+		return client.CacheOptionsEntry{
+			Type:  CacheRegistry,
+			Attrs: map[string]string{"ref": spec},
+		}, nil
+	}
+
+	entry := client.CacheOptionsEntry{Attrs: map[string]string{}}
+	for _, field := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return client.CacheOptionsEntry{}, fmt.Errorf("invalid field: %s", field)
+		}
+
+		if key == "type" {
+			entry.Type = value
+		} else {
+			entry.Attrs[key] = value
+		}
+	}
+
+	if entry.Type == "" {
+		return client.CacheOptionsEntry{}, errors.New("cache type is required")
+	}
+
+	return entry, nil
+}
+
+// gatewayCacheImports returns the cache imports used by the solves made from
+// the build function. Solves made through the gateway don't inherit the
+// imports of the build, and local imports need an explicit digest, which is
+// read from the index of the cache directory. Local caches that don't exist
+// yet (eg. on the first build) are skipped.
+func gatewayCacheImports(imports []client.CacheOptionsEntry) ([]gateway.CacheOptionsEntry, error) {
+	var entries []gateway.CacheOptionsEntry
+	for _, im := range imports {
+		attrs := make(map[string]string, len(im.Attrs))
+		for k, v := range im.Attrs {
+			attrs[k] = v
+		}
+
+		if im.Type == CacheLocal && attrs["digest"] == "" {
+			dgst, err := localCacheDigest(attrs["src"], attrs["tag"])
+			if errors.Is(err, os.ErrNotExist) {
+				slog.Warn("Local cache not found, skipping import", slog.String("src", attrs["src"]))
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			attrs["digest"] = dgst
+		}
+
+		entries = append(entries, gateway.CacheOptionsEntry{
+			Type:  im.Type,
+			Attrs: attrs,
+		})
+	}
+
+	return entries, nil
+}
+
+// localCacheDigest returns the digest of the cache manifest with the given
+// tag (defaults to latest) in the index of a local cache directory.
+func localCacheDigest(dir, tag string) (string, error) {
+	if tag == "" {
+		tag = "latest"
+	}
+
+	indexBytes, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return "", err
+	}
+
+	var index ocispecs.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return "", fmt.Errorf("failed to parse cache index: %w", err)
+	}
+
+	for _, m := range index.Manifests {
+		if m.Annotations[ocispecs.AnnotationRefName] == tag {
+			return m.Digest.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("cache %s not found in %s: %w", tag, dir, os.ErrNotExist)
+}
@@ -0,0 +1,70 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit_test
+
+import (
+	"testing"
+
+	"github.com/immutos/debco/internal/buildkit"
+	"github.com/moby/buildkit/client"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCacheExports(t *testing.T) {
+	exports, err := buildkit.ParseCacheExports([]string{
+		"type=local,dest=/tmp/cache,mode=max",
+		"type=registry,ref=registry.example.com/debco/cache",
+		"type=inline",
+		"registry.example.com/debco/cache:bookworm",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []client.CacheOptionsEntry{
+		{Type: buildkit.CacheLocal, Attrs: map[string]string{"dest": "/tmp/cache", "mode": "max"}},
+		{Type: buildkit.CacheRegistry, Attrs: map[string]string{"ref": "registry.example.com/debco/cache"}},
+		{Type: buildkit.CacheInline, Attrs: map[string]string{}},
+		{Type: buildkit.CacheRegistry, Attrs: map[string]string{"ref": "registry.example.com/debco/cache:bookworm"}},
+	}, exports)
+
+	_, err = buildkit.ParseCacheExports([]string{"type=local,src=/tmp/cache"})
+	require.Error(t, err)
+
+	_, err = buildkit.ParseCacheExports([]string{"type=gha"})
+	require.Error(t, err)
+
+	_, err = buildkit.ParseCacheExports([]string{"dest=/tmp/cache"})
+	require.Error(t, err)
+}
+
+func TestParseCacheImports(t *testing.T) {
+	imports, err := buildkit.ParseCacheImports([]string{
+		"type=local,src=/tmp/cache",
+		"registry.example.com/debco/debian:latest",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []client.CacheOptionsEntry{
+		{Type: buildkit.CacheLocal, Attrs: map[string]string{"src": "/tmp/cache"}},
+		{Type: buildkit.CacheRegistry, Attrs: map[string]string{"ref": "registry.example.com/debco/debian:latest"}},
+	}, imports)
+
+	_, err = buildkit.ParseCacheImports([]string{"type=inline"})
+	require.Error(t, err)
+
+	_, err = buildkit.ParseCacheImports([]string{"type=registry"})
+	require.Error(t, err)
+}
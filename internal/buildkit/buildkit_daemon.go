@@ -19,16 +19,24 @@
 package buildkit
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/url"
 	"os"
-	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,22 +47,69 @@ import (
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/go-connections/nat"
 	"github.com/immutos/debco/internal/constants"
+	"github.com/immutos/debco/internal/progress"
 	"golang.org/x/term"
 )
 
-// StartDaemon starts the BuildKit daemon in a Docker container (if it is not already running).
+// The rootless BuildKit image runs the daemon as this user, with its home
+// directory at /home/user.
+const (
+	rootlessUID      = 1000
+	rootlessCertsDir = "/home/user/certs"
+	rootlessStateDir = "/home/user/.local/share/buildkit"
+)
+
+// Where the BuildKit daemon keeps its state (eg. the build cache), and reads
+// its configuration from.
+const (
+	stateDir        = "/var/lib/buildkit"
+	configDir       = "/etc/buildkit"
+	configHashLabel = "com.github.immutos.debco.config-hash"
+)
+
+// DaemonOptions are the options of the BuildKit daemon started by debco.
+type DaemonOptions struct {
+	// GCKeepStorage is the amount of build cache (in bytes) kept by the
+	// garbage collector. Zero uses the BuildKit default.
+	GCKeepStorage int64
+	// GCKeepDuration is how long unused build cache is kept for by the garbage
+	// collector. Zero uses the BuildKit default.
+	GCKeepDuration time.Duration
+}
+
+// The routing table of the network namespace we are running in.
+const procNetRoutePath = "/proc/net/route"
+
+// StartDaemon starts the BuildKit daemon in a Docker (or Podman) container, if
+// it is not already running. If the container engine is rootless, the
+// rootless BuildKit image is used without a privileged container. The state
+// of the daemon is kept in a named volume, so the build cache survives the
+// container being recreated (eg. when the certificates are rotated). It does
+// nothing when using an existing BuildKit daemon.
 func (b *BuildKit) StartDaemon(ctx context.Context) error {
+	if b.external {
+		return nil
+	}
+
 	needsRestart, err := refreshCertificates(b.certsDir)
 	if err != nil {
 		return fmt.Errorf("failed to refresh certificates: %w", err)
 	}
 
-	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	cli, err := newEngineClient()
 	if err != nil {
-		return fmt.Errorf("failed to create Docker client: %w", err)
+		return err
 	}
 	defer cli.Close()
 
+	rootless, err := isRootless(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	daemonConfig := b.daemonOpts.config()
+	configHash := fmt.Sprintf("%x", sha256.Sum256(daemonConfig))
+
 	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
 	if err != nil {
 		return fmt.Errorf("failed to list containers: %w", err)
@@ -63,8 +118,8 @@ func (b *BuildKit) StartDaemon(ctx context.Context) error {
 	var containerID string
 	for _, c := range containers {
 		if c.Names[0] == "/"+b.containerName {
-			// Check if the container is already running.
-			if c.State == "running" && !needsRestart {
+			// Check if the container is already running (with the same configuration).
+			if c.State == "running" && !needsRestart && c.Labels[configHashLabel] == configHash {
 				containerID = c.ID
 				goto BUILDKITD_ALREADY_RUNNING
 			}
@@ -78,17 +133,36 @@ func (b *BuildKit) StartDaemon(ctx context.Context) error {
 	}
 
 	{
+		// Where the certificates and state are found in the container.
+		containerCertsDir := "/certs"
+		containerStateDir := stateDir
+		if rootless {
+			// The rootless image runs as an unprivileged user.
+			containerCertsDir = rootlessCertsDir
+			containerStateDir = rootlessStateDir
+		}
+
 		config := &container.Config{
 			Image: constants.BuildKitImage,
 			Cmd: []string{
 				"--addr", "tcp://0.0.0.0:8443",
-				"--tlscert", "/certs/buildkitd.pem",
-				"--tlskey", "/certs/buildkitd-key.pem",
-				"--tlscacert", "/certs/ca.pem",
+				"--tlscert", path.Join(containerCertsDir, "buildkitd.pem"),
+				"--tlskey", path.Join(containerCertsDir, "buildkitd-key.pem"),
+				"--tlscacert", path.Join(containerCertsDir, "ca.pem"),
+				"--config", path.Join(configDir, "buildkitd.toml"),
 			},
 			ExposedPorts: map[nat.Port]struct{}{
 				"8443/tcp": {},
 			},
+			Labels: map[string]string{
+				configHashLabel: configHash,
+			},
+		}
+
+		stateVolume := mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: b.containerName + "-state",
+			Target: containerStateDir,
 		}
 
 		hostConfig := &container.HostConfig{
@@ -109,9 +183,25 @@ func (b *BuildKit) StartDaemon(ctx context.Context) error {
 					Target:   "/certs/",
 					ReadOnly: true,
 				},
+				stateVolume,
 			},
 		}
 
+		if rootless {
+			slog.Debug("Container engine is rootless, using rootless buildkit")
+
+			// Run BuildKit under rootlesskit, without any extra privileges.
+			// See: https://github.com/moby/buildkit/blob/master/docs/rootless.md
+			config.Image = constants.BuildKitRootlessImage
+			config.Cmd = append(config.Cmd, "--oci-worker-no-process-sandbox")
+
+			hostConfig.Privileged = false
+			hostConfig.SecurityOpt = []string{"seccomp=unconfined", "apparmor=unconfined"}
+			// The certificates are copied into the container, as the files in a
+			// bind mount would be owned by a user the daemon can't read as.
+			hostConfig.Mounts = []mount.Mount{stateVolume}
+		}
+
 		// Check if the buildkit image is already available.
 		_, _, err := cli.ImageInspectWithRaw(ctx, config.Image)
 		if err != nil {
@@ -136,6 +226,16 @@ func (b *BuildKit) StartDaemon(ctx context.Context) error {
 			return fmt.Errorf("failed to create buildkit container: %w", err)
 		}
 
+		if err := copyDaemonConfig(ctx, cli, resp.ID, daemonConfig); err != nil {
+			return fmt.Errorf("failed to copy configuration into buildkit container: %w", err)
+		}
+
+		if rootless {
+			if err := copyCertificates(ctx, cli, resp.ID, b.certsDir); err != nil {
+				return fmt.Errorf("failed to copy certificates into buildkit container: %w", err)
+			}
+		}
+
 		if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
 			return fmt.Errorf("failed to start buildkit container: %w", err)
 		}
@@ -157,11 +257,16 @@ BUILDKITD_ALREADY_RUNNING:
 	return nil
 }
 
-// StopDaemon stops the BuildKit daemon running in a Docker container.
+// StopDaemon stops the BuildKit daemon running in a Docker container. It does
+// nothing when using an existing BuildKit daemon.
 func (b *BuildKit) StopDaemon(ctx context.Context) error {
-	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
+	if b.external {
+		return nil
+	}
+
+	cli, err := newEngineClient()
 	if err != nil {
-		return fmt.Errorf("failed to create Docker client: %w", err)
+		return err
 	}
 	defer cli.Close()
 
@@ -202,29 +307,236 @@ func getBuildKitAddress(ctx context.Context, cli *dockerclient.Client, container
 	case "http", "https", "tcp":
 		host = daemonHostURL.Hostname()
 	case "unix", "npipe":
-		// Use the default gateway IP (presumably the Docker host) if we are in a container.
-		if _, err := os.Stat("/.dockerenv"); err == nil {
-			cmd := exec.CommandContext(ctx, "ip", "route")
-			stdout, err := cmd.Output()
+		// Use the default gateway IP (presumably the container host) if we are
+		// in a container.
+		if inContainer() {
+			f, err := os.Open(procNetRoutePath)
 			if err != nil {
-				return "", fmt.Errorf("failed to get default gateway IP: %w", err)
+				return "", fmt.Errorf("failed to read routing table: %w", err)
 			}
+			defer f.Close()
 
-			for _, line := range strings.Split(string(stdout), "\n") {
-				if strings.Contains(line, "default") {
-					fields := strings.Fields(line)
-					host = fields[2]
-					break
-				}
+			gateway, err := defaultGateway(f)
+			if err != nil {
+				return "", fmt.Errorf("failed to get default gateway IP: %w", err)
 			}
+
+			host = gateway.String()
 		}
 	default:
-		return "", fmt.Errorf("unsupported daemon host scheme: %s" + daemonHostURL.Scheme)
+		return "", fmt.Errorf("unsupported daemon host scheme: %s", daemonHostURL.Scheme)
 	}
 
 	return "tcp://" + net.JoinHostPort(host, port[0].HostPort), nil
 }
 
+// newEngineClient returns a client for the Docker Engine API of the local
+// container engine. This is either Docker, or Podman using its Docker
+// compatible API. DOCKER_HOST takes precedence, otherwise the first engine
+// socket found is used.
+func newEngineClient() (*dockerclient.Client, error) {
+	opts := []dockerclient.Opt{dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation()}
+
+	if os.Getenv("DOCKER_HOST") == "" {
+		if socketPath := findEngineSocket(engineSocketPaths()); socketPath != "" {
+			opts = append(opts, dockerclient.WithHost("unix://"+socketPath))
+		}
+	}
+
+	cli, err := dockerclient.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container engine client: %w", err)
+	}
+
+	return cli, nil
+}
+
+// engineSocketPaths returns the paths of the Docker Engine API sockets of
+// the supported container engines, in order of preference.
+func engineSocketPaths() []string {
+	socketPaths := []string{"/var/run/docker.sock"}
+
+	// Rootless Docker and Podman.
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		socketPaths = append(socketPaths,
+			filepath.Join(runtimeDir, "docker.sock"),
+			filepath.Join(runtimeDir, "podman", "podman.sock"))
+	}
+
+	return append(socketPaths, "/run/podman/podman.sock")
+}
+
+// findEngineSocket returns the first of the socket paths that exists.
+func findEngineSocket(socketPaths []string) string {
+	for _, socketPath := range socketPaths {
+		if fi, err := os.Stat(socketPath); err == nil && fi.Mode().Type() == fs.ModeSocket {
+			return socketPath
+		}
+	}
+
+	return ""
+}
+
+// isRootless returns whether the container engine is running in rootless
+// mode (in which case privileged containers are not available).
+func isRootless(ctx context.Context, cli *dockerclient.Client) (bool, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get container engine info: %w", err)
+	}
+
+	// Both Docker and Podman report rootless mode as a security option.
+	for _, opt := range info.SecurityOptions {
+		if strings.Contains(opt, "name=rootless") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// copyCertificates copies the certificates used by the daemon into the
+// rootless BuildKit container, owned by the user the daemon runs as.
+func copyCertificates(ctx context.Context, cli *dockerclient.Client, containerID, certsDir string) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     path.Base(rootlessCertsDir) + "/",
+		Mode:     0o700,
+		Uid:      rootlessUID,
+		Gid:      rootlessUID,
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"ca.pem", "buildkitd.pem", "buildkitd-key.pem"} {
+		data, err := os.ReadFile(filepath.Join(certsDir, name))
+		if err != nil {
+			return err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Join(path.Base(rootlessCertsDir), name),
+			Mode:     0o600,
+			Uid:      rootlessUID,
+			Gid:      rootlessUID,
+			Size:     int64(len(data)),
+		}); err != nil {
+			return err
+		}
+
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return cli.CopyToContainer(ctx, containerID, path.Dir(rootlessCertsDir), &buf, types.CopyToContainerOptions{})
+}
+
+// config returns the BuildKit daemon configuration file (buildkitd.toml).
+func (o DaemonOptions) config() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[worker.oci]\n  gc = true\n")
+
+	if o.GCKeepStorage > 0 || o.GCKeepDuration > 0 {
+		buf.WriteString("\n[[worker.oci.gcpolicy]]\n  all = true\n")
+
+		if o.GCKeepStorage > 0 {
+			fmt.Fprintf(&buf, "  keepBytes = %q\n", strconv.FormatInt(o.GCKeepStorage, 10))
+		}
+
+		if o.GCKeepDuration > 0 {
+			fmt.Fprintf(&buf, "  keepDuration = %q\n", o.GCKeepDuration.String())
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// copyDaemonConfig copies the BuildKit daemon configuration file into the
+// container (before it is started).
+func copyDaemonConfig(ctx context.Context, cli *dockerclient.Client, containerID string, config []byte) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     path.Base(configDir) + "/",
+		Mode:     0o755,
+	}); err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     path.Join(path.Base(configDir), "buildkitd.toml"),
+		Mode:     0o644,
+		Size:     int64(len(config)),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(config); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return cli.CopyToContainer(ctx, containerID, path.Dir(configDir), &buf, types.CopyToContainerOptions{})
+}
+
+// inContainer returns whether we are running in a Docker or Podman container.
+func inContainer() bool {
+	for _, markerPath := range []string{"/.dockerenv", "/run/.containerenv"} {
+		if _, err := os.Stat(markerPath); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// defaultGateway returns the default gateway from a Linux routing table (in
+// the format of /proc/net/route).
+func defaultGateway(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+
+	// Skip the header.
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		// The gateway is a little-endian hex encoded IPv4 address.
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gateway %q: %w", fields[2], err)
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		binary.LittleEndian.PutUint32(ip, uint32(gateway))
+		return ip, nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, errors.New("no default route")
+}
+
 func waitForBuildKit(ctx context.Context, cli *dockerclient.Client, containerID, buildkitAddress string) error {
 	buildkitURL, err := url.Parse(buildkitAddress)
 	if err != nil {
@@ -264,7 +576,7 @@ func waitForBuildKit(ctx context.Context, cli *dockerclient.Client, containerID,
 }
 
 func displayImagePullProgress(ctx context.Context, progressReader io.Reader) error {
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+	if slog.Default().Enabled(ctx, slog.LevelDebug) || progress.CurrentMode() != progress.ModeAuto {
 		seen := make(map[string]bool)
 
 		dec := json.NewDecoder(progressReader)
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultGateway(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000FEA9	00000000	0001	0	0	0	0000FFFF	0	0	0
+eth0	00000000	010011AC	0003	0	0	0	00000000	0	0	0
+eth0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+`
+
+	gateway, err := defaultGateway(strings.NewReader(routes))
+	require.NoError(t, err)
+	require.True(t, net.ParseIP("172.17.0.1").Equal(gateway))
+
+	t.Run("No Default Route", func(t *testing.T) {
+		_, err := defaultGateway(strings.NewReader(strings.Join(strings.Split(routes, "\n")[:2], "\n")))
+		require.Error(t, err)
+	})
+}
+
+func TestFindEngineSocket(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Only sockets are considered.
+	regularFilePath := filepath.Join(tempDir, "docker.sock")
+	require.NoError(t, os.WriteFile(regularFilePath, nil, 0o644))
+
+	socketPath := filepath.Join(tempDir, "podman.sock")
+	l, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	require.Equal(t, socketPath, findEngineSocket([]string{
+		filepath.Join(tempDir, "missing.sock"),
+		regularFilePath,
+		socketPath,
+	}))
+
+	require.Empty(t, findEngineSocket([]string{regularFilePath}))
+}
+
+func TestDaemonConfig(t *testing.T) {
+	require.Equal(t, "[worker.oci]\n  gc = true\n", string(DaemonOptions{}.config()))
+
+	expected := `[worker.oci]
+  gc = true
+
+[[worker.oci.gcpolicy]]
+  all = true
+  keepBytes = "20000000000"
+  keepDuration = "168h0m0s"
+`
+
+	config := DaemonOptions{
+		GCKeepStorage:  20_000_000_000,
+		GCKeepDuration: 7 * 24 * time.Hour,
+	}.config()
+	require.Equal(t, expected, string(config))
+}
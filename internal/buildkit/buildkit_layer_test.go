@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseLayerState(t *testing.T) {
+	ctx := context.Background()
+
+	platformOpt := PlatformBuildOptions{
+		Platform:                platforms.MustParse("linux/amd64"),
+		BuildContextDir:         "/tmp/build",
+		DpkgDatabaseArchivePath: "/tmp/build/dpkg.tar",
+		DataArchivePaths:        []string{"/tmp/build/base-files_data.tar.xz", "/tmp/build/hello_data.tar.xz"},
+		BaseLayer: &LayerOptions{
+			DpkgDatabaseArchivePath: "/tmp/build/base/dpkg.tar",
+			DataArchivePaths:        []string{"/tmp/build/base-files_data.tar.xz"},
+			PreinstPackages:         []string{"base-files:amd64"},
+			SecondStageArchivePath:  "/tmp/build/debco_data.tar.xz",
+		},
+	}
+
+	marshal := func(t *testing.T, platformOpt PlatformBuildOptions) (digest.Digest, string) {
+		state, err := baseLayerState(BuildOptions{}, platformOpt, "build-context")
+		require.NoError(t, err)
+
+		// Every marshal gets a new local source ID (which doesn't affect the
+		// cache key of the source), so use a fixed one.
+		def, err := state.Marshal(ctx, llb.Platform(platformOpt.Platform), llb.LocalUniqueID("debco-test"))
+		require.NoError(t, err)
+
+		var ops strings.Builder
+		for _, dt := range def.Def {
+			ops.Write(dt)
+		}
+
+		// The last op references its inputs by digest, so identifies the layer.
+		return digest.FromBytes(def.Def[len(def.Def)-1]), ops.String()
+	}
+
+	expected, ops := marshal(t, platformOpt)
+
+	// The same base layer is built every time.
+	actual, _ := marshal(t, platformOpt)
+	require.Equal(t, expected, actual)
+
+	// Regardless of the rest of the image.
+	platformOpt.DataArchivePaths = append(platformOpt.DataArchivePaths, "/tmp/build/vim_data.tar.xz")
+	actual, _ = marshal(t, platformOpt)
+	require.Equal(t, expected, actual)
+
+	// The second-stage binary is removed without dpkg (which would log the
+	// removal with the current time).
+	require.NotContains(t, ops, "dpkg -r debco")
+	require.Contains(t, ops, "debco_data.tar.xz")
+}
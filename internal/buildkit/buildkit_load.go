@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/immutos/debco/internal/oci"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// LoadImage loads the image in an OCI image archive into the local Docker
+// daemon. For multi-platform images, the image matching the platform of the
+// Docker daemon is loaded.
+func LoadImage(ctx context.Context, ociArchivePath string, tags []string) error {
+	cli, err := newEngineClient()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get Docker info: %w", err)
+	}
+
+	// The daemon reports the kernel architecture (eg. x86_64).
+	platform := platforms.Normalize(ocispecs.Platform{OS: info.OSType, Architecture: info.Architecture})
+
+	slog.Info("Loading image into Docker", slog.String("platform", platforms.Format(platform)))
+
+	// Stream the image into the daemon, without writing it to disk.
+	pr, pw := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := oci.WriteDockerArchive(pw, ociArchivePath, platform, tags)
+		_ = pw.CloseWithError(err)
+		writeErr <- err
+	}()
+	defer pr.Close()
+
+	resp, err := cli.ImageLoad(ctx, pr, true)
+	if err != nil {
+		_ = pr.Close()
+		return fmt.Errorf("failed to load image: %w", errors.Join(<-writeErr, err))
+	}
+	defer resp.Body.Close()
+
+	// Errors are reported in the response stream.
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var j jsonmessage.JSONMessage
+		if err := dec.Decode(&j); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("failed to read image load response: %w", err)
+		}
+
+		if j.Error != nil {
+			// The daemon only sees a truncated archive if the image couldn't be
+			// converted.
+			_ = pr.Close()
+			return fmt.Errorf("failed to load image: %w", errors.Join(<-writeErr, j.Error))
+		}
+
+		if msg := strings.TrimSpace(j.Stream); msg != "" {
+			slog.Info(msg)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/debco/internal/util"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OutputType is the type of output produced by a build.
+type OutputType string
+
+const (
+	// OutputOCI is an OCI image archive (the default).
+	OutputOCI OutputType = "oci"
+	// OutputTar is an archive of the root filesystem.
+	OutputTar OutputType = "tar"
+	// OutputLocal is a directory containing the root filesystem.
+	OutputLocal OutputType = "local"
+	// OutputDisk is a bootable virtual machine disk image (the recipe must
+	// have a disk section).
+	OutputDisk OutputType = "disk"
+)
+
+// Output is the output of a build.
+type Output struct {
+	// Type is the type of output.
+	Type OutputType
+	// Dest is the path to the output archive (or directory).
+	Dest string
+}
+
+// ParseOutput parses an output in the form type=<type>,dest=<path>. A plain
+// path is treated as an OCI image archive.
+func ParseOutput(s string) (Output, error) {
+	if !strings.Contains(s, "=") {
+		return Output{Type: OutputOCI, Dest: s}, nil
+	}
+
+	output := Output{Type: OutputOCI}
+	for _, field := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Output{}, fmt.Errorf("invalid output field: %s", field)
+		}
+
+		switch key {
+		case "type":
+			output.Type = OutputType(value)
+		case "dest":
+			output.Dest = value
+		default:
+			return Output{}, fmt.Errorf("unsupported output field: %s", key)
+		}
+	}
+
+	switch output.Type {
+	case OutputOCI, OutputTar, OutputLocal, OutputDisk:
+	default:
+		return Output{}, fmt.Errorf("unsupported output type: %s", output.Type)
+	}
+
+	if output.Dest == "" {
+		return Output{}, errors.New("output destination is required")
+	}
+
+	return output, nil
+}
+
+// PlatformDest returns the destination of the root filesystem (or disk image)
+// for a platform. For multi-platform builds each platform gets its own
+// subdirectory (or file), named after the platform (eg. linux_amd64).
+func (o Output) PlatformDest(platform ocispecs.Platform, isMultiPlatform bool) string {
+	if !isMultiPlatform {
+		return o.Dest
+	}
+
+	platformID := platformID(platform)
+	if o.Type == OutputLocal {
+		return filepath.Join(o.Dest, platformID)
+	}
+
+	ext := filepath.Ext(o.Dest)
+	return strings.TrimSuffix(o.Dest, ext) + "_" + platformID + ext
+}
+
+// platformID is the name BuildKit uses for the platform subdirectories of
+// multi-platform root filesystem exports.
+func platformID(platform ocispecs.Platform) string {
+	return strings.ReplaceAll(platforms.Format(platforms.Normalize(platform)), "/", "_")
+}
+
+// splitPlatformArchives returns a writer that splits a multi-platform root
+// filesystem archive (as exported by BuildKit, with a subdirectory for each
+// platform) into an archive per platform.
+func splitPlatformArchives(dests map[string]string) io.WriteCloser {
+	return newArchiveWriter(func(r io.Reader) error {
+		return splitArchive(r, dests)
+	})
+}
+
+// extractDiskImages returns a writer that extracts the disk images from an
+// archive (as exported by BuildKit) to their destinations, keyed by platform
+// (or by the empty string for single platform builds).
+func extractDiskImages(dests map[string]string) io.WriteCloser {
+	return newArchiveWriter(func(r io.Reader) error {
+		return extractFiles(r, dests)
+	})
+}
+
+// newArchiveWriter returns a writer that passes the archive written to it to
+// read (which is run in a separate goroutine). Closing the writer waits for
+// read to return.
+func newArchiveWriter(read func(r io.Reader) error) io.WriteCloser {
+	pr, pw := io.Pipe()
+
+	w := &archiveWriter{
+		PipeWriter: pw,
+		done:       make(chan error, 1),
+	}
+
+	go func() {
+		err := read(pr)
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w
+}
+
+type archiveWriter struct {
+	*io.PipeWriter
+	done chan error
+}
+
+func (w *archiveWriter) Close() error {
+	if err := w.PipeWriter.Close(); err != nil {
+		return err
+	}
+
+	return <-w.done
+}
+
+func splitArchive(r io.Reader, dests map[string]string) error {
+	writers := make(map[string]*tar.Writer)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return err
+		}
+
+		platformID, name, _ := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+		dest, ok := dests[platformID]
+		if !ok {
+			return fmt.Errorf("unexpected path in archive: %s", hdr.Name)
+		}
+
+		// The platform subdirectory itself.
+		if name == "" {
+			continue
+		}
+
+		tw, ok := writers[platformID]
+		if !ok {
+			f, err := os.Create(dest)
+			if err != nil {
+				return fmt.Errorf("failed to create output archive: %w", err)
+			}
+			files = append(files, f)
+
+			tw = tar.NewWriter(f)
+			writers[platformID] = tw
+		}
+
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeLink {
+			_, hdr.Linkname, _ = strings.Cut(strings.TrimPrefix(hdr.Linkname, "./"), "/")
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	for _, tw := range writers {
+		if err := tw.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	files = nil
+
+	return nil
+}
+
+func extractFiles(r io.Reader, dests map[string]string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		platformID := path.Dir(strings.TrimPrefix(hdr.Name, "./"))
+		if platformID == "." {
+			platformID = ""
+		}
+
+		dest, ok := dests[platformID]
+		if !ok {
+			return fmt.Errorf("unexpected path in archive: %s", hdr.Name)
+		}
+
+		if err := extractFile(tr, hdr.Size, dest); err != nil {
+			return fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+	}
+}
+
+func extractFile(r io.Reader, size int64, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	// Disk images are mostly empty, so are written sparsely.
+	if err := util.CopySparse(f, r, size); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
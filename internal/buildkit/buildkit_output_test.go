@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit_test
+
+import (
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/debco/internal/buildkit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutput(t *testing.T) {
+	output, err := buildkit.ParseOutput("debian-image.tar")
+	require.NoError(t, err)
+	require.Equal(t, buildkit.Output{Type: buildkit.OutputOCI, Dest: "debian-image.tar"}, output)
+
+	output, err = buildkit.ParseOutput("type=tar,dest=rootfs.tar")
+	require.NoError(t, err)
+	require.Equal(t, buildkit.Output{Type: buildkit.OutputTar, Dest: "rootfs.tar"}, output)
+
+	output, err = buildkit.ParseOutput("type=local,dest=./rootfs")
+	require.NoError(t, err)
+	require.Equal(t, buildkit.Output{Type: buildkit.OutputLocal, Dest: "./rootfs"}, output)
+
+	output, err = buildkit.ParseOutput("type=disk,dest=debian.qcow2")
+	require.NoError(t, err)
+	require.Equal(t, buildkit.Output{Type: buildkit.OutputDisk, Dest: "debian.qcow2"}, output)
+
+	_, err = buildkit.ParseOutput("type=docker,dest=image.tar")
+	require.Error(t, err)
+
+	_, err = buildkit.ParseOutput("type=tar")
+	require.Error(t, err)
+
+	_, err = buildkit.ParseOutput("type=tar,compression=gzip,dest=rootfs.tar")
+	require.Error(t, err)
+
+	t.Run("Platform Destination", func(t *testing.T) {
+		arm64 := platforms.MustParse("linux/arm64/v8")
+
+		tarOutput := buildkit.Output{Type: buildkit.OutputTar, Dest: "out/rootfs.tar"}
+		require.Equal(t, "out/rootfs.tar", tarOutput.PlatformDest(arm64, false))
+		require.Equal(t, "out/rootfs_linux_arm64.tar", tarOutput.PlatformDest(arm64, true))
+
+		localOutput := buildkit.Output{Type: buildkit.OutputLocal, Dest: "rootfs"}
+		require.Equal(t, "rootfs", localOutput.PlatformDest(arm64, false))
+		require.Equal(t, "rootfs/linux_arm64", localOutput.PlatformDest(arm64, true))
+	})
+}
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package buildkit
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/immutos/debco/internal/progress"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/util/progress/progresswriter"
+	"github.com/opencontainers/go-digest"
+)
+
+// newProgressWriter creates a BuildKit progress writer for the configured
+// progress mode.
+func newProgressWriter(ctx context.Context) (progresswriter.Writer, error) {
+	switch progress.CurrentMode() {
+	case progress.ModeJSON:
+		return newJSONProgressWriter(), nil
+	case progress.ModePlain:
+		return progresswriter.NewPrinter(ctx, os.Stdout, "plain")
+	default:
+		mode := "auto"
+		if slog.Default().Enabled(ctx, slog.LevelDebug) {
+			mode = "plain"
+		}
+
+		return progresswriter.NewPrinter(ctx, os.Stdout, mode)
+	}
+}
+
+// jsonProgressWriter converts BuildKit solve status updates into progress events.
+type jsonProgressWriter struct {
+	status chan *client.SolveStatus
+	done   chan struct{}
+	// The last reported state of each vertex, used to suppress duplicates.
+	vertices map[digest.Digest]progress.Status
+	names    map[digest.Digest]string
+}
+
+func newJSONProgressWriter() *jsonProgressWriter {
+	w := &jsonProgressWriter{
+		status:   make(chan *client.SolveStatus),
+		done:     make(chan struct{}),
+		vertices: make(map[digest.Digest]progress.Status),
+		names:    make(map[digest.Digest]string),
+	}
+
+	go func() {
+		defer close(w.done)
+
+		for st := range w.status {
+			w.write(st)
+		}
+	}()
+
+	return w
+}
+
+func (w *jsonProgressWriter) Done() <-chan struct{} {
+	return w.done
+}
+
+func (w *jsonProgressWriter) Err() error {
+	return nil
+}
+
+func (w *jsonProgressWriter) Status() chan *client.SolveStatus {
+	return w.status
+}
+
+func (w *jsonProgressWriter) write(st *client.SolveStatus) {
+	for _, v := range st.Vertexes {
+		w.names[v.Digest] = v.Name
+
+		e := progress.Event{
+			Phase:  progress.PhaseBuild,
+			ID:     v.Digest.String(),
+			Name:   v.Name,
+			Cached: v.Cached,
+		}
+
+		switch {
+		case v.Error != "":
+			e.Status = progress.StatusFailed
+			e.Error = v.Error
+		case v.Completed != nil:
+			e.Status = progress.StatusCompleted
+			e.Time = *v.Completed
+			if v.Started != nil {
+				e.Duration = v.Completed.Sub(*v.Started).Seconds()
+			}
+		case v.Started != nil:
+			e.Status = progress.StatusStarted
+			e.Time = *v.Started
+		default:
+			// The vertex has not started yet.
+			continue
+		}
+
+		if w.vertices[v.Digest] == e.Status {
+			continue
+		}
+		w.vertices[v.Digest] = e.Status
+
+		progress.Emit(e)
+	}
+
+	for _, s := range st.Statuses {
+		e := progress.Event{
+			Time:    s.Timestamp,
+			Phase:   progress.PhaseBuild,
+			Status:  progress.StatusProgress,
+			ID:      s.Vertex.String(),
+			Name:    w.names[s.Vertex],
+			Message: s.ID,
+			Current: s.Current,
+			Total:   s.Total,
+		}
+
+		if s.Completed != nil {
+			e.Status = progress.StatusCompleted
+			if s.Started != nil {
+				e.Duration = s.Completed.Sub(*s.Started).Seconds()
+			}
+		}
+
+		progress.Emit(e)
+	}
+
+	for _, l := range st.Logs {
+		progress.Emit(progress.Event{
+			Time:    l.Timestamp,
+			Phase:   progress.PhaseBuild,
+			Status:  progress.StatusLog,
+			ID:      l.Vertex.String(),
+			Name:    w.names[l.Vertex],
+			Message: string(l.Data),
+		})
+	}
+}
@@ -46,7 +46,10 @@ import (
 func TestBuild(t *testing.T) {
 	testutil.SetupGlobals(t)
 
-	if _, err := os.Stat("/var/run/docker.sock"); err != nil {
+	// An existing BuildKit daemon can be used instead of Docker.
+	buildkitAddr := os.Getenv("DEBCO_TEST_BUILDKIT_ADDR")
+
+	if _, err := os.Stat("/var/run/docker.sock"); err != nil && buildkitAddr == "" {
 		t.Skip("Docker is not available")
 	}
 
@@ -60,7 +63,11 @@ func TestBuild(t *testing.T) {
 	err := os.MkdirAll(certsDir, 0o700)
 	require.NoError(t, err)
 
-	b := buildkit.New("debco-test", certsDir)
+	b := buildkit.New("debco-test", certsDir, buildkit.DaemonOptions{})
+	if buildkitAddr != "" {
+		b, err = buildkit.NewWithAddress(buildkitAddr, nil)
+		require.NoError(t, err)
+	}
 
 	// Make sure we're starting with a clean slate.
 	_ = b.StopDaemon(ctx)
@@ -82,9 +89,12 @@ func TestBuild(t *testing.T) {
 		packagePaths = append(packagePaths, filepath.Join(packagesDir, e.Name()))
 	}
 
-	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths)
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, unpack.Options{})
 	require.NoError(t, err)
 
+	// base-passwd creates the /etc/group and /etc/passwd files needed by dpkg.
+	preinstPackages := []string{"base-passwd:amd64"}
+
 	outputDir := t.TempDir()
 	ociArchivePath := filepath.Join(outputDir, "image.tar")
 
@@ -92,7 +102,7 @@ func TestBuild(t *testing.T) {
 	require.NoError(t, err)
 
 	err = b.Build(ctx, buildkit.BuildOptions{
-		OCIArchivePath:        ociArchivePath,
+		Output:                buildkit.Output{Type: buildkit.OutputOCI, Dest: ociArchivePath},
 		RecipePath:            "testdata/debco.yaml",
 		SecondStageBinaryPath: filepath.Join(binaryDir, "debco"),
 		SourceDateEpoch:       sourceDateEpoch,
@@ -102,6 +112,7 @@ func TestBuild(t *testing.T) {
 				BuildContextDir:         tempDir,
 				DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
 				DataArchivePaths:        dataArchivePaths,
+				PreinstPackages:         preinstPackages,
 			},
 			{
 				// Terrible but binfmt_misc will save us.
@@ -109,6 +120,7 @@ func TestBuild(t *testing.T) {
 				BuildContextDir:         tempDir,
 				DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
 				DataArchivePaths:        dataArchivePaths,
+				PreinstPackages:         preinstPackages,
 			},
 		},
 	})
@@ -118,6 +130,15 @@ func TestBuild(t *testing.T) {
 	require.FileExists(t, ociArchivePath)
 }
 
+func TestVersion(t *testing.T) {
+	b := buildkit.New("debco-test", t.TempDir(), buildkit.DaemonOptions{})
+	require.Equal(t, "v0.13.2", b.Version())
+
+	b, err := buildkit.NewWithAddress("unix:///run/buildkit/buildkitd.sock", nil)
+	require.NoError(t, err)
+	require.Equal(t, buildkit.UnknownVersion, b.Version())
+}
+
 const repositoryURL = "https://snapshot.debian.org/archive/debian/20240801T024036Z"
 
 // The minimum set of packages required to build a functioning Debian base system.
@@ -267,6 +288,26 @@ var packages = []struct {
 	},
 }
 
+func TestNewWithAddress(t *testing.T) {
+	for _, address := range []string{
+		"unix:///run/buildkit/buildkitd.sock",
+		"tcp://buildkitd:1234",
+		"docker-container://buildkitd",
+	} {
+		_, err := buildkit.NewWithAddress(address, nil)
+		require.NoError(t, err, address)
+	}
+
+	_, err := buildkit.NewWithAddress("tcp://buildkitd:1234", &buildkit.TLSOptions{CACertPath: "ca.pem"})
+	require.NoError(t, err)
+
+	_, err = buildkit.NewWithAddress("unix:///run/buildkit/buildkitd.sock", &buildkit.TLSOptions{CACertPath: "ca.pem"})
+	require.Error(t, err)
+
+	_, err = buildkit.NewWithAddress("ssh://buildkitd", nil)
+	require.Error(t, err)
+}
+
 func downloadPackages(packagesDir string) error {
 	cacheDir, err := xdg.CacheFile("debco")
 	if err != nil {
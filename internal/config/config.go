@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package config loads the debco configuration file. The configuration file
+// is a YAML map of command line flag names to values, that are used for any
+// flags not set on the command line. Flags that can be repeated take a list
+// of values, eg.
+//
+//	buildkit-addr: unix:///run/buildkit/buildkitd.sock
+//	cache-from:
+//	  - type=local,src=/var/cache/debco
+//	  - registry.example.com/debco/debian:latest
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config maps flag names to their configured values.
+type Config map[string][]string
+
+// Load reads the configuration file at path. A missing configuration file is
+// treated as an empty configuration.
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Config{}, nil
+		}
+
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	conf := make(Config)
+	for key, value := range values {
+		if list, ok := value.([]any); ok {
+			for _, elem := range list {
+				if !isScalar(elem) {
+					return nil, fmt.Errorf("invalid value for config key %s: expected a list of scalars", key)
+				}
+
+				conf[key] = append(conf[key], fmt.Sprint(elem))
+			}
+
+			continue
+		}
+
+		if !isScalar(value) {
+			return nil, fmt.Errorf("invalid value for config key %s: expected a scalar or a list", key)
+		}
+
+		conf[key] = []string{fmt.Sprint(value)}
+	}
+
+	return conf, nil
+}
+
+func isScalar(value any) bool {
+	switch value.(type) {
+	case []any, map[string]any, map[any]any, nil:
+		return false
+	default:
+		return true
+	}
+}
+
+// Apply sets the flags of the command that were not set on the command line
+// to their configured values. Keys that don't match a flag of the command
+// are ignored, as they may be used by other commands.
+func (conf Config) Apply(c *cli.Context) error {
+	for _, flag := range c.Command.Flags {
+		for _, name := range flag.Names() {
+			values, ok := conf[name]
+			if !ok || c.IsSet(flag.Names()[0]) {
+				continue
+			}
+
+			if len(values) > 1 && !isSliceFlag(flag) {
+				return fmt.Errorf("invalid value for config key %s: expected a single value", name)
+			}
+
+			// Each value is appended to slice flags.
+			for _, value := range values {
+				if err := c.Set(flag.Names()[0], value); err != nil {
+					return fmt.Errorf("invalid value %q for config key %s: %w", value, name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func isSliceFlag(flag cli.Flag) bool {
+	switch flag.(type) {
+	case *cli.StringSliceFlag, *cli.IntSliceFlag, *cli.Int64SliceFlag, *cli.Float64SliceFlag:
+		return true
+	default:
+		return false
+	}
+}
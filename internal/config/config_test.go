@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/debco/internal/config"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestConfig(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(configPath, []byte(`buildkit-addr: unix:///run/buildkit/buildkitd.sock
+dev: true
+p: linux/arm64
+unknown: ignored
+`), 0o644))
+
+	conf, err := config.Load(configPath)
+	require.NoError(t, err)
+
+	run := func(t *testing.T, args ...string) (addr, platform string, dev bool) {
+		app := &cli.App{
+			Commands: []*cli.Command{
+				{
+					Name: "build",
+					Flags: []cli.Flag{
+						&cli.StringFlag{Name: "buildkit-addr"},
+						&cli.StringFlag{Name: "platform", Aliases: []string{"p"}, Value: "linux/amd64"},
+						&cli.BoolFlag{Name: "dev"},
+					},
+					Before: conf.Apply,
+					Action: func(c *cli.Context) error {
+						addr, platform, dev = c.String("buildkit-addr"), c.String("platform"), c.Bool("dev")
+						return nil
+					},
+				},
+			},
+		}
+
+		require.NoError(t, app.Run(append([]string{"debco", "build"}, args...)))
+		return
+	}
+
+	addr, platform, dev := run(t)
+	require.Equal(t, "unix:///run/buildkit/buildkitd.sock", addr)
+	require.Equal(t, "linux/arm64", platform)
+	require.True(t, dev)
+
+	// Flags set on the command line take precedence.
+	addr, _, _ = run(t, "--buildkit-addr", "tcp://buildkitd:1234")
+	require.Equal(t, "tcp://buildkitd:1234", addr)
+
+	t.Run("List", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte(`platform:
+  - linux/amd64
+  - linux/arm64
+`), 0o644))
+
+		conf, err := config.Load(configPath)
+		require.NoError(t, err)
+
+		var platforms []string
+		app := &cli.App{
+			Commands: []*cli.Command{
+				{
+					Name: "build",
+					Flags: []cli.Flag{
+						&cli.StringSliceFlag{Name: "platform", Value: cli.NewStringSlice("linux/riscv64")},
+					},
+					Before: conf.Apply,
+					Action: func(c *cli.Context) error {
+						platforms = c.StringSlice("platform")
+						return nil
+					},
+				},
+			},
+		}
+
+		require.NoError(t, app.Run([]string{"debco", "build"}))
+		require.Equal(t, []string{"linux/amd64", "linux/arm64"}, platforms)
+
+		// A list can't be used for a flag that takes a single value.
+		app.Commands[0].Flags = []cli.Flag{&cli.StringFlag{Name: "platform"}}
+		require.ErrorContains(t, app.Run([]string{"debco", "build"}), "expected a single value")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(configPath, []byte(`buildkit:
+  addr: unix:///run/buildkit/buildkitd.sock
+`), 0o644))
+
+		_, err := config.Load(configPath)
+		require.ErrorContains(t, err, "invalid value for config key buildkit")
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		conf, err := config.Load(filepath.Join(t.TempDir(), "config.yaml"))
+		require.NoError(t, err)
+		require.Empty(t, conf)
+	})
+}
@@ -21,6 +21,9 @@ package constants
 var (
 	// BuildKitImage is the image used for the BuildKit daemon.
 	BuildKitImage = "docker.io/moby/buildkit:v0.13.2"
+	// BuildKitRootlessImage is the image used for the BuildKit daemon when the
+	// container engine is running in rootless mode.
+	BuildKitRootlessImage = "docker.io/moby/buildkit:v0.13.2-rootless"
 	// TelemetryURL is the URL to send anonymized telemetry data to.
 	TelemetryURL = "https://telemetry.dpeckett.dev"
 	// Version will be populated during build time.
@@ -74,16 +74,25 @@ func Load(ctx context.Context, key string) (openpgp.EntityList, error) {
 			return nil, err
 		}
 
-		return openpgp.ReadArmoredKeyRing(bytes.NewReader(keyringData))
+		return readKeyRing(keyringData)
 	} else { // If the key is a file, open it.
 		slog.Debug("Reading key file", slog.String("path", key))
 
-		f, err := os.Open(key)
+		keyringData, err := os.ReadFile(key)
 		if err != nil {
 			return nil, err
 		}
-		defer f.Close()
 
-		return openpgp.ReadArmoredKeyRing(f)
+		return readKeyRing(keyringData)
+	}
+}
+
+// readKeyRing reads an ASCII armored or binary (eg. Ubuntu's
+// ubuntu-archive-keyring.gpg) OpenPGP keyring.
+func readKeyRing(keyringData []byte) (openpgp.EntityList, error) {
+	if bytes.Contains(keyringData, []byte("-----BEGIN PGP")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(keyringData))
 	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(keyringData))
 }
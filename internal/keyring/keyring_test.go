@@ -20,9 +20,12 @@ package keyring_test
 
 import (
 	"context"
+	"io"
+	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/immutos/debco/internal/keyring"
 	"github.com/immutos/debco/internal/testutil"
 	"github.com/stretchr/testify/require"
@@ -46,4 +49,25 @@ func TestKeyringRead(t *testing.T) {
 
 		require.NotEmpty(t, keyring)
 	})
+
+	t.Run("Binary File", func(t *testing.T) {
+		f, err := os.Open(filepath.Join(testutil.Root(), "testdata/archive-key-12.asc"))
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, f.Close())
+		})
+
+		block, err := armor.Decode(f)
+		require.NoError(t, err)
+
+		keyringPath := filepath.Join(t.TempDir(), "archive-key-12.gpg")
+		keyringData, err := io.ReadAll(block.Body)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyringPath, keyringData, 0o644))
+
+		keyring, err := keyring.Load(ctx, keyringPath)
+		require.NoError(t, err)
+
+		require.NotEmpty(t, keyring)
+	})
 }
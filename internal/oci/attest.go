@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeInToto is the media type of an in-toto statement.
+	MediaTypeInToto = "application/vnd.in-toto+json"
+	// MediaTypeDSSE is the media type of a DSSE envelope (of a signed in-toto
+	// statement).
+	MediaTypeDSSE = "application/vnd.dsse.envelope.v1+json"
+	// InTotoStatementType is the type of in-toto (v1) statements.
+	InTotoStatementType = "https://in-toto.io/Statement/v1"
+	// Annotations used by BuildKit (and understood by tools such as docker
+	// buildx imagetools) to link attestation manifests to their image.
+	annotationPredicateType   = "in-toto.io/predicate-type"
+	annotationReferenceDigest = "vnd.docker.reference.digest"
+	annotationReferenceType   = "vnd.docker.reference.type"
+	attestationManifestType   = "attestation-manifest"
+)
+
+// Attestation is an in-toto attestation about the image of a platform (eg.
+// an SBOM).
+type Attestation struct {
+	// Platform is the platform of the image the attestation is about.
+	Platform ocispecs.Platform
+	// PredicateType is the type of the predicate (eg. https://spdx.dev/Document).
+	PredicateType string
+	// Predicate is the JSON encoded predicate.
+	Predicate json.RawMessage
+	// Signer optionally signs the in-toto statement, which is then stored in
+	// a DSSE envelope.
+	Signer EnvelopeSigner
+}
+
+// EnvelopeSigner signs a payload, returning a (JSON encoded) DSSE envelope.
+type EnvelopeSigner interface {
+	Sign(payloadType string, payload []byte) ([]byte, error)
+}
+
+// InTotoStatement is an in-toto (v1) statement.
+// See: https://github.com/in-toto/attestation/blob/main/spec/v1/statement.md
+type InTotoStatement struct {
+	Type          string          `json:"_type"`
+	Subject       []InTotoSubject `json:"subject"`
+	PredicateType string          `json:"predicateType"`
+	Predicate     json.RawMessage `json:"predicate"`
+}
+
+// InTotoSubject is the artifact an in-toto statement is about.
+type InTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Attest attaches attestations to the images in an OCI image archive (or
+// image layout directory). The attestations of each platform are stored in
+// an attestation manifest, that is added to the image index (in the same way
+// as BuildKit). The subject of each attestation is the image manifest of its
+// platform. Single platform images are turned into an image index.
+func Attest(ctx context.Context, path string, sourceDateEpoch time.Time, attestations []Attestation) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return attest(path, attestations)
+	}
+
+	layoutDir, err := os.MkdirTemp(filepath.Dir(path), ".oci-layout-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(layoutDir)
+	}()
+
+	if err := extractArchive(path, layoutDir); err != nil {
+		return fmt.Errorf("failed to extract OCI image archive: %w", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := attest(layoutDir, attestations); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".oci-archive-*")
+	if err != nil {
+		return fmt.Errorf("failed to create OCI archive: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if err := tarDirectory(f, layoutDir, sourceDateEpoch); err != nil {
+		return fmt.Errorf("failed to write OCI archive: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func attest(dir string, attestations []Attestation) error {
+	var layoutIndex ocispecs.Index
+	if err := readJSON(filepath.Join(dir, "index.json"), &layoutIndex); err != nil {
+		return fmt.Errorf("failed to read index: %w", err)
+	}
+
+	rootDesc, err := rootDescriptor(dir)
+	if err != nil {
+		return err
+	}
+
+	imageIndex := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+	}
+
+	switch rootDesc.MediaType {
+	case ocispecs.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		// The platform of a single platform image is only found in its config.
+		if rootDesc.Platform == nil {
+			var manifest ocispecs.Manifest
+			if err := readJSONBlob(dir, rootDesc, &manifest); err != nil {
+				return fmt.Errorf("failed to read manifest: %w", err)
+			}
+
+			var img ocispecs.Image
+			if err := readJSONBlob(dir, manifest.Config, &img); err != nil {
+				return fmt.Errorf("failed to read image config: %w", err)
+			}
+
+			rootDesc.Platform = &img.Platform
+		}
+
+		imageIndex.Manifests = []ocispecs.Descriptor{rootDesc}
+	case ocispecs.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		if err := readJSONBlob(dir, rootDesc, &imageIndex); err != nil {
+			return fmt.Errorf("failed to read image index: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported media type: %s", rootDesc.MediaType)
+	}
+
+	// The name of the image (if any) is used as the name of the subject.
+	subjectName := "_"
+	for _, desc := range layoutIndex.Manifests {
+		if name := desc.Annotations[images.AnnotationImageName]; name != "" {
+			subjectName = name
+			break
+		}
+	}
+
+	attestationsByPlatform := make(map[string][]Attestation)
+	for _, attestation := range attestations {
+		platformStr := platforms.Format(platforms.Normalize(attestation.Platform))
+		attestationsByPlatform[platformStr] = append(attestationsByPlatform[platformStr], attestation)
+	}
+
+	var attestationDescs []ocispecs.Descriptor
+	for _, imageDesc := range imageIndex.Manifests {
+		if imageDesc.Platform == nil {
+			continue
+		}
+
+		platformStr := platforms.Format(platforms.Normalize(*imageDesc.Platform))
+
+		platformAttestations, ok := attestationsByPlatform[platformStr]
+		if !ok {
+			continue
+		}
+		delete(attestationsByPlatform, platformStr)
+
+		desc, err := writeAttestationManifest(dir, imageDesc, subjectName, platformAttestations)
+		if err != nil {
+			return fmt.Errorf("failed to write attestations for platform %s: %w", platformStr, err)
+		}
+
+		attestationDescs = append(attestationDescs, *desc)
+	}
+
+	if len(attestationsByPlatform) > 0 {
+		return errors.New("image does not contain the platforms of all attestations")
+	}
+
+	imageIndex.Manifests = append(imageIndex.Manifests, attestationDescs...)
+
+	newRootDesc, err := writeJSONBlob(dir, ocispecs.MediaTypeImageIndex, imageIndex)
+	if err != nil {
+		return fmt.Errorf("failed to write image index: %w", err)
+	}
+
+	for i, desc := range layoutIndex.Manifests {
+		if desc.Digest != rootDesc.Digest {
+			continue
+		}
+
+		layoutIndex.Manifests[i].MediaType = newRootDesc.MediaType
+		layoutIndex.Manifests[i].Digest = newRootDesc.Digest
+		layoutIndex.Manifests[i].Size = newRootDesc.Size
+		layoutIndex.Manifests[i].Platform = nil
+	}
+
+	if err := writeJSON(filepath.Join(dir, "index.json"), layoutIndex); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	// The previous image index is no longer referenced.
+	if rootDesc.MediaType == ocispecs.MediaTypeImageIndex || rootDesc.MediaType == images.MediaTypeDockerSchema2ManifestList {
+		if err := os.Remove(blobPath(dir, rootDesc.Digest)); err != nil {
+			return fmt.Errorf("failed to remove previous image index: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// writeAttestationManifest writes an attestation manifest, containing an
+// in-toto statement for each attestation, about the image.
+func writeAttestationManifest(dir string, imageDesc ocispecs.Descriptor, subjectName string, attestations []Attestation) (*ocispecs.Descriptor, error) {
+	subject := InTotoSubject{
+		Name:   subjectName,
+		Digest: map[string]string{imageDesc.Digest.Algorithm().String(): imageDesc.Digest.Encoded()},
+	}
+
+	// The attestation manifest is not runnable.
+	img := ocispecs.Image{
+		Platform: ocispecs.Platform{OS: "unknown", Architecture: "unknown"},
+		RootFS:   ocispecs.RootFS{Type: "layers"},
+	}
+
+	var layerDescs []ocispecs.Descriptor
+	for _, attestation := range attestations {
+		statement, err := json.Marshal(InTotoStatement{
+			Type:          InTotoStatementType,
+			Subject:       []InTotoSubject{subject},
+			PredicateType: attestation.PredicateType,
+			Predicate:     attestation.Predicate,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		mediaType := MediaTypeInToto
+		if attestation.Signer != nil {
+			statement, err = attestation.Signer.Sign(MediaTypeInToto, statement)
+			if err != nil {
+				return nil, fmt.Errorf("failed to sign in-toto statement: %w", err)
+			}
+
+			mediaType = MediaTypeDSSE
+		}
+
+		layerDesc, err := writeBlob(dir, mediaType, statement)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write in-toto statement: %w", err)
+		}
+
+		layerDesc.Annotations = map[string]string{
+			annotationPredicateType: attestation.PredicateType,
+		}
+
+		layerDescs = append(layerDescs, *layerDesc)
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, layerDesc.Digest)
+	}
+
+	configDesc, err := writeJSONBlob(dir, ocispecs.MediaTypeImageConfig, img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	subjectDesc := ocispecs.Descriptor{
+		MediaType: imageDesc.MediaType,
+		Digest:    imageDesc.Digest,
+		Size:      imageDesc.Size,
+	}
+
+	manifestDesc, err := writeJSONBlob(dir, ocispecs.MediaTypeImageManifest, ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    *configDesc,
+		Layers:    layerDescs,
+		// Registries that support the referrers API also link the
+		// attestations to the image.
+		Subject: &subjectDesc,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	manifestDesc.Platform = &img.Platform
+	manifestDesc.Annotations = map[string]string{
+		annotationReferenceDigest: imageDesc.Digest.String(),
+		annotationReferenceType:   attestationManifestType,
+	}
+
+	return manifestDesc, nil
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/debco/internal/oci"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttest(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Size: 6}))
+	_, err := tw.Write([]byte("debco\n"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	layerPath := filepath.Join(tempDir, "rootfs.tar")
+	require.NoError(t, os.WriteFile(layerPath, layer.Bytes(), 0o644))
+
+	sourceDateEpoch := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	amd64 := ocispecs.Platform{OS: "linux", Architecture: "amd64"}
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	require.NoError(t, oci.WriteArchive(context.Background(), archivePath, oci.Options{
+		Tags:            []string{"debco/debian:bookworm"},
+		SourceDateEpoch: sourceDateEpoch,
+		Images: []oci.PlatformImage{
+			{Platform: amd64, LayerPaths: []string{layerPath}},
+		},
+	}))
+
+	files := readArchive(t, archivePath)
+
+	var originalIndex ocispecs.Index
+	require.NoError(t, json.Unmarshal(files["index.json"], &originalIndex))
+	imageDesc := originalIndex.Manifests[0]
+
+	require.NoError(t, oci.Attest(context.Background(), archivePath, sourceDateEpoch, []oci.Attestation{
+		{Platform: amd64, PredicateType: "https://spdx.dev/Document", Predicate: json.RawMessage(`{"spdxVersion":"SPDX-2.3"}`)},
+		{Platform: amd64, PredicateType: "https://cyclonedx.org/bom", Predicate: json.RawMessage(`{"bomFormat":"CycloneDX"}`)},
+	}))
+
+	files = readArchive(t, archivePath)
+
+	// The single platform image is now referenced through an image index.
+	var index ocispecs.Index
+	require.NoError(t, json.Unmarshal(files["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, ocispecs.MediaTypeImageIndex, index.Manifests[0].MediaType)
+	require.Equal(t, imageDesc.Annotations, index.Manifests[0].Annotations)
+
+	var imageIndex ocispecs.Index
+	require.NoError(t, json.Unmarshal(blob(t, files, index.Manifests[0]), &imageIndex))
+	require.Len(t, imageIndex.Manifests, 2)
+	require.Equal(t, imageDesc.Digest, imageIndex.Manifests[0].Digest)
+	require.Equal(t, &amd64, imageIndex.Manifests[0].Platform)
+
+	attestationDesc := imageIndex.Manifests[1]
+	require.Equal(t, "unknown/unknown", attestationDesc.Platform.OS+"/"+attestationDesc.Platform.Architecture)
+	require.Equal(t, map[string]string{
+		"vnd.docker.reference.digest": imageDesc.Digest.String(),
+		"vnd.docker.reference.type":   "attestation-manifest",
+	}, attestationDesc.Annotations)
+
+	var manifest ocispecs.Manifest
+	require.NoError(t, json.Unmarshal(blob(t, files, attestationDesc), &manifest))
+	require.Equal(t, imageDesc.Digest, manifest.Subject.Digest)
+	require.Len(t, manifest.Layers, 2)
+	require.Equal(t, oci.MediaTypeInToto, manifest.Layers[0].MediaType)
+	require.Equal(t, "https://spdx.dev/Document", manifest.Layers[0].Annotations["in-toto.io/predicate-type"])
+
+	var statement oci.InTotoStatement
+	require.NoError(t, json.Unmarshal(blob(t, files, manifest.Layers[0]), &statement))
+	require.Equal(t, oci.InTotoStatementType, statement.Type)
+	require.Equal(t, "https://spdx.dev/Document", statement.PredicateType)
+	require.JSONEq(t, `{"spdxVersion":"SPDX-2.3"}`, string(statement.Predicate))
+	require.Equal(t, []oci.InTotoSubject{{
+		Name:   "docker.io/debco/debian:bookworm",
+		Digest: map[string]string{"sha256": imageDesc.Digest.Encoded()},
+	}}, statement.Subject)
+
+	// The image can still be loaded into docker.
+	require.NoError(t, oci.WriteDockerArchive(&bytes.Buffer{}, archivePath, amd64, nil))
+
+	t.Run("Signed", func(t *testing.T) {
+		layoutDir := filepath.Join(tempDir, "layout")
+		require.NoError(t, oci.WriteLayout(context.Background(), layoutDir, oci.Options{
+			Images: []oci.PlatformImage{
+				{Platform: amd64, LayerPaths: []string{layerPath}},
+			},
+		}))
+
+		require.NoError(t, oci.Attest(context.Background(), layoutDir, sourceDateEpoch, []oci.Attestation{
+			{Platform: amd64, PredicateType: "https://slsa.dev/provenance/v1", Predicate: json.RawMessage(`{}`), Signer: &fakeSigner{}},
+		}))
+
+		indexData, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+		require.NoError(t, err)
+
+		var index, imageIndex ocispecs.Index
+		require.NoError(t, json.Unmarshal(indexData, &index))
+		require.NoError(t, readJSONFile(filepath.Join(layoutDir, "blobs", "sha256", index.Manifests[0].Digest.Encoded()), &imageIndex))
+
+		var manifest ocispecs.Manifest
+		require.NoError(t, readJSONFile(filepath.Join(layoutDir, "blobs", "sha256", imageIndex.Manifests[1].Digest.Encoded()), &manifest))
+		require.Equal(t, oci.MediaTypeDSSE, manifest.Layers[0].MediaType)
+
+		var envelope map[string]string
+		require.NoError(t, readJSONFile(filepath.Join(layoutDir, "blobs", "sha256", manifest.Layers[0].Digest.Encoded()), &envelope))
+		require.Equal(t, oci.MediaTypeInToto, envelope["payloadType"])
+	})
+
+	t.Run("Missing Platform", func(t *testing.T) {
+		err := oci.Attest(context.Background(), archivePath, sourceDateEpoch, []oci.Attestation{
+			{Platform: ocispecs.Platform{OS: "linux", Architecture: "arm64"}, PredicateType: "https://spdx.dev/Document", Predicate: json.RawMessage(`{}`)},
+		})
+		require.Error(t, err)
+	})
+}
+
+type fakeSigner struct{}
+
+func (s *fakeSigner) Sign(payloadType string, payload []byte) ([]byte, error) {
+	return json.Marshal(map[string]string{"payloadType": payloadType, "payload": string(payload)})
+}
+
+func readJSONFile(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerManifest is an entry in the manifest.json file of a docker image
+// archive (as read by docker load).
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// WriteDockerArchive writes the image in an OCI image archive (or image
+// layout directory) to w, in the format understood by docker load. As docker
+// can only load a single platform, the image that best matches the given
+// platform is written for multi-platform images.
+func WriteDockerArchive(w io.Writer, srcPath string, platform ocispecs.Platform, tags []string) error {
+	tempDir, err := os.MkdirTemp("", "debco-docker-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := openImageLayout(srcPath, tempDir); err != nil {
+		return err
+	}
+
+	rootDesc, err := rootDescriptor(tempDir)
+	if err != nil {
+		return err
+	}
+
+	manifestDesc, err := platformManifest(tempDir, rootDesc, platform)
+	if err != nil {
+		return err
+	}
+
+	var manifest ocispecs.Manifest
+	if err := readJSONBlob(tempDir, manifestDesc, &manifest); err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var repoTags []string
+	for _, tag := range tags {
+		named, err := docker.ParseNormalizedNamed(tag)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag %q: %w", tag, err)
+		}
+
+		repoTags = append(repoTags, docker.FamiliarString(docker.TagNameOnly(named)))
+	}
+
+	tw := tar.NewWriter(w)
+
+	writeBlob := func(desc ocispecs.Descriptor) (string, error) {
+		name := path.Join(ocispecs.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+
+		f, err := os.Open(blobPath(tempDir, desc.Digest))
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0o644,
+			Size:     fi.Size(),
+		}); err != nil {
+			return "", err
+		}
+
+		if _, err := io.Copy(tw, f); err != nil {
+			return "", err
+		}
+
+		return name, nil
+	}
+
+	entry := dockerManifest{RepoTags: repoTags}
+
+	entry.Config, err = writeBlob(manifest.Config)
+	if err != nil {
+		return fmt.Errorf("failed to write image config: %w", err)
+	}
+
+	for _, layer := range manifest.Layers {
+		layerName, err := writeBlob(layer)
+		if err != nil {
+			return fmt.Errorf("failed to write layer: %w", err)
+		}
+
+		entry.Layers = append(entry.Layers, layerName)
+	}
+
+	manifestData, err := json.Marshal([]dockerManifest{entry})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "manifest.json",
+		Mode:     0o644,
+		Size:     int64(len(manifestData)),
+	}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(manifestData); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// platformManifest returns the descriptor of the image manifest that best
+// matches the platform.
+func platformManifest(dir string, desc ocispecs.Descriptor, platform ocispecs.Platform) (ocispecs.Descriptor, error) {
+	switch desc.MediaType {
+	case ocispecs.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+		return desc, nil
+	case ocispecs.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+	default:
+		return ocispecs.Descriptor{}, fmt.Errorf("unsupported media type: %s", desc.MediaType)
+	}
+
+	var index ocispecs.Index
+	if err := readJSONBlob(dir, desc, &index); err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to read image index: %w", err)
+	}
+
+	matcher := platforms.Only(platform)
+
+	var (
+		best      *ocispecs.Descriptor
+		available []string
+	)
+	for i, m := range index.Manifests {
+		// Attestation manifests are not images.
+		if m.Platform == nil || m.Annotations[annotationReferenceType] == attestationManifestType {
+			continue
+		}
+		available = append(available, platforms.Format(*m.Platform))
+
+		if !matcher.Match(*m.Platform) {
+			continue
+		}
+
+		if best == nil || matcher.Less(*m.Platform, *best.Platform) {
+			best = &index.Manifests[i]
+		}
+	}
+
+	if best == nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("image does not support platform %s (available: %s)",
+			platforms.Format(platform), strings.Join(available, ", "))
+	}
+
+	return platformManifest(dir, *best, platform)
+}
+
+func readJSONBlob(dir string, desc ocispecs.Descriptor, v any) error {
+	data, err := os.ReadFile(blobPath(dir, desc.Digest))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/debco/internal/oci"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteDockerArchive(t *testing.T) {
+	tempDir := t.TempDir()
+
+	var images []oci.PlatformImage
+	for _, arch := range []string{"amd64", "arm64"} {
+		var layer bytes.Buffer
+		tw := tar.NewWriter(&layer)
+		require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/arch", Mode: 0o644, Size: int64(len(arch))}))
+		_, err := tw.Write([]byte(arch))
+		require.NoError(t, err)
+		require.NoError(t, tw.Close())
+
+		layerPath := filepath.Join(tempDir, arch+".tar")
+		require.NoError(t, os.WriteFile(layerPath, layer.Bytes(), 0o644))
+
+		images = append(images, oci.PlatformImage{
+			Platform:   ocispecs.Platform{OS: "linux", Architecture: arch},
+			LayerPaths: []string{layerPath},
+		})
+	}
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	require.NoError(t, oci.WriteArchive(context.Background(), archivePath, oci.Options{
+		Tags:   []string{"debco/debian:bookworm"},
+		Images: images,
+	}))
+
+	var dockerArchive bytes.Buffer
+	require.NoError(t, oci.WriteDockerArchive(&dockerArchive, archivePath,
+		ocispecs.Platform{OS: "linux", Architecture: "arm64"}, []string{"debco/debian:bookworm", "registry.example.com/debian"}))
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&dockerArchive)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+
+		var buf bytes.Buffer
+		_, err = buf.ReadFrom(tr)
+		require.NoError(t, err)
+
+		files[hdr.Name] = buf.Bytes()
+	}
+
+	var manifests []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	require.NoError(t, json.Unmarshal(files["manifest.json"], &manifests))
+	require.Len(t, manifests, 1)
+	require.Equal(t, []string{"debco/debian:bookworm", "registry.example.com/debian:latest"}, manifests[0].RepoTags)
+	require.Len(t, manifests[0].Layers, 1)
+
+	// The image for the requested platform is written.
+	var img ocispecs.Image
+	require.NoError(t, json.Unmarshal(files[manifests[0].Config], &img))
+	require.Equal(t, "arm64", img.Architecture)
+	require.Len(t, img.RootFS.DiffIDs, 1)
+
+	layer, ok := files[manifests[0].Layers[0]]
+	require.True(t, ok)
+	require.Equal(t, "blobs/sha256/"+digest.FromBytes(layer).Encoded(), manifests[0].Layers[0])
+
+	t.Run("Unsupported Platform", func(t *testing.T) {
+		err := oci.WriteDockerArchive(&bytes.Buffer{}, archivePath,
+			ocispecs.Platform{OS: "linux", Architecture: "riscv64"}, nil)
+		require.ErrorContains(t, err, "image does not support platform linux/riscv64 (available: linux/amd64, linux/arm64)")
+	})
+}
@@ -0,0 +1,402 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package oci writes OCI images natively, without the need for BuildKit or
+// a container runtime. It is used for images that don't require any commands
+// to be run during the build (eg. download only images).
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Options configures how an OCI image is written.
+type Options struct {
+	// Tags is a list of names (and optionally tags) for the image.
+	Tags []string
+	// ImageConf is the OCI image configuration.
+	ImageConf ocispecs.ImageConfig
+	// SourceDateEpoch is used as the creation time of the image.
+	SourceDateEpoch time.Time
+	// Images are the images for each platform.
+	Images []PlatformImage
+}
+
+// PlatformImage is the image for a single platform.
+type PlatformImage struct {
+	// Platform is the platform of the image.
+	Platform ocispecs.Platform
+	// LayerPaths are the paths to the uncompressed layer archives, from the
+	// lowest to the highest layer.
+	LayerPaths []string
+}
+
+// NewImage returns the OCI image configuration used for debco images (with
+// the default environment variables set).
+func NewImage(imageConf ocispecs.ImageConfig, platform ocispecs.Platform) ocispecs.Image {
+	defaultEnv := []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"TERM=xterm",
+	}
+
+	imageConf.Env = append(defaultEnv, imageConf.Env...)
+
+	return ocispecs.Image{
+		Platform: platform,
+		Config:   imageConf,
+		RootFS: ocispecs.RootFS{
+			Type: "layers",
+		},
+	}
+}
+
+// WriteArchive writes the image as an OCI image archive (a tarball of an
+// OCI image layout) to path.
+func WriteArchive(ctx context.Context, path string, opts Options) error {
+	layoutDir, err := os.MkdirTemp(filepath.Dir(path), ".oci-layout-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(layoutDir)
+	}()
+
+	if err := WriteLayout(ctx, layoutDir, opts); err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create OCI archive: %w", err)
+	}
+	defer f.Close()
+
+	if err := tarDirectory(f, layoutDir, opts.SourceDateEpoch); err != nil {
+		return fmt.Errorf("failed to write OCI archive: %w", err)
+	}
+
+	return f.Close()
+}
+
+// WriteLayout writes the image as an OCI image layout into dir.
+func WriteLayout(ctx context.Context, dir string, opts Options) error {
+	if len(opts.Images) == 0 {
+		return fmt.Errorf("no images to write")
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, ocispecs.ImageBlobsDir, string(digest.Canonical)), 0o755); err != nil {
+		return fmt.Errorf("failed to create blobs directory: %w", err)
+	}
+
+	var manifestDescs []ocispecs.Descriptor
+	for _, image := range opts.Images {
+		manifestDesc, err := writeImage(ctx, dir, opts, image)
+		if err != nil {
+			return fmt.Errorf("failed to write image for platform %s: %w", platforms.Format(image.Platform), err)
+		}
+
+		manifestDescs = append(manifestDescs, *manifestDesc)
+	}
+
+	// Multi-platform images are referenced through an image index.
+	rootDesc := manifestDescs[0]
+	rootDesc.Platform = nil
+	if len(manifestDescs) > 1 {
+		desc, err := writeJSONBlob(dir, ocispecs.MediaTypeImageIndex, ocispecs.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispecs.MediaTypeImageIndex,
+			Manifests: manifestDescs,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to write image index: %w", err)
+		}
+
+		rootDesc = *desc
+	}
+
+	index := ocispecs.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageIndex,
+	}
+
+	if len(opts.Tags) == 0 {
+		index.Manifests = append(index.Manifests, rootDesc)
+	}
+
+	for _, tag := range opts.Tags {
+		named, err := docker.ParseNormalizedNamed(tag)
+		if err != nil {
+			return fmt.Errorf("failed to parse tag %q: %w", tag, err)
+		}
+		named = docker.TagNameOnly(named)
+
+		desc := rootDesc
+		desc.Annotations = map[string]string{
+			"io.containerd.image.name": named.String(),
+		}
+
+		if tagged, ok := named.(docker.Tagged); ok {
+			desc.Annotations[ocispecs.AnnotationRefName] = tagged.Tag()
+		}
+
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	if err := writeJSON(filepath.Join(dir, "index.json"), index); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+
+	if err := writeJSON(filepath.Join(dir, ocispecs.ImageLayoutFile), ocispecs.ImageLayout{
+		Version: ocispecs.ImageLayoutVersion,
+	}); err != nil {
+		return fmt.Errorf("failed to write image layout: %w", err)
+	}
+
+	return nil
+}
+
+func writeImage(ctx context.Context, dir string, opts Options, image PlatformImage) (*ocispecs.Descriptor, error) {
+	img := NewImage(opts.ImageConf, platforms.Normalize(image.Platform))
+
+	var createdTime *time.Time
+	if !opts.SourceDateEpoch.IsZero() {
+		created := opts.SourceDateEpoch.UTC()
+		createdTime = &created
+	}
+	img.Created = createdTime
+
+	var layerDescs []ocispecs.Descriptor
+	for _, layerPath := range image.LayerPaths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		layerDesc, diffID, err := writeLayer(dir, layerPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write layer: %w", err)
+		}
+
+		layerDescs = append(layerDescs, *layerDesc)
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, diffID)
+		img.History = append(img.History, ocispecs.History{
+			Created:   createdTime,
+			CreatedBy: "debco",
+			Comment:   "debco.image.v0",
+		})
+	}
+
+	configDesc, err := writeJSONBlob(dir, ocispecs.MediaTypeImageConfig, img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write image config: %w", err)
+	}
+
+	manifestDesc, err := writeJSONBlob(dir, ocispecs.MediaTypeImageManifest, ocispecs.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispecs.MediaTypeImageManifest,
+		Config:    *configDesc,
+		Layers:    layerDescs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write image manifest: %w", err)
+	}
+
+	manifestDesc.Platform = &img.Platform
+
+	return manifestDesc, nil
+}
+
+// writeLayer compresses a layer archive into the blobs directory, returning
+// its descriptor and its diff ID (the digest of the uncompressed archive).
+func writeLayer(dir, layerPath string) (*ocispecs.Descriptor, digest.Digest, error) {
+	src, err := os.Open(layerPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Join(dir, ocispecs.ImageBlobsDir), ".layer-*")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	compressedDigester := digest.Canonical.Digester()
+	uncompressedDigester := digest.Canonical.Digester()
+
+	// The gzip header has no modification time or name, so the compressed
+	// layer is reproducible.
+	counter := &countingWriter{w: io.MultiWriter(tmp, compressedDigester.Hash())}
+	gw := gzip.NewWriter(counter)
+
+	if _, err := io.Copy(io.MultiWriter(gw, uncompressedDigester.Hash()), src); err != nil {
+		return nil, "", err
+	}
+
+	if err := gw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, "", err
+	}
+
+	desc := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayerGzip,
+		Digest:    compressedDigester.Digest(),
+		Size:      counter.n,
+	}
+
+	if err := os.Rename(tmp.Name(), blobPath(dir, desc.Digest)); err != nil {
+		return nil, "", err
+	}
+
+	return &desc, uncompressedDigester.Digest(), nil
+}
+
+func writeJSONBlob(dir, mediaType string, v any) (*ocispecs.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return writeBlob(dir, mediaType, data)
+}
+
+func writeBlob(dir, mediaType string, data []byte) (*ocispecs.Descriptor, error) {
+	desc := ocispecs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+
+	if err := os.WriteFile(blobPath(dir, desc.Digest), data, 0o644); err != nil {
+		return nil, err
+	}
+
+	return &desc, nil
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+func blobPath(dir string, dgst digest.Digest) string {
+	return filepath.Join(dir, ocispecs.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// tarDirectory writes a reproducible tarball of the directory.
+func tarDirectory(w io.Writer, dir string, modTime time.Time) error {
+	var paths []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != dir {
+			paths = append(paths, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	tw := tar.NewWriter(w)
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    0o644,
+			ModTime: modTime.UTC(),
+		}
+
+		if fi.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0o755
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(tw, f)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
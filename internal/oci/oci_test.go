@@ -0,0 +1,266 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/immutos/debco/internal/oci"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/immutos/debco/internal/unpack"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteArchive(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// A minimal layer.
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Size: 6}))
+	_, err := tw.Write([]byte("debco\n"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	layerPath := filepath.Join(tempDir, "rootfs.tar")
+	require.NoError(t, os.WriteFile(layerPath, layer.Bytes(), 0o644))
+
+	sourceDateEpoch := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	opts := oci.Options{
+		Tags: []string{"debco/debian:bookworm"},
+		ImageConf: ocispecs.ImageConfig{
+			Env: []string{"FOO=bar"},
+			Cmd: []string{"/bin/sh"},
+		},
+		SourceDateEpoch: sourceDateEpoch,
+		Images: []oci.PlatformImage{
+			{
+				Platform:   ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+				LayerPaths: []string{layerPath},
+			},
+		},
+	}
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	require.NoError(t, oci.WriteArchive(context.Background(), archivePath, opts))
+
+	files := readArchive(t, archivePath)
+
+	require.JSONEq(t, `{"imageLayoutVersion":"1.0.0"}`, string(files["oci-layout"]))
+
+	var index ocispecs.Index
+	require.NoError(t, json.Unmarshal(files["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, ocispecs.MediaTypeImageManifest, index.Manifests[0].MediaType)
+	require.Equal(t, map[string]string{
+		"io.containerd.image.name": "docker.io/debco/debian:bookworm",
+		ocispecs.AnnotationRefName: "bookworm",
+	}, index.Manifests[0].Annotations)
+
+	var manifest ocispecs.Manifest
+	require.NoError(t, json.Unmarshal(blob(t, files, index.Manifests[0]), &manifest))
+	require.Len(t, manifest.Layers, 1)
+	require.Equal(t, ocispecs.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+
+	var img ocispecs.Image
+	require.NoError(t, json.Unmarshal(blob(t, files, manifest.Config), &img))
+	require.Equal(t, "amd64", img.Architecture)
+	require.Equal(t, sourceDateEpoch, img.Created.UTC())
+	require.Equal(t, []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "TERM=xterm", "FOO=bar"}, img.Config.Env)
+	require.Equal(t, []string{"/bin/sh"}, img.Config.Cmd)
+	require.Equal(t, []digest.Digest{digest.FromBytes(layer.Bytes())}, img.RootFS.DiffIDs)
+
+	// The layer is the gzip compressed layer archive.
+	gr, err := gzip.NewReader(bytes.NewReader(blob(t, files, manifest.Layers[0])))
+	require.NoError(t, err)
+
+	uncompressed, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	require.Equal(t, layer.Bytes(), uncompressed)
+
+	t.Run("Reproducible", func(t *testing.T) {
+		otherArchivePath := filepath.Join(tempDir, "image-other.tar")
+		require.NoError(t, oci.WriteArchive(context.Background(), otherArchivePath, opts))
+
+		expected, err := os.ReadFile(archivePath)
+		require.NoError(t, err)
+
+		actual, err := os.ReadFile(otherArchivePath)
+		require.NoError(t, err)
+
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("Multi-Platform", func(t *testing.T) {
+		multiOpts := opts
+		multiOpts.Images = append(multiOpts.Images, oci.PlatformImage{
+			Platform:   ocispecs.Platform{OS: "linux", Architecture: "arm64"},
+			LayerPaths: []string{layerPath},
+		})
+
+		layoutDir := filepath.Join(tempDir, "layout")
+		require.NoError(t, oci.WriteLayout(context.Background(), layoutDir, multiOpts))
+
+		indexData, err := os.ReadFile(filepath.Join(layoutDir, "index.json"))
+		require.NoError(t, err)
+
+		var index ocispecs.Index
+		require.NoError(t, json.Unmarshal(indexData, &index))
+		require.Len(t, index.Manifests, 1)
+		require.Equal(t, ocispecs.MediaTypeImageIndex, index.Manifests[0].MediaType)
+
+		imageIndexData, err := os.ReadFile(filepath.Join(layoutDir, "blobs", "sha256", index.Manifests[0].Digest.Encoded()))
+		require.NoError(t, err)
+
+		var imageIndex ocispecs.Index
+		require.NoError(t, json.Unmarshal(imageIndexData, &imageIndex))
+		require.Len(t, imageIndex.Manifests, 2)
+		require.Equal(t, "amd64", imageIndex.Manifests[0].Platform.Architecture)
+		require.Equal(t, "arm64", imageIndex.Manifests[1].Platform.Architecture)
+	})
+}
+
+func TestXattrs(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	// cap_net_raw=ep
+	capability := "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"
+
+	archives := []unpack.Archives{
+		testutil.DecompressPackage(t, tempDir, testutil.Package{
+			Name: "iputils-ping",
+			Files: []testutil.DebFile{{Name: "/usr/bin/ping", Mode: 0o755, Content: "ping", PAXRecords: map[string]string{
+				"SCHILY.xattr.security.capability": capability,
+			}}},
+		}),
+		// As written by bsdtar.
+		testutil.DecompressPackage(t, tempDir, testutil.Package{
+			Name: "iputils-arping",
+			Files: []testutil.DebFile{{Name: "/usr/bin/arping", Mode: 0o755, Content: "arping", PAXRecords: map[string]string{
+				"LIBARCHIVE.xattr.security.capability": base64.RawStdEncoding.EncodeToString([]byte(capability)),
+			}}},
+		}),
+	}
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+	require.NoError(t, err)
+
+	rootFSArchivePath := filepath.Join(tempDir, "rootfs.tar")
+	require.NoError(t, unpack.MergeArchives(context.Background(), rootFSArchivePath,
+		append([]string{dpkgDatabaseArchivePath}, dataArchivePaths...), time.Time{}))
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	require.NoError(t, oci.WriteArchive(context.Background(), archivePath, oci.Options{
+		Images: []oci.PlatformImage{
+			{
+				Platform:   ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+				LayerPaths: []string{rootFSArchivePath},
+			},
+		},
+	}))
+
+	files := readArchive(t, archivePath)
+
+	var index ocispecs.Index
+	require.NoError(t, json.Unmarshal(files["index.json"], &index))
+	require.Len(t, index.Manifests, 1)
+
+	var manifest ocispecs.Manifest
+	require.NoError(t, json.Unmarshal(blob(t, files, index.Manifests[0]), &manifest))
+	require.Len(t, manifest.Layers, 1)
+
+	gr, err := gzip.NewReader(bytes.NewReader(blob(t, files, manifest.Layers[0])))
+	require.NoError(t, err)
+
+	xattrs := make(map[string]map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		for key, value := range hdr.PAXRecords {
+			if xattrs[hdr.Name] == nil {
+				xattrs[hdr.Name] = make(map[string]string)
+			}
+			xattrs[hdr.Name][key] = value
+		}
+	}
+
+	require.Equal(t, map[string]map[string]string{
+		"usr/bin/ping":   {"SCHILY.xattr.security.capability": capability},
+		"usr/bin/arping": {"SCHILY.xattr.security.capability": capability},
+	}, xattrs)
+}
+
+func readArchive(t *testing.T, archivePath string) map[string][]byte {
+	f, err := os.Open(archivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(tr)
+		require.NoError(t, err)
+
+		files[hdr.Name] = data
+	}
+
+	return files
+}
+
+func blob(t *testing.T, files map[string][]byte, desc ocispecs.Descriptor) []byte {
+	data, ok := files["blobs/sha256/"+desc.Digest.Encoded()]
+	require.True(t, ok, "missing blob %s", desc.Digest)
+	require.Equal(t, desc.Size, int64(len(data)))
+	require.Equal(t, desc.Digest, digest.FromBytes(data))
+
+	return data
+}
@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	remotesdocker "github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/credentials"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Push pushes the image in an OCI image archive (or image layout directory)
+// to each of the given references. Registry credentials are read from the
+// Docker configuration file (eg. ~/.docker/config.json), including any
+// configured credential helpers.
+func Push(ctx context.Context, path string, refs []string) error {
+	if len(refs) == 0 {
+		return errors.New("no references to push to")
+	}
+
+	tempDir, err := os.MkdirTemp("", "debco-push-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	if err := openImageLayout(path, tempDir); err != nil {
+		return err
+	}
+
+	rootDesc, err := rootDescriptor(tempDir)
+	if err != nil {
+		return err
+	}
+
+	store, err := local.NewStore(tempDir)
+	if err != nil {
+		return fmt.Errorf("failed to open image layout: %w", err)
+	}
+
+	hosts := remotesdocker.ConfigureDefaultRegistries(
+		remotesdocker.WithAuthorizer(remotesdocker.NewDockerAuthorizer(remotesdocker.WithAuthCreds(registryCredentials))),
+		// Local registries (eg. for testing) generally don't use TLS.
+		remotesdocker.WithPlainHTTP(remotesdocker.MatchLocalhost),
+	)
+
+	for _, ref := range refs {
+		named, err := docker.ParseNormalizedNamed(ref)
+		if err != nil {
+			return fmt.Errorf("failed to parse reference %q: %w", ref, err)
+		}
+		named = docker.TagNameOnly(named)
+
+		slog.Info("Pushing image", slog.String("ref", named.String()), slog.String("digest", rootDesc.Digest.String()))
+
+		// Each reference gets its own resolver, as the push status is tracked
+		// per resolver and the image would otherwise not be tagged again.
+		resolver := remotesdocker.NewResolver(remotesdocker.ResolverOptions{Hosts: hosts})
+
+		pusher, err := resolver.Pusher(ctx, named.String())
+		if err != nil {
+			return fmt.Errorf("failed to create pusher for %s: %w", named, err)
+		}
+
+		if err := remotes.PushContent(ctx, pusher, rootDesc, store, nil, platforms.All, nil); err != nil {
+			return fmt.Errorf("failed to push image to %s: %w", named, err)
+		}
+	}
+
+	return nil
+}
+
+// openImageLayout makes the image in an OCI image archive (or image layout
+// directory) available as an image layout in dir.
+func openImageLayout(path, dir string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		if err := extractArchive(path, dir); err != nil {
+			return fmt.Errorf("failed to extract OCI image archive: %w", err)
+		}
+
+		return nil
+	}
+
+	// Don't write anything into the image layout itself.
+	layoutDir, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Symlink(filepath.Join(layoutDir, "blobs"), filepath.Join(dir, "blobs")); err != nil {
+		return fmt.Errorf("failed to link image layout blobs: %w", err)
+	}
+
+	if err := copyFile(filepath.Join(layoutDir, "index.json"), filepath.Join(dir, "index.json")); err != nil {
+		return fmt.Errorf("failed to read image layout index: %w", err)
+	}
+
+	return nil
+}
+
+// rootDescriptor returns the descriptor of the image (or image index) in an
+// image layout. The layout may reference the image more than once (eg. with
+// different tags) but must only contain a single image.
+func rootDescriptor(dir string) (ocispecs.Descriptor, error) {
+	indexData, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	var index ocispecs.Index
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return ocispecs.Descriptor{}, fmt.Errorf("failed to parse index: %w", err)
+	}
+
+	if len(index.Manifests) == 0 {
+		return ocispecs.Descriptor{}, errors.New("image layout does not contain an image")
+	}
+
+	rootDesc := index.Manifests[0]
+	for _, desc := range index.Manifests[1:] {
+		if desc.Digest != rootDesc.Digest {
+			return ocispecs.Descriptor{}, errors.New("image layout contains more than one image")
+		}
+	}
+
+	// The annotations only apply to the image layout (eg. the image name).
+	rootDesc.Annotations = nil
+
+	return rootDesc, nil
+}
+
+// registryCredentials returns the credentials for a registry host from the
+// Docker configuration file.
+func registryCredentials(host string) (string, string, error) {
+	// DOCKER_CONFIG is read on every call, rather than once per process.
+	cfg, err := config.Load(os.Getenv("DOCKER_CONFIG"))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load docker config: %w", err)
+	}
+
+	if !cfg.ContainsAuth() {
+		cfg.CredentialsStore = credentials.DetectDefaultStore(cfg.CredentialsStore)
+	}
+
+	// Docker Hub credentials are stored under the legacy index address.
+	if host == "registry-1.docker.io" {
+		host = "https://index.docker.io/v1/"
+	}
+
+	authConfig, err := cfg.GetAuthConfig(host)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get credentials for %s: %w", host, err)
+	}
+
+	if authConfig.IdentityToken != "" {
+		return "", authConfig.IdentityToken, nil
+	}
+
+	return authConfig.Username, authConfig.Password, nil
+}
+
+// extractArchive extracts an OCI image archive into dir.
+func extractArchive(archivePath, dir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return err
+			}
+
+			if err := writeFile(path, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return writeFile(dstPath, src)
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
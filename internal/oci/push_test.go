@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package oci_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/debco/internal/oci"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPush(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	registry := testutil.NewRegistry(t, "debco", "secret")
+
+	// Credentials are read from the docker config file.
+	dockerConfigDir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dockerConfigDir)
+
+	dockerConfig, err := json.Marshal(map[string]any{
+		"auths": map[string]any{
+			registry.Host: map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte("debco:secret")),
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dockerConfigDir, "config.json"), dockerConfig, 0o600))
+
+	tempDir := t.TempDir()
+
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644, Size: 6}))
+	_, err = tw.Write([]byte("debco\n"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	layerPath := filepath.Join(tempDir, "rootfs.tar")
+	require.NoError(t, os.WriteFile(layerPath, layer.Bytes(), 0o644))
+
+	opts := oci.Options{
+		Tags: []string{"debco/debian:bookworm"},
+		Images: []oci.PlatformImage{
+			{
+				Platform:   ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+				LayerPaths: []string{layerPath},
+			},
+			{
+				Platform:   ocispecs.Platform{OS: "linux", Architecture: "arm64"},
+				LayerPaths: []string{layerPath},
+			},
+		},
+	}
+
+	archivePath := filepath.Join(tempDir, "image.tar")
+	require.NoError(t, oci.WriteArchive(context.Background(), archivePath, opts))
+
+	require.NoError(t, oci.Push(context.Background(), archivePath, []string{
+		registry.Host + "/debco/debian:bookworm",
+		registry.Host + "/debco/debian:latest",
+	}))
+
+	index, mediaType, ok := registry.Manifest("debco/debian", "bookworm")
+	require.True(t, ok)
+	require.Equal(t, ocispecs.MediaTypeImageIndex, mediaType)
+
+	latestIndex, _, ok := registry.Manifest("debco/debian", "latest")
+	require.True(t, ok)
+	require.Equal(t, index, latestIndex)
+
+	// The platform manifests, and everything they reference, are pushed too.
+	var imageIndex ocispecs.Index
+	require.NoError(t, json.Unmarshal(index, &imageIndex))
+	require.Len(t, imageIndex.Manifests, 2)
+
+	for _, desc := range imageIndex.Manifests {
+		manifestData, _, ok := registry.Manifest("debco/debian", desc.Digest.String())
+		require.True(t, ok)
+
+		var manifest ocispecs.Manifest
+		require.NoError(t, json.Unmarshal(manifestData, &manifest))
+
+		for _, blobDesc := range append([]ocispecs.Descriptor{manifest.Config}, manifest.Layers...) {
+			blob, ok := registry.Blob(blobDesc.Digest)
+			require.True(t, ok)
+			require.Equal(t, blobDesc.Digest, digest.FromBytes(blob))
+		}
+	}
+
+	t.Run("Image Layout", func(t *testing.T) {
+		layoutDir := filepath.Join(tempDir, "layout")
+		require.NoError(t, oci.WriteLayout(context.Background(), layoutDir, opts))
+
+		require.NoError(t, oci.Push(context.Background(), layoutDir, []string{registry.Host + "/debco/layout"}))
+
+		layoutIndex, _, ok := registry.Manifest("debco/layout", "latest")
+		require.True(t, ok)
+		require.Equal(t, index, layoutIndex)
+
+		// Nothing is written into the image layout.
+		_, err := os.Stat(filepath.Join(layoutDir, "ingest"))
+		require.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dockerConfigDir, "config.json"), []byte("{}"), 0o600))
+
+		err := oci.Push(context.Background(), archivePath, []string{registry.Host + "/debco/debian:unauthorized"})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,402 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+)
+
+// Mode is the progress output mode.
+type Mode string
+
+const (
+	// ModeAuto displays interactive progress bars.
+	ModeAuto Mode = "auto"
+	// ModePlain disables progress bars and uses plain text output.
+	ModePlain Mode = "plain"
+	// ModeJSON emits a stream of newline-delimited JSON events.
+	ModeJSON Mode = "json"
+)
+
+// ParseMode parses a progress output mode.
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(s); mode {
+	case ModeAuto, ModePlain, ModeJSON:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unsupported progress mode: %s", s)
+	}
+}
+
+// Phase is a phase of the image build.
+type Phase string
+
+const (
+	PhaseSource     Phase = "source"
+	PhaseIndex      Phase = "index"
+	PhaseResolve    Phase = "resolve"
+	PhaseDownload   Phase = "download"
+	PhaseDecompress Phase = "decompress"
+	PhaseUnpack     Phase = "unpack"
+	PhaseBuild      Phase = "build"
+)
+
+// Status is the status of an operation.
+type Status string
+
+const (
+	StatusStarted   Status = "started"
+	StatusProgress  Status = "progress"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusLog       Status = "log"
+)
+
+// Event is a machine-readable progress event.
+type Event struct {
+	// Time is when the event occurred.
+	Time time.Time `json:"time"`
+	// Phase is the build phase the event belongs to.
+	Phase Phase `json:"phase"`
+	// Status is the status of the operation.
+	Status Status `json:"status"`
+	// ID optionally identifies the operation (eg. a BuildKit vertex digest).
+	ID string `json:"id,omitempty"`
+	// Name is a human readable name for the operation.
+	Name string `json:"name,omitempty"`
+	// Current is the number of units of work completed.
+	Current int64 `json:"current,omitempty"`
+	// Total is the total number of units of work.
+	Total int64 `json:"total,omitempty"`
+	// Bytes is the number of bytes transferred.
+	Bytes int64 `json:"bytes,omitempty"`
+	// Duration is the duration of the operation in seconds.
+	Duration float64 `json:"duration,omitempty"`
+	// Cached is true if the result of the operation was cached.
+	Cached bool `json:"cached,omitempty"`
+	// Message is an optional log message.
+	Message string `json:"message,omitempty"`
+	// Error is the error message if the operation failed.
+	Error string `json:"error,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	mode             = ModeAuto
+	output io.Writer = os.Stdout
+)
+
+// SetMode sets the global progress output mode.
+func SetMode(m Mode) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	mode = m
+}
+
+// CurrentMode returns the global progress output mode.
+func CurrentMode() Mode {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return mode
+}
+
+// SetOutput sets where progress bars and events are written (defaults to stdout).
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	output = w
+}
+
+// Emit writes an event to the JSON event stream. It does nothing unless
+// the JSON progress mode is enabled.
+func Emit(e Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if mode != ModeJSON {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	if err := json.NewEncoder(output).Encode(&e); err != nil {
+		slog.Warn("Failed to write progress event", slog.Any("error", err))
+	}
+}
+
+// Progress is a container for the progress bars of an operation.
+type Progress struct {
+	p *mpb.Progress
+}
+
+// New creates a new progress container. Progress bars are only displayed in
+// the auto mode, and not when debug logging is enabled.
+func New(ctx context.Context) *Progress {
+	mu.Lock()
+	var progressOutput io.Writer = output
+	if mode != ModeAuto || slog.Default().Enabled(ctx, slog.LevelDebug) {
+		progressOutput = io.Discard
+	}
+	mu.Unlock()
+
+	return &Progress{
+		p: mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput)),
+	}
+}
+
+// Shutdown stops rendering progress bars.
+func (p *Progress) Shutdown() {
+	p.p.Shutdown()
+}
+
+// AddBar adds a progress bar counting units of work.
+func (p *Progress) AddBar(phase Phase, name string, total int64) *Bar {
+	bar := p.p.AddBar(total,
+		mpb.PrependDecorators(
+			decor.Name(name+": "),
+			decor.CountersNoUnit("%d / %d"),
+		),
+		mpb.AppendDecorators(
+			decor.Percentage(),
+		),
+	)
+
+	return newBar(bar, phase, name, total, false)
+}
+
+// AddBytesBar adds a progress bar counting bytes transferred, it displays the
+// remaining bytes, throughput and estimated time remaining.
+func (p *Progress) AddBytesBar(phase Phase, name string, total int64) *Bar {
+	// The total is set separately so that the bar is not completed early if
+	// retried transfers push the current value past the original total.
+	bar := p.p.AddBar(0,
+		mpb.PrependDecorators(
+			decor.Name(name+": "),
+			decor.Counters(decor.SizeB1024(0), "% .1f / % .1f"),
+		),
+		mpb.AppendDecorators(
+			decor.Any(func(s decor.Statistics) string {
+				remaining := s.Total - s.Current
+				if remaining < 0 {
+					remaining = 0
+				}
+
+				return fmt.Sprintf("% .1f left", decor.SizeB1024(remaining))
+			}, decor.WCSyncSpace),
+			decor.AverageSpeed(decor.SizeB1024(0), "% .1f", decor.WCSyncSpace),
+			decor.AverageETA(decor.ET_STYLE_GO, decor.WCSyncSpace),
+		),
+	)
+	bar.SetTotal(total, false)
+
+	return newBar(bar, phase, name, total, true)
+}
+
+// Bar is a progress bar that also reports progress as events.
+type Bar struct {
+	bar     *mpb.Bar
+	phase   Phase
+	name    string
+	bytes   bool
+	total   atomic.Int64
+	current atomic.Int64
+	started time.Time
+	// When the last progress event was emitted (in unix nanoseconds).
+	lastEmitted atomic.Int64
+}
+
+// Byte counting bars emit progress events at most this often.
+const bytesEventInterval = 500 * time.Millisecond
+
+func newBar(bar *mpb.Bar, phase Phase, name string, total int64, bytes bool) *Bar {
+	b := &Bar{
+		bar:     bar,
+		phase:   phase,
+		name:    name,
+		bytes:   bytes,
+		started: time.Now(),
+	}
+	b.total.Store(total)
+
+	Emit(Event{
+		Phase:  phase,
+		Status: StatusStarted,
+		Name:   name,
+		Total:  total,
+	})
+
+	return b
+}
+
+// Increment increments the progress bar by one unit of work.
+func (b *Bar) Increment() {
+	b.IncrBy(1)
+}
+
+// IncrBy increments the progress bar by n units of work.
+func (b *Bar) IncrBy(n int64) {
+	b.bar.IncrInt64(n)
+	current := b.current.Add(n)
+
+	if b.bytes {
+		now := time.Now().UnixNano()
+		last := b.lastEmitted.Load()
+		if now-last < int64(bytesEventInterval) || !b.lastEmitted.CompareAndSwap(last, now) {
+			return
+		}
+	}
+
+	Emit(Event{
+		Phase:   b.phase,
+		Status:  StatusProgress,
+		Name:    b.name,
+		Current: current,
+		Total:   b.total.Load(),
+	})
+}
+
+// ExtendTotal increases the total units of work by n (eg. when a transfer
+// needs to be retried).
+func (b *Bar) ExtendTotal(n int64) {
+	b.bar.SetTotal(b.total.Add(n), false)
+}
+
+// Reader returns a reader that increments the progress bar by the number of
+// bytes read.
+func (b *Bar) Reader(r io.Reader) io.Reader {
+	return &barReader{r: r, bar: b}
+}
+
+// Done completes the progress bar, marking it as failed if err is not nil,
+// and waits for it to finish rendering.
+func (b *Bar) Done(err error) {
+	if err != nil {
+		b.bar.Abort(true)
+	} else {
+		b.bar.SetTotal(b.bar.Current(), true)
+	}
+	b.bar.Wait()
+
+	e := Event{
+		Phase:    b.phase,
+		Status:   StatusCompleted,
+		Name:     b.name,
+		Current:  b.current.Load(),
+		Total:    b.total.Load(),
+		Duration: time.Since(b.started).Seconds(),
+	}
+	if err != nil {
+		e.Status = StatusFailed
+		e.Error = err.Error()
+	}
+
+	Emit(e)
+}
+
+type barReader struct {
+	r   io.Reader
+	bar *Bar
+}
+
+func (br *barReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if n > 0 {
+		br.bar.IncrBy(int64(n))
+	}
+	return n, err
+}
+
+// Operation is an individual operation within a build phase (eg. a single
+// package download).
+type Operation struct {
+	phase   Phase
+	name    string
+	started time.Time
+	bytes   atomic.Int64
+}
+
+// Start reports the start of an operation.
+func Start(phase Phase, name string) *Operation {
+	Emit(Event{
+		Phase:  phase,
+		Status: StatusStarted,
+		Name:   name,
+	})
+
+	return &Operation{
+		phase:   phase,
+		name:    name,
+		started: time.Now(),
+	}
+}
+
+// Reader returns a reader that counts the bytes transferred by the operation.
+func (o *Operation) Reader(r io.Reader) io.Reader {
+	return &countingReader{r: r, n: &o.bytes}
+}
+
+// Bytes returns the number of bytes transferred by the operation so far.
+func (o *Operation) Bytes() int64 {
+	return o.bytes.Load()
+}
+
+// Done reports the completion of an operation, marking it as failed if err
+// is not nil.
+func (o *Operation) Done(err error) {
+	e := Event{
+		Phase:    o.phase,
+		Status:   StatusCompleted,
+		Name:     o.name,
+		Bytes:    o.bytes.Load(),
+		Duration: time.Since(o.started).Seconds(),
+	}
+	if err != nil {
+		e.Status = StatusFailed
+		e.Error = err.Error()
+	}
+
+	Emit(e)
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
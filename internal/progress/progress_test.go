@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package progress_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/immutos/debco/internal/progress"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgress(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	var buf bytes.Buffer
+	progress.SetOutput(&buf)
+	progress.SetMode(progress.ModeJSON)
+	t.Cleanup(func() {
+		progress.SetOutput(os.Stdout)
+		progress.SetMode(progress.ModeAuto)
+	})
+
+	progressBars := progress.New(context.Background())
+
+	bar := progressBars.AddBar(progress.PhaseDownload, "Downloading", 2)
+
+	op := progress.Start(progress.PhaseDownload, "http://example.com/foo.deb")
+	_, err := io.Copy(io.Discard, op.Reader(strings.NewReader("hello")))
+	require.NoError(t, err)
+	op.Done(nil)
+	bar.Increment()
+
+	op = progress.Start(progress.PhaseDownload, "http://example.com/bar.deb")
+	op.Done(errors.New("not found"))
+	bar.Increment()
+
+	bar.Done(nil)
+	progressBars.Shutdown()
+
+	var events []progress.Event
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e progress.Event
+		require.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+
+	require.Len(t, events, 8)
+
+	require.Equal(t, progress.StatusStarted, events[0].Status)
+	require.Equal(t, int64(2), events[0].Total)
+
+	require.Equal(t, progress.StatusCompleted, events[2].Status)
+	require.Equal(t, "http://example.com/foo.deb", events[2].Name)
+	require.Equal(t, int64(5), events[2].Bytes)
+
+	require.Equal(t, progress.StatusFailed, events[5].Status)
+	require.Equal(t, "not found", events[5].Error)
+
+	require.Equal(t, progress.StatusCompleted, events[7].Status)
+	require.Equal(t, progress.PhaseDownload, events[7].Phase)
+	require.Equal(t, int64(2), events[7].Current)
+}
+
+func TestBytesBar(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	var buf bytes.Buffer
+	progress.SetOutput(&buf)
+	progress.SetMode(progress.ModeJSON)
+	t.Cleanup(func() {
+		progress.SetOutput(os.Stdout)
+		progress.SetMode(progress.ModeAuto)
+	})
+
+	progressBars := progress.New(context.Background())
+
+	bar := progressBars.AddBytesBar(progress.PhaseDownload, "Downloading", 5)
+
+	// A failed transfer that will be retried.
+	_, err := io.Copy(io.Discard, bar.Reader(iotest.OneByteReader(strings.NewReader("hel"))))
+	require.NoError(t, err)
+	bar.ExtendTotal(3)
+
+	_, err = io.Copy(io.Discard, bar.Reader(iotest.OneByteReader(strings.NewReader("hello"))))
+	require.NoError(t, err)
+
+	bar.Done(nil)
+	progressBars.Shutdown()
+
+	var events []progress.Event
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e progress.Event
+		require.NoError(t, dec.Decode(&e))
+		events = append(events, e)
+	}
+
+	// Progress events are rate limited, so only the first read is reported.
+	require.Len(t, events, 3)
+
+	require.Equal(t, progress.StatusStarted, events[0].Status)
+	require.Equal(t, int64(5), events[0].Total)
+
+	require.Equal(t, progress.StatusProgress, events[1].Status)
+	require.Equal(t, int64(1), events[1].Current)
+
+	require.Equal(t, progress.StatusCompleted, events[2].Status)
+	require.Equal(t, int64(8), events[2].Current)
+	require.Equal(t, int64(8), events[2].Total)
+}
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package provenance generates SLSA provenance describing how an image was
+// built by debco.
+package provenance
+
+import (
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"slices"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/debco/internal/sbom"
+	"github.com/immutos/debco/internal/source"
+	"github.com/immutos/debco/internal/types"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// PredicateType is the in-toto predicate type of SLSA v1 provenance.
+	PredicateType = "https://slsa.dev/provenance/v1"
+	// BuildType describes how debco builds images from recipes.
+	BuildType = "https://github.com/immutos/debco/buildtypes/recipe/v1"
+	// BuilderID identifies debco as the builder.
+	BuilderID = "https://github.com/immutos/debco"
+)
+
+// Options describes the build of the image of a platform.
+type Options struct {
+	// RecipePath is the path to the recipe file.
+	RecipePath string
+	// RecipeSHA256 is the SHA-256 digest of the recipe file.
+	RecipeSHA256 string
+	// Platform is the platform of the image.
+	Platform ocispecs.Platform
+	// ToolVersion is the version of debco.
+	ToolVersion string
+	// BuildKitVersion is the version of the BuildKit daemon (if known).
+	BuildKitVersion string
+	// Releases are the InRelease files of the repositories used.
+	Releases []source.InRelease
+	// Packages are the packages resolved for the image (including any that
+	// are removed once it has been provisioned, eg. debco).
+	Packages []types.Package
+	// BuildPackages are the packages used to build the image that are not
+	// part of it (eg. the disk build tools).
+	BuildPackages []types.Package
+}
+
+// SLSA v1 provenance predicate.
+// See: https://slsa.dev/spec/v1.0/provenance
+type predicate struct {
+	BuildDefinition buildDefinition `json:"buildDefinition"`
+	RunDetails      runDetails      `json:"runDetails"`
+}
+
+type buildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   externalParameters   `json:"externalParameters"`
+	ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies"`
+}
+
+type externalParameters struct {
+	Recipe   resourceDescriptor `json:"recipe"`
+	Platform string             `json:"platform"`
+}
+
+type runDetails struct {
+	Builder builder `json:"builder"`
+}
+
+type builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// resourceDescriptor is an in-toto (v1) resource descriptor.
+// See: https://github.com/in-toto/attestation/blob/main/spec/v1/resource_descriptor.md
+type resourceDescriptor struct {
+	URI              string            `json:"uri,omitempty"`
+	Digest           map[string]string `json:"digest,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	DownloadLocation string            `json:"downloadLocation,omitempty"`
+	Annotations      map[string]string `json:"annotations,omitempty"`
+}
+
+// Predicate returns the SLSA v1 provenance predicate describing the build.
+// Timestamps are omitted, so that the provenance of reproducible builds is
+// also reproducible.
+func Predicate(opts Options) (json.RawMessage, error) {
+	p := predicate{
+		BuildDefinition: buildDefinition{
+			BuildType: BuildType,
+			ExternalParameters: externalParameters{
+				Recipe: resourceDescriptor{
+					Name:   filepath.Base(opts.RecipePath),
+					Digest: map[string]string{"sha256": opts.RecipeSHA256},
+				},
+				Platform: platforms.Format(opts.Platform),
+			},
+			ResolvedDependencies: []resourceDescriptor{},
+		},
+		RunDetails: runDetails{
+			Builder: builder{
+				ID:      BuilderID,
+				Version: map[string]string{"debco": opts.ToolVersion},
+			},
+		},
+	}
+
+	if opts.BuildKitVersion != "" {
+		p.RunDetails.Builder.Version["buildkit"] = opts.BuildKitVersion
+	}
+
+	for _, release := range opts.Releases {
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, resourceDescriptor{
+			URI:    release.URL,
+			Digest: map[string]string{"sha256": release.SHA256},
+			Annotations: map[string]string{
+				"signer": release.Signer,
+			},
+		})
+	}
+
+	// Packages used both in the image and to build it are only listed once.
+	seen := make(map[string]bool)
+	for _, pkg := range append(slices.Clone(opts.Packages), opts.BuildPackages...) {
+		if seen[pkg.ID()] {
+			continue
+		}
+		seen[pkg.ID()] = true
+
+		digest := make(map[string]string)
+		if pkg.SHA256 != "" {
+			digest["sha256"] = pkg.SHA256
+		}
+		if pkg.SHA512 != "" {
+			digest["sha512"] = pkg.SHA512
+		}
+		if pkg.MD5sum != "" {
+			digest["md5"] = pkg.MD5sum
+		}
+
+		dependency := resourceDescriptor{
+			URI:    sbom.PackageURL(pkg),
+			Name:   path.Base(pkg.Filename),
+			Digest: digest,
+		}
+
+		if len(pkg.URLs) > 0 {
+			dependency.DownloadLocation = pkg.URLs[0]
+		}
+
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, dependency)
+	}
+
+	return json.Marshal(p)
+}
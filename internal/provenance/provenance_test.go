@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package provenance_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/platforms"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/immutos/debco/internal/provenance"
+	"github.com/immutos/debco/internal/source"
+	"github.com/immutos/debco/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredicate(t *testing.T) {
+	baseFiles := types.Package{
+		Package: debtypes.Package{
+			Name:         "base-files",
+			Version:      version.MustParse("12.4+deb12u6"),
+			Architecture: arch.MustParse("arm64"),
+			Filename:     "pool/main/b/base-files/base-files_12.4+deb12u6_arm64.deb",
+			SHA256:       "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0",
+		},
+		URLs:     []string{"https://deb.debian.org/debian/pool/main/b/base-files/base-files_12.4+deb12u6_arm64.deb"},
+		Origin:   "Debian",
+		Codename: "bookworm",
+	}
+
+	predicate, err := provenance.Predicate(provenance.Options{
+		RecipePath:      "examples/bookworm-ultraslim.yaml",
+		RecipeSHA256:    "4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945",
+		Platform:        platforms.MustParse("linux/arm64"),
+		ToolVersion:     "v0.1.0",
+		BuildKitVersion: "v0.13.2",
+		Releases: []source.InRelease{{
+			URL:    "https://deb.debian.org/debian/dists/bookworm/InRelease",
+			SHA256: "9f2a0e3b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f",
+			Signer: "4CB50190207B4758A3F73A796ED0E7B82643E131",
+		}},
+		Packages: []types.Package{baseFiles},
+	})
+	require.NoError(t, err)
+
+	expected := `{
+  "buildDefinition": {
+    "buildType": "https://github.com/immutos/debco/buildtypes/recipe/v1",
+    "externalParameters": {
+      "recipe": {
+        "name": "bookworm-ultraslim.yaml",
+        "digest": {"sha256": "4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"}
+      },
+      "platform": "linux/arm64"
+    },
+    "resolvedDependencies": [
+      {
+        "uri": "https://deb.debian.org/debian/dists/bookworm/InRelease",
+        "digest": {"sha256": "9f2a0e3b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f1a0b9c8d7e6f"},
+        "annotations": {"signer": "4CB50190207B4758A3F73A796ED0E7B82643E131"}
+      },
+      {
+        "uri": "pkg:deb/debian/base-files@12.4%2Bdeb12u6?arch=arm64&distro=bookworm",
+        "name": "base-files_12.4+deb12u6_arm64.deb",
+        "digest": {"sha256": "0f1e2d3c4b5a69788796a5b4c3d2e1f00f1e2d3c4b5a69788796a5b4c3d2e1f0"},
+        "downloadLocation": "https://deb.debian.org/debian/pool/main/b/base-files/base-files_12.4+deb12u6_arm64.deb"
+      }
+    ]
+  },
+  "runDetails": {
+    "builder": {
+      "id": "https://github.com/immutos/debco",
+      "version": {"debco": "v0.1.0", "buildkit": "v0.13.2"}
+    }
+  }
+}`
+
+	require.JSONEq(t, expected, string(predicate))
+
+	t.Run("Build Packages", func(t *testing.T) {
+		e2fsprogs := types.Package{
+			Package: debtypes.Package{
+				Name:         "e2fsprogs",
+				Version:      version.MustParse("1.47.0-2"),
+				Architecture: arch.MustParse("arm64"),
+				Filename:     "pool/main/e/e2fsprogs/e2fsprogs_1.47.0-2_arm64.deb",
+				SHA256:       "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90",
+			},
+			Origin:   "Debian",
+			Codename: "bookworm",
+		}
+
+		predicate, err := provenance.Predicate(provenance.Options{
+			Platform:      platforms.MustParse("linux/arm64"),
+			Packages:      []types.Package{baseFiles},
+			BuildPackages: []types.Package{baseFiles, e2fsprogs},
+		})
+		require.NoError(t, err)
+
+		var p struct {
+			BuildDefinition struct {
+				ResolvedDependencies []struct {
+					Name string `json:"name"`
+				} `json:"resolvedDependencies"`
+			} `json:"buildDefinition"`
+		}
+		require.NoError(t, json.Unmarshal(predicate, &p))
+
+		var names []string
+		for _, dependency := range p.BuildDefinition.ResolvedDependencies {
+			names = append(names, dependency.Name)
+		}
+
+		// Packages used both in the image and to build it are listed once.
+		require.Equal(t, []string{"base-files_12.4+deb12u6_arm64.deb", "e2fsprogs_1.47.0-2_arm64.deb"}, names)
+	})
+}
+
+func TestSigner(t *testing.T) {
+	payload := []byte(`{"_type":"https://in-toto.io/Statement/v1"}`)
+
+	t.Run("ECDSA", func(t *testing.T) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+
+		keyPath := filepath.Join(t.TempDir(), "key.pem")
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+		signer, err := provenance.LoadSigner(keyPath)
+		require.NoError(t, err)
+
+		envelope := sign(t, signer, payload)
+
+		digest := sha256.Sum256(provenance.PAE(envelope.PayloadType, envelope.Payload))
+		require.True(t, ecdsa.VerifyASN1(&key.PublicKey, digest[:], envelope.Signatures[0].Sig))
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+
+		keyPath := filepath.Join(t.TempDir(), "key.pem")
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+		signer, err := provenance.LoadSigner(keyPath)
+		require.NoError(t, err)
+
+		envelope := sign(t, signer, payload)
+
+		require.True(t, ed25519.Verify(publicKey, provenance.PAE(envelope.PayloadType, envelope.Payload), envelope.Signatures[0].Sig))
+	})
+}
+
+func sign(t *testing.T, signer *provenance.Signer, payload []byte) provenance.Envelope {
+	envelopeData, err := signer.Sign("application/vnd.in-toto+json", payload)
+	require.NoError(t, err)
+
+	var envelope provenance.Envelope
+	require.NoError(t, json.Unmarshal(envelopeData, &envelope))
+	require.Equal(t, "application/vnd.in-toto+json", envelope.PayloadType)
+	require.Equal(t, payload, envelope.Payload)
+	require.Len(t, envelope.Signatures, 1)
+	require.Len(t, envelope.Signatures[0].KeyID, 64)
+
+	return envelope
+}
@@ -38,8 +38,13 @@ type Recipe struct {
 	Groups []GroupConfig `yaml:"groups,omitempty"`
 	// Users is a list of users to create.
 	Users []UserConfig `yaml:"users,omitempty"`
+	// Alternatives is a list of alternatives selections to apply.
+	Alternatives []AlternativeConfig `yaml:"alternatives,omitempty"`
 	// Container is the OCI image configuration.
 	Container *ContainerConfig `yaml:"container,omitempty"`
+	// Disk is the optional configuration for a bootable virtual machine disk
+	// image (see: --output type=disk).
+	Disk *DiskConfig `yaml:"disk,omitempty"`
 }
 
 // OptionsConfig contains configuration options for the image.
@@ -51,6 +56,31 @@ type OptionsConfig struct {
 	Slimify bool `yaml:"slimify,omitempty"`
 	// DownloadOnly specifies whether to only download packages and not install them.
 	DownloadOnly bool `yaml:"downloadOnly,omitempty"`
+	// FileConflicts specifies how files shipped by more than one package (that
+	// are not covered by a Replaces relationship) are handled. Either "error"
+	// (the default) to fail the build, or "warn" to let the last unpacked
+	// package win.
+	FileConflicts string `yaml:"fileConflicts,omitempty"`
+	// Layering specifies how the image is split into layers. Either "squash"
+	// (the default) for a single layer, or "packages" to put the base packages
+	// (eg. those of priority required) in their own layer, which can be shared
+	// between images, followed by a layer with the recipe's additions.
+	Layering string `yaml:"layering,omitempty"`
+	// PathFilters is an ordered list of dpkg path filters, that determine which
+	// files are installed from packages (the last matching filter wins). The
+	// filters are also written to /etc/dpkg/dpkg.cfg.d so that packages
+	// installed later on honour them.
+	PathFilters []PathFilterConfig `yaml:"pathFilters,omitempty"`
+}
+
+// PathFilterConfig is a dpkg path filter, either Exclude or Include must be set.
+// See: dpkg(1) --path-exclude.
+type PathFilterConfig struct {
+	// Exclude is a glob matching paths to exclude (eg. /usr/share/doc/*).
+	Exclude string `yaml:"exclude,omitempty"`
+	// Include is a glob matching paths to include, even if they were excluded
+	// by an earlier filter (eg. /usr/share/doc/*/copyright).
+	Include string `yaml:"include,omitempty"`
 }
 
 // SourceConfig is the configuration for an apt repository.
@@ -65,6 +95,14 @@ type SourceConfig struct {
 	// Components is a list of components to use from the repository.
 	// If not specified, defaults to ["main"].
 	Components []string `yaml:"components,omitempty"`
+	// Architectures restricts the repository to the given target architectures.
+	// If not specified, the repository is used for all architectures. This is
+	// useful for distributions such as Ubuntu that serve some architectures
+	// from a separate ports repository.
+	Architectures []string `yaml:"architectures,omitempty"`
+	// AllowWeakHashes allows the use of weak hashes (eg. MD5Sum) when a
+	// repository does not provide SHA256 or SHA512 checksums.
+	AllowWeakHashes bool `yaml:"allowWeakHashes,omitempty"`
 }
 
 // PackagesConfig is the configuration for packages.
@@ -109,6 +147,15 @@ type UserConfig struct {
 	System bool `yaml:"system,omitempty"`
 }
 
+// AlternativeConfig is the configuration for an alternatives selection.
+// See: update-alternatives(1).
+type AlternativeConfig struct {
+	// Name is the name of the alternatives group (eg. editor).
+	Name string `yaml:"name"`
+	// Path is the alternative to select (eg. /usr/bin/vim.basic).
+	Path string `yaml:"path"`
+}
+
 // ContainerConfig is the configuration for the container.
 type ContainerConfig struct {
 	// User defines the username or UID which the process in the container should run as.
@@ -133,6 +180,50 @@ type ContainerConfig struct {
 	StopSignal string `yaml:"stopSignal,omitempty"`
 }
 
+// DiskConfig is the configuration for a bootable virtual machine disk image.
+type DiskConfig struct {
+	// Format is the format of the disk image, either "raw" (the default) or
+	// "qcow2".
+	Format string `yaml:"format,omitempty"`
+	// Size is the total size of the disk (eg. 2GiB).
+	Size string `yaml:"size"`
+	// Kernel is the kernel package to install. If not specified, defaults to
+	// linux-image-<arch> (eg. linux-image-amd64).
+	Kernel string `yaml:"kernel,omitempty"`
+	// KernelCommandLine is a list of additional kernel command line arguments.
+	// If not specified, defaults to the serial console of the architecture
+	// (eg. console=ttyS0).
+	KernelCommandLine []string `yaml:"kernelCommandLine,omitempty"`
+	// Bootloader is the EFI bootloader to install, either "systemd-boot" (the
+	// default) or "grub".
+	Bootloader string `yaml:"bootloader,omitempty"`
+	// Partitions is the partition layout of the disk, in order. If not
+	// specified, defaults to a 256MiB EFI system partition mounted at
+	// /boot/efi followed by an ext4 root partition filling the rest of the
+	// disk.
+	Partitions []PartitionConfig `yaml:"partitions,omitempty"`
+}
+
+// PartitionConfig is the configuration for a disk partition. Exactly one
+// partition must be mounted at /, and exactly one vfat partition must be
+// mounted at /boot/efi (or /efi), the EFI system partition.
+type PartitionConfig struct {
+	// Label is the filesystem label of the partition, it is also used to
+	// mount the partition (eg. LABEL=root).
+	Label string `yaml:"label"`
+	// Size is the size of the partition (eg. 256MiB). If not specified, the
+	// partition fills the rest of the disk (only the last partition may omit
+	// the size).
+	Size string `yaml:"size,omitempty"`
+	// Filesystem is the filesystem of the partition, either "ext4" or "vfat".
+	Filesystem string `yaml:"filesystem"`
+	// MountPoint is where the partition is mounted (eg. /boot/efi).
+	MountPoint string `yaml:"mountPoint"`
+	// MountOptions are the fstab mount options of the partition. If not
+	// specified, defaults to "defaults" (or "umask=0077" for vfat).
+	MountOptions string `yaml:"mountOptions,omitempty"`
+}
+
 func (c *Recipe) GetAPIVersion() string {
 	return APIVersion
 }
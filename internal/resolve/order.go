@@ -0,0 +1,161 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package resolve
+
+import (
+	"log/slog"
+
+	"github.com/immutos/debco/internal/database"
+	"github.com/immutos/debco/internal/types"
+)
+
+// PreDependsOrder returns the selected packages in the order that they would
+// be unpacked by dpkg during a fresh install, such that each package comes
+// after the packages it pre-depends on. Essential packages (eg. base-passwd)
+// and their pre-dependencies otherwise come first, followed by the remaining
+// packages in name order.
+func PreDependsOrder(selectedDB *database.PackageDB) []types.Package {
+	var pkgs []types.Package
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		pkgs = append(pkgs, pkg)
+		return nil
+	})
+
+	index := make(map[string]int, len(pkgs))
+	for i, pkg := range pkgs {
+		index[pkg.ID()] = i
+	}
+
+	// Edges from each package to the packages that pre-depend on it.
+	after := make([]map[int]bool, len(pkgs))
+	before := make([][]int, len(pkgs))
+	for i := range after {
+		after[i] = make(map[int]bool)
+	}
+
+	inDegree := make([]int, len(pkgs))
+	for i, pkg := range pkgs {
+		for _, dep := range preDependencies(selectedDB, pkg) {
+			j, ok := index[dep.ID()]
+			if !ok || j == i || after[j][i] {
+				continue
+			}
+
+			after[j][i] = true
+			before[i] = append(before[i], j)
+			inDegree[i]++
+		}
+	}
+
+	// Essential packages, and the packages they pre-depend on, come first.
+	early := make([]bool, len(pkgs))
+	var markEarly func(i int)
+	markEarly = func(i int) {
+		if early[i] {
+			return
+		}
+
+		early[i] = true
+		for _, j := range before[i] {
+			markEarly(j)
+		}
+	}
+	for i, pkg := range pkgs {
+		if isEssential(pkg) {
+			markEarly(i)
+		}
+	}
+
+	// The order in which packages that are ready are picked.
+	var priority []int
+	for _, isEarly := range []bool{true, false} {
+		for i := range pkgs {
+			if early[i] == isEarly {
+				priority = append(priority, i)
+			}
+		}
+	}
+
+	order := make([]types.Package, 0, len(pkgs))
+	done := make([]bool, len(pkgs))
+	for len(order) < len(pkgs) {
+		next := -1
+		for _, i := range priority {
+			if !done[i] && inDegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+
+		// Packages that pre-depend on each other, use the default order.
+		if next == -1 {
+			for _, i := range priority {
+				if !done[i] {
+					next = i
+					break
+				}
+			}
+
+			slog.Warn("Circular pre-dependency, using the default order",
+				slog.String("package", pkgs[next].Name))
+		}
+
+		done[next] = true
+		order = append(order, pkgs[next])
+		for j := range after[next] {
+			inDegree[j]--
+		}
+	}
+
+	return order
+}
+
+// preDependencies returns the selected packages that satisfy the
+// pre-dependencies of a package.
+func preDependencies(selectedDB *database.PackageDB, pkg types.Package) []types.Package {
+	var dependencies []types.Package
+	for _, rel := range pkg.PreDepends.Relations {
+		for _, possi := range rel.Possibilities {
+			var resolvedPackages []types.Package
+			for _, candidate := range selectedDB.Get(possi.Name) {
+				if candidate.IsVirtual {
+					for _, provider := range candidate.Providers {
+						if _, exists := selectedDB.ExactlyEqual(provider.Name, provider.Version); exists {
+							resolvedPackages = append(resolvedPackages, provider)
+						}
+					}
+				} else {
+					resolvedPackages = append(resolvedPackages, candidate)
+				}
+			}
+
+			// The first satisfiable alternative is the one that was selected.
+			if len(resolvedPackages) > 0 {
+				dependencies = append(dependencies, resolvedPackages...)
+				break
+			}
+		}
+	}
+
+	return dependencies
+}
+
+func isEssential(pkg types.Package) bool {
+	return pkg.Essential != nil && bool(*pkg.Essential)
+}
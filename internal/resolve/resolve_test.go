@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/dpeckett/deb822"
@@ -81,3 +82,62 @@ func TestResolve(t *testing.T) {
 
 	require.ElementsMatch(t, expectedNameVersions, selectedNameVersions)
 }
+
+func TestPreDependsOrder(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	packages := `Package: zlib1g
+Version: 1:1.2.13.dfsg-1
+Architecture: amd64
+Multi-Arch: same
+Pre-Depends: libc6 (>= 2.14)
+
+Package: libc6
+Version: 2.36-9+deb12u4
+Architecture: amd64
+Multi-Arch: same
+
+Package: dpkg
+Version: 1.21.22
+Architecture: amd64
+Essential: yes
+Pre-Depends: libc6 (>= 2.34), zlib1g (>= 1:1.1.4), tar (>= 1.28-1)
+
+Package: tar
+Version: 1.34+dfsg-1.2
+Architecture: amd64
+Essential: yes
+Pre-Depends: libacl1-or-alternative | libc6 (>= 2.34)
+
+Package: base-passwd
+Version: 3.6.1
+Architecture: amd64
+Essential: yes
+
+Package: adduser
+Version: 3.134
+Architecture: all
+Pre-Depends: awk
+
+Package: mawk
+Version: 1.3.4.20200120-3.1
+Architecture: amd64
+Provides: awk
+`
+
+	decoder, err := deb822.NewDecoder(strings.NewReader(packages), nil)
+	require.NoError(t, err)
+
+	var packageList []types.Package
+	require.NoError(t, decoder.Decode(&packageList))
+
+	selectedDB := database.NewPackageDB()
+	selectedDB.AddAll(packageList)
+
+	var names []string
+	for _, pkg := range resolve.PreDependsOrder(selectedDB) {
+		names = append(names, pkg.Name)
+	}
+
+	require.Equal(t, []string{"base-passwd", "libc6", "tar", "zlib1g", "dpkg", "mawk", "adduser"}, names)
+}
@@ -0,0 +1,156 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sbom
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+)
+
+// CycloneDX 1.5 BOM (only the fields used by debco).
+// See: https://cyclonedx.org/docs/1.5/json/
+type cdxBOM struct {
+	BOMFormat    string         `json:"bomFormat"`
+	SpecVersion  string         `json:"specVersion"`
+	SerialNumber string         `json:"serialNumber"`
+	Version      int            `json:"version"`
+	Metadata     cdxMetadata    `json:"metadata"`
+	Components   []cdxComponent `json:"components"`
+}
+
+type cdxMetadata struct {
+	Timestamp string       `json:"timestamp"`
+	Tools     cdxTools     `json:"tools"`
+	Component cdxComponent `json:"component"`
+}
+
+type cdxTools struct {
+	Components []cdxComponent `json:"components"`
+}
+
+type cdxComponent struct {
+	Type               string                   `json:"type"`
+	BOMRef             string                   `json:"bom-ref,omitempty"`
+	Supplier           *cdxOrganizationalEntity `json:"supplier,omitempty"`
+	Name               string                   `json:"name"`
+	Version            string                   `json:"version,omitempty"`
+	Description        string                   `json:"description,omitempty"`
+	Hashes             []cdxHash                `json:"hashes,omitempty"`
+	PURL               string                   `json:"purl,omitempty"`
+	ExternalReferences []cdxExternalReference   `json:"externalReferences,omitempty"`
+	Properties         []cdxProperty            `json:"properties,omitempty"`
+}
+
+type cdxOrganizationalEntity struct {
+	Name string `json:"name"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxExternalReference struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// WriteCycloneDX writes a CycloneDX 1.5 (JSON) SBOM describing the image.
+func WriteCycloneDX(w io.Writer, opts Options) error {
+	bom := cdxBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + documentID("cyclonedx", opts),
+		Version:      1,
+		Metadata: cdxMetadata{
+			Timestamp: opts.Created.UTC().Format(time.RFC3339),
+			Tools: cdxTools{
+				Components: []cdxComponent{{
+					Type:    "application",
+					Name:    "debco",
+					Version: opts.ToolVersion,
+				}},
+			},
+			Component: cdxComponent{
+				Type:    "container",
+				BOMRef:  "image",
+				Name:    opts.Name,
+				Version: platforms.Format(opts.Platform),
+			},
+		},
+		Components: []cdxComponent{},
+	}
+
+	for _, pkg := range opts.Packages {
+		purl := PackageURL(pkg)
+
+		component := cdxComponent{
+			Type:        "library",
+			BOMRef:      purl,
+			Name:        pkg.Name,
+			Version:     pkg.Version.String(),
+			Description: summary(pkg),
+			PURL:        purl,
+		}
+
+		if supplier := supplier(pkg); supplier != "" {
+			component.Supplier = &cdxOrganizationalEntity{Name: supplier}
+		}
+
+		for _, hash := range []cdxHash{
+			{Alg: "SHA-512", Content: pkg.SHA512},
+			{Alg: "SHA-256", Content: pkg.SHA256},
+			{Alg: "MD5", Content: pkg.MD5sum},
+		} {
+			if hash.Content != "" {
+				component.Hashes = append(component.Hashes, hash)
+			}
+		}
+
+		for _, url := range pkg.URLs {
+			component.ExternalReferences = append(component.ExternalReferences,
+				cdxExternalReference{Type: "distribution", URL: url})
+		}
+
+		if pkg.Homepage != "" {
+			component.ExternalReferences = append(component.ExternalReferences,
+				cdxExternalReference{Type: "website", URL: pkg.Homepage})
+		}
+
+		sourceName, sourceVersion := source(pkg)
+		component.Properties = []cdxProperty{
+			{Name: "debco:package:source", Value: sourceName},
+			{Name: "debco:package:sourceVersion", Value: sourceVersion},
+		}
+
+		bom.Components = append(bom.Components, component)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(bom)
+}
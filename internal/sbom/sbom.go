@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package sbom generates software bills of materials (SBOMs) describing the
+// packages installed in an image, from the resolved package set.
+package sbom
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	"github.com/immutos/debco/internal/types"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// In-toto predicate types of the supported SBOM formats.
+const (
+	PredicateTypeSPDX      = "https://spdx.dev/Document"
+	PredicateTypeCycloneDX = "https://cyclonedx.org/bom"
+)
+
+// Options describes the image an SBOM is generated for.
+type Options struct {
+	// Name is the name of the image.
+	Name string
+	// Platform is the platform of the image.
+	Platform ocispecs.Platform
+	// Created is the creation time of the SBOM (eg. the source date epoch).
+	Created time.Time
+	// ToolVersion is the version of debco.
+	ToolVersion string
+	// Packages are the packages installed in the image.
+	Packages []types.Package
+}
+
+// PackageURL returns the package URL (purl) of a Debian package, eg.
+// pkg:deb/debian/libc6@2.36-9?arch=amd64&distro=bookworm&upstream=glibc.
+// See: https://github.com/package-url/purl-spec
+func PackageURL(pkg types.Package) string {
+	namespace := "debian"
+	if pkg.Origin != "" {
+		namespace = strings.ToLower(pkg.Origin)
+	}
+
+	purl := fmt.Sprintf("pkg:deb/%s/%s@%s", url.PathEscape(namespace),
+		url.PathEscape(pkg.Name), url.QueryEscape(pkg.Version.String()))
+
+	// Qualifiers are sorted by key.
+	qualifiers := []string{"arch=" + url.QueryEscape(pkg.Architecture.String())}
+
+	if pkg.Codename != "" {
+		qualifiers = append(qualifiers, "distro="+url.QueryEscape(pkg.Codename))
+	}
+
+	if sourceName, _ := source(pkg); sourceName != pkg.Name {
+		qualifiers = append(qualifiers, "upstream="+url.QueryEscape(sourceName))
+	}
+
+	return purl + "?" + strings.Join(qualifiers, "&")
+}
+
+// source returns the name and version of the source package a package was
+// built from.
+func source(pkg types.Package) (name, version string) {
+	if pkg.Source == "" {
+		return pkg.Name, pkg.Version.String()
+	}
+
+	// The source version is only given when it differs, eg. "glibc (2.36-9)".
+	name, version, ok := strings.Cut(pkg.Source, " ")
+	if !ok {
+		return pkg.Source, pkg.Version.String()
+	}
+
+	return name, strings.Trim(version, "()")
+}
+
+// supplier returns the name of the maintainer of a package, in the form
+// "Name (email)".
+func supplier(pkg types.Package) string {
+	name, email, ok := strings.Cut(pkg.Maintainer, "<")
+	if !ok {
+		return strings.TrimSpace(pkg.Maintainer)
+	}
+
+	return fmt.Sprintf("%s (%s)", strings.TrimSpace(name), strings.TrimSuffix(strings.TrimSpace(email), ">"))
+}
+
+// summary returns the first line of the description of a package.
+func summary(pkg types.Package) string {
+	summary, _, _ := strings.Cut(pkg.Description, "\n")
+	return strings.TrimSpace(summary)
+}
+
+// documentID returns a stable identifier for the SBOM, derived from its
+// contents, as a (random) UUID.
+func documentID(format string, opts Options) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", format, opts.Name, platforms.Format(opts.Platform))
+	for _, pkg := range opts.Packages {
+		fmt.Fprintf(h, "%s\n", PackageURL(pkg))
+	}
+	sum := h.Sum(nil)
+
+	// Set the version (4) and variant bits.
+	sum[6] = (sum[6] & 0x0f) | 0x40
+	sum[8] = (sum[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
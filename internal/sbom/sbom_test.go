@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sbom_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/arch"
+	"github.com/dpeckett/deb822/types/version"
+	"github.com/immutos/debco/internal/sbom"
+	"github.com/immutos/debco/internal/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageURL(t *testing.T) {
+	libc := types.Package{
+		Package: debtypes.Package{
+			Name:         "libc6",
+			Source:       "glibc",
+			Version:      version.MustParse("2.36-9+deb12u7"),
+			Architecture: arch.MustParse("amd64"),
+		},
+		Origin:   "Debian",
+		Codename: "bookworm",
+	}
+
+	require.Equal(t, "pkg:deb/debian/libc6@2.36-9%2Bdeb12u7?arch=amd64&distro=bookworm&upstream=glibc", sbom.PackageURL(libc))
+
+	attr := types.Package{
+		Package: debtypes.Package{
+			Name:         "attr",
+			Version:      version.MustParse("1:2.5.1-4"),
+			Architecture: arch.MustParse("arm64"),
+		},
+	}
+
+	require.Equal(t, "pkg:deb/debian/attr@1%3A2.5.1-4?arch=arm64", sbom.PackageURL(attr))
+}
+
+func TestWriteSBOM(t *testing.T) {
+	opts := sbom.Options{
+		Name:        "debco/debian:bookworm",
+		Platform:    platforms.MustParse("linux/amd64"),
+		Created:     time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC),
+		ToolVersion: "v0.1.0",
+		Packages: []types.Package{
+			{
+				Package: debtypes.Package{
+					Name:         "libc6",
+					Source:       "glibc (2.36-9)",
+					Version:      version.MustParse("2.36-9+deb12u7"),
+					Architecture: arch.MustParse("amd64"),
+					Maintainer:   "GNU Libc Maintainers <debian-glibc@lists.debian.org>",
+					Description:  "GNU C Library: Shared libraries\n Contains the standard libraries.",
+					SHA256:       "ba2a6e5f6c3e3c8a6d7d4b0d1c3f9e8a7b6c5d4e3f2a1b0c9d8e7f6a5b4c3d2e",
+				},
+				URLs:     []string{"https://deb.debian.org/debian/pool/main/g/glibc/libc6_2.36-9+deb12u7_amd64.deb"},
+				Origin:   "Debian",
+				Codename: "bookworm",
+			},
+		},
+	}
+
+	t.Run("SPDX", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, sbom.WriteSPDX(&buf, opts))
+
+		var doc map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+
+		require.Equal(t, "SPDX-2.3", doc["spdxVersion"])
+		require.Equal(t, "2024-06-01T00:00:00Z", doc["creationInfo"].(map[string]any)["created"])
+
+		packages := doc["packages"].([]any)
+		require.Len(t, packages, 2)
+
+		pkg := packages[1].(map[string]any)
+		require.Equal(t, "SPDXRef-Package-deb-libc6-amd64", pkg["SPDXID"])
+		require.Equal(t, "2.36-9+deb12u7", pkg["versionInfo"])
+		require.Equal(t, "Person: GNU Libc Maintainers (debian-glibc@lists.debian.org)", pkg["supplier"])
+		require.Equal(t, "built package from: glibc 2.36-9", pkg["sourceInfo"])
+		require.Equal(t, "GNU C Library: Shared libraries", pkg["summary"])
+		require.Equal(t, opts.Packages[0].URLs[0], pkg["downloadLocation"])
+		require.Equal(t, sbom.PackageURL(opts.Packages[0]), pkg["externalRefs"].([]any)[0].(map[string]any)["referenceLocator"])
+
+		// The document should be reproducible.
+		var again bytes.Buffer
+		require.NoError(t, sbom.WriteSPDX(&again, opts))
+		require.Equal(t, buf.String(), again.String())
+	})
+
+	t.Run("CycloneDX", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, sbom.WriteCycloneDX(&buf, opts))
+
+		var bom map[string]any
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &bom))
+
+		require.Equal(t, "CycloneDX", bom["bomFormat"])
+		require.Equal(t, "1.5", bom["specVersion"])
+		require.Regexp(t, `^urn:uuid:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, bom["serialNumber"])
+
+		components := bom["components"].([]any)
+		require.Len(t, components, 1)
+
+		component := components[0].(map[string]any)
+		require.Equal(t, "libc6", component["name"])
+		require.Equal(t, sbom.PackageURL(opts.Packages[0]), component["purl"])
+		require.Equal(t, []any{map[string]any{"alg": "SHA-256", "content": opts.Packages[0].SHA256}}, component["hashes"])
+	})
+}
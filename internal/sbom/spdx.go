@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sbom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/containerd/containerd/platforms"
+)
+
+const noAssertion = "NOASSERTION"
+
+// SPDX 2.3 document (only the fields used by debco).
+// See: https://spdx.github.io/spdx-spec/v2.3/
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name                  string            `json:"name"`
+	SPDXID                string            `json:"SPDXID"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	Supplier              string            `json:"supplier,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	Checksums             []spdxChecksum    `json:"checksums,omitempty"`
+	Homepage              string            `json:"homepage,omitempty"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	CopyrightText         string            `json:"copyrightText"`
+	Summary               string            `json:"summary,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// SPDX identifiers may only contain letters, numbers, '.' and '-'.
+var invalidSPDXIDChars = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+// WriteSPDX writes an SPDX 2.3 (JSON) SBOM describing the image.
+func WriteSPDX(w io.Writer, opts Options) error {
+	imageID := "SPDXRef-Image"
+
+	doc := spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        opts.Name,
+		DocumentNamespace: fmt.Sprintf("https://github.com/immutos/debco/spdx/%s-%s",
+			invalidSPDXIDChars.ReplaceAllString(opts.Name, "-"), documentID("spdx", opts)),
+		CreationInfo: spdxCreationInfo{
+			Created:  opts.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: debco-" + opts.ToolVersion},
+		},
+		Packages: []spdxPackage{{
+			Name:                  opts.Name,
+			SPDXID:                imageID,
+			VersionInfo:           platforms.Format(opts.Platform),
+			DownloadLocation:      noAssertion,
+			LicenseConcluded:      noAssertion,
+			LicenseDeclared:       noAssertion,
+			CopyrightText:         noAssertion,
+			PrimaryPackagePurpose: "CONTAINER",
+		}},
+		Relationships: []spdxRelationship{{
+			SPDXElementID:      "SPDXRef-DOCUMENT",
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: imageID,
+		}},
+	}
+
+	seenIDs := make(map[string]int)
+	for _, pkg := range opts.Packages {
+		id := "SPDXRef-Package-deb-" + invalidSPDXIDChars.ReplaceAllString(pkg.Name+"-"+pkg.Architecture.String(), "-")
+		if n := seenIDs[id]; n > 0 {
+			seenIDs[id]++
+			id = fmt.Sprintf("%s-%d", id, n)
+		} else {
+			seenIDs[id] = 1
+		}
+
+		downloadLocation := noAssertion
+		if len(pkg.URLs) > 0 {
+			downloadLocation = pkg.URLs[0]
+		}
+
+		var checksums []spdxChecksum
+		for _, checksum := range []spdxChecksum{
+			{Algorithm: "SHA512", ChecksumValue: pkg.SHA512},
+			{Algorithm: "SHA256", ChecksumValue: pkg.SHA256},
+			{Algorithm: "MD5", ChecksumValue: pkg.MD5sum},
+		} {
+			if checksum.ChecksumValue != "" {
+				checksums = append(checksums, checksum)
+			}
+		}
+
+		sourceName, sourceVersion := source(pkg)
+
+		spdxPkg := spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version.String(),
+			DownloadLocation: downloadLocation,
+			Checksums:        checksums,
+			Homepage:         pkg.Homepage,
+			SourceInfo:       fmt.Sprintf("built package from: %s %s", sourceName, sourceVersion),
+			// Licenses are only found in the copyright files of the packages.
+			LicenseConcluded: noAssertion,
+			LicenseDeclared:  noAssertion,
+			CopyrightText:    noAssertion,
+			Summary:          summary(pkg),
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  PackageURL(pkg),
+			}},
+		}
+
+		if supplier := supplier(pkg); supplier != "" {
+			spdxPkg.Supplier = "Person: " + supplier
+		}
+
+		doc.Packages = append(doc.Packages, spdxPkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      imageID,
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
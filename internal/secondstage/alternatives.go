@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// AlternativesAdminDir is the default alternatives administrative directory.
+	AlternativesAdminDir = "/var/lib/dpkg/alternatives"
+	// AlternativesDir is the default directory of alternatives symlinks.
+	AlternativesDir = "/etc/alternatives"
+)
+
+// SetAlternative manually selects the alternative at path for the named
+// alternatives group (eg. the editor). The alternatives are recorded in
+// adminDir, with their symlinks in altDir (see update-alternatives(1)).
+func SetAlternative(ctx context.Context, adminDir, altDir, name, path string) error {
+	// Don't write to the alternatives log, it would make the build irreproducible.
+	cmd := exec.CommandContext(ctx, "update-alternatives",
+		"--admindir", adminDir,
+		"--altdir", altDir,
+		"--log", "/dev/null",
+		"--set", name, path)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to set alternative: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
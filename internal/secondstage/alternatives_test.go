@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/debco/internal/secondstage"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetAlternative(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	if _, err := exec.LookPath("update-alternatives"); err != nil {
+		t.Skip("update-alternatives is not available")
+	}
+
+	dir := t.TempDir()
+
+	adminDir := filepath.Join(dir, "admin")
+	altDir := filepath.Join(dir, "alternatives")
+
+	require.NoError(t, os.MkdirAll(adminDir, 0o755))
+	require.NoError(t, os.MkdirAll(altDir, 0o755))
+
+	link := filepath.Join(dir, "editor")
+	nano := filepath.Join(dir, "nano")
+	vim := filepath.Join(dir, "vim.basic")
+
+	for i, path := range []string{nano, vim} {
+		require.NoError(t, os.WriteFile(path, nil, 0o755))
+
+		// Nano has the higher priority, so would be selected automatically.
+		priority := []string{"40", "30"}[i]
+		cmd := exec.Command("update-alternatives",
+			"--admindir", adminDir, "--altdir", altDir, "--log", "/dev/null",
+			"--install", link, "editor", path, priority)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	target, err := os.Readlink(filepath.Join(altDir, "editor"))
+	require.NoError(t, err)
+	require.Equal(t, nano, target)
+
+	require.NoError(t, secondstage.SetAlternative(context.Background(), adminDir, altDir, "editor", vim))
+
+	target, err = os.Readlink(filepath.Join(altDir, "editor"))
+	require.NoError(t, err)
+	require.Equal(t, vim, target)
+
+	t.Run("Unknown Alternative", func(t *testing.T) {
+		require.Error(t, secondstage.SetAlternative(context.Background(), adminDir, altDir, "editor", filepath.Join(dir, "emacs")))
+	})
+}
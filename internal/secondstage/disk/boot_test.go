@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package disk_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBoot boots a disk image built with --output type=disk under QEMU, and
+// waits for a login prompt on the serial console. As building the image
+// requires BuildKit (and network access), the image must be built beforehand,
+// eg:
+//
+//	debco build -f examples/bookworm-vm.yaml --output type=disk,dest=debian.qcow2
+//	DEBCO_TEST_DISK_IMAGE=$PWD/debian.qcow2 go test ./internal/secondstage/disk -run TestBoot
+func TestBoot(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	imagePath := os.Getenv("DEBCO_TEST_DISK_IMAGE")
+	if imagePath == "" {
+		t.Skip("DEBCO_TEST_DISK_IMAGE is not set")
+	}
+
+	if _, err := exec.LookPath("qemu-system-x86_64"); err != nil {
+		t.Skip("QEMU is not available")
+	}
+
+	ovmfCodePath := "/usr/share/OVMF/OVMF_CODE_4M.fd"
+	ovmfVarsPath := "/usr/share/OVMF/OVMF_VARS_4M.fd"
+	if _, err := os.Stat(ovmfCodePath); err != nil {
+		t.Skip("OVMF firmware is not available")
+	}
+
+	// The firmware variables are written to, so use a copy.
+	varsData, err := os.ReadFile(ovmfVarsPath)
+	require.NoError(t, err)
+
+	varsPath := filepath.Join(t.TempDir(), "OVMF_VARS.fd")
+	require.NoError(t, os.WriteFile(varsPath, varsData, 0o644))
+
+	format := "raw"
+	if strings.HasSuffix(imagePath, ".qcow2") {
+		format = "qcow2"
+	}
+
+	accel := "tcg"
+	if f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0); err == nil {
+		_ = f.Close()
+		accel = "kvm"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	console := &consoleBuffer{loginPrompt: make(chan struct{})}
+
+	cmd := exec.CommandContext(ctx, "qemu-system-x86_64",
+		"-accel", accel, "-m", "1G", "-nographic", "-snapshot",
+		"-drive", "if=pflash,format=raw,readonly=on,file="+ovmfCodePath,
+		"-drive", "if=pflash,format=raw,file="+varsPath,
+		"-drive", "if=virtio,format="+format+",file="+imagePath,
+	)
+	cmd.Stdout = console
+	cmd.Stderr = console
+
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+
+	select {
+	case <-console.loginPrompt:
+	case <-ctx.Done():
+		t.Fatalf("Timed out waiting for a login prompt, console output:\n%s", console.String())
+	}
+}
+
+// consoleBuffer records the serial console output of a virtual machine, and
+// signals when a login prompt is shown.
+type consoleBuffer struct {
+	mu          sync.Mutex
+	buf         bytes.Buffer
+	loginPrompt chan struct{}
+	found       bool
+}
+
+func (c *consoleBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n, _ := c.buf.Write(p)
+	if !c.found && bytes.Contains(c.buf.Bytes(), []byte("login:")) {
+		c.found = true
+		close(c.loginPrompt)
+	}
+
+	return n, nil
+}
+
+func (c *consoleBuffer) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.buf.String()
+}
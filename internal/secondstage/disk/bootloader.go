@@ -0,0 +1,190 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package disk
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Where the bootloader files are found in the root filesystem of the disk
+// build tools.
+var (
+	systemdBootDir = "/usr/lib/systemd/boot/efi"
+	grubDir        = "/usr/lib/grub"
+)
+
+// The kernel and initramfs are copied to the root of the EFI system
+// partition, where both bootloaders can read them.
+const (
+	espKernelPath = "/vmlinuz"
+	espInitrdPath = "/initrd.img"
+)
+
+// efiArch returns the EFI name of the architecture (as used in the names of
+// EFI binaries, eg. BOOTX64.EFI).
+func efiArch(arch string) (string, error) {
+	switch arch {
+	case "amd64":
+		return "x64", nil
+	case "arm64":
+		return "aa64", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture for disk images: %s", arch)
+	}
+}
+
+// grubTarget returns the GRUB platform of the architecture.
+func grubTarget(arch string) (string, error) {
+	switch arch {
+	case "amd64":
+		return "x86_64-efi", nil
+	case "arm64":
+		return "arm64-efi", nil
+	default:
+		return "", fmt.Errorf("unsupported architecture for GRUB: %s", arch)
+	}
+}
+
+// grubPackage returns the package containing the GRUB EFI modules of the
+// architecture.
+func grubPackage(arch string) (string, error) {
+	if _, err := grubTarget(arch); err != nil {
+		return "", err
+	}
+
+	return "grub-efi-" + arch + "-bin", nil
+}
+
+// installBootloader copies the kernel and initramfs of the root filesystem
+// into the EFI system partition directory, and installs the bootloader as the
+// removable media (fallback) boot entry, so no EFI variables are needed.
+func installBootloader(ctx context.Context, layout *Layout, arch, rootFSDir, espDir string) error {
+	kernelPath, initrdPath, err := findKernel(rootFSDir)
+	if err != nil {
+		return err
+	}
+
+	if err := copyFile(kernelPath, filepath.Join(espDir, espKernelPath)); err != nil {
+		return fmt.Errorf("failed to copy kernel: %w", err)
+	}
+
+	if err := copyFile(initrdPath, filepath.Join(espDir, espInitrdPath)); err != nil {
+		return fmt.Errorf("failed to copy initramfs: %w", err)
+	}
+
+	efiArch, err := efiArch(arch)
+	if err != nil {
+		return err
+	}
+
+	bootDir := filepath.Join(espDir, "EFI", "BOOT")
+	if err := os.MkdirAll(bootDir, 0o755); err != nil {
+		return err
+	}
+
+	bootPath := filepath.Join(bootDir, "BOOT"+strings.ToUpper(efiArch)+".EFI")
+	title := osPrettyName(rootFSDir)
+	cmdline := strings.Join(layout.KernelCommandLine, " ")
+
+	switch layout.Bootloader {
+	case BootloaderSystemdBoot:
+		if err := copyFile(filepath.Join(systemdBootDir, "systemd-boot"+efiArch+".efi"), bootPath); err != nil {
+			return fmt.Errorf("failed to copy systemd-boot: %w", err)
+		}
+
+		loaderConf := "default debian.conf\ntimeout 0\n"
+		entryConf := fmt.Sprintf("title %s\nlinux %s\ninitrd %s\noptions %s\n", title, espKernelPath, espInitrdPath, cmdline)
+
+		if err := writeFile(filepath.Join(espDir, "loader", "loader.conf"), loaderConf); err != nil {
+			return err
+		}
+
+		return writeFile(filepath.Join(espDir, "loader", "entries", "debian.conf"), entryConf)
+	case BootloaderGRUB:
+		target, err := grubTarget(arch)
+		if err != nil {
+			return err
+		}
+
+		// GRUB reads its configuration from the prefix on the device it was
+		// loaded from (ie. the EFI system partition).
+		if err := run(ctx, "grub-mkimage", "-O", target, "-d", filepath.Join(grubDir, target),
+			"-o", bootPath, "-p", "/EFI/BOOT",
+			"part_gpt", "fat", "ext2", "normal", "linux", "configfile", "search", "echo", "all_video"); err != nil {
+			return fmt.Errorf("failed to create GRUB image: %w", err)
+		}
+
+		grubConf := fmt.Sprintf("set timeout=0\n\nmenuentry %q {\n\tlinux %s %s\n\tinitrd %s\n}\n", title, espKernelPath, cmdline, espInitrdPath)
+
+		return writeFile(filepath.Join(bootDir, "grub.cfg"), grubConf)
+	default:
+		return fmt.Errorf("unsupported bootloader: %s", layout.Bootloader)
+	}
+}
+
+// findKernel returns the paths to the newest kernel and its initramfs in the
+// root filesystem.
+func findKernel(rootFSDir string) (string, string, error) {
+	kernelPaths, err := filepath.Glob(filepath.Join(rootFSDir, "boot", "vmlinuz-*"))
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(kernelPaths) == 0 {
+		return "", "", fmt.Errorf("no kernel found in /boot (is the kernel package installed?)")
+	}
+	sort.Strings(kernelPaths)
+
+	kernelPath := kernelPaths[len(kernelPaths)-1]
+	version := strings.TrimPrefix(filepath.Base(kernelPath), "vmlinuz-")
+
+	initrdPath := filepath.Join(rootFSDir, "boot", "initrd.img-"+version)
+	if _, err := os.Stat(initrdPath); err != nil {
+		return "", "", fmt.Errorf("no initramfs found for kernel %s: %w", version, err)
+	}
+
+	return kernelPath, initrdPath, nil
+}
+
+// osPrettyName returns the name of the operating system in the root
+// filesystem, for use in boot menus.
+func osPrettyName(rootFSDir string) string {
+	for _, path := range []string{"etc/os-release", "usr/lib/os-release"} {
+		f, err := os.Open(filepath.Join(rootFSDir, path))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+				return strings.Trim(value, `"'`)
+			}
+		}
+	}
+
+	return "Linux"
+}
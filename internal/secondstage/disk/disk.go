@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package disk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
+	"github.com/immutos/debco/internal/util"
+)
+
+// Build builds a bootable disk image at outputPath from the root filesystem
+// at rootFSDir (which is modified in the process, eg. the fstab is written
+// and the contents of other partitions are moved out of it). It must be run
+// in a root filesystem with the disk build tools installed (see
+// ToolPackages).
+func Build(ctx context.Context, conf latestrecipe.DiskConfig, arch, rootFSDir, outputPath string) error {
+	layout, err := NewLayout(conf, arch)
+	if err != nil {
+		return err
+	}
+
+	workDir, err := os.MkdirTemp(filepath.Dir(outputPath), ".disk-*")
+	if err != nil {
+		return fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(workDir)
+	}()
+
+	slog.Info("Writing fstab")
+
+	if err := writeFile(filepath.Join(rootFSDir, "etc", "fstab"), layout.Fstab()); err != nil {
+		return fmt.Errorf("failed to write fstab: %w", err)
+	}
+
+	for _, partition := range layout.Partitions {
+		if err := os.MkdirAll(filepath.Join(rootFSDir, partition.MountPoint), 0o755); err != nil {
+			return fmt.Errorf("failed to create mount point %s: %w", partition.MountPoint, err)
+		}
+	}
+
+	slog.Info("Installing bootloader", slog.String("bootloader", layout.Bootloader))
+
+	espDir := filepath.Join(rootFSDir, layout.ESP().MountPoint)
+	if err := installBootloader(ctx, layout, arch, rootFSDir, espDir); err != nil {
+		return fmt.Errorf("failed to install bootloader: %w", err)
+	}
+
+	// Create the filesystems of the most deeply nested mount points first, so
+	// that their contents can be moved out of the filesystems they are mounted
+	// on (leaving behind an empty mount point).
+	partitions := make([]Partition, len(layout.Partitions))
+	copy(partitions, layout.Partitions)
+	sort.SliceStable(partitions, func(i, j int) bool {
+		return mountDepth(partitions[i].MountPoint) > mountDepth(partitions[j].MountPoint)
+	})
+
+	partitionPaths := make(map[string]string)
+	for _, partition := range partitions {
+		slog.Info("Creating filesystem",
+			slog.String("label", partition.Label), slog.String("filesystem", partition.Filesystem))
+
+		srcDir := filepath.Join(rootFSDir, partition.MountPoint)
+		partitionPath := filepath.Join(workDir, partition.Label+".img")
+
+		if err := createFilesystem(ctx, layout, partition, srcDir, partitionPath); err != nil {
+			return fmt.Errorf("failed to create filesystem for partition %s: %w", partition.Label, err)
+		}
+
+		partitionPaths[partition.Label] = partitionPath
+
+		if partition.MountPoint != "/" {
+			if err := emptyDir(srcDir); err != nil {
+				return fmt.Errorf("failed to empty mount point %s: %w", partition.MountPoint, err)
+			}
+		}
+	}
+
+	slog.Info("Writing disk image", slog.String("format", layout.Format))
+
+	rawPath := outputPath
+	if layout.Format != FormatRaw {
+		rawPath = filepath.Join(workDir, "disk.raw")
+	}
+
+	if err := writeRawDisk(layout, arch, partitionPaths, rawPath); err != nil {
+		return fmt.Errorf("failed to write disk image: %w", err)
+	}
+
+	if layout.Format == FormatQCOW2 {
+		if err := run(ctx, "qemu-img", "convert", "-f", "raw", "-O", "qcow2", rawPath, outputPath); err != nil {
+			return fmt.Errorf("failed to convert disk image: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// createFilesystem creates a filesystem image populated with the contents of
+// srcDir.
+func createFilesystem(ctx context.Context, layout *Layout, partition Partition, srcDir, dstPath string) error {
+	switch partition.Filesystem {
+	case FilesystemExt4:
+		f, err := os.Create(dstPath)
+		if err != nil {
+			return err
+		}
+
+		if err := f.Truncate(partition.Size); err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		uuid := formatGUID(derivedGUID(layout, "filesystem:"+partition.Label))
+
+		return run(ctx, "mkfs.ext4", "-q", "-F",
+			"-L", partition.Label,
+			"-U", uuid,
+			"-E", "root_owner=0:0,hash_seed="+uuid,
+			"-d", srcDir, dstPath)
+	case FilesystemVFAT:
+		volumeID := derivedGUID(layout, "filesystem:"+partition.Label)
+
+		if err := run(ctx, "mkfs.vfat", "-C",
+			"-n", partition.Label,
+			"-i", fmt.Sprintf("%x", volumeID[:4]),
+			dstPath, strconv.FormatInt(partition.Size/1024, 10)); err != nil {
+			return err
+		}
+
+		entries, err := os.ReadDir(srcDir)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			return nil
+		}
+
+		args := []string{"-s", "-p", "-m", "-i", dstPath}
+		for _, entry := range entries {
+			args = append(args, filepath.Join(srcDir, entry.Name()))
+		}
+		args = append(args, "::/")
+
+		return run(ctx, "mcopy", args...)
+	default:
+		return fmt.Errorf("unsupported filesystem: %s", partition.Filesystem)
+	}
+}
+
+// writeRawDisk writes the partition table and the partition images to a raw
+// disk image. The image is written sparsely.
+func writeRawDisk(layout *Layout, arch string, partitionPaths map[string]string, dstPath string) error {
+	f, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(layout.Size); err != nil {
+		return err
+	}
+
+	if err := WritePartitionTable(f, layout, arch); err != nil {
+		return err
+	}
+
+	for _, partition := range layout.Partitions {
+		src, err := os.Open(partitionPaths[partition.Label])
+		if err != nil {
+			return err
+		}
+
+		err = util.CopySparse(io.NewOffsetWriter(f, partition.Offset), src, partition.Size)
+		_ = src.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write partition %s: %w", partition.Label, err)
+		}
+	}
+
+	return f.Close()
+}
+
+// emptyDir removes the contents of a directory.
+func emptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
+		return err
+	}
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+func writeFile(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, []byte(content), 0o644)
+}
+
+func run(ctx context.Context, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
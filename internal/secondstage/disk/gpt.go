@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 512
+	// The number of partition entries (and the size of each entry), as used
+	// by most partitioning tools.
+	maxPartitions      = 128
+	partitionEntrySize = 128
+	// The size of the partition entry array, and of the partition entry array
+	// plus the GPT header.
+	partitionEntriesSize = maxPartitions * partitionEntrySize
+	partitionTableSize   = partitionEntriesSize + sectorSize
+)
+
+// Partition type GUIDs.
+// See: https://uapi-group.org/specifications/specs/discoverable_partitions_specification/
+const (
+	espTypeGUID       = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	linuxFSTypeGUID   = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+	rootAMD64TypeGUID = "4F68BCE3-E8CD-4CA1-96E7-FBCAF984B709"
+	rootARM64TypeGUID = "B921B045-1DF0-41C3-AF44-4C6F280D3FAE"
+)
+
+// WritePartitionTable writes a protective MBR, and the primary and backup
+// GUID partition tables for the layout. The disk and partition GUIDs are
+// derived from the layout so that the partition table is reproducible.
+func WritePartitionTable(w io.WriterAt, layout *Layout, arch string) error {
+	totalSectors := uint64(layout.Size / sectorSize)
+	entriesSectors := uint64(partitionEntriesSize / sectorSize)
+
+	entries := make([]byte, partitionEntriesSize)
+	for i, partition := range layout.Partitions {
+		entry := entries[i*partitionEntrySize : (i+1)*partitionEntrySize]
+
+		typeGUID := linuxFSTypeGUID
+		switch {
+		case partition.ESP:
+			typeGUID = espTypeGUID
+		case partition.MountPoint == "/" && arch == "amd64":
+			typeGUID = rootAMD64TypeGUID
+		case partition.MountPoint == "/" && arch == "arm64":
+			typeGUID = rootARM64TypeGUID
+		}
+
+		if err := putGUID(entry[0:16], typeGUID); err != nil {
+			return err
+		}
+		putGUIDBytes(entry[16:32], derivedGUID(layout, "partition:"+partition.Label))
+		binary.LittleEndian.PutUint64(entry[32:40], uint64(partition.Offset/sectorSize))
+		binary.LittleEndian.PutUint64(entry[40:48], uint64((partition.Offset+partition.Size)/sectorSize-1))
+
+		name := utf16.Encode([]rune(partition.Label))
+		if len(name) > 36 {
+			return fmt.Errorf("partition name %s is too long", partition.Label)
+		}
+
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(entry[56+j*2:], c)
+		}
+	}
+
+	entriesCRC := crc32.ChecksumIEEE(entries)
+	diskGUID := derivedGUID(layout, "disk")
+
+	header := func(currentLBA, backupLBA, entriesLBA uint64) []byte {
+		hdr := make([]byte, sectorSize)
+		copy(hdr[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(hdr[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(hdr[12:16], 92)
+		binary.LittleEndian.PutUint64(hdr[24:32], currentLBA)
+		binary.LittleEndian.PutUint64(hdr[32:40], backupLBA)
+		binary.LittleEndian.PutUint64(hdr[40:48], 2+entriesSectors)
+		binary.LittleEndian.PutUint64(hdr[48:56], totalSectors-entriesSectors-2)
+		putGUIDBytes(hdr[56:72], diskGUID)
+		binary.LittleEndian.PutUint64(hdr[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(hdr[80:84], maxPartitions)
+		binary.LittleEndian.PutUint32(hdr[84:88], partitionEntrySize)
+		binary.LittleEndian.PutUint32(hdr[88:92], entriesCRC)
+		binary.LittleEndian.PutUint32(hdr[16:20], crc32.ChecksumIEEE(hdr[:92]))
+		return hdr
+	}
+
+	// The protective MBR marks the whole disk as in use by a GPT partition.
+	mbr := make([]byte, sectorSize)
+	mbr[446+1], mbr[446+2], mbr[446+3] = 0x00, 0x02, 0x00
+	mbr[446+4] = 0xEE
+	mbr[446+5], mbr[446+6], mbr[446+7] = 0xFF, 0xFF, 0xFF
+	binary.LittleEndian.PutUint32(mbr[446+8:], 1)
+	binary.LittleEndian.PutUint32(mbr[446+12:], uint32(min(totalSectors-1, 0xFFFFFFFF)))
+	mbr[510], mbr[511] = 0x55, 0xAA
+
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{0, mbr},
+		{1, header(1, totalSectors-1, 2)},
+		{2, entries},
+		{totalSectors - 1 - entriesSectors, entries},
+		{totalSectors - 1, header(totalSectors-1, 1, totalSectors-1-entriesSectors)},
+	}
+
+	for _, write := range writes {
+		if _, err := w.WriteAt(write.data, int64(write.lba*sectorSize)); err != nil {
+			return fmt.Errorf("failed to write partition table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// derivedGUID returns a random (version 4) GUID derived from the layout and
+// the given name.
+func derivedGUID(layout *Layout, name string) [16]byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d\n%s\n", layout.Size, name)
+	for _, partition := range layout.Partitions {
+		fmt.Fprintf(&sb, "%s %s %d %d\n", partition.Label, partition.Filesystem, partition.Offset, partition.Size)
+	}
+
+	sum := sha256.Sum256([]byte(sb.String()))
+
+	var guid [16]byte
+	copy(guid[:], sum[:16])
+	guid[6] = (guid[6] & 0x0f) | 0x40
+	guid[8] = (guid[8] & 0x3f) | 0x80
+	return guid
+}
+
+// formatGUID formats a GUID in its canonical textual form.
+func formatGUID(guid [16]byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:16])
+}
+
+// putGUID writes the textual GUID in its mixed-endian on-disk form.
+func putGUID(b []byte, s string) error {
+	var guid [16]byte
+	src := []byte(strings.ReplaceAll(s, "-", ""))
+	if len(src) != hex.EncodedLen(len(guid)) {
+		return fmt.Errorf("invalid GUID: %s", s)
+	}
+
+	if _, err := hex.Decode(guid[:], src); err != nil {
+		return fmt.Errorf("invalid GUID %s: %w", s, err)
+	}
+
+	putGUIDBytes(b, guid)
+	return nil
+}
+
+// putGUIDBytes writes the GUID in its mixed-endian on-disk form, the first
+// three fields are little-endian.
+func putGUIDBytes(b []byte, guid [16]byte) {
+	b[0], b[1], b[2], b[3] = guid[3], guid[2], guid[1], guid[0]
+	b[4], b[5] = guid[5], guid[4]
+	b[6], b[7] = guid[7], guid[6]
+	copy(b[8:16], guid[8:16])
+}
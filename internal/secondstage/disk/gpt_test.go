@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package disk_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
+	"github.com/immutos/debco/internal/secondstage/disk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePartitionTable(t *testing.T) {
+	layout, err := disk.NewLayout(latestrecipe.DiskConfig{Size: "1GiB"}, "amd64")
+	require.NoError(t, err)
+
+	diskPath := filepath.Join(t.TempDir(), "disk.raw")
+	f, err := os.Create(diskPath)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(layout.Size))
+
+	require.NoError(t, disk.WritePartitionTable(f, layout, "amd64"))
+	require.NoError(t, f.Close())
+
+	data, err := os.ReadFile(diskPath)
+	require.NoError(t, err)
+
+	const sectorSize = 512
+	totalSectors := uint64(len(data) / sectorSize)
+
+	// Protective MBR.
+	require.Equal(t, []byte{0x55, 0xAA}, data[510:512])
+	require.Equal(t, byte(0xEE), data[446+4])
+
+	readHeader := func(t *testing.T, lba uint64) (hdr []byte, entries []byte) {
+		hdr = data[lba*sectorSize : lba*sectorSize+92]
+		require.Equal(t, "EFI PART", string(hdr[0:8]))
+		require.Equal(t, lba, binary.LittleEndian.Uint64(hdr[24:32]))
+
+		// Verify the header checksum.
+		expectedCRC := binary.LittleEndian.Uint32(hdr[16:20])
+		zeroed := bytes.Clone(hdr)
+		binary.LittleEndian.PutUint32(zeroed[16:20], 0)
+		require.Equal(t, expectedCRC, crc32.ChecksumIEEE(zeroed))
+
+		entriesLBA := binary.LittleEndian.Uint64(hdr[72:80])
+		numEntries := binary.LittleEndian.Uint32(hdr[80:84])
+		entrySize := binary.LittleEndian.Uint32(hdr[84:88])
+
+		entries = data[entriesLBA*sectorSize : entriesLBA*sectorSize+uint64(numEntries*entrySize)]
+		require.Equal(t, binary.LittleEndian.Uint32(hdr[88:92]), crc32.ChecksumIEEE(entries))
+
+		return hdr, entries
+	}
+
+	primary, primaryEntries := readHeader(t, 1)
+	require.Equal(t, totalSectors-1, binary.LittleEndian.Uint64(primary[32:40]))
+
+	backup, backupEntries := readHeader(t, totalSectors-1)
+	require.Equal(t, uint64(1), binary.LittleEndian.Uint64(backup[32:40]))
+	require.Equal(t, primaryEntries, backupEntries)
+
+	for i, partition := range layout.Partitions {
+		entry := primaryEntries[i*128 : (i+1)*128]
+
+		require.Equal(t, uint64(partition.Offset/sectorSize), binary.LittleEndian.Uint64(entry[32:40]))
+		require.Equal(t, uint64((partition.Offset+partition.Size)/sectorSize-1), binary.LittleEndian.Uint64(entry[40:48]))
+
+		var name []uint16
+		for j := 56; j < 128; j += 2 {
+			if c := binary.LittleEndian.Uint16(entry[j:]); c != 0 {
+				name = append(name, c)
+			}
+		}
+		require.Equal(t, partition.Label, string(utf16.Decode(name)))
+	}
+
+	// EFI system partition type GUID (C12A7328-F81F-11D2-BA4B-00A0C93EC93B).
+	require.Equal(t, []byte{0x28, 0x73, 0x2A, 0xC1, 0x1F, 0xF8, 0xD2, 0x11, 0xBA, 0x4B, 0x00, 0xA0, 0xC9, 0x3E, 0xC9, 0x3B}, primaryEntries[0:16])
+
+	// The unused entries are empty.
+	require.Equal(t, make([]byte, 128), primaryEntries[2*128:3*128])
+}
@@ -0,0 +1,356 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package disk builds bootable virtual machine disk images from a root
+// filesystem.
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/go-units"
+	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
+)
+
+const (
+	// FormatRaw is a raw disk image.
+	FormatRaw = "raw"
+	// FormatQCOW2 is a QEMU copy-on-write disk image.
+	FormatQCOW2 = "qcow2"
+)
+
+const (
+	// BootloaderSystemdBoot is the systemd-boot EFI boot manager.
+	BootloaderSystemdBoot = "systemd-boot"
+	// BootloaderGRUB is the GRUB bootloader.
+	BootloaderGRUB = "grub"
+)
+
+const (
+	// FilesystemExt4 is an ext4 filesystem.
+	FilesystemExt4 = "ext4"
+	// FilesystemVFAT is a FAT filesystem (as used by the EFI system partition).
+	FilesystemVFAT = "vfat"
+)
+
+// Partitions are aligned to 1MiB boundaries.
+const alignment = 1 << 20
+
+// Layout is the partition layout of a disk image.
+type Layout struct {
+	// Format is the format of the disk image.
+	Format string
+	// Size is the total size of the disk in bytes.
+	Size int64
+	// Bootloader is the EFI bootloader to install.
+	Bootloader string
+	// KernelCommandLine is the kernel command line (including the root
+	// filesystem).
+	KernelCommandLine []string
+	// Partitions are the partitions of the disk, in order.
+	Partitions []Partition
+}
+
+// Partition is a partition of a disk image.
+type Partition struct {
+	// Label is the filesystem label of the partition.
+	Label string
+	// Filesystem is the filesystem of the partition.
+	Filesystem string
+	// MountPoint is where the partition is mounted.
+	MountPoint string
+	// MountOptions are the fstab mount options of the partition.
+	MountOptions string
+	// Offset is the offset of the partition from the start of the disk in
+	// bytes.
+	Offset int64
+	// Size is the size of the partition in bytes.
+	Size int64
+	// ESP is whether the partition is the EFI system partition.
+	ESP bool
+}
+
+// DefaultPartitions is the partition layout used when a recipe doesn't
+// specify one.
+var DefaultPartitions = []latestrecipe.PartitionConfig{
+	{Label: "ESP", Size: "256MiB", Filesystem: FilesystemVFAT, MountPoint: "/boot/efi"},
+	{Label: "root", Filesystem: FilesystemExt4, MountPoint: "/"},
+}
+
+// NewLayout validates the disk configuration and returns its partition
+// layout for the given architecture.
+func NewLayout(conf latestrecipe.DiskConfig, arch string) (*Layout, error) {
+	layout := Layout{
+		Format:     conf.Format,
+		Bootloader: conf.Bootloader,
+	}
+
+	switch layout.Format {
+	case "":
+		layout.Format = FormatRaw
+	case FormatRaw, FormatQCOW2:
+	default:
+		return nil, fmt.Errorf("unsupported disk format: %s", conf.Format)
+	}
+
+	switch layout.Bootloader {
+	case "":
+		layout.Bootloader = BootloaderSystemdBoot
+	case BootloaderSystemdBoot, BootloaderGRUB:
+	default:
+		return nil, fmt.Errorf("unsupported bootloader: %s", conf.Bootloader)
+	}
+
+	if _, err := efiArch(arch); err != nil {
+		return nil, err
+	}
+
+	if conf.Size == "" {
+		return nil, errors.New("disk size is required")
+	}
+
+	size, err := units.RAMInBytes(conf.Size)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disk size %q: %w", conf.Size, err)
+	}
+	layout.Size = alignUp(size)
+
+	partitionConfs := conf.Partitions
+	if len(partitionConfs) == 0 {
+		partitionConfs = DefaultPartitions
+	}
+
+	if len(partitionConfs) > maxPartitions {
+		return nil, fmt.Errorf("too many partitions (maximum %d)", maxPartitions)
+	}
+
+	// The end of the usable space, leaving room for the backup partition table.
+	usableEnd := alignDown(layout.Size - partitionTableSize)
+
+	labels := make(map[string]bool)
+	mountPoints := make(map[string]bool)
+	offset := int64(alignment)
+	for i, partitionConf := range partitionConfs {
+		partition := Partition{
+			Label:        partitionConf.Label,
+			Filesystem:   partitionConf.Filesystem,
+			MountPoint:   path.Clean(partitionConf.MountPoint),
+			MountOptions: partitionConf.MountOptions,
+			Offset:       offset,
+		}
+
+		if err := validatePartition(partition, labels, mountPoints); err != nil {
+			return nil, err
+		}
+
+		if partition.MountOptions == "" {
+			partition.MountOptions = "defaults"
+			if partition.Filesystem == FilesystemVFAT {
+				partition.MountOptions = "umask=0077"
+			}
+		}
+
+		partition.ESP = partition.Filesystem == FilesystemVFAT &&
+			(partition.MountPoint == "/boot/efi" || partition.MountPoint == "/efi")
+
+		if partitionConf.Size == "" {
+			if i != len(partitionConfs)-1 {
+				return nil, fmt.Errorf("partition %s must have a size (only the last partition may omit it)", partition.Label)
+			}
+
+			partition.Size = usableEnd - offset
+		} else {
+			size, err := units.RAMInBytes(partitionConf.Size)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %q for partition %s: %w", partitionConf.Size, partition.Label, err)
+			}
+
+			partition.Size = alignUp(size)
+		}
+
+		if partition.Size <= 0 || offset+partition.Size > usableEnd {
+			return nil, fmt.Errorf("partition %s does not fit on a %s disk", partition.Label, conf.Size)
+		}
+
+		offset += partition.Size
+		layout.Partitions = append(layout.Partitions, partition)
+	}
+
+	if layout.Root() == nil {
+		return nil, errors.New("no partition is mounted at /")
+	}
+
+	if layout.ESP() == nil {
+		return nil, errors.New("no EFI system partition (a vfat partition mounted at /boot/efi or /efi)")
+	}
+
+	if layout.Root().Filesystem != FilesystemExt4 {
+		return nil, errors.New("the root partition must be ext4")
+	}
+
+	layout.KernelCommandLine = []string{"root=LABEL=" + layout.Root().Label, "ro"}
+	if len(conf.KernelCommandLine) > 0 {
+		layout.KernelCommandLine = append(layout.KernelCommandLine, conf.KernelCommandLine...)
+	} else {
+		layout.KernelCommandLine = append(layout.KernelCommandLine, serialConsole(arch))
+	}
+
+	return &layout, nil
+}
+
+func validatePartition(partition Partition, labels, mountPoints map[string]bool) error {
+	if partition.Label == "" {
+		return errors.New("partition label is required")
+	}
+
+	if labels[partition.Label] {
+		return fmt.Errorf("duplicate partition label: %s", partition.Label)
+	}
+	labels[partition.Label] = true
+
+	if !path.IsAbs(partition.MountPoint) {
+		return fmt.Errorf("partition %s must have an absolute mount point", partition.Label)
+	}
+
+	if mountPoints[partition.MountPoint] {
+		return fmt.Errorf("duplicate partition mount point: %s", partition.MountPoint)
+	}
+	mountPoints[partition.MountPoint] = true
+
+	switch partition.Filesystem {
+	case FilesystemExt4:
+		if len(partition.Label) > 16 {
+			return fmt.Errorf("ext4 label %s is longer than 16 characters", partition.Label)
+		}
+	case FilesystemVFAT:
+		if len(partition.Label) > 11 || strings.ToUpper(partition.Label) != partition.Label {
+			return fmt.Errorf("vfat label %s must be uppercase and at most 11 characters", partition.Label)
+		}
+	default:
+		return fmt.Errorf("unsupported filesystem %q for partition %s", partition.Filesystem, partition.Label)
+	}
+
+	return nil
+}
+
+// Root returns the root partition.
+func (l *Layout) Root() *Partition {
+	for i := range l.Partitions {
+		if l.Partitions[i].MountPoint == "/" {
+			return &l.Partitions[i]
+		}
+	}
+
+	return nil
+}
+
+// ESP returns the EFI system partition.
+func (l *Layout) ESP() *Partition {
+	for i := range l.Partitions {
+		if l.Partitions[i].ESP {
+			return &l.Partitions[i]
+		}
+	}
+
+	return nil
+}
+
+// Fstab returns the contents of /etc/fstab for the layout.
+func (l *Layout) Fstab() string {
+	// Mount points are listed in the order they need to be mounted.
+	partitions := make([]Partition, len(l.Partitions))
+	copy(partitions, l.Partitions)
+	sort.SliceStable(partitions, func(i, j int) bool {
+		return mountDepth(partitions[i].MountPoint) < mountDepth(partitions[j].MountPoint)
+	})
+
+	var sb strings.Builder
+	sb.WriteString("# <file system>\t<mount point>\t<type>\t<options>\t<dump>\t<pass>\n")
+	for _, partition := range partitions {
+		pass := 2
+		if partition.MountPoint == "/" {
+			pass = 1
+		}
+
+		fmt.Fprintf(&sb, "LABEL=%s\t%s\t%s\t%s\t0\t%d\n",
+			partition.Label, partition.MountPoint, partition.Filesystem, partition.MountOptions, pass)
+	}
+
+	return sb.String()
+}
+
+// KernelPackage returns the kernel package to install.
+func KernelPackage(conf latestrecipe.DiskConfig, arch string) string {
+	if conf.Kernel != "" {
+		return conf.Kernel
+	}
+
+	return "linux-image-" + arch
+}
+
+// ToolPackages returns the packages needed to build the disk image (these
+// are not installed into the image itself).
+func ToolPackages(layout *Layout, arch string) ([]string, error) {
+	pkgs := []string{"e2fsprogs", "dosfstools", "mtools"}
+
+	if layout.Format == FormatQCOW2 {
+		pkgs = append(pkgs, "qemu-utils")
+	}
+
+	switch layout.Bootloader {
+	case BootloaderSystemdBoot:
+		pkgs = append(pkgs, "systemd-boot-efi")
+	case BootloaderGRUB:
+		grubPkg, err := grubPackage(arch)
+		if err != nil {
+			return nil, err
+		}
+
+		pkgs = append(pkgs, "grub-common", grubPkg)
+	}
+
+	return pkgs, nil
+}
+
+func mountDepth(mountPoint string) int {
+	if mountPoint == "/" {
+		return 0
+	}
+
+	return strings.Count(mountPoint, "/")
+}
+
+func serialConsole(arch string) string {
+	if arch == "arm64" {
+		return "console=ttyAMA0"
+	}
+
+	return "console=ttyS0"
+}
+
+func alignUp(n int64) int64 {
+	return (n + alignment - 1) / alignment * alignment
+}
+
+func alignDown(n int64) int64 {
+	return n / alignment * alignment
+}
@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package disk_test
+
+import (
+	"testing"
+
+	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
+	"github.com/immutos/debco/internal/secondstage/disk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewLayout(t *testing.T) {
+	layout, err := disk.NewLayout(latestrecipe.DiskConfig{Size: "2GiB"}, "amd64")
+	require.NoError(t, err)
+
+	require.Equal(t, disk.FormatRaw, layout.Format)
+	require.Equal(t, disk.BootloaderSystemdBoot, layout.Bootloader)
+	require.Equal(t, int64(2<<30), layout.Size)
+	require.Equal(t, []string{"root=LABEL=root", "ro", "console=ttyS0"}, layout.KernelCommandLine)
+
+	require.Len(t, layout.Partitions, 2)
+
+	esp := layout.ESP()
+	require.NotNil(t, esp)
+	require.Equal(t, "ESP", esp.Label)
+	require.Equal(t, int64(1<<20), esp.Offset)
+	require.Equal(t, int64(256<<20), esp.Size)
+
+	root := layout.Root()
+	require.NotNil(t, root)
+	require.Equal(t, "root", root.Label)
+	require.Equal(t, int64(257<<20), root.Offset)
+	// The last MiB is left for the backup partition table.
+	require.Equal(t, int64(2<<30)-(258<<20), root.Size)
+
+	require.Equal(t, "# <file system>\t<mount point>\t<type>\t<options>\t<dump>\t<pass>\n"+
+		"LABEL=root\t/\text4\tdefaults\t0\t1\n"+
+		"LABEL=ESP\t/boot/efi\tvfat\tumask=0077\t0\t2\n", layout.Fstab())
+
+	t.Run("Custom", func(t *testing.T) {
+		layout, err := disk.NewLayout(latestrecipe.DiskConfig{
+			Format:            disk.FormatQCOW2,
+			Size:              "4G",
+			Bootloader:        disk.BootloaderGRUB,
+			KernelCommandLine: []string{"console=ttyAMA0", "quiet"},
+			Partitions: []latestrecipe.PartitionConfig{
+				{Label: "EFI", Size: "100M", Filesystem: "vfat", MountPoint: "/efi"},
+				{Label: "root", Size: "2G", Filesystem: "ext4", MountPoint: "/"},
+				{Label: "home", Filesystem: "ext4", MountPoint: "/home/", MountOptions: "nodev,nosuid"},
+			},
+		}, "arm64")
+		require.NoError(t, err)
+
+		require.Equal(t, disk.FormatQCOW2, layout.Format)
+		require.Equal(t, []string{"root=LABEL=root", "ro", "console=ttyAMA0", "quiet"}, layout.KernelCommandLine)
+		require.Equal(t, "EFI", layout.ESP().Label)
+		require.Equal(t, "/home", layout.Partitions[2].MountPoint)
+		require.Contains(t, layout.Fstab(), "LABEL=home\t/home\text4\tnodev,nosuid\t0\t2\n")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		invalid := map[string]latestrecipe.DiskConfig{
+			"No Size":         {},
+			"Unknown Format":  {Size: "1G", Format: "vmdk"},
+			"Unknown Loader":  {Size: "1G", Bootloader: "lilo"},
+			"Too Small":       {Size: "100M"},
+			"No Root":         {Size: "1G", Partitions: []latestrecipe.PartitionConfig{{Label: "ESP", Size: "256M", Filesystem: "vfat", MountPoint: "/boot/efi"}}},
+			"No ESP":          {Size: "1G", Partitions: []latestrecipe.PartitionConfig{{Label: "root", Filesystem: "ext4", MountPoint: "/"}}},
+			"Size Not Last":   {Size: "1G", Partitions: []latestrecipe.PartitionConfig{{Label: "root", Filesystem: "ext4", MountPoint: "/"}, {Label: "ESP", Size: "256M", Filesystem: "vfat", MountPoint: "/boot/efi"}}},
+			"Lowercase VFAT":  {Size: "1G", Partitions: []latestrecipe.PartitionConfig{{Label: "esp", Size: "256M", Filesystem: "vfat", MountPoint: "/boot/efi"}, {Label: "root", Filesystem: "ext4", MountPoint: "/"}}},
+			"Duplicate Label": {Size: "1G", Partitions: []latestrecipe.PartitionConfig{{Label: "ESP", Size: "256M", Filesystem: "vfat", MountPoint: "/boot/efi"}, {Label: "ESP", Filesystem: "ext4", MountPoint: "/"}}},
+		}
+
+		for name, conf := range invalid {
+			_, err := disk.NewLayout(conf, "amd64")
+			require.Error(t, err, name)
+		}
+
+		_, err := disk.NewLayout(latestrecipe.DiskConfig{Size: "1G"}, "riscv64")
+		require.Error(t, err)
+	})
+}
@@ -20,27 +20,32 @@ package secondstage
 
 import (
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
-
-	cp "github.com/otiai10/copy"
+	"strings"
+	"syscall"
 )
 
 // usrMergeDirectories is the complete list of directories that can be merged into /usr.
 var usrMergeDirectories = []string{"/bin", "/lib", "/lib32", "/lib64", "/libo32", "/libx32", "/sbin"}
 
-// MergeUsr merges the /usr directory into the root filesystem
+// MergeUsr merges the /usr directory into the root filesystem at rootDir.
+// The merged directories are replaced with relative symlinks (eg. bin -> usr/bin)
+// as is done by both Debian and Ubuntu.
 // See: https://wiki.debian.org/UsrMerge
-func MergeUsr() error {
+func MergeUsr(rootDir string) error {
 	for _, dir := range usrMergeDirectories {
+		path := filepath.Join(rootDir, dir)
+
 		// The architecture does not have this directory.
-		if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
 			continue
 		}
 
 		// The directory is already usr merged.
-		if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
 			slog.Info("Directory is already usr merged", slog.String("dir", dir))
 			continue
 		}
@@ -49,20 +54,71 @@ func MergeUsr() error {
 
 		slog.Info("Merging into /usr", slog.String("dir", dir), slog.String("canonDir", canonDir))
 
-		if err := cp.Copy(dir, canonDir, cp.Options{OnSymlink: func(src string) cp.SymlinkAction {
-			return cp.Shallow
-		}}); err != nil {
+		if err := moveDir(path, filepath.Join(rootDir, canonDir)); err != nil {
 			return fmt.Errorf("failed to copy %s to %s: %w", dir, canonDir, err)
 		}
 
-		if err := os.RemoveAll(dir); err != nil {
+		if err := os.RemoveAll(path); err != nil {
 			return fmt.Errorf("failed to remove %s: %w", dir, err)
 		}
 
-		if err := os.Symlink(canonDir, dir); err != nil {
-			return fmt.Errorf("failed to symlink %s -> /usr%s: %w", dir, canonDir, err)
+		if err := os.Symlink(strings.TrimPrefix(canonDir, "/"), path); err != nil {
+			return fmt.Errorf("failed to symlink %s -> %s: %w", dir, canonDir, err)
 		}
 	}
 
 	return nil
 }
+
+// moveDir moves the contents of srcDir into dstDir, merging any existing
+// directories. Files are renamed rather than copied so that their ownership,
+// permissions, and extended attributes (eg. file capabilities) are preserved.
+func moveDir(srcDir, dstDir string) error {
+	return filepath.WalkDir(srcDir, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			return err
+		}
+
+		dstPath := filepath.Join(dstDir, rel)
+
+		if !d.IsDir() {
+			return os.Rename(srcPath, dstPath)
+		}
+
+		if info, err := os.Lstat(dstPath); err == nil && info.IsDir() {
+			return nil
+		} else if err == nil {
+			if err := os.Remove(dstPath); err != nil {
+				return err
+			}
+		}
+
+		// Directories are created rather than renamed, as renaming a directory
+		// from a lower layer is not supported by all overlay filesystems.
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := os.Mkdir(dstPath, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(dstPath, int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Chmod(dstPath, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+			return err
+		}
+
+		return syncXattrs(srcPath, dstPath)
+	})
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/debco/internal/secondstage"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeUsr(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	rootDir := t.TempDir()
+
+	// An Ubuntu style root filesystem as unpacked from the package data
+	// archives (prior to any maintainer scripts being run).
+	for _, dir := range []string{"bin", "sbin", "lib/x86_64-linux-gnu", "lib64", "usr/bin", "usr/lib/x86_64-linux-gnu"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(rootDir, dir), 0o755))
+	}
+
+	for path, content := range map[string]string{
+		"bin/bash":                           "bash",
+		"sbin/ldconfig":                      "ldconfig",
+		"lib/x86_64-linux-gnu/libc.so.6":     "libc",
+		"usr/bin/hello":                      "hello",
+		"usr/lib/x86_64-linux-gnu/libz.so.1": "libz",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(rootDir, path), []byte(content), 0o644))
+	}
+
+	require.NoError(t, os.Symlink("/lib/x86_64-linux-gnu/ld-linux-x86-64.so.2", filepath.Join(rootDir, "lib64/ld-linux-x86-64.so.2")))
+
+	// Already merged by the usr-is-merged package.
+	require.NoError(t, os.Symlink("usr/libx32", filepath.Join(rootDir, "libx32")))
+
+	require.NoError(t, secondstage.MergeUsr(rootDir))
+
+	for dir, target := range map[string]string{
+		"bin":    "usr/bin",
+		"sbin":   "usr/sbin",
+		"lib":    "usr/lib",
+		"lib64":  "usr/lib64",
+		"libx32": "usr/libx32",
+	} {
+		linkTarget, err := os.Readlink(filepath.Join(rootDir, dir))
+		require.NoError(t, err)
+		require.Equal(t, target, linkTarget)
+	}
+
+	_, err := os.Lstat(filepath.Join(rootDir, "lib32"))
+	require.True(t, os.IsNotExist(err))
+
+	for _, path := range []string{"usr/bin/bash", "usr/bin/hello", "usr/sbin/ldconfig", "usr/lib/x86_64-linux-gnu/libc.so.6", "usr/lib/x86_64-linux-gnu/libz.so.1"} {
+		_, err := os.Stat(filepath.Join(rootDir, path))
+		require.NoError(t, err)
+	}
+
+	linkTarget, err := os.Readlink(filepath.Join(rootDir, "usr/lib64/ld-linux-x86-64.so.2"))
+	require.NoError(t, err)
+	require.Equal(t, "/lib/x86_64-linux-gnu/ld-linux-x86-64.so.2", linkTarget)
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// DpkgAdminDir is the default dpkg administrative directory.
+const DpkgAdminDir = "/var/lib/dpkg"
+
+// RunPreinst runs the preinst maintainer scripts of the given packages (in
+// the form name:arch) in order, with the same arguments and environment
+// that dpkg uses when installing a package for the first time. Packages
+// without a preinst script are skipped.
+//
+// Unlike dpkg, which runs each preinst script before unpacking its package,
+// the scripts are run after the data archives of all packages have been
+// unpacked (the root filesystem is assembled before the second stage runs).
+// So a preinst script will find its own package's files (and those of every
+// other package) already in place. Packages whose preinst script uses
+// dpkg-maintscript-helper are rejected when the dpkg database is created.
+func RunPreinst(ctx context.Context, adminDir string, packages []string) error {
+	for _, pkg := range packages {
+		name, arch, ok := strings.Cut(pkg, ":")
+		if !ok {
+			return fmt.Errorf("invalid package %q, expected name:arch", pkg)
+		}
+
+		// Multi-Arch: same packages are qualified by their architecture.
+		scriptPath := filepath.Join(adminDir, "info", name+":"+arch+".preinst")
+		if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+			scriptPath = filepath.Join(adminDir, "info", name+".preinst")
+			if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		slog.Info("Running preinst script", slog.String("package", name), slog.String("arch", arch))
+
+		cmd := exec.CommandContext(ctx, scriptPath, "install")
+		cmd.Dir = "/"
+		cmd.Env = append(os.Environ(),
+			"DPKG_MAINTSCRIPT_PACKAGE="+name,
+			"DPKG_MAINTSCRIPT_PACKAGE_REFCOUNT=1",
+			"DPKG_MAINTSCRIPT_ARCH="+arch,
+			"DPKG_MAINTSCRIPT_NAME=preinst",
+			"DPKG_MAINTSCRIPT_DEBUG=0",
+			"DPKG_ADMINDIR="+adminDir,
+			"DPKG_ROOT=",
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to run preinst script of package %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/immutos/debco/internal/secondstage"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPreinst(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	dir := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "info"), 0o755))
+
+	logPath := filepath.Join(dir, "preinst.log")
+	script := "#!/bin/sh\nset -e\necho \"$DPKG_MAINTSCRIPT_PACKAGE $DPKG_MAINTSCRIPT_ARCH $DPKG_MAINTSCRIPT_NAME $1\" >> " + logPath + "\n"
+
+	for _, name := range []string{"base-passwd.preinst", "libc6:amd64.preinst", "adduser.preinst"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "info", name), []byte(script), 0o755))
+	}
+
+	require.NoError(t, secondstage.RunPreinst(context.Background(), dir, []string{"base-passwd:amd64", "libc6:amd64", "mawk:amd64", "adduser:all"}))
+
+	log, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+
+	require.Equal(t, "base-passwd amd64 preinst install\nlibc6 amd64 preinst install\nadduser all preinst install\n", string(log))
+
+	t.Run("Failure", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "info", "broken.preinst"), []byte("#!/bin/sh\nexit 1\n"), 0o755))
+
+		err := secondstage.RunPreinst(context.Background(), dir, []string{"broken:amd64", "adduser:all"})
+		require.ErrorContains(t, err, "failed to run preinst script of package broken")
+	})
+}
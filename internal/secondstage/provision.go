@@ -37,6 +37,15 @@ func Provision(ctx context.Context, rx *latestrecipe.Recipe) error {
 		}
 	}
 
+	for _, altConf := range rx.Alternatives {
+		slog.Info("Setting alternative",
+			slog.String("name", altConf.Name), slog.String("path", altConf.Path))
+
+		if err := SetAlternative(ctx, AlternativesAdminDir, AlternativesDir, altConf.Name, altConf.Path); err != nil {
+			return fmt.Errorf("failed to set alternative %q: %w", altConf.Name, err)
+		}
+	}
+
 	for _, groupConf := range rx.Groups {
 		slog.Info("Creating or updating group", slog.String("name", groupConf.Name))
 
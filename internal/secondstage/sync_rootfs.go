@@ -0,0 +1,396 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Paths that are managed by the container runtime and are never synchronized.
+var runtimePaths = []string{"/dev", "/proc", "/sys", "/etc/hosts", "/etc/resolv.conf"}
+
+// SyncRootFS makes the root filesystem at dstDir identical to the one at
+// srcDir (ignoring modification times), only modifying the files that differ.
+// When run on top of an existing layer, the resulting layer only contains the
+// differences between the two root filesystems. Excluded paths (relative to
+// the root filesystem) are left untouched.
+func SyncRootFS(srcDir, dstDir string, exclude []string) error {
+	excluded := make(map[string]bool)
+	for _, path := range append(runtimePaths, exclude...) {
+		excluded[filepath.Clean("/"+path)] = true
+	}
+
+	// Remove anything that is no longer present (or has changed type).
+	err := filepath.WalkDir(dstDir, func(dstPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		path, err := rootFSPath(dstDir, dstPath)
+		if err != nil {
+			return err
+		}
+
+		if excluded[path] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if path == "/" {
+			return nil
+		}
+
+		srcInfo, err := os.Lstat(filepath.Join(srcDir, path))
+		if err == nil && srcInfo.Mode().Type() == d.Type() {
+			return nil
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		slog.Debug("Removing path", slog.String("path", path))
+
+		if err := os.RemoveAll(dstPath); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hard linked files are linked to the first path they were synchronized to.
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	linked := make(map[inode]string)
+
+	// Directory metadata is updated after their contents.
+	var dirs []string
+
+	err = filepath.WalkDir(srcDir, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		path, err := rootFSPath(srcDir, srcPath)
+		if err != nil {
+			return err
+		}
+
+		if excluded[path] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil {
+			return err
+		}
+
+		dstPath := filepath.Join(dstDir, path)
+
+		if st, ok := srcInfo.Sys().(*syscall.Stat_t); ok && srcInfo.Mode().IsRegular() && st.Nlink > 1 {
+			key := inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+			if linkPath, ok := linked[key]; ok {
+				return syncHardLink(linkPath, dstPath)
+			}
+			linked[key] = dstPath
+		}
+
+		if srcInfo.IsDir() {
+			dirs = append(dirs, path)
+		}
+
+		changed, err := syncPath(srcPath, dstPath, srcInfo)
+		if err != nil {
+			return fmt.Errorf("failed to synchronize %s: %w", path, err)
+		}
+
+		if changed {
+			slog.Debug("Synchronized path", slog.String("path", path))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		srcInfo, err := os.Lstat(filepath.Join(srcDir, dirs[i]))
+		if err != nil {
+			return err
+		}
+
+		dstInfo, err := os.Lstat(filepath.Join(dstDir, dirs[i]))
+		if err != nil {
+			return err
+		}
+
+		// Avoid needlessly including unchanged directories in the layer.
+		if sameMetadata(srcInfo, dstInfo) {
+			same, err := sameXattrs(filepath.Join(srcDir, dirs[i]), filepath.Join(dstDir, dirs[i]))
+			if err != nil {
+				return fmt.Errorf("failed to compare %s: %w", dirs[i], err)
+			}
+
+			if same {
+				continue
+			}
+		}
+
+		if err := syncMetadata(filepath.Join(srcDir, dirs[i]), filepath.Join(dstDir, dirs[i]), srcInfo, true); err != nil {
+			return fmt.Errorf("failed to synchronize %s: %w", dirs[i], err)
+		}
+	}
+
+	return nil
+}
+
+func rootFSPath(rootDir, path string) (string, error) {
+	rel, err := filepath.Rel(rootDir, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Clean("/" + rel), nil
+}
+
+// syncPath makes dstPath identical to srcPath, it returns true if dstPath was
+// modified.
+func syncPath(srcPath, dstPath string, srcInfo fs.FileInfo) (bool, error) {
+	dstInfo, err := os.Lstat(dstPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	exists := err == nil
+
+	switch srcInfo.Mode().Type() {
+	case fs.ModeDir:
+		if !exists {
+			if err := os.Mkdir(dstPath, 0o700); err != nil {
+				return false, err
+			}
+		}
+
+		// Directory metadata is synchronized once its contents are.
+		return !exists, nil
+	case fs.ModeSymlink:
+		target, err := os.Readlink(srcPath)
+		if err != nil {
+			return false, err
+		}
+
+		if exists {
+			if dstTarget, err := os.Readlink(dstPath); err == nil && dstTarget == target && sameOwner(srcInfo, dstInfo) {
+				return false, nil
+			}
+
+			if err := os.Remove(dstPath); err != nil {
+				return false, err
+			}
+		}
+
+		if err := os.Symlink(target, dstPath); err != nil {
+			return false, err
+		}
+
+		return true, syncMetadata(srcPath, dstPath, srcInfo, false)
+	case 0:
+		if exists {
+			same, err := sameFile(srcPath, dstPath, srcInfo, dstInfo)
+			if err != nil {
+				return false, err
+			}
+
+			if same {
+				return false, nil
+			}
+
+			// The file might be hard linked to another file.
+			if err := os.Remove(dstPath); err != nil {
+				return false, err
+			}
+		}
+
+		if err := copyFile(srcPath, dstPath); err != nil {
+			return false, err
+		}
+
+		return true, syncMetadata(srcPath, dstPath, srcInfo, true)
+	default:
+		// Device nodes, named pipes, and sockets.
+		st, ok := srcInfo.Sys().(*syscall.Stat_t)
+		if !ok {
+			return false, fmt.Errorf("unsupported file type: %s", srcInfo.Mode().Type())
+		}
+
+		if exists {
+			if dstSt, ok := dstInfo.Sys().(*syscall.Stat_t); ok && dstSt.Rdev == st.Rdev && sameMetadata(srcInfo, dstInfo) {
+				if same, err := sameXattrs(srcPath, dstPath); err != nil {
+					return false, err
+				} else if same {
+					return false, nil
+				}
+			}
+
+			if err := os.Remove(dstPath); err != nil {
+				return false, err
+			}
+		}
+
+		if err := syscall.Mknod(dstPath, st.Mode, int(st.Rdev)); err != nil {
+			return false, err
+		}
+
+		return true, syncMetadata(srcPath, dstPath, srcInfo, true)
+	}
+}
+
+func syncHardLink(linkPath, dstPath string) error {
+	if linkInfo, err := os.Lstat(linkPath); err == nil {
+		if dstInfo, err := os.Lstat(dstPath); err == nil && os.SameFile(linkInfo, dstInfo) {
+			return nil
+		}
+	}
+
+	if err := os.Remove(dstPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Link(linkPath, dstPath)
+}
+
+// syncMetadata copies the ownership, permissions, extended attributes, and
+// modification time of a file (only ownership is supported for symlinks).
+func syncMetadata(srcPath, dstPath string, srcInfo fs.FileInfo, followSymlinks bool) error {
+	if st, ok := srcInfo.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dstPath, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+
+	if !followSymlinks {
+		return nil
+	}
+
+	// Permissions must be set after the ownership, as chown clears the setuid
+	// and setgid bits.
+	if err := os.Chmod(dstPath, srcInfo.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+
+	// Extended attributes must also be set after the ownership, as chown
+	// clears any file capabilities.
+	if err := syncXattrs(srcPath, dstPath); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dstPath, srcInfo.ModTime(), srcInfo.ModTime())
+}
+
+func sameOwner(a, b fs.FileInfo) bool {
+	aSt, aOK := a.Sys().(*syscall.Stat_t)
+	bSt, bOK := b.Sys().(*syscall.Stat_t)
+	return aOK && bOK && aSt.Uid == bSt.Uid && aSt.Gid == bSt.Gid
+}
+
+func sameMetadata(a, b fs.FileInfo) bool {
+	return a.Mode() == b.Mode() && sameOwner(a, b)
+}
+
+// sameFile compares the metadata (excluding modification times), extended
+// attributes, and contents of two regular files.
+func sameFile(aPath, bPath string, aInfo, bInfo fs.FileInfo) (bool, error) {
+	if !sameMetadata(aInfo, bInfo) || aInfo.Size() != bInfo.Size() {
+		return false, nil
+	}
+
+	if same, err := sameXattrs(aPath, bPath); err != nil || !same {
+		return false, err
+	}
+
+	a, err := os.Open(aPath)
+	if err != nil {
+		return false, err
+	}
+	defer a.Close()
+
+	b, err := os.Open(bPath)
+	if err != nil {
+		return false, err
+	}
+	defer b.Close()
+
+	aBuf := make([]byte, 32*1024)
+	bBuf := make([]byte, 32*1024)
+	for {
+		aN, aErr := io.ReadFull(a, aBuf)
+		bN, bErr := io.ReadFull(b, bBuf)
+
+		if aN != bN || !bytes.Equal(aBuf[:aN], bBuf[:bN]) {
+			return false, nil
+		}
+
+		if errors.Is(aErr, io.EOF) || errors.Is(aErr, io.ErrUnexpectedEOF) {
+			return errors.Is(bErr, io.EOF) || errors.Is(bErr, io.ErrUnexpectedEOF), nil
+		} else if aErr != nil {
+			return false, aErr
+		} else if bErr != nil {
+			return false, bErr
+		}
+	}
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
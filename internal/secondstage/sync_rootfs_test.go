@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/immutos/debco/internal/secondstage"
+	"github.com/immutos/debco/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncRootFS(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	writeFiles := func(t *testing.T, rootDir string, files map[string]string) {
+		for path, content := range files {
+			require.NoError(t, os.MkdirAll(filepath.Join(rootDir, filepath.Dir(path)), 0o755))
+			require.NoError(t, os.WriteFile(filepath.Join(rootDir, path), []byte(content), 0o644))
+		}
+	}
+
+	// The base layer.
+	writeFiles(t, dstDir, map[string]string{
+		"etc/unchanged":   "unchanged",
+		"etc/changed":     "old",
+		"etc/removed":     "removed",
+		"lib/libfoo.so":   "foo",
+		"mnt/excluded":    "excluded",
+		"usr/bin/tool":    "tool",
+		"usr/bin/chmoded": "chmoded",
+	})
+
+	// The final root filesystem.
+	writeFiles(t, srcDir, map[string]string{
+		"etc/unchanged":     "unchanged",
+		"etc/changed":       "new",
+		"usr/lib/libfoo.so": "foo",
+		"usr/bin/tool":      "tool",
+		"usr/bin/chmoded":   "chmoded",
+		"usr/bin/added":     "added",
+	})
+	require.NoError(t, os.Chmod(filepath.Join(srcDir, "usr/bin/chmoded"), 0o755))
+	require.NoError(t, os.Symlink("usr/lib", filepath.Join(srcDir, "lib")))
+	require.NoError(t, os.Link(filepath.Join(srcDir, "usr/bin/added"), filepath.Join(srcDir, "usr/bin/linked")))
+
+	unchangedInfo, err := os.Stat(filepath.Join(dstDir, "etc/unchanged"))
+	require.NoError(t, err)
+
+	require.NoError(t, secondstage.SyncRootFS(srcDir, dstDir, []string{"/mnt"}))
+
+	// Walk both root filesystems and compare them.
+	listFiles := func(t *testing.T, rootDir string) map[string]string {
+		files := make(map[string]string)
+		require.NoError(t, filepath.WalkDir(rootDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(rootDir, path)
+			require.NoError(t, err)
+
+			info, err := d.Info()
+			require.NoError(t, err)
+
+			switch {
+			case d.Type()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(path)
+				require.NoError(t, err)
+				files[rel] = "-> " + target
+			case d.Type().IsRegular():
+				content, err := os.ReadFile(path)
+				require.NoError(t, err)
+				files[rel] = info.Mode().String() + " " + string(content)
+			default:
+				files[rel] = info.Mode().String()
+			}
+
+			return nil
+		}))
+
+		return files
+	}
+
+	expected := listFiles(t, srcDir)
+	expected["mnt"] = "drwxr-xr-x"
+	expected["mnt/excluded"] = "-rw-r--r-- excluded"
+
+	require.Equal(t, expected, listFiles(t, dstDir))
+
+	// Unchanged files are left alone.
+	info, err := os.Stat(filepath.Join(dstDir, "etc/unchanged"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(unchangedInfo, info))
+
+	// Hard links are preserved.
+	addedInfo, err := os.Stat(filepath.Join(dstDir, "usr/bin/added"))
+	require.NoError(t, err)
+
+	linkedInfo, err := os.Stat(filepath.Join(dstDir, "usr/bin/linked"))
+	require.NoError(t, err)
+
+	require.True(t, os.SameFile(addedInfo, linkedInfo))
+
+	t.Run("Extended Attributes", func(t *testing.T) {
+		srcPath := filepath.Join(srcDir, "usr/bin/tool")
+		dstPath := filepath.Join(dstDir, "usr/bin/tool")
+
+		if err := syscall.Setxattr(srcPath, "user.debco.test", []byte("new"), 0); err != nil {
+			if errors.Is(err, syscall.ENOTSUP) {
+				t.Skip("Extended attributes are not supported")
+			}
+			require.NoError(t, err)
+		}
+
+		require.NoError(t, syscall.Setxattr(dstPath, "user.debco.removed", []byte("removed"), 0))
+
+		require.NoError(t, secondstage.SyncRootFS(srcDir, dstDir, []string{"/mnt"}))
+
+		value := make([]byte, 16)
+		n, err := syscall.Getxattr(dstPath, "user.debco.test", value)
+		require.NoError(t, err)
+		require.Equal(t, "new", string(value[:n]))
+
+		_, err = syscall.Getxattr(dstPath, "user.debco.removed", value)
+		require.ErrorIs(t, err, syscall.ENODATA)
+	})
+}
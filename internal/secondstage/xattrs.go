@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package secondstage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// listXattrs returns the extended attributes of a file (including file
+// capabilities). Filesystems that do not support extended attributes are
+// treated as having none.
+func listXattrs(path string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		size, err := syscall.Getxattr(path, name, nil)
+		if err != nil {
+			// The attribute was removed after it was listed.
+			if errors.Is(err, syscall.ENODATA) {
+				continue
+			}
+			return nil, err
+		}
+
+		value := make([]byte, size)
+		if size > 0 {
+			size, err = syscall.Getxattr(path, name, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		xattrs[name] = value[:size]
+	}
+
+	return xattrs, nil
+}
+
+// sameXattrs returns true if two files have identical extended attributes.
+func sameXattrs(aPath, bPath string) (bool, error) {
+	aXattrs, err := listXattrs(aPath)
+	if err != nil {
+		return false, err
+	}
+
+	bXattrs, err := listXattrs(bPath)
+	if err != nil {
+		return false, err
+	}
+
+	if len(aXattrs) != len(bXattrs) {
+		return false, nil
+	}
+
+	for name, value := range aXattrs {
+		if bValue, ok := bXattrs[name]; !ok || !bytes.Equal(value, bValue) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// syncXattrs makes the extended attributes of dstPath identical to those of
+// srcPath. As changing the ownership of a file clears its capabilities, this
+// must be done after any chown.
+func syncXattrs(srcPath, dstPath string) error {
+	srcXattrs, err := listXattrs(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+
+	dstXattrs, err := listXattrs(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to list extended attributes: %w", err)
+	}
+
+	for name := range dstXattrs {
+		if _, ok := srcXattrs[name]; ok {
+			continue
+		}
+
+		if err := syscall.Removexattr(dstPath, name); err != nil && !errors.Is(err, syscall.ENODATA) {
+			return fmt.Errorf("failed to remove extended attribute %s: %w", name, err)
+		}
+	}
+
+	for name, value := range srcXattrs {
+		if dstValue, ok := dstXattrs[name]; ok && bytes.Equal(value, dstValue) {
+			continue
+		}
+
+		if err := syscall.Setxattr(dstPath, name, value, 0); err != nil {
+			return fmt.Errorf("failed to set extended attribute %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
@@ -22,6 +22,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
@@ -44,17 +45,30 @@ type Component struct {
 	Arch arch.Arch
 	// URL is the base URL of the component.
 	URL *url.URL
-	// SHA256Sums are the SHA256 sums of files in the component.
-	SHA256Sums map[string]string
+	// Checksums are the (strongest available) checksums of files in the component.
+	Checksums map[string]hashreader.Checksum
+	// Origin is the origin of the release (eg. Debian).
+	Origin string
+	// Codename is the codename of the release (eg. bookworm).
+	Codename string
+	// InRelease is the InRelease file the component is listed in.
+	InRelease InRelease
 	// Internal fields.
-	keyring   openpgp.EntityList
-	sourceURL *url.URL
+	keyring         openpgp.EntityList
+	sourceURL       *url.URL
+	allowWeakHashes bool
 }
 
 func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, error) {
 	var errs error
 
 	for _, name := range []string{"Packages.xz", "Packages.gz", "Packages"} {
+		checksum, ok := c.Checksums[name]
+		if !ok {
+			errs = errors.Join(errs, fmt.Errorf("no usable checksum for %s file", name))
+			continue
+		}
+
 		packagesURL, err := url.Parse(c.URL.String())
 		if err != nil {
 			return nil, time.Time{}, fmt.Errorf("failed to parse component URL: %w", err)
@@ -88,7 +102,10 @@ func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, e
 				slog.String("url", packagesURL.String()), slog.Any("error", err))
 		}
 
-		hr := hashreader.NewReader(resp.Body)
+		hr, err := hashreader.NewReader(resp.Body, checksum)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to create hash reader: %w", err)
+		}
 
 		dr, err := uncompr.NewReader(hr)
 		if err != nil {
@@ -111,11 +128,22 @@ func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, e
 			continue
 		}
 
-		if err := hr.Verify(c.SHA256Sums[name]); err != nil {
+		// Read any trailing data so that it is covered by the hash.
+		if _, err := io.Copy(io.Discard, hr); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("failed to read %s file: %w", name, err))
+			continue
+		}
+
+		if err := hr.Verify(); err != nil {
 			errs = errors.Join(errs, fmt.Errorf("failed to verify %s file: %w", name, err))
 			continue
 		}
 
+		// Make sure every package can be verified before it is downloaded.
+		if err := c.checkPackageChecksums(packageList); err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to verify %s file: %w", name, err)
+		}
+
 		packageURL, err := url.Parse(c.sourceURL.String())
 		if err != nil {
 			return nil, time.Time{}, fmt.Errorf("failed to parse source URL: %w", err)
@@ -125,6 +153,8 @@ func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, e
 		for i := range packageList {
 			packageURL.Path = path.Join(basePath, packageList[i].Filename)
 			packageList[i].URLs = append(packageList[i].URLs, packageURL.String())
+			packageList[i].Origin = c.Origin
+			packageList[i].Codename = c.Codename
 		}
 
 		return packageList, lastUpdated, nil
@@ -132,3 +162,13 @@ func (c *Component) Packages(ctx context.Context) ([]types.Package, time.Time, e
 
 	return nil, time.Time{}, fmt.Errorf("failed to download Packages file: %w", errs)
 }
+
+func (c *Component) checkPackageChecksums(packageList []types.Package) error {
+	for _, pkg := range packageList {
+		if _, err := hashreader.Strongest(pkg.Checksums(), c.allowWeakHashes); err != nil {
+			return fmt.Errorf("package %s: %w", pkg.ID(), err)
+		}
+	}
+
+	return nil
+}
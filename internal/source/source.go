@@ -20,32 +20,51 @@ package source
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
 	"strings"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/dpeckett/deb822"
-	"github.com/dpeckett/deb822/types"
 	"github.com/dpeckett/deb822/types/arch"
 	"github.com/immutos/debco/internal/keyring"
 	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
+	"github.com/immutos/debco/internal/types"
+	"github.com/immutos/debco/internal/util/hashreader"
 )
 
 const defaultDistribution = "stable"
 
 var defaultComponents = []string{"main"}
 
+// InRelease describes the signed InRelease file of a repository.
+type InRelease struct {
+	// URL is the URL the InRelease file was downloaded from.
+	URL string
+	// SHA256 is the SHA-256 digest of the InRelease file.
+	SHA256 string
+	// Signer is the fingerprint of the (primary) key that signed the file.
+	Signer string
+}
+
 // Source represents a Debian repository source.
 type Source struct {
 	keyring      openpgp.EntityList
 	sourceURL    *url.URL
 	distribution string
 	components   []string
+	// The target architectures the source is restricted to (if any).
+	architectures []arch.Arch
+	// Whether weak hashes (eg. MD5Sum) are acceptable.
+	allowWeakHashes bool
 }
 
 // NewSource creates a new Debian repository source.
@@ -65,21 +84,41 @@ func NewSource(ctx context.Context, conf latestrecipe.SourceConfig) (*Source, er
 		return nil, fmt.Errorf("failed to parse source URL: %w", err)
 	}
 
+	var architectures []arch.Arch
+	for _, a := range conf.Architectures {
+		sourceArch, err := arch.Parse(a)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse source architecture: %w", err)
+		}
+
+		architectures = append(architectures, sourceArch)
+	}
+
 	keyring, err := keyring.Load(ctx, conf.SignedBy)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read keyring: %w", err)
 	}
 
 	return &Source{
-		keyring:      keyring,
-		sourceURL:    sourceURL,
-		distribution: distribution,
-		components:   components,
+		keyring:         keyring,
+		sourceURL:       sourceURL,
+		distribution:    distribution,
+		components:      components,
+		architectures:   architectures,
+		allowWeakHashes: conf.AllowWeakHashes,
 	}, nil
 }
 
 // Components returns the components available in the source for the target architecture.
 func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Component, error) {
+	if len(s.architectures) > 0 && !slices.ContainsFunc(s.architectures, func(a arch.Arch) bool {
+		return a.Is(&targetArch)
+	}) {
+		slog.Debug("Source is not used for the target architecture",
+			slog.String("url", s.sourceURL.String()), slog.String("arch", targetArch.String()))
+		return nil, nil
+	}
+
 	inReleaseURL, err := url.Parse(s.sourceURL.String())
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse source URL: %w", err)
@@ -102,12 +141,17 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 		return nil, fmt.Errorf("failed to download InRelease file: %s", resp.Status)
 	}
 
-	decoder, err := deb822.NewDecoder(resp.Body, s.keyring)
+	// The digest of the InRelease file is recorded in the build provenance.
+	h := sha256.New()
+	body := io.TeeReader(resp.Body, h)
+
+	decoder, err := deb822.NewDecoder(body, s.keyring)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create decoder: %w", err)
 	}
 
-	if decoder.Signer() == nil {
+	signer := decoder.Signer()
+	if signer == nil {
 		return nil, errors.New("InRelease file is not signed")
 	}
 
@@ -116,6 +160,22 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 		return nil, fmt.Errorf("failed to unmarshal InRelease file: %w", err)
 	}
 
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return nil, fmt.Errorf("failed to read InRelease file: %w", err)
+	}
+
+	inRelease := InRelease{
+		URL:    inReleaseURL.String(),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Signer: strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint)),
+	}
+
+	if len(release.SHA512) == 0 && len(release.SHA256) == 0 && !s.allowWeakHashes {
+		return nil, errors.New("InRelease file only lists weak hashes (set allowWeakHashes to use this source)")
+	}
+
+	releaseChecksums := release.Checksums()
+
 	allArch := arch.MustParse("all")
 	var availableArchitectures []arch.Arch
 	for _, releaseArch := range release.Architectures {
@@ -161,20 +221,33 @@ func (s *Source) Components(ctx context.Context, targetArch arch.Arch) ([]Compon
 
 			componentDir := path.Join(path.Base(component), "binary-"+arch.String())
 
-			componentSHA256Sums := make(map[string]string)
-			for _, hash := range release.SHA256 {
-				if strings.HasPrefix(hash.Filename, componentDir) {
-					componentSHA256Sums[strings.TrimPrefix(hash.Filename, componentDir+"/")] = hash.Hash
+			componentChecksums := make(map[string]hashreader.Checksum)
+			for filename, checksums := range releaseChecksums {
+				if !strings.HasPrefix(filename, componentDir+"/") {
+					continue
 				}
+
+				checksum, err := hashreader.Strongest(checksums, s.allowWeakHashes)
+				if err != nil {
+					slog.Debug("Ignoring file without a usable checksum",
+						slog.String("filename", filename), slog.Any("error", err))
+					continue
+				}
+
+				componentChecksums[strings.TrimPrefix(filename, componentDir+"/")] = *checksum
 			}
 
 			components = append(components, Component{
-				Name:       component,
-				Arch:       arch,
-				URL:        componentURL,
-				SHA256Sums: componentSHA256Sums,
-				keyring:    s.keyring,
-				sourceURL:  s.sourceURL,
+				Name:            component,
+				Arch:            arch,
+				URL:             componentURL,
+				Checksums:       componentChecksums,
+				Origin:          release.Origin,
+				Codename:        release.Codename,
+				InRelease:       inRelease,
+				keyring:         s.keyring,
+				sourceURL:       s.sourceURL,
+				allowWeakHashes: s.allowWeakHashes,
 			})
 		}
 	}
@@ -19,58 +19,160 @@
 package source_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
 	"github.com/dpeckett/deb822/types/arch"
 	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
 	"github.com/immutos/debco/internal/source"
 	"github.com/immutos/debco/internal/testutil"
+	"github.com/immutos/debco/internal/util/hashreader"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSource(t *testing.T) {
 	testutil.SetupGlobals(t)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	t.Cleanup(cancel)
+	t.Run("Debian", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
 
-	resultCh := make(chan runMirrorResult, 1)
-	t.Cleanup(func() {
-		close(resultCh)
-	})
+		resultCh := make(chan runMirrorResult, 1)
+		t.Cleanup(func() {
+			close(resultCh)
+		})
 
-	go runDebianMirror(ctx, resultCh)
+		go runDebianMirror(ctx, resultCh)
 
-	mirrorResult := <-resultCh
-	require.NoError(t, mirrorResult.err)
+		mirrorResult := <-resultCh
+		require.NoError(t, mirrorResult.err)
 
-	s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
-		URL:      fmt.Sprintf("http://%s/debian", mirrorResult.addr.String()),
-		SignedBy: filepath.Join(testutil.Root(), "testdata/archive-key-12.asc"),
+		s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
+			URL:      fmt.Sprintf("http://%s/debian", mirrorResult.addr.String()),
+			SignedBy: filepath.Join(testutil.Root(), "testdata/archive-key-12.asc"),
+		})
+		require.NoError(t, err)
+
+		components, err := s.Components(ctx, arch.MustParse("amd64"))
+		require.NoError(t, err)
+
+		require.Len(t, components, 2)
+		require.Equal(t, "main", components[0].Name)
+		require.Equal(t, "all", components[0].Arch.String())
+		require.Equal(t, "main", components[1].Name)
+		require.Equal(t, "amd64", components[1].Arch.String())
+
+		inReleaseData, err := os.ReadFile(filepath.Join(testutil.Root(), "testdata/InRelease"))
+		require.NoError(t, err)
+
+		inRelease := components[1].InRelease
+		require.Equal(t, fmt.Sprintf("http://%s/debian/dists/stable/InRelease", mirrorResult.addr.String()), inRelease.URL)
+		require.Equal(t, fmt.Sprintf("%x", sha256.Sum256(inReleaseData)), inRelease.SHA256)
+		require.Regexp(t, "^[0-9A-F]{40,64}$", inRelease.Signer)
+
+		componentPackages, lastUpdated, err := components[1].Packages(ctx)
+		require.NoError(t, err)
+
+		require.Len(t, componentPackages, 63408)
+
+		require.NotEqual(t, time.Time{}, lastUpdated)
 	})
-	require.NoError(t, err)
 
-	components, err := s.Components(ctx, arch.MustParse("amd64"))
-	require.NoError(t, err)
+	t.Run("Weak Hashes", func(t *testing.T) {
+		ctx := context.Background()
 
-	require.Len(t, components, 2)
-	require.Equal(t, "main", components[0].Name)
-	require.Equal(t, "all", components[0].Arch.String())
-	require.Equal(t, "main", components[1].Name)
-	require.Equal(t, "amd64", components[1].Arch.String())
+		entity, err := openpgp.NewEntity("Test Archive Automatic Signing Key", "", "ftpmaster@example.com", nil)
+		require.NoError(t, err)
 
-	componentPackages, lastUpdated, err := components[1].Packages(ctx)
-	require.NoError(t, err)
+		var keyringBuf bytes.Buffer
+		require.NoError(t, entity.Serialize(&keyringBuf))
+
+		keyringPath := filepath.Join(t.TempDir(), "archive-keyring.gpg")
+		require.NoError(t, os.WriteFile(keyringPath, keyringBuf.Bytes(), 0o644))
+
+		packages := []byte(`Package: hello
+Architecture: amd64
+Version: 2.10-3
+Priority: optional
+Section: devel
+Maintainer: Santiago Vila <sanvila@debian.org>
+Installed-Size: 281
+Depends: libc6 (>= 2.34)
+Filename: pool/main/h/hello/hello_2.10-3_amd64.deb
+Size: 53080
+MD5sum: 3d3c0d4cf2bf0b3d9c1a24c1e1e6a2c9
+Description: example package based on GNU hello
+`)
+
+		// The release file only lists MD5 hashes.
+		var release bytes.Buffer
+		fmt.Fprintf(&release, `Origin: Debian
+Label: Debian
+Suite: stable
+Codename: bookworm
+Date: Sat, 10 Feb 2024 10:09:13 UTC
+Architectures: amd64
+Components: main
+Description: Debian 12.5 Released 10 February 2024
+MD5Sum:
+ %x %d main/binary-amd64/Packages
+`, md5.Sum(packages), len(packages))
+
+		var inRelease bytes.Buffer
+		w, err := clearsign.Encode(&inRelease, entity.PrivateKey, nil)
+		require.NoError(t, err)
+		_, err = w.Write(release.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
 
-	require.Len(t, componentPackages, 63408)
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debian/dists/stable/InRelease", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(inRelease.Bytes())
+		})
+		mux.HandleFunc("/debian/dists/stable/main/binary-amd64/Packages", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(packages)
+		})
 
-	require.NotEqual(t, time.Time{}, lastUpdated)
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+
+		conf := latestrecipe.SourceConfig{
+			URL:      srv.URL + "/debian",
+			SignedBy: keyringPath,
+		}
+
+		s, err := source.NewSource(ctx, conf)
+		require.NoError(t, err)
+
+		_, err = s.Components(ctx, arch.MustParse("amd64"))
+		require.ErrorContains(t, err, "weak hashes")
+
+		conf.AllowWeakHashes = true
+		s, err = source.NewSource(ctx, conf)
+		require.NoError(t, err)
+
+		components, err := s.Components(ctx, arch.MustParse("amd64"))
+		require.NoError(t, err)
+		require.Len(t, components, 1)
+
+		componentPackages, _, err := components[0].Packages(ctx)
+		require.NoError(t, err)
+		require.Len(t, componentPackages, 1)
+	})
 }
 
 type runMirrorResult struct {
@@ -116,3 +218,140 @@ func runDebianMirror(ctx context.Context, result chan runMirrorResult) {
 		return
 	}
 }
+
+func TestUbuntuSource(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	ctx := context.Background()
+
+	entity, err := openpgp.NewEntity("Ubuntu Archive Automatic Signing Key", "", "ftpmaster@ubuntu.com", nil)
+	require.NoError(t, err)
+
+	// Ubuntu distributes its archive keyring in the binary format.
+	var keyringBuf bytes.Buffer
+	require.NoError(t, entity.Serialize(&keyringBuf))
+
+	keyringPath := filepath.Join(t.TempDir(), "ubuntu-archive-keyring.gpg")
+	require.NoError(t, os.WriteFile(keyringPath, keyringBuf.Bytes(), 0o644))
+
+	packages := []byte(`Package: hello
+Architecture: amd64
+Version: 2.10-3build1
+Priority: optional
+Section: devel
+Origin: Ubuntu
+Maintainer: Ubuntu Developers <ubuntu-devel-discuss@lists.ubuntu.com>
+Installed-Size: 112
+Depends: libc6 (>= 2.34)
+Filename: pool/main/h/hello/hello_2.10-3build1_amd64.deb
+Size: 28456
+MD5sum: 3d3c0d4cf2bf0b3d9c1a24c1e1e6a2c9
+SHA256: 4f4bb20bd2d4fe1f1f2d0cf9e3e59a6f3bf1b0f7cdf2e3b26a1a36c4ad3d31d4
+SHA512: 6b7e1f1f0a0c8f7e5b4c1d3d6e1b9a57bb8a3e9d0c2e1f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f
+Description: example package based on GNU hello
+`)
+
+	var compressedPackages bytes.Buffer
+	gw := gzip.NewWriter(&compressedPackages)
+	_, err = gw.Write(packages)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	// Ubuntu release files list MD5Sum, SHA1 and SHA256 hashes.
+	release := func() []byte {
+		var buf bytes.Buffer
+
+		fmt.Fprintf(&buf, `Origin: Ubuntu
+Label: Ubuntu
+Suite: noble
+Version: 24.04
+Codename: noble
+Date: Thu, 25 Apr 2024 15:10:33 UTC
+Architectures: amd64 i386
+Components: main restricted universe multiverse
+Description: Ubuntu Noble 24.04
+`)
+
+		files := map[string][]byte{
+			"main/binary-amd64/Packages.gz": compressedPackages.Bytes(),
+			"main/binary-amd64/Packages":    packages,
+		}
+
+		var names []string
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		buf.WriteString("MD5Sum:\n")
+		for _, name := range names {
+			fmt.Fprintf(&buf, " %x %d %s\n", md5.Sum(files[name]), len(files[name]), name)
+		}
+
+		buf.WriteString("SHA256:\n")
+		for _, name := range names {
+			fmt.Fprintf(&buf, " %x %d %s\n", sha256.Sum256(files[name]), len(files[name]), name)
+		}
+
+		var signed bytes.Buffer
+		w, err := clearsign.Encode(&signed, entity.PrivateKey, nil)
+		require.NoError(t, err)
+		_, err = w.Write(buf.Bytes())
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		return signed.Bytes()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ubuntu/dists/noble/InRelease", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(release())
+	})
+	mux.HandleFunc("/ubuntu/dists/noble/main/binary-amd64/Packages.gz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(compressedPackages.Bytes())
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	s, err := source.NewSource(ctx, latestrecipe.SourceConfig{
+		URL:           srv.URL + "/ubuntu",
+		SignedBy:      keyringPath,
+		Distribution:  "noble",
+		Components:    []string{"main", "universe"},
+		Architectures: []string{"amd64", "i386"},
+	})
+	require.NoError(t, err)
+
+	t.Run("Components", func(t *testing.T) {
+		components, err := s.Components(ctx, arch.MustParse("amd64"))
+		require.NoError(t, err)
+
+		// Ubuntu does not publish separate indices for architecture independent packages.
+		require.Len(t, components, 2)
+		require.Equal(t, "main", components[0].Name)
+		require.Equal(t, "amd64", components[0].Arch.String())
+		require.Equal(t, "universe", components[1].Name)
+
+		require.Equal(t, hashreader.SHA256, components[0].Checksums["Packages.gz"].Algorithm)
+
+		componentPackages, _, err := components[0].Packages(ctx)
+		require.NoError(t, err)
+
+		require.Len(t, componentPackages, 1)
+		require.Equal(t, "hello", componentPackages[0].Name)
+		require.Equal(t, srv.URL+"/ubuntu/pool/main/h/hello/hello_2.10-3build1_amd64.deb", componentPackages[0].URLs[0])
+
+		checksum, err := hashreader.Strongest(componentPackages[0].Checksums(), false)
+		require.NoError(t, err)
+		require.Equal(t, hashreader.SHA512, checksum.Algorithm)
+		require.Equal(t, int64(28456), checksum.Size)
+	})
+
+	t.Run("Ports", func(t *testing.T) {
+		// Other architectures are served from ports.ubuntu.com.
+		components, err := s.Components(ctx, arch.MustParse("arm64"))
+		require.NoError(t, err)
+		require.Empty(t, components)
+	})
+}
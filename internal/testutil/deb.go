@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/immutos/debco/internal/unpack"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+)
+
+// Deb describes a Debian package fixture.
+type Deb struct {
+	// Control is the contents of the control file.
+	Control string
+	// ControlFiles are additional files to include in the control archive
+	// (eg. conffiles, md5sums, or maintainer scripts).
+	ControlFiles map[string]string
+	// Files are the entries of the data archive.
+	Files []DebFile
+	// Compression is the compression used for the control and data archives,
+	// one of "gz", "zst" (as used by Ubuntu) or "" (uncompressed).
+	Compression string
+}
+
+// DebFile is an entry in the data archive of a Debian package fixture.
+type DebFile struct {
+	// Name is the absolute path of the entry.
+	Name string
+	// Mode is the permission bits of the entry (defaults to 0o644 or 0o755).
+	Mode int64
+	// Content is the contents of a regular file.
+	Content string
+	// Linkname is the target of a symlink, if set the entry is a symlink.
+	Linkname string
+	// Dir is true if the entry is a directory.
+	Dir bool
+	// PAXRecords are optional PAX records (eg. extended attributes).
+	PAXRecords map[string]string
+}
+
+// BuildDeb builds a Debian package fixture.
+func BuildDeb(t testing.TB, deb Deb) []byte {
+	t.Helper()
+
+	controlFiles := []DebFile{{Name: "/control", Content: deb.Control}}
+	for name, content := range deb.ControlFiles {
+		mode := int64(0o644)
+		if strings.HasSuffix(name, "inst") || strings.HasSuffix(name, "rm") {
+			mode = 0o755
+		}
+
+		controlFiles = append(controlFiles, DebFile{Name: "/" + name, Content: content, Mode: mode})
+	}
+
+	controlArchive := buildTar(t, controlFiles, deb.Compression)
+	dataArchive := buildTar(t, deb.Files, deb.Compression)
+
+	suffix := ""
+	if deb.Compression != "" {
+		suffix = "." + deb.Compression
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar" + suffix, controlArchive},
+		{"data.tar" + suffix, dataArchive},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, 0, 0, 0, "100644", len(member.data))
+		buf.Write(member.data)
+		if len(member.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// Package describes a minimal amd64 Debian package fixture, that ships the
+// /usr and /usr/bin directories along with its files.
+type Package struct {
+	// Name is the name of the package.
+	Name string
+	// Version is the version of the package (defaults to 1.0).
+	Version string
+	// ExtraControl are additional fields to include in the control file
+	// (eg. "Replaces: foo\n").
+	ExtraControl string
+	// ControlFiles are additional files to include in the control archive
+	// (eg. maintainer scripts).
+	ControlFiles map[string]string
+	// Files are the entries of the data archive.
+	Files []DebFile
+}
+
+// DecompressPackage builds a package fixture and decompresses it into dir.
+func DecompressPackage(t testing.TB, dir string, pkg Package) unpack.Archives {
+	t.Helper()
+
+	version := pkg.Version
+	if version == "" {
+		version = "1.0"
+	}
+
+	packageData := BuildDeb(t, Deb{
+		Control: "Package: " + pkg.Name + "\nVersion: " + version + "\nArchitecture: amd64\n" + pkg.ExtraControl +
+			"Maintainer: Test <test@example.com>\nDescription: test package\n",
+		ControlFiles: pkg.ControlFiles,
+		Files:        append([]DebFile{{Name: "/usr", Dir: true}, {Name: "/usr/bin", Dir: true}}, pkg.Files...),
+	})
+
+	archives, err := unpack.DecompressPackage(bytes.NewReader(packageData), dir, pkg.Name+"_"+version+"_amd64.deb", nil)
+	require.NoError(t, err)
+
+	return *archives
+}
+
+func buildTar(t testing.TB, files []DebFile, compression string) []byte {
+	var buf bytes.Buffer
+
+	var w io.WriteCloser
+	switch compression {
+	case "gz":
+		w = gzip.NewWriter(&buf)
+	case "zst":
+		var err error
+		w, err = zstd.NewWriter(&buf)
+		require.NoError(t, err)
+	case "":
+		w = nopWriteCloser{&buf}
+	default:
+		t.Fatalf("unsupported compression: %s", compression)
+	}
+
+	tw := tar.NewWriter(w)
+
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:       "." + f.Name,
+			Mode:       f.Mode,
+			ModTime:    time.Unix(0, 0),
+			PAXRecords: f.PAXRecords,
+		}
+
+		switch {
+		case f.Dir:
+			hdr.Typeflag = tar.TypeDir
+			if !strings.HasSuffix(hdr.Name, "/") {
+				hdr.Name += "/"
+			}
+			if hdr.Mode == 0 {
+				hdr.Mode = 0o755
+			}
+		case f.Linkname != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = f.Linkname
+			hdr.Mode = 0o777
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(f.Content))
+			if hdr.Mode == 0 {
+				hdr.Mode = 0o644
+			}
+		}
+
+		require.NoError(t, tw.WriteHeader(hdr))
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(f.Content))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
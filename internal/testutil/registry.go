@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package testutil
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Registry is an in-memory stand-in for an OCI distribution registry, that
+// supports the subset of the API needed to push images.
+type Registry struct {
+	// Host is the host (and port) of the registry.
+	Host string
+
+	username, password string
+
+	mu        sync.Mutex
+	uploads   map[string][]byte
+	blobs     map[digest.Digest][]byte
+	manifests map[string]registryManifest
+}
+
+type registryManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// NewRegistry starts a registry stand-in, if a username is provided clients
+// must authenticate with basic authentication.
+func NewRegistry(t testing.TB, username, password string) *Registry {
+	r := &Registry{
+		username:  username,
+		password:  password,
+		uploads:   make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+		manifests: make(map[string]registryManifest),
+	}
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Host = u.Host
+
+	return r
+}
+
+// Manifest returns the manifest (and its media type) for a repository name
+// and tag or digest.
+func (r *Registry) Manifest(name, ref string) ([]byte, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.manifests[name+"@"+ref]
+	return m.content, m.mediaType, ok
+}
+
+// Blob returns the blob with the given digest.
+func (r *Registry) Blob(dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	blob, ok := r.blobs[dgst]
+	return blob, ok
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="debco"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := strings.LastIndex(path, "/blobs/uploads/"); i != -1 {
+		r.serveUpload(w, req, path[:i], strings.TrimPrefix(path[i:], "/blobs/uploads/"))
+	} else if i := strings.LastIndex(path, "/blobs/"); i != -1 {
+		r.serveBlob(w, req, digest.Digest(path[i+len("/blobs/"):]))
+	} else if i := strings.LastIndex(path, "/manifests/"); i != -1 {
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		id = fmt.Sprintf("%d", len(r.uploads)+1)
+		r.uploads[id] = nil
+
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch, http.MethodPut:
+		upload, ok := r.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		data, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		upload = append(upload, data...)
+		r.uploads[id] = upload
+
+		if req.Method == http.MethodPatch {
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+			w.Header().Set("Range", fmt.Sprintf("0-%d", len(upload)-1))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		dgst := digest.Digest(req.URL.Query().Get("digest"))
+		if dgst != digest.FromBytes(upload) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		delete(r.uploads, id)
+		r.blobs[dgst] = upload
+
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, dgst))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, dgst digest.Digest) {
+	blob, ok := r.blobs[dgst]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(blob)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, name, ref string) {
+	switch req.Method {
+	case http.MethodPut:
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dgst := digest.FromBytes(content)
+		m := registryManifest{mediaType: req.Header.Get("Content-Type"), content: content}
+		r.manifests[name+"@"+ref] = m
+		r.manifests[name+"@"+dgst.String()] = m
+
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, dgst))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.manifests[name+"@"+ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.content).String())
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(m.content)))
+		w.WriteHeader(http.StatusOK)
+
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.content)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -21,22 +21,52 @@ package types
 import (
 	debtypes "github.com/dpeckett/deb822/types"
 	"github.com/google/btree"
+	"github.com/immutos/debco/internal/util/hashreader"
 )
 
 // Package represents a Debian package.
 type Package struct {
 	debtypes.Package
+	// SHA512 is the SHA-512 checksum of the package file.
+	SHA512 string `json:",omitempty"`
+	// MD5sum is the (weak) MD5 checksum of the package file.
+	MD5sum string `json:",omitempty"`
+
 	// Additional fields that are not part of the standard control file but are
 	// used internally by debco.
 
 	// URLs is a list of URLs that the package can be downloaded from.
 	URLs []string `json:"-"`
+	// Origin is the origin of the repository the package is from (eg. Debian).
+	Origin string `json:"-"`
+	// Codename is the codename of the release the package is from (eg. bookworm).
+	Codename string `json:"-"`
 	// IsVirtual is true if the package is a virtual package.
 	IsVirtual bool `json:"-"`
 	// Providers lists packages that provide this virtual package.
 	Providers []Package `json:"-"`
 }
 
+// Checksums returns the available checksums of the package file.
+func (p Package) Checksums() []hashreader.Checksum {
+	var checksums []hashreader.Checksum
+	for algorithm, hash := range map[hashreader.Algorithm]string{
+		hashreader.SHA512: p.SHA512,
+		hashreader.SHA256: p.SHA256,
+		hashreader.MD5:    p.MD5sum,
+	} {
+		if hash != "" {
+			checksums = append(checksums, hashreader.Checksum{
+				Algorithm: algorithm,
+				Hash:      hash,
+				Size:      int64(p.Size),
+			})
+		}
+	}
+
+	return checksums
+}
+
 func (p Package) Compare(other Package) int {
 	return p.Package.Compare(other.Package)
 }
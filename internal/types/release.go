@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	debtypes "github.com/dpeckett/deb822/types"
+	"github.com/dpeckett/deb822/types/filehash"
+	"github.com/dpeckett/deb822/types/list"
+	"github.com/immutos/debco/internal/util/hashreader"
+)
+
+// Release represents a Debian repository release file.
+type Release struct {
+	debtypes.Release
+	// SHA512 lists SHA-512 checksums for files in the release.
+	SHA512 list.NewLineDelimited[filehash.FileHash] `json:",omitempty"`
+	// MD5Sum lists (weak) MD5 checksums for files in the release.
+	MD5Sum list.NewLineDelimited[filehash.FileHash] `json:",omitempty"`
+}
+
+// Checksums returns the available checksums for each file in the release.
+func (r *Release) Checksums() map[string][]hashreader.Checksum {
+	checksums := make(map[string][]hashreader.Checksum)
+	for algorithm, hashes := range map[hashreader.Algorithm][]filehash.FileHash{
+		hashreader.SHA512: r.SHA512,
+		hashreader.SHA256: r.SHA256,
+		hashreader.MD5:    r.MD5Sum,
+	} {
+		for _, hash := range hashes {
+			checksums[hash.Filename] = append(checksums[hash.Filename], hashreader.Checksum{
+				Algorithm: algorithm,
+				Hash:      hash.Hash,
+				Size:      hash.Size,
+			})
+		}
+	}
+
+	return checksums
+}
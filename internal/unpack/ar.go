@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	arMagic      = "!<arch>\n"
+	arHeaderSize = 60
+)
+
+// arReader reads the members of an ar(1) archive sequentially, unlike arfs
+// it does not require random access to the underlying archive.
+type arReader struct {
+	r io.Reader
+	// The unread remainder of the current member (and any padding).
+	remaining int64
+	padding   int64
+}
+
+func newARReader(r io.Reader) (*arReader, error) {
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("failed to read ar archive header: %w", err)
+	}
+
+	if string(magic) != arMagic {
+		return nil, errors.New("invalid ar archive header")
+	}
+
+	return &arReader{r: r}, nil
+}
+
+// Next advances to the next member of the archive and returns its name.
+// io.EOF is returned when there are no more members.
+func (ar *arReader) Next() (string, error) {
+	// Skip any unread data in the current member.
+	if _, err := io.CopyN(io.Discard, ar.r, ar.remaining+ar.padding); err != nil {
+		return "", fmt.Errorf("failed to skip ar member: %w", err)
+	}
+
+	header := make([]byte, arHeaderSize)
+	if _, err := io.ReadFull(ar.r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", io.EOF
+		}
+
+		return "", fmt.Errorf("failed to read ar member header: %w", err)
+	}
+
+	if header[58] != 0x60 || header[59] != 0x0A {
+		return "", errors.New("malformed ar member header")
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("failed to parse ar member size: %w", err)
+	}
+
+	ar.remaining = size
+	// Members are aligned to an even offset.
+	ar.padding = size % 2
+
+	// GNU ar terminates names with a slash.
+	return strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/"), nil
+}
+
+// Read reads from the current member of the archive.
+func (ar *arReader) Read(p []byte) (int, error) {
+	if ar.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > ar.remaining {
+		p = p[:ar.remaining]
+	}
+
+	n, err := ar.r.Read(p)
+	ar.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && ar.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
@@ -0,0 +1,283 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/dpeckett/deb822/types"
+)
+
+// ConflictPolicy determines how files shipped by more than one package are
+// handled, when the conflict is not resolved by a Replaces relationship.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyError fails the build (the default).
+	ConflictPolicyError ConflictPolicy = "error"
+	// ConflictPolicyWarn logs a warning and lets the package that is unpacked
+	// last win (like dpkg --force-overwrite).
+	ConflictPolicyWarn ConflictPolicy = "warn"
+)
+
+// ParseConflictPolicy parses a file conflict policy, an empty string is
+// treated as the default policy.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(s); policy {
+	case "":
+		return ConflictPolicyError, nil
+	case ConflictPolicyError, ConflictPolicyWarn:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unsupported file conflict policy: %s", s)
+	}
+}
+
+// FileConflict is a path that is shipped by more than one package.
+type FileConflict struct {
+	// Path is the absolute path of the file.
+	Path string
+	// Packages are the names of the packages that ship the file.
+	Packages []string
+}
+
+// FileConflictError is returned when packages ship conflicting files.
+type FileConflictError struct {
+	Conflicts []FileConflict
+}
+
+func (e *FileConflictError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d conflicting files between packages", len(e.Conflicts))
+
+	// Don't overwhelm the user with thousands of paths.
+	const maxReported = 10
+	for i, c := range e.Conflicts {
+		if i == maxReported {
+			fmt.Fprintf(&sb, "\n  ... and %d more", len(e.Conflicts)-maxReported)
+			break
+		}
+
+		fmt.Fprintf(&sb, "\n  %s (%s)", c.Path, strings.Join(c.Packages, ", "))
+	}
+
+	return sb.String()
+}
+
+// resolveFileConflicts finds paths that are shipped by more than one package
+// and applies dpkg's Replaces semantics. It returns the paths that each
+// package no longer owns and the order in which the data archives should be
+// applied, so that the package that owns a path is always applied last.
+func resolveFileConflicts(pkgs []*types.Package, dataEntries [][]dataArchiveEntry, policy ConflictPolicy) ([]map[string]bool, []int, error) {
+	type owner struct {
+		index int
+		// The path of the entry in the data archive (before any diversion).
+		path    string
+		dir     bool
+		symlink bool
+		md5sum  string
+	}
+
+	// Packages conflict over the location a file is installed at.
+	owners := make(map[string][]owner)
+	for i, entries := range dataEntries {
+		for _, entry := range entries {
+			installedPath := entry.installedPath()
+			owners[installedPath] = append(owners[installedPath], owner{index: i, path: entry.path, dir: entry.dir, symlink: entry.symlink, md5sum: entry.md5sum})
+		}
+	}
+
+	disowned := make([]map[string]bool, len(pkgs))
+	for i := range disowned {
+		disowned[i] = make(map[string]bool)
+	}
+
+	// Edges from each package to the packages that must be applied after it.
+	after := make([]map[int]bool, len(pkgs))
+	for i := range after {
+		after[i] = make(map[int]bool)
+	}
+
+	var conflicts []FileConflict
+	for path, pathOwners := range owners {
+		if len(pathOwners) < 2 {
+			continue
+		}
+
+		for i := 0; i < len(pathOwners); i++ {
+			for j := i + 1; j < len(pathOwners); j++ {
+				a, b := pathOwners[i], pathOwners[j]
+				pkgA, pkgB := pkgs[a.index], pkgs[b.index]
+
+				// Directories can be shared freely, and like dpkg a directory can
+				// share its path with a symlink (eg. /bin on merged /usr systems).
+				// A directory does conflict with a regular file.
+				if (a.dir && (b.dir || b.symlink)) || (b.dir && a.symlink) {
+					continue
+				}
+
+				// Multi-Arch: same packages can share identical files.
+				if a.md5sum != "" && a.md5sum == b.md5sum &&
+					pkgA.Name == pkgB.Name && pkgA.MultiArch == "same" && pkgB.MultiArch == "same" {
+					continue
+				}
+
+				// The replacing package takes ownership of the file (if both
+				// packages replace each other, the last one unpacked wins).
+				winner, loser := b, a
+				switch {
+				case replaces(pkgB, pkgA):
+				case replaces(pkgA, pkgB):
+					winner, loser = a, b
+				default:
+					conflicts = append(conflicts, FileConflict{
+						Path:     path,
+						Packages: []string{pkgA.Name, pkgB.Name},
+					})
+				}
+
+				disowned[loser.index][loser.path] = true
+				after[loser.index][winner.index] = true
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		sort.Slice(conflicts, func(i, j int) bool {
+			return conflicts[i].Path < conflicts[j].Path
+		})
+
+		if policy != ConflictPolicyWarn {
+			return nil, nil, &FileConflictError{Conflicts: conflicts}
+		}
+
+		for _, c := range conflicts {
+			slog.Warn("File is shipped by more than one package",
+				slog.String("path", c.Path), slog.Any("packages", c.Packages))
+		}
+	}
+
+	return disowned, applyOrder(pkgs, after), nil
+}
+
+// applyOrder returns the order in which the data archives should be applied,
+// such that packages are applied after any package they take files from. The
+// existing order is otherwise preserved.
+func applyOrder(pkgs []*types.Package, after []map[int]bool) []int {
+	inDegree := make([]int, len(after))
+	for _, successors := range after {
+		for j := range successors {
+			inDegree[j]++
+		}
+	}
+
+	order := make([]int, 0, len(after))
+	done := make([]bool, len(after))
+	for len(order) < len(after) {
+		next := -1
+		for i := range after {
+			if !done[i] && inDegree[i] == 0 {
+				next = i
+				break
+			}
+		}
+
+		// Packages that take files from each other, the last one wins.
+		if next == -1 {
+			for i := range after {
+				if !done[i] {
+					next = i
+					break
+				}
+			}
+
+			slog.Warn("Packages replace each other, using the default unpack order",
+				slog.String("package", pkgs[next].Name))
+		}
+
+		done[next] = true
+		order = append(order, next)
+		for j := range after[next] {
+			inDegree[j]--
+		}
+	}
+
+	return order
+}
+
+// replaces returns true if pkg declares that it replaces other.
+func replaces(pkg, other *types.Package) bool {
+	for _, rel := range pkg.Replaces.Relations {
+		for _, possi := range rel.Possibilities {
+			if possi.Name != other.Name {
+				// Unversioned replaces can also refer to a virtual package.
+				if possi.Version != nil || !provides(other, possi.Name) {
+					continue
+				}
+
+				return true
+			}
+
+			if possi.Version == nil {
+				return true
+			}
+
+			cmp := other.Version.Compare(possi.Version.Version)
+			switch possi.Version.Operator {
+			case "<<":
+				if cmp < 0 {
+					return true
+				}
+			case "<=":
+				if cmp <= 0 {
+					return true
+				}
+			case "=":
+				if cmp == 0 {
+					return true
+				}
+			case ">=":
+				if cmp >= 0 {
+					return true
+				}
+			case ">>":
+				if cmp > 0 {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func provides(pkg *types.Package, name string) bool {
+	for _, rel := range pkg.Provides.Relations {
+		for _, possi := range rel.Possibilities {
+			if possi.Name == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,216 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// diversion is a dpkg diversion, any package other than the diverting package
+// that ships the file has it installed at the diverted location instead.
+// See: dpkg-divert(1).
+type diversion struct {
+	// The path being diverted.
+	from string
+	// The location the file is diverted to.
+	to string
+	// The package that owns the diversion, empty for a local diversion.
+	pkg string
+}
+
+// divertedPath returns where a file shipped by the named package should be
+// installed.
+func divertedPath(diversions map[string]diversion, pkgName, path string) string {
+	if d, ok := diversions[path]; ok && d.pkg != pkgName {
+		return d.to
+	}
+
+	return path
+}
+
+// parseDiversions statically extracts the diversions added by a maintainer
+// script. Only invocations of dpkg-divert with literal arguments are
+// understood, a warning is logged for any other invocation that (may) add a
+// diversion, as files would silently be installed at the wrong location.
+func parseDiversions(pkgName string, script []byte) []diversion {
+	var diversions []diversion
+
+	// Join any continuation lines.
+	script = bytes.ReplaceAll(script, []byte("\\\n"), []byte(" "))
+
+	for _, line := range strings.Split(string(script), "\n") {
+		if !strings.Contains(line, "dpkg-divert") {
+			continue
+		}
+
+		tokens, err := shlex.Split(line)
+		if err != nil {
+			slog.Warn("Unable to apply diversion offline, failed to parse maintainer script line",
+				slog.String("package", pkgName), slog.String("line", strings.TrimSpace(line)), slog.Any("error", err))
+			continue
+		}
+
+		for i, token := range tokens {
+			if filepath.Base(token) != "dpkg-divert" {
+				continue
+			}
+
+			// Collect the arguments up until the end of the command.
+			var args []string
+			for _, arg := range tokens[i+1:] {
+				if isCommandSeparator(arg) || isRedirection(arg) {
+					break
+				}
+
+				if trimmed := strings.TrimRight(arg, ";"); trimmed != arg {
+					args = append(args, trimmed)
+					break
+				}
+
+				args = append(args, arg)
+			}
+
+			d, err := parseDpkgDivertArgs(pkgName, args)
+			if err != nil {
+				slog.Warn("Unable to apply diversion offline, unsupported dpkg-divert invocation",
+					slog.String("package", pkgName), slog.String("line", strings.TrimSpace(line)), slog.Any("error", err))
+				continue
+			}
+
+			// Not adding a diversion.
+			if d == nil {
+				continue
+			}
+
+			diversions = append(diversions, *d)
+		}
+	}
+
+	return diversions
+}
+
+// parseDpkgDivertArgs returns the diversion added by a dpkg-divert
+// invocation, or nil if it doesn't add a diversion (eg. --list). An error is
+// returned if the arguments can't be evaluated offline.
+func parseDpkgDivertArgs(pkgName string, args []string) (*diversion, error) {
+	d := diversion{pkg: pkgName}
+
+	var files []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// Variables and command substitutions can't be evaluated offline.
+		if strings.ContainsAny(arg, "$`") {
+			return nil, fmt.Errorf("argument %q is not a literal", arg)
+		}
+
+		name, value, hasValue := strings.Cut(arg, "=")
+		takeValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("option %s requires a value", name)
+			}
+			if strings.ContainsAny(args[i+1], "$`") {
+				return "", fmt.Errorf("value of option %s %q is not a literal", name, args[i+1])
+			}
+
+			i++
+			return args[i], nil
+		}
+
+		switch name {
+		case "--add", "--rename", "--no-rename", "--quiet":
+		case "--remove", "--list", "--listpackage", "--truename", "--test", "--help", "--version":
+			// Not adding a diversion.
+			return nil, nil
+		case "--local":
+			d.pkg = ""
+		case "--package":
+			pkg, err := takeValue()
+			if err != nil {
+				return nil, err
+			}
+			d.pkg = pkg
+		case "--divert":
+			to, err := takeValue()
+			if err != nil {
+				return nil, err
+			}
+			d.to = to
+		case "--admindir", "--instdir", "--root":
+			if _, err := takeValue(); err != nil {
+				return nil, err
+			}
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return nil, fmt.Errorf("unsupported option %s", arg)
+			}
+
+			files = append(files, arg)
+		}
+	}
+
+	if len(files) != 1 || !strings.HasPrefix(files[0], "/") {
+		return nil, fmt.Errorf("expected a single absolute path, got %q", files)
+	}
+
+	d.from = files[0]
+	if d.to == "" {
+		d.to = d.from + ".distrib"
+	}
+
+	return &d, nil
+}
+
+func isCommandSeparator(token string) bool {
+	switch token {
+	case ";", "&", "&&", "||", "|":
+		return true
+	default:
+		return false
+	}
+}
+
+func isRedirection(token string) bool {
+	token = strings.TrimLeft(token, "0123456789&")
+	return strings.HasPrefix(token, ">") || strings.HasPrefix(token, "<")
+}
+
+// writeDiversions returns the contents of the dpkg diversions database.
+func writeDiversions(diversions []diversion) []byte {
+	var buf bytes.Buffer
+	for _, d := range diversions {
+		pkg := d.pkg
+		if pkg == "" {
+			pkg = ":"
+		}
+
+		fmt.Fprintf(&buf, "%s\n%s\n%s\n", d.from, d.to, pkg)
+	}
+
+	return buf.Bytes()
+}
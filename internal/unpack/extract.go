@@ -0,0 +1,227 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExtractArchive extracts a root filesystem archive (eg. one written by
+// MergeArchives) into dstDir. Ownership, device nodes and extended attributes
+// are restored on a best effort basis, as they generally require root.
+func ExtractArchive(ctx context.Context, archivePath, dstDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(dstDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	type dirTimes struct {
+		path    string
+		modTime time.Time
+	}
+
+	// Directory modification times are set last, as extracting their
+	// contents would otherwise change them.
+	var dirs []dirTimes
+
+	tr := tar.NewReader(f)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		path, err := extractPath(dstDir, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		if err := extractEntry(tr, hdr, dstDir, path); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: path, modTime: hdr.ModTime})
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].modTime, dirs[i].modTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", dirs[i].path, err)
+		}
+	}
+
+	return nil
+}
+
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dstDir, path string) error {
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			_ = f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+
+		return extractOwnership(path, hdr, os.Lchown)
+	case tar.TypeLink:
+		target, err := extractPath(dstDir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+
+		// Hard links share the metadata of their target.
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(syscall.S_IFIFO)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			devMode = syscall.S_IFCHR
+		case tar.TypeBlock:
+			devMode = syscall.S_IFBLK
+		}
+
+		dev := int((hdr.Devmajor&0xfff)<<8 | hdr.Devminor&0xff | (hdr.Devminor&^0xff)<<12)
+		if err := syscall.Mknod(path, devMode|uint32(mode), dev); err != nil {
+			if errors.Is(err, syscall.EPERM) {
+				slog.Debug("Skipping device node", slog.String("path", hdr.Name))
+				return nil
+			}
+
+			return err
+		}
+	default:
+		slog.Debug("Skipping unsupported entry", slog.String("path", hdr.Name))
+		return nil
+	}
+
+	if err := extractOwnership(path, hdr, os.Chown); err != nil {
+		return err
+	}
+
+	// Chmod after chown, as chown clears the setuid and setgid bits.
+	if err := os.Chmod(path, mode|tarModeBits(hdr.Mode)); err != nil {
+		return err
+	}
+
+	for key, value := range normaliseXattrs(hdr.PAXRecords) {
+		name, ok := strings.CutPrefix(key, schilyXattrPrefix)
+		if !ok {
+			continue
+		}
+
+		if err := syscall.Setxattr(path, name, []byte(value), 0); err != nil {
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.ENOTSUP) {
+				slog.Debug("Skipping extended attribute",
+					slog.String("path", hdr.Name), slog.String("name", name))
+				continue
+			}
+
+			slog.Warn("Failed to set extended attribute",
+				slog.String("path", hdr.Name), slog.String("name", name), slog.Any("error", err))
+		}
+	}
+
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+// extractOwnership sets the owner of the path, ignoring permission errors
+// when not running as root.
+func extractOwnership(path string, hdr *tar.Header, chown func(string, int, int) error) error {
+	if err := chown(path, hdr.Uid, hdr.Gid); err != nil && !errors.Is(err, syscall.EPERM) {
+		return err
+	}
+
+	return nil
+}
+
+// tarModeBits converts the setuid, setgid and sticky bits of a tar mode to
+// their os.FileMode equivalents.
+func tarModeBits(mode int64) os.FileMode {
+	var fm os.FileMode
+	if mode&04000 != 0 {
+		fm |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		fm |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		fm |= os.ModeSticky
+	}
+
+	return fm
+}
+
+// extractPath returns the path of an archive entry within dstDir, rejecting
+// any entries that would escape it.
+func extractPath(dstDir, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "./")))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid path in archive: %s", name)
+	}
+
+	return filepath.Join(dstDir, rel), nil
+}
@@ -0,0 +1,235 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathFilter is a dpkg path filter, it determines whether files matching the
+// pattern are installed. See: dpkg(1) --path-exclude.
+type PathFilter struct {
+	// Include is true for a path-include filter, or false for a path-exclude
+	// filter.
+	Include bool
+	// Pattern is a shell glob matched against the absolute path of each file.
+	// Unlike filepath.Match, wildcards also match the path separator.
+	Pattern string
+}
+
+// String returns the filter in the form used by dpkg configuration files.
+func (f PathFilter) String() string {
+	if f.Include {
+		return "path-include=" + f.Pattern
+	}
+
+	return "path-exclude=" + f.Pattern
+}
+
+// DpkgConfig returns a dpkg configuration file (eg. for /etc/dpkg/dpkg.cfg.d)
+// containing the filters, so that they continue to apply to packages that are
+// installed later on.
+func DpkgConfig(filters []PathFilter) []byte {
+	var sb strings.Builder
+	for _, f := range filters {
+		sb.WriteString(f.String() + "\n")
+	}
+
+	return []byte(sb.String())
+}
+
+func validatePathFilters(filters []PathFilter) error {
+	for _, f := range filters {
+		if !strings.HasPrefix(f.Pattern, "/") {
+			return fmt.Errorf("path filter pattern must be absolute: %s", f.Pattern)
+		}
+
+		if err := validateGlob(f.Pattern); err != nil {
+			return fmt.Errorf("invalid path filter pattern %q: %w", f.Pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// filterSkips returns true if the data archive entry should not be installed.
+// Like dpkg, the last matching filter wins, and directories (or symlinks)
+// are kept if a more specific include filter could match files beneath them.
+func filterSkips(filters []PathFilter, entry dataArchiveEntry) bool {
+	var skip bool
+	for _, f := range filters {
+		if matched, _ := fnmatch(f.Pattern, entry.path); matched {
+			skip = !f.Include
+		}
+	}
+
+	if skip && (entry.dir || entry.symlink) {
+		for _, f := range filters {
+			if !f.Include {
+				continue
+			}
+
+			prefix := f.Pattern
+			if i := strings.IndexAny(prefix, "*?[\\"); i >= 0 {
+				prefix = prefix[:i]
+			}
+			prefix = strings.TrimRight(prefix, "/")
+
+			if strings.HasPrefix(entry.path, prefix) {
+				return false
+			}
+		}
+	}
+
+	return skip
+}
+
+// fnmatch matches a name against a shell glob, as fnmatch(3) does without any
+// flags (ie. wildcards also match '/' and leading periods).
+func fnmatch(pattern, name string) (bool, error) {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Collapse consecutive stars.
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+
+			if len(pattern) == 0 {
+				return true, nil
+			}
+
+			for i := 0; i <= len(name); i++ {
+				matched, err := fnmatch(pattern, name[i:])
+				if err != nil || matched {
+					return matched, err
+				}
+			}
+
+			return false, nil
+		case '?':
+			if len(name) == 0 {
+				return false, nil
+			}
+
+			pattern, name = pattern[1:], name[1:]
+		case '[':
+			if len(name) == 0 {
+				return false, nil
+			}
+
+			end, matched, err := matchBracket(pattern, name[0])
+			if err != nil {
+				return false, err
+			}
+
+			if !matched {
+				return false, nil
+			}
+
+			pattern, name = pattern[end:], name[1:]
+		case '\\':
+			if len(pattern) < 2 {
+				return false, fmt.Errorf("trailing backslash")
+			}
+
+			if len(name) == 0 || name[0] != pattern[1] {
+				return false, nil
+			}
+
+			pattern, name = pattern[2:], name[1:]
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false, nil
+			}
+
+			pattern, name = pattern[1:], name[1:]
+		}
+	}
+
+	return len(name) == 0, nil
+}
+
+func validateGlob(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i+1 == len(pattern) {
+				return fmt.Errorf("trailing backslash")
+			}
+			i++
+		case '[':
+			end, _, err := matchBracket(pattern[i:], 0)
+			if err != nil {
+				return err
+			}
+			i += end - 1
+		}
+	}
+
+	return nil
+}
+
+// matchBracket matches a character against a bracket expression at the start
+// of the pattern, returning the length of the expression.
+func matchBracket(pattern string, c byte) (int, bool, error) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '!' || pattern[i] == '^') {
+		negate = true
+		i++
+	}
+
+	var matched bool
+	for first := true; ; first = false {
+		if i >= len(pattern) {
+			return 0, false, fmt.Errorf("unterminated bracket expression")
+		}
+
+		// A closing bracket is literal if it is the first character.
+		if pattern[i] == ']' && !first {
+			i++
+			break
+		}
+
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		i++
+
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			hi = pattern[i+1]
+			if hi == '\\' && i+2 < len(pattern) {
+				i++
+				hi = pattern[i+1]
+			}
+			i += 2
+		}
+
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+
+	return i, matched != negate, nil
+}
@@ -0,0 +1,510 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/debco/internal/progress"
+)
+
+// rootFSEntry is an entry in the merged root filesystem archive.
+type rootFSEntry struct {
+	hdr *tar.Header
+	// The index of the archive the entry was read from.
+	archive int
+	// The offset of the entries file data within the archive.
+	offset int64
+}
+
+// MergeArchives merges the given tar archives (eg. the dpkg database archive
+// followed by the data archives in the order they are to be applied) into a
+// single normalised root filesystem archive at dstPath. Later archives take
+// precedence over earlier ones, as if they were extracted on top of each
+// other. The entries are sorted by path, modification times are clamped to
+// sourceDateEpoch and owners are canonicalised (and recorded by numeric id
+// only), so the result does not depend on the order or origin of the
+// archives.
+func MergeArchives(ctx context.Context, dstPath string, archivePaths []string, sourceDateEpoch time.Time) error {
+	progressBars := progress.New(ctx)
+	defer progressBars.Shutdown()
+
+	bar := progressBars.AddBar(progress.PhaseUnpack, "Merging", int64(len(archivePaths)))
+
+	err := mergeArchives(dstPath, archivePaths, sourceDateEpoch, bar.Increment)
+	bar.Done(err)
+
+	return err
+}
+
+func mergeArchives(dstPath string, archivePaths []string, sourceDateEpoch time.Time, archiveIndexed func()) error {
+	// Entries are copied out of the archives in a different order than they
+	// are read, which requires random access to the decompressed archives.
+	archivePaths, cleanup, err := decompressArchives(filepath.Dir(dstPath), archivePaths)
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]*rootFSEntry)
+	for i, archivePath := range archivePaths {
+		if err := indexArchive(entries, i, archivePath, sourceDateEpoch); err != nil {
+			return fmt.Errorf("failed to read archive %s: %w", filepath.Base(archivePath), err)
+		}
+
+		archiveIndexed()
+	}
+
+	var paths []string
+	for path := range entries {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var sorted, hardLinks []*rootFSEntry
+	for _, path := range paths {
+		if entries[path].hdr.Typeflag == tar.TypeLink {
+			// Hard links must come after their targets.
+			hardLinks = append(hardLinks, entries[path])
+			continue
+		}
+
+		sorted = append(sorted, entries[path])
+	}
+
+	for _, e := range hardLinks {
+		if target, ok := entries[e.hdr.Linkname]; !ok || target.hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("hard link %s has no target %s", e.hdr.Name, e.hdr.Linkname)
+		}
+	}
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return fmt.Errorf("failed to create root filesystem archive: %w", err)
+	}
+	defer dst.Close()
+
+	archiveFiles := make([]*os.File, len(archivePaths))
+	defer func() {
+		for _, f := range archiveFiles {
+			if f != nil {
+				_ = f.Close()
+			}
+		}
+	}()
+
+	for i, archivePath := range archivePaths {
+		archiveFiles[i], err = os.Open(archivePath)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+	}
+
+	owners, err := canonicalOwners(entries, archiveFiles)
+	if err != nil {
+		return fmt.Errorf("failed to read canonical owners: %w", err)
+	}
+
+	tw := tar.NewWriter(dst)
+	for _, e := range append(sorted, hardLinks...) {
+		hdr := normaliseHeader(e.hdr, sourceDateEpoch, owners)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write %s: %w", hdr.Name, err)
+		}
+
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(archiveFiles[e.archive], e.offset, hdr.Size)); err != nil {
+				return fmt.Errorf("failed to write %s: %w", hdr.Name, err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write root filesystem archive: %w", err)
+	}
+
+	return dst.Close()
+}
+
+// indexArchive records the entries of an archive (and where their data is
+// located), as if the archive were extracted on top of the previous archives.
+// Paths are resolved through any symlinks to directories (eg. /bin on merged
+// /usr systems), and a directory that is replaced by anything other than a
+// directory loses its contents. Like dpkg, a directory in the archive does not
+// replace an existing symlink to a directory.
+func indexArchive(entries map[string]*rootFSEntry, index int, path string, sourceDateEpoch time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	or := &offsetReader{f: f}
+	tr := tar.NewReader(or)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeGNUSparse || hasSparseRecords(hdr) {
+			return fmt.Errorf("sparse files are not supported: %s", hdr.Name)
+		}
+
+		name := strings.TrimPrefix(archivePath(hdr.Name), "/")
+		if name == "." {
+			// The root directory is created by BuildKit.
+			continue
+		}
+
+		dir, err := resolveDir(entries, filepath.Dir(name))
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", hdr.Name, err)
+		}
+		name = filepath.Join(dir, filepath.Base(name))
+
+		if hdr.Typeflag == tar.TypeLink {
+			linkname := strings.TrimPrefix(archivePath(hdr.Linkname), "/")
+
+			linkDir, err := resolveDir(entries, filepath.Dir(linkname))
+			if err != nil {
+				return fmt.Errorf("failed to resolve %s: %w", hdr.Linkname, err)
+			}
+			hdr.Linkname = filepath.Join(linkDir, filepath.Base(linkname))
+		}
+		hdr.Name = name
+
+		if existing, ok := entries[name]; ok {
+			switch {
+			case existing.hdr.Typeflag == tar.TypeSymlink && hdr.Typeflag == tar.TypeDir:
+				if target, err := resolveDir(entries, name); err == nil {
+					createDirs(entries, index, target, sourceDateEpoch)
+					continue
+				}
+			case existing.hdr.Typeflag == tar.TypeDir && hdr.Typeflag != tar.TypeDir:
+				removeTree(entries, name)
+			}
+		}
+
+		createDirs(entries, index, dir, sourceDateEpoch)
+
+		entries[name] = &rootFSEntry{
+			hdr:     hdr,
+			archive: index,
+			offset:  or.n,
+		}
+	}
+
+	return nil
+}
+
+// maxSymlinks is the maximum number of symlinks followed when resolving a
+// path (the same limit as Linux).
+const maxSymlinks = 40
+
+// resolveDir returns the path of a directory with any symlinks resolved. An
+// error is returned if a component of the path is not a directory (or a
+// symlink to one). Missing components are not an error, they will be created.
+func resolveDir(entries map[string]*rootFSEntry, dir string) (string, error) {
+	return resolveDirLinks(entries, dir, 0)
+}
+
+func resolveDirLinks(entries map[string]*rootFSEntry, dir string, links int) (string, error) {
+	if dir == "." {
+		return dir, nil
+	}
+
+	parent, err := resolveDirLinks(entries, filepath.Dir(dir), links)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := filepath.Join(parent, filepath.Base(dir))
+
+	e, ok := entries[resolved]
+	if !ok {
+		return resolved, nil
+	}
+
+	switch e.hdr.Typeflag {
+	case tar.TypeDir:
+		return resolved, nil
+	case tar.TypeSymlink:
+		if links >= maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", resolved)
+		}
+
+		target := e.hdr.Linkname
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(resolved), target)
+		}
+
+		return resolveDirLinks(entries, strings.TrimPrefix(archivePath(target), "/"), links+1)
+	default:
+		return "", fmt.Errorf("not a directory: %s", resolved)
+	}
+}
+
+// createDirs creates dir (and any of its parents) if they don't exist yet.
+func createDirs(entries map[string]*rootFSEntry, index int, dir string, sourceDateEpoch time.Time) {
+	// Don't record the zero time, it would be written as the year 1.
+	modTime := sourceDateEpoch
+	if modTime.IsZero() {
+		modTime = time.Unix(0, 0)
+	}
+
+	for ; dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := entries[dir]; ok {
+			break
+		}
+
+		entries[dir] = &rootFSEntry{
+			hdr: &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir,
+				Mode:     0o755,
+				ModTime:  modTime,
+			},
+			archive: index,
+		}
+	}
+}
+
+// removeTree removes an entry and, if it is a directory, everything in it.
+func removeTree(entries map[string]*rootFSEntry, name string) {
+	delete(entries, name)
+
+	prefix := name + "/"
+	for path := range entries {
+		if strings.HasPrefix(path, prefix) {
+			delete(entries, path)
+		}
+	}
+}
+
+// decompressArchives returns the paths of decompressed copies (written into
+// dir) of any compressed archives (eg. data archives as stored in packages).
+// Uncompressed archives are used as is. The returned function removes the
+// decompressed copies.
+func decompressArchives(dir string, archivePaths []string) ([]string, func(), error) {
+	var decompressedPaths []string
+	cleanup := func() {
+		for _, path := range decompressedPaths {
+			_ = os.Remove(path)
+		}
+	}
+
+	archivePaths = slices.Clone(archivePaths)
+	for i, archivePath := range archivePaths {
+		if filepath.Ext(archivePath) == ".tar" {
+			continue
+		}
+
+		f, err := os.CreateTemp(dir, strings.TrimSuffix(filepath.Base(archivePath), filepath.Ext(archivePath))+".*")
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("failed to create decompressed archive: %w", err)
+		}
+		decompressedPaths = append(decompressedPaths, f.Name())
+
+		err = decompressArchive(archivePath, f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("failed to decompress archive %s: %w", filepath.Base(archivePath), err)
+		}
+
+		archivePaths[i] = f.Name()
+	}
+
+	return archivePaths, cleanup, nil
+}
+
+func decompressArchive(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dr, err := uncompr.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	_, err = io.Copy(w, dr)
+	return err
+}
+
+func hasSparseRecords(hdr *tar.Header) bool {
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// owners maps user and group names to their canonical ids.
+type owners struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+// canonicalOwners returns the ids of root and of the users and groups that
+// have static ids allocated by base-passwd (if it is being installed). Like
+// dpkg, files are owned by the named user and group, so the ids recorded in
+// the archives (which depend on the machine the package was built on) are
+// only used for other users and groups.
+func canonicalOwners(entries map[string]*rootFSEntry, archiveFiles []*os.File) (*owners, error) {
+	o := &owners{
+		users:  map[string]int{"root": 0},
+		groups: map[string]int{"root": 0},
+	}
+
+	for path, ids := range map[string]map[string]int{
+		"usr/share/base-passwd/passwd.master": o.users,
+		"usr/share/base-passwd/group.master":  o.groups,
+	} {
+		e, ok := entries[path]
+		if !ok || e.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := io.ReadAll(io.NewSectionReader(archiveFiles[e.archive], e.offset, e.hdr.Size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		// The fields are name:password:id:...
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Split(line, ":")
+			if len(fields) < 3 {
+				continue
+			}
+
+			id, err := strconv.Atoi(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid id in %s: %s", path, line)
+			}
+
+			ids[fields[0]] = id
+		}
+	}
+
+	return o, nil
+}
+
+// normaliseHeader returns a copy of the header with any metadata that would
+// make the archive irreproducible removed, and with canonical owners.
+func normaliseHeader(hdr *tar.Header, sourceDateEpoch time.Time, owners *owners) *tar.Header {
+	modTime := hdr.ModTime.Truncate(time.Second)
+	if !sourceDateEpoch.IsZero() && modTime.After(sourceDateEpoch) {
+		modTime = sourceDateEpoch.Truncate(time.Second)
+	}
+
+	typeflag := hdr.Typeflag
+	if typeflag == tar.TypeRegA {
+		typeflag = tar.TypeReg
+	}
+
+	name := hdr.Name
+	if typeflag == tar.TypeDir {
+		name += "/"
+	}
+
+	uid := hdr.Uid
+	if id, ok := owners.users[hdr.Uname]; ok {
+		uid = id
+	}
+
+	gid := hdr.Gid
+	if id, ok := owners.groups[hdr.Gname]; ok {
+		gid = id
+	}
+
+	normalised := &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Linkname: hdr.Linkname,
+		Mode:     hdr.Mode,
+		Uid:      uid,
+		Gid:      gid,
+		ModTime:  modTime.UTC(),
+		Devmajor: hdr.Devmajor,
+		Devminor: hdr.Devminor,
+	}
+
+	if typeflag == tar.TypeReg {
+		normalised.Size = hdr.Size
+	}
+
+	// Extended attributes (eg. file capabilities) are preserved.
+	for key, value := range normaliseXattrs(hdr.PAXRecords) {
+		if strings.HasPrefix(key, schilyXattrPrefix) {
+			if normalised.PAXRecords == nil {
+				normalised.PAXRecords = make(map[string]string)
+			}
+
+			normalised.PAXRecords[key] = value
+		}
+	}
+
+	return normalised
+}
+
+// offsetReader tracks the current offset within a file. It also implements
+// io.Seeker so that tar.Reader can skip over file data.
+type offsetReader struct {
+	f *os.File
+	n int64
+}
+
+func (or *offsetReader) Read(p []byte) (int, error) {
+	n, err := or.f.Read(p)
+	or.n += int64(n)
+	return n, err
+}
+
+func (or *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := or.f.Seek(offset, whence)
+	if err == nil {
+		or.n = n
+	}
+	return n, err
+}
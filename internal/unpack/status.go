@@ -0,0 +1,206 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/dpeckett/deb822/types"
+)
+
+// newConffileFlag is the hash recorded by dpkg for a conffile that has not
+// been configured yet.
+const newConffileFlag = "newconffile"
+
+// statusFieldOrder is the order in which dpkg writes the fields it knows
+// about to the status database. Any other fields are written afterwards, in
+// the order they appeared in the control file.
+// See: lib/dpkg/parse.c in the dpkg sources.
+var statusFieldOrder = []string{
+	"Package",
+	"Essential",
+	"Protected",
+	"Status",
+	"Priority",
+	"Section",
+	"Installed-Size",
+	"Origin",
+	"Maintainer",
+	"Bugs",
+	"Architecture",
+	"Multi-Arch",
+	"Source",
+	"Version",
+	"Config-Version",
+	"Replaces",
+	"Provides",
+	"Depends",
+	"Pre-Depends",
+	"Recommends",
+	"Suggests",
+	"Breaks",
+	"Conflicts",
+	"Enhances",
+	"Conffiles",
+	"Filename",
+	"Size",
+	"MD5sum",
+	"MSDOS-Filename",
+	"Description",
+	"Triggers-Pending",
+	"Triggers-Awaited",
+}
+
+// controlField is a field from a control file, the value is kept verbatim
+// (including any continuation lines).
+type controlField struct {
+	name  string
+	value string
+}
+
+// conffile is an entry in the Conffiles field of the status database.
+type conffile struct {
+	path string
+	hash string
+	// Optional flags (eg. "remove-on-upgrade").
+	flags []string
+}
+
+// parseControlFields parses the fields of a control file, preserving their
+// order and formatting.
+func parseControlFields(data []byte) ([]controlField, error) {
+	var fields []controlField
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t")
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			// The control file should only contain a single stanza.
+			if len(fields) > 0 {
+				return fields, nil
+			}
+		case strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("unexpected continuation line: %q", line)
+			}
+
+			fields[len(fields)-1].value += "\n" + line
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("malformed control file line: %q", line)
+			}
+
+			fields = append(fields, controlField{
+				name:  strings.TrimSpace(name),
+				value: strings.TrimSpace(value),
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// parseConffiles parses the conffiles file from a control archive.
+func parseConffiles(data []byte) []conffile {
+	var conffiles []conffile
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Flags precede the path (eg. "remove-on-upgrade /etc/foo").
+		conffiles = append(conffiles, conffile{
+			path:  fields[len(fields)-1],
+			flags: fields[:len(fields)-1],
+		})
+	}
+
+	return conffiles
+}
+
+// writeStatusStanza writes the status database entry for a package in the
+// same format as dpkg.
+func writeStatusStanza(buf *bytes.Buffer, pkg *types.Package, fields []controlField, status string, conffiles []conffile) {
+	values := make(map[string]string, len(fields))
+	for _, f := range fields {
+		values[strings.ToLower(f.name)] = f.value
+	}
+
+	known := make(map[string]bool, len(statusFieldOrder))
+	for _, name := range statusFieldOrder {
+		known[strings.ToLower(name)] = true
+
+		var value string
+		switch name {
+		case "Status":
+			value = status
+		case "Essential", "Protected":
+			// dpkg only records these fields when they are set.
+			if values[strings.ToLower(name)] == "yes" {
+				value = "yes"
+			}
+		case "Multi-Arch":
+			if value = values["multi-arch"]; value == "no" {
+				value = ""
+			}
+		case "Version":
+			// Normalize the version (eg. drop a zero epoch).
+			value = pkg.Version.String()
+		case "Conffiles":
+			if len(conffiles) == 0 {
+				continue
+			}
+
+			buf.WriteString("Conffiles:\n")
+			for _, cf := range conffiles {
+				fmt.Fprintf(buf, " %s %s", cf.path, cf.hash)
+				for _, flag := range cf.flags {
+					buf.WriteString(" " + flag)
+				}
+				buf.WriteString("\n")
+			}
+			continue
+		default:
+			value = values[strings.ToLower(name)]
+		}
+
+		if value != "" {
+			fmt.Fprintf(buf, "%s: %s\n", name, value)
+		}
+	}
+
+	for _, f := range fields {
+		if !known[strings.ToLower(f.name)] && f.value != "" {
+			fmt.Fprintf(buf, "%s: %s\n", f.name, f.value)
+		}
+	}
+
+	buf.WriteString("\n")
+}
@@ -19,8 +19,12 @@
 package unpack
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -28,41 +32,42 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 
-	"github.com/dpeckett/archivefs/arfs"
 	"github.com/dpeckett/archivefs/memfs"
 	"github.com/dpeckett/archivefs/tarfs"
 	"github.com/dpeckett/deb822"
 	"github.com/dpeckett/deb822/types"
 	"github.com/dpeckett/uncompr"
-	"github.com/vbauerster/mpb/v8"
-	"github.com/vbauerster/mpb/v8/decor"
+	"github.com/immutos/debco/internal/progress"
 	"golang.org/x/sync/errgroup"
 )
 
-func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string, []string, error) {
-	var progressOutput io.Writer = os.Stdout
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
-		progressOutput = io.Discard
-	}
+// Archives are the extracted control archive and data archive of a Debian
+// package, as produced by DecompressPackage.
+type Archives struct {
+	// DataArchivePath is the path to the data archive. It is stored as it was
+	// in the package (eg. compressed with xz), BuildKit decompresses it when
+	// it is copied into the root filesystem.
+	DataArchivePath string
+	// The control archive and the data archive file list, both read while
+	// the package was being decompressed.
+	control     *controlArchive
+	dataEntries []dataArchiveEntry
+}
 
-	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
-	defer progress.Shutdown()
+// Unpack decompresses the given Debian packages and assembles a dpkg database
+// archive. It returns the path to the dpkg database archive and the paths to
+// the data archives of each package.
+func Unpack(ctx context.Context, tempDir string, packagePaths []string, opts Options) (string, []string, error) {
+	progressBars := progress.New(ctx)
+	defer progressBars.Shutdown()
 
 	// Decompress the packages in parallel.
-	controlArchivePaths := make([]string, len(packagePaths))
-	dataArchivePaths := make([]string, len(packagePaths))
+	archives := make([]Archives, len(packagePaths))
 	{
-		bar := progress.AddBar(int64(len(packagePaths)),
-			mpb.PrependDecorators(
-				decor.Name("Decompressing: "),
-				decor.CountersNoUnit("%d / %d"),
-			),
-			mpb.AppendDecorators(
-				decor.Percentage(),
-			),
-		)
+		bar := progressBars.AddBar(progress.PhaseDecompress, "Decompressing", int64(len(packagePaths)))
 
 		var g errgroup.Group
 		g.SetLimit(runtime.NumCPU())
@@ -74,110 +79,343 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 			g.Go(func() error {
 				defer bar.Increment()
 
-				controlArchivePath, dataArchivePath, err := decompressPackage(tempDir, packagePath)
+				packageArchives, err := decompressPackage(tempDir, packagePath)
 				if err != nil {
 					return fmt.Errorf("failed to decompress package %s: %w", filepath.Base(packagePath), err)
 				}
 
-				controlArchivePaths[i] = controlArchivePath
-				dataArchivePaths[i] = dataArchivePath
+				archives[i] = *packageArchives
 
 				return nil
 			})
 		}
 
 		err := g.Wait()
+		bar.Done(err)
 
 		if err != nil {
-			bar.Abort(true)
-		} else {
-			bar.SetTotal(bar.Current(), true)
+			return "", nil, fmt.Errorf("failed to decompress packages: %w", err)
 		}
-		bar.Wait()
+	}
 
-		if err != nil {
-			return "", nil, fmt.Errorf("failed to decompress packages: %w", err)
+	return CreateDatabase(ctx, tempDir, archives, opts)
+}
+
+// Options configures how the dpkg database is created.
+type Options struct {
+	// FileConflicts determines how file conflicts between packages are handled.
+	// Defaults to ConflictPolicyError.
+	FileConflicts ConflictPolicy
+	// PathFilters determine which files are installed, the last matching
+	// filter wins. Files are installed by default.
+	PathFilters []PathFilter
+}
+
+// CreateDatabase assembles a dpkg database archive from already decompressed
+// packages (eg. those produced by DecompressPackage). It returns the path to
+// the dpkg database archive and the paths to the data archives of each package.
+func CreateDatabase(ctx context.Context, tempDir string, archives []Archives, opts Options) (string, []string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+
+	op := progress.Start(progress.PhaseUnpack, "Creating dpkg database")
+	dpkgDatabaseArchivePath, dataArchivePaths, err := createDatabase(tempDir, archives, opts)
+	op.Done(err)
+
+	return dpkgDatabaseArchivePath, dataArchivePaths, err
+}
+
+type controlArchiveEntry struct {
+	name    string
+	content []byte
+	mode    fs.FileMode
+}
+
+// controlArchive is the extracted contents of a control archive.
+type controlArchive struct {
+	pkg *types.Package
+	// The fields of the control file, in their original order.
+	fields []controlField
+	// Files from the control archive that belong in the dpkg database.
+	files []controlArchiveEntry
+}
+
+// dataArchiveEntry is an entry in a data archive.
+type dataArchiveEntry struct {
+	// The absolute path of the entry, as recorded in the dpkg files list.
+	path string
+	// The hex encoded MD5 hash of regular files.
+	md5sum string
+	// Whether the entry is a directory.
+	dir bool
+	// Whether the entry is a symlink.
+	symlink bool
+	// The absolute path of the target of a hard link.
+	hardLink string
+	// The path the entry is installed at if it has been diverted.
+	divertedTo string
+	// Whether the entry has extended attributes in the libarchive format.
+	libarchiveXattrs bool
+}
+
+// installedPath returns the path the entry is installed at.
+func (e *dataArchiveEntry) installedPath() string {
+	if e.divertedTo != "" {
+		return e.divertedTo
+	}
+
+	return e.path
+}
+
+func createDatabase(tempDir string, archives []Archives, opts Options) (string, []string, error) {
+	type extractedPackage struct {
+		control     *controlArchive
+		dataEntries []dataArchiveEntry
+	}
+
+	// The archives may be shared with other databases, so the file lists are
+	// copied before they are modified.
+	extracted := make([]extractedPackage, len(archives))
+	for i, a := range archives {
+		if a.control == nil {
+			return "", nil, fmt.Errorf("package %s was not decompressed", filepath.Base(a.DataArchivePath))
+		}
+
+		extracted[i] = extractedPackage{
+			control:     a.control,
+			dataEntries: slices.Clone(a.dataEntries),
 		}
 	}
 
-	dpkgDatabaseFS := memfs.New()
-	if err := dpkgDatabaseFS.MkdirAll("var/lib/dpkg/info", 0o755); err != nil {
-		return "", nil, fmt.Errorf("failed to create dpkg info directory: %w", err)
+	if err := validatePathFilters(opts.PathFilters); err != nil {
+		return "", nil, err
 	}
 
-	var packages []types.Package
-	{
-		bar := progress.AddBar(int64(len(packagePaths)),
-			mpb.PrependDecorators(
-				decor.Name("Extracting: "),
-				decor.CountersNoUnit("%d / %d"),
-			),
-			mpb.AppendDecorators(
-				decor.Percentage(),
-			),
-		)
-
-		for i := range packagePaths {
-			slog.Debug("Extracting control archive",
-				slog.String("path", filepath.Base(controlArchivePaths[i])))
-
-			controlArchiveFile, err := os.Open(controlArchivePaths[i])
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+	// Drop any files excluded by the path filters.
+	skipped := make([]map[string]bool, len(extracted))
+	for i, e := range extracted {
+		skipped[i] = make(map[string]bool)
+		for _, entry := range e.dataEntries {
+			// Hard links can't outlive their targets.
+			if filterSkips(opts.PathFilters, entry) || (entry.hardLink != "" && skipped[i][entry.hardLink]) {
+				skipped[i][entry.path] = true
+			}
+		}
 
-				return "", nil, fmt.Errorf("failed to open control archive file: %w", err)
+		extracted[i].dataEntries = slices.DeleteFunc(e.dataEntries, func(entry dataArchiveEntry) bool {
+			return skipped[i][entry.path]
+		})
+	}
+
+	// Collect the diversions declared by the packages maintainer scripts.
+	diversions := make(map[string]diversion)
+	var diversionsList []diversion
+	for _, e := range extracted {
+		for _, cf := range e.control.files {
+			if cf.name != "preinst" {
+				continue
 			}
 
-			pkg, err := extractControlArchive(dpkgDatabaseFS, controlArchiveFile)
-			_ = controlArchiveFile.Close()
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+			// Preinst scripts are run after every package has been unpacked, so
+			// dpkg-maintscript-helper (eg. dir_to_symlink, or conffile moves)
+			// would find the package's own files already in place.
+			if usesMaintscriptHelper(cf.content) {
+				return "", nil, fmt.Errorf("package %s is not supported, its preinst script uses dpkg-maintscript-helper", e.control.pkg.Name)
+			}
+
+			for _, d := range parseDiversions(e.control.pkg.Name, cf.content) {
+				if existing, ok := diversions[d.from]; ok {
+					if existing != d {
+						slog.Warn("Ignoring conflicting diversion",
+							slog.String("path", d.from), slog.String("package", e.control.pkg.Name))
+					}
+					continue
+				}
 
-				return "", nil, fmt.Errorf("failed to extract control archive: %w", err)
+				diversions[d.from] = d
+				diversionsList = append(diversionsList, d)
 			}
+		}
+	}
 
-			pkg.Status = []string{"install", "ok", "unpacked"}
-			packages = append(packages, *pkg)
+	// Files shipped by packages other than the diverting package are installed
+	// at the diverted location.
+	renames := make([]map[string]string, len(extracted))
+	for i, e := range extracted {
+		for j, entry := range e.dataEntries {
+			if entry.dir {
+				continue
+			}
 
-			// Get the list of files in the data archive.
-			dataArchiveFile, err := os.Open(dataArchivePaths[i])
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+			if to := divertedPath(diversions, e.control.pkg.Name, entry.path); to != entry.path {
+				slog.Debug("Diverting file", slog.String("package", e.control.pkg.Name),
+					slog.String("path", entry.path), slog.String("divertedTo", to))
 
-				return "", nil, fmt.Errorf("failed to open data archive file: %w", err)
+				if renames[i] == nil {
+					renames[i] = make(map[string]string)
+				}
+				renames[i][entry.path] = to
+				extracted[i].dataEntries[j].divertedTo = to
 			}
+		}
+	}
 
-			filesList, err := getDataArchiveFileList(dataArchiveFile)
-			_ = dataArchiveFile.Close()
-			if err != nil {
-				bar.Abort(true)
-				bar.Wait()
+	// Rewrite any data archives that have had files excluded or diverted, or
+	// that have extended attributes BuildKit would otherwise drop.
+	archives = slices.Clone(archives)
+	for i := range archives {
+		libarchiveXattrs := slices.ContainsFunc(extracted[i].dataEntries, func(entry dataArchiveEntry) bool {
+			return entry.libarchiveXattrs
+		})
 
-				return "", nil, fmt.Errorf("failed to get data archive file list: %w", err)
+		if len(skipped[i]) == 0 && len(renames[i]) == 0 && !libarchiveXattrs {
+			continue
+		}
+
+		basename, _, _ := strings.Cut(filepath.Base(archives[i].DataArchivePath), "_data.tar")
+		rewrittenArchivePath := filepath.Join(tempDir, basename+"_data_rewritten.tar")
+		if err := rewriteDataArchive(archives[i].DataArchivePath, rewrittenArchivePath, skipped[i], renames[i]); err != nil {
+			return "", nil, fmt.Errorf("failed to rewrite data archive of package %s: %w", extracted[i].control.pkg.Name, err)
+		}
+
+		archives[i].DataArchivePath = rewrittenArchivePath
+	}
+
+	pkgs := make([]*types.Package, len(extracted))
+	dataEntries := make([][]dataArchiveEntry, len(extracted))
+	for i, e := range extracted {
+		pkgs[i] = e.control.pkg
+		dataEntries[i] = e.dataEntries
+	}
+
+	// Detect files shipped by more than one package.
+	disowned, applyOrder, err := resolveFileConflicts(pkgs, dataEntries, opts.FileConflicts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i := range extracted {
+		// Remove any files that have been taken over by another package.
+		extracted[i].dataEntries = slices.DeleteFunc(slices.Clone(extracted[i].dataEntries), func(entry dataArchiveEntry) bool {
+			return disowned[i][entry.path]
+		})
+	}
+
+	dpkgDatabaseFS := memfs.New()
+	if err := dpkgDatabaseFS.MkdirAll("var/lib/dpkg/info", 0o755); err != nil {
+		return "", nil, fmt.Errorf("failed to create dpkg info directory: %w", err)
+	}
+
+	// Keep honouring the path filters when packages are installed later on.
+	if len(opts.PathFilters) > 0 {
+		if err := dpkgDatabaseFS.MkdirAll("etc/dpkg/dpkg.cfg.d", 0o755); err != nil {
+			return "", nil, fmt.Errorf("failed to create dpkg configuration directory: %w", err)
+		}
+
+		if err := dpkgDatabaseFS.WriteFile("etc/dpkg/dpkg.cfg.d/debco", DpkgConfig(opts.PathFilters), 0o644); err != nil {
+			return "", nil, fmt.Errorf("failed to write dpkg path filters: %w", err)
+		}
+	}
+
+	// The version of the dpkg database layout.
+	if err := dpkgDatabaseFS.WriteFile("var/lib/dpkg/info/format", []byte("1\n"), 0o644); err != nil {
+		return "", nil, fmt.Errorf("failed to write dpkg database format: %w", err)
+	}
+
+	for _, e := range extracted {
+		pkg := e.control.pkg
+
+		// Multi-Arch: same packages are qualified by their architecture.
+		infoName := pkg.Name
+		if pkg.MultiArch == "same" {
+			infoName = pkg.Name + ":" + pkg.Architecture.String()
+		}
+
+		infoPath := func(name string) string {
+			return filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.%s", infoName, name))
+		}
+
+		// Add relevant files from the control archive to the dpkg database.
+		var hasMD5Sums bool
+		for _, cf := range e.control.files {
+			if err := dpkgDatabaseFS.WriteFile(infoPath(cf.name), cf.content, cf.mode); err != nil {
+				return "", nil, fmt.Errorf("failed to write file in control archive: %w", err)
 			}
 
-			if len(filesList) > 0 {
-				// Write the files list to the dpkg info directory.
-				filesListPath := filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.list", pkg.Name))
-				if err := dpkgDatabaseFS.WriteFile(filesListPath, []byte(strings.Join(filesList, "\n")+"\n"), 0o644); err != nil {
-					bar.Abort(true)
-					bar.Wait()
+			hasMD5Sums = hasMD5Sums || cf.name == "md5sums"
+		}
 
-					return "", nil, fmt.Errorf("failed to write files list: %w", err)
+		// Like dpkg, generate the md5sums file if the package doesn't provide one.
+		if !hasMD5Sums {
+			var md5sums strings.Builder
+			for _, entry := range e.dataEntries {
+				if entry.md5sum != "" {
+					fmt.Fprintf(&md5sums, "%s  %s\n", entry.md5sum, strings.TrimPrefix(entry.path, "/"))
 				}
 			}
 
-			bar.Increment()
+			if md5sums.Len() > 0 {
+				if err := dpkgDatabaseFS.WriteFile(infoPath("md5sums"), []byte(md5sums.String()), 0o644); err != nil {
+					return "", nil, fmt.Errorf("failed to write md5sums: %w", err)
+				}
+			}
+		}
+
+		if len(e.dataEntries) > 0 {
+			var filesList strings.Builder
+			for _, entry := range e.dataEntries {
+				filesList.WriteString(entry.path + "\n")
+			}
+
+			// Write the files list to the dpkg info directory.
+			if err := dpkgDatabaseFS.WriteFile(infoPath("list"), []byte(filesList.String()), 0o644); err != nil {
+				return "", nil, fmt.Errorf("failed to write files list: %w", err)
+			}
 		}
 	}
 
+	if len(diversionsList) > 0 {
+		if err := dpkgDatabaseFS.WriteFile("var/lib/dpkg/diversions", writeDiversions(diversionsList), 0o644); err != nil {
+			return "", nil, fmt.Errorf("failed to write diversions: %w", err)
+		}
+	}
+
+	// Data archives are applied in order, so packages that replace files in
+	// other packages need to come later.
+	dataArchivePaths := make([]string, len(archives))
+	for i, index := range applyOrder {
+		dataArchivePaths[i] = archives[index].DataArchivePath
+	}
+
+	// dpkg sorts the status database by package name and architecture.
+	sorted := slices.Clone(extracted)
+	slices.SortStableFunc(sorted, func(a, b extractedPackage) int {
+		if cmp := strings.Compare(a.control.pkg.Name, b.control.pkg.Name); cmp != 0 {
+			return cmp
+		}
+
+		return strings.Compare(a.control.pkg.Architecture.String(), b.control.pkg.Architecture.String())
+	})
+
 	// Write the dpkg status file.
 	var buf bytes.Buffer
-	if err := deb822.Marshal(&buf, packages); err != nil {
-		return "", nil, fmt.Errorf("failed to marshal packages: %w", err)
+	for _, e := range sorted {
+		var conffiles []conffile
+		for _, cf := range e.control.files {
+			if cf.name == "conffiles" {
+				conffiles = parseConffiles(cf.content)
+			}
+		}
+
+		// Like dpkg --unpack, conffiles are not hashed until they are configured.
+		// The conffiles are extracted in place (rather than as .dpkg-new files),
+		// which dpkg --configure handles by hashing the installed file.
+		for i := range conffiles {
+			conffiles[i].hash = newConffileFlag
+		}
+
+		writeStatusStanza(&buf, e.control.pkg, e.control.fields, "install ok unpacked", conffiles)
 	}
 
 	if err := dpkgDatabaseFS.WriteFile("var/lib/dpkg/status", buf.Bytes(), 0o644); err != nil {
@@ -197,124 +435,203 @@ func Unpack(ctx context.Context, tempDir string, packagePaths []string) (string,
 	return dpkgDatabaseArchiveFile.Name(), dataArchivePaths, nil
 }
 
-func decompressPackage(tempDir string, packagePath string) (string, string, error) {
+func decompressPackage(tempDir string, packagePath string) (*Archives, error) {
 	pf, err := os.Open(packagePath)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open package file: %w", err)
+		return nil, fmt.Errorf("failed to open package file: %w", err)
 	}
 	defer pf.Close()
 
-	debFS, err := arfs.Open(pf)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to parse debian package: %w", err)
-	}
+	return DecompressPackage(pf, tempDir, filepath.Base(packagePath), nil)
+}
 
-	// Check that the package is a debian 2.0 format package.
-	debianBinaryFile, err := debFS.Open("debian-binary")
+// DecompressPackage reads a Debian package from r in a single pass, so it can
+// be decompressed while it is still being downloaded. The control archive is
+// extracted in memory (in parallel with reading the rest of the package). The
+// data archive is written into dir exactly as it is stored in the package,
+// the file list (and file hashes) being read from it as it is written. The
+// name is the filename of the package and is used to name the data archive.
+//
+// The package is always read to the end, after which verify (if not nil) is
+// called, eg. to check the checksum of a download. Until verify succeeds the
+// data archive only exists under a temporary name, which is removed on any
+// error, so nothing from a corrupt (or tampered with) package is left behind.
+func DecompressPackage(r io.Reader, dir, name string, verify func() error) (_ *Archives, err error) {
+	ar, err := newARReader(r)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open debian-binary file: %w", err)
+		return nil, fmt.Errorf("failed to parse debian package: %w", err)
 	}
 
-	debianBinary, err := io.ReadAll(debianBinaryFile)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read debian-binary file: %w", err)
-	}
+	basePath := filepath.Join(dir, strings.TrimSuffix(name, ".deb"))
 
-	if string(debianBinary) != "2.0\n" {
-		return "", "", fmt.Errorf("unsupported debian package version: %s", debianBinary)
-	}
+	var a Archives
+	var partialDataArchivePath string
+	defer func() {
+		// Don't leave partially written archives behind.
+		if err != nil && partialDataArchivePath != "" {
+			_ = os.Remove(partialDataArchivePath)
+		}
+	}()
 
-	// Look for control and data archives in the debian package.
-	entries, err := debFS.ReadDir(".")
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read debian package: %w", err)
-	}
+	var g errgroup.Group
+	defer func() {
+		_ = g.Wait()
+	}()
+
+	var seenDebianBinary, seenControlArchive bool
+	for {
+		memberName, err := ar.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
 
-	var controlArchivePath, dataArchivePath string
-	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), "control.tar") {
-			controlArchivePath = entry.Name()
-		} else if strings.HasPrefix(entry.Name(), "data.tar") {
-			dataArchivePath = entry.Name()
+			return nil, fmt.Errorf("failed to read debian package: %w", err)
+		}
+
+		switch {
+		case memberName == "debian-binary":
+			// Check that the package is a debian 2.0 format package.
+			debianBinary, err := io.ReadAll(ar)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read debian-binary file: %w", err)
+			}
+
+			if string(debianBinary) != "2.0\n" {
+				return nil, fmt.Errorf("unsupported debian package version: %s", debianBinary)
+			}
+
+			seenDebianBinary = true
+		case strings.HasPrefix(memberName, "control.tar"):
+			slog.Debug("Decompressing control archive",
+				slog.String("package", name),
+				slog.String("controlArchivePath", memberName))
+
+			controlArchiveData, err := decompressMember(ar)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decompress control archive: %w", err)
+			}
+
+			seenControlArchive = true
+			g.Go(func() error {
+				control, err := extractControlArchive(bytes.NewReader(controlArchiveData))
+				if err != nil {
+					return fmt.Errorf("failed to extract control archive: %w", err)
+				}
+
+				a.control = control
+
+				return nil
+			})
+		case strings.HasPrefix(memberName, "data.tar"):
+			slog.Debug("Decompressing data archive",
+				slog.String("package", name),
+				slog.String("dataArchivePath", memberName))
+
+			a.DataArchivePath = basePath + "_" + memberName
+
+			f, err := os.CreateTemp(dir, filepath.Base(a.DataArchivePath)+".*.partial")
+			if err != nil {
+				return nil, fmt.Errorf("failed to create data archive: %w", err)
+			}
+			partialDataArchivePath = f.Name()
+
+			a.dataEntries, err = writeDataArchive(ar, f)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to write data archive: %w", err)
+			}
 		}
 	}
-	if controlArchivePath == "" {
-		return "", "", fmt.Errorf("failed to find control archive in debian package")
+
+	if !seenDebianBinary {
+		return nil, fmt.Errorf("failed to find debian-binary file in debian package")
 	}
-	if dataArchivePath == "" {
-		return "", "", fmt.Errorf("failed to find data archive in debian package")
+	if !seenControlArchive {
+		return nil, fmt.Errorf("failed to find control archive in debian package")
 	}
-
-	// Decompress the control archive.
-	slog.Debug("Decompressing control archive",
-		slog.String("packagePath", packagePath),
-		slog.String("controlArchivePath", filepath.Base(controlArchivePath)))
-
-	controlArchive, err := debFS.Open(controlArchivePath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to open control archive: %w", err)
+	if a.DataArchivePath == "" {
+		return nil, fmt.Errorf("failed to find data archive in debian package")
 	}
 
-	dr, err := uncompr.NewReader(controlArchive)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to decompress control archive: %w", err)
+	if err := g.Wait(); err != nil {
+		return nil, err
 	}
 
-	decompressedControlArchivePath := filepath.Join(tempDir, strings.TrimSuffix(filepath.Base(packagePath), ".deb")+"_control.tar")
+	// Read the package completely so that any trailing data is verified too.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, fmt.Errorf("failed to read debian package: %w", err)
+	}
 
-	decompressedControlArchive, err := os.Create(decompressedControlArchivePath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create decompressed control archive: %w", err)
+	if verify != nil {
+		if err := verify(); err != nil {
+			return nil, err
+		}
 	}
-	defer decompressedControlArchive.Close()
 
-	if _, err := io.Copy(decompressedControlArchive, dr); err != nil {
-		return "", "", fmt.Errorf("failed to write to decompressed control archive: %w", err)
+	if err := os.Rename(partialDataArchivePath, a.DataArchivePath); err != nil {
+		return nil, fmt.Errorf("failed to rename data archive: %w", err)
 	}
 
-	// Decompress the data archive.
-	slog.Debug("Decompressing data archive",
-		slog.String("packagePath", packagePath),
-		slog.String("dataArchivePath", filepath.Base(dataArchivePath)))
+	return &a, nil
+}
 
-	dataArchive, err := debFS.Open(dataArchivePath)
+// decompressMember returns the decompressed contents of a (small) member of
+// a Debian package.
+func decompressMember(r io.Reader) ([]byte, error) {
+	dr, err := uncompr.NewReader(r)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to open data archive: %w", err)
+		return nil, err
 	}
+	defer dr.Close()
+
+	return io.ReadAll(dr)
+}
+
+// writeDataArchive copies a (possibly compressed) data archive to w, and
+// returns its entries, which are read from the data as it is copied.
+func writeDataArchive(r io.Reader, w io.Writer) ([]dataArchiveEntry, error) {
+	tr := io.TeeReader(r, w)
 
-	dr, err = uncompr.NewReader(dataArchive)
+	dr, err := uncompr.NewReader(tr)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to decompress data archive: %w", err)
+		return nil, err
 	}
+	defer dr.Close()
 
-	decompressedDataArchivePath := filepath.Join(tempDir, strings.TrimSuffix(filepath.Base(packagePath), ".deb")+"_data.tar")
-
-	decompressedDataArchive, err := os.Create(decompressedDataArchivePath)
+	entries, err := readDataArchive(dr)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create decompressed data archive: %w", err)
+		return nil, err
 	}
 
-	if _, err := io.Copy(decompressedDataArchive, dr); err != nil {
-		return "", "", fmt.Errorf("failed to write to decompressed data archive: %w", err)
+	// Copy any remaining data (eg. the end of archive padding).
+	if _, err := io.Copy(io.Discard, tr); err != nil {
+		return nil, err
 	}
 
-	return decompressedControlArchivePath, decompressedDataArchivePath, nil
+	return entries, nil
 }
 
-func extractControlArchive(dpkgDatabaseFS *memfs.FS, controlArchiveFile *os.File) (*types.Package, error) {
-	controlFS, err := tarfs.Open(controlArchiveFile)
+func extractControlArchive(r io.ReaderAt) (*controlArchive, error) {
+	controlFS, err := tarfs.Open(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open control archive: %w", err)
 	}
 
-	controlFile, err := controlFS.Open("control")
+	controlData, err := fs.ReadFile(controlFS, "control")
 	if err != nil {
-		return nil, fmt.Errorf("failed to open control file: %w", err)
+		return nil, fmt.Errorf("failed to read control file: %w", err)
+	}
+
+	fields, err := parseControlFields(controlData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control file: %w", err)
 	}
-	defer controlFile.Close()
 
 	// Parse the control file.
-	decoder, err := deb822.NewDecoder(controlFile, nil)
+	decoder, err := deb822.NewDecoder(bytes.NewReader(controlData), nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create control file decoder: %w", err)
 	}
@@ -329,7 +646,8 @@ func extractControlArchive(dpkgDatabaseFS *memfs.FS, controlArchiveFile *os.File
 		return nil, fmt.Errorf("failed to read control archive: %w", err)
 	}
 
-	// Iterate over the files in the control archive and add relevant files to the dpkg database.
+	// Collect the files in the control archive that belong in the dpkg database.
+	var controlFiles []controlArchiveEntry
 	for _, file := range files {
 		if file.Name() == "control" {
 			continue
@@ -351,38 +669,152 @@ func extractControlArchive(dpkgDatabaseFS *memfs.FS, controlArchiveFile *os.File
 			return nil, fmt.Errorf("failed to get file info from control archive: %w", err)
 		}
 
-		if err := dpkgDatabaseFS.WriteFile(filepath.Join("var/lib/dpkg/info", fmt.Sprintf("%s.%s", pkg.Name, file.Name())),
-			content, fi.Mode()); err != nil {
-			return nil, fmt.Errorf("failed to write file in control archive: %w", err)
+		controlFiles = append(controlFiles, controlArchiveEntry{
+			name:    file.Name(),
+			content: content,
+			mode:    fi.Mode(),
+		})
+	}
+
+	return &controlArchive{
+		pkg:    &pkg,
+		fields: fields,
+		files:  controlFiles,
+	}, nil
+}
+
+// readDataArchive returns the entries of a data archive in archive order, the
+// same order that dpkg records them in.
+func readDataArchive(r io.Reader) ([]dataArchiveEntry, error) {
+	var entries []dataArchiveEntry
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return nil, err
+		}
+
+		entry := dataArchiveEntry{
+			path:             archivePath(hdr.Name),
+			dir:              hdr.Typeflag == tar.TypeDir,
+			symlink:          hdr.Typeflag == tar.TypeSymlink,
+			libarchiveXattrs: hasLibarchiveXattrs(hdr.PAXRecords),
 		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			entry.hardLink = archivePath(hdr.Linkname)
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			h := md5.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, fmt.Errorf("failed to hash %s: %w", hdr.Name, err)
+			}
+
+			entry.md5sum = hex.EncodeToString(h.Sum(nil))
+		}
+
+		entries = append(entries, entry)
 	}
 
-	return &pkg, nil
+	return entries, nil
 }
 
-func getDataArchiveFileList(dataArchiveFile *os.File) ([]string, error) {
-	// Open the data archive as a tar archive.
-	dataFS, err := tarfs.Open(dataArchiveFile)
+// rewriteDataArchive writes a decompressed copy of a data archive to dstPath,
+// without the skipped entries, and with renamed entries (and hard links to them) moved to
+// their new locations (eg. due to a diversion). Extended attributes are
+// converted to the SCHILY format. The original data archive is
+// left untouched as it may be shared with other databases.
+func rewriteDataArchive(srcPath, dstPath string, skip map[string]bool, renames map[string]string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open data archive: %w", err)
+	}
+	defer f.Close()
+
+	src, err := uncompr.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to decompress data archive: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open data archive: %w", err)
+		return fmt.Errorf("failed to create data archive: %w", err)
 	}
+	defer dst.Close()
 
-	var filesList []string
-	err = fs.WalkDir(dataFS, ".", func(path string, d fs.DirEntry, err error) error {
+	rename := func(name string) string {
+		if to, ok := renames[archivePath(name)]; ok {
+			return "." + to
+		}
+
+		return name
+	}
+
+	tr := tar.NewReader(src)
+	tw := tar.NewWriter(dst)
+	for {
+		hdr, err := tr.Next()
 		if err != nil {
-			return err
+			if errors.Is(err, io.EOF) {
+				break
+			}
+
+			return fmt.Errorf("failed to read data archive: %w", err)
 		}
-		if path == "." {
-			return nil
+
+		if skip[archivePath(hdr.Name)] {
+			continue
 		}
 
-		filesList = append(filesList, path)
+		hdr.Name = rename(hdr.Name)
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rename(hdr.Linkname)
+		}
+		hdr.PAXRecords = normaliseXattrs(hdr.PAXRecords)
 
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to walk data archive: %w", err)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write data archive: %w", err)
+		}
+
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("failed to write data archive: %w", err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write data archive: %w", err)
+	}
+
+	return dst.Close()
+}
+
+// archivePath returns the absolute path of a data archive entry, in the form
+// recorded in the dpkg files list.
+func archivePath(name string) string {
+	path := "/" + strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	if path == "/" {
+		path = "/."
+	}
+
+	return path
+}
+
+// usesMaintscriptHelper returns whether a maintainer script invokes
+// dpkg-maintscript-helper (ignoring comments).
+func usesMaintscriptHelper(script []byte) bool {
+	for _, line := range strings.Split(string(script), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if strings.Contains(line, "dpkg-maintscript-helper") {
+			return true
+		}
 	}
 
-	return filesList, nil
+	return false
 }
@@ -19,13 +19,27 @@
 package unpack_test
 
 import (
+	"archive/tar"
+	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/dpeckett/archivefs/arfs"
 	"github.com/dpeckett/archivefs/tarfs"
+	"github.com/dpeckett/uncompr"
+	"github.com/immutos/debco/internal/progress"
 	"github.com/immutos/debco/internal/testutil"
 	"github.com/immutos/debco/internal/unpack"
 	"github.com/stretchr/testify/require"
@@ -43,12 +57,12 @@ func TestUnpack(t *testing.T) {
 		filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"),
 	}
 
-	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths)
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(ctx, tempDir, packagePaths, unpack.Options{})
 	require.NoError(t, err)
 
 	require.Len(t, dataArchivePaths, 2)
-	require.Equal(t, "base-files_12.4+deb12u5_amd64_data.tar", filepath.Base(dataArchivePaths[0]))
-	require.Equal(t, "base-passwd_3.6.1_amd64_data.tar", filepath.Base(dataArchivePaths[1]))
+	require.Equal(t, "base-files_12.4+deb12u5_amd64_data.tar.xz", filepath.Base(dataArchivePaths[0]))
+	require.Equal(t, "base-passwd_3.6.1_amd64_data.tar.xz", filepath.Base(dataArchivePaths[1]))
 
 	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
 	require.NoError(t, err)
@@ -78,6 +92,7 @@ func TestUnpack(t *testing.T) {
 		"var/lib",
 		"var/lib/dpkg",
 		"var/lib/dpkg/info",
+		"var/lib/dpkg/info/format",
 		"var/lib/dpkg/info/base-files.conffiles",
 		"var/lib/dpkg/info/base-files.list",
 		"var/lib/dpkg/info/base-files.md5sums",
@@ -93,3 +108,1062 @@ func TestUnpack(t *testing.T) {
 
 	require.ElementsMatch(t, expectedFilesList, filesList)
 }
+
+func TestDecompressPackage(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	packageData, err := os.ReadFile(filepath.Join(testutil.Root(), "testdata/debs/base-passwd_3.6.1_amd64.deb"))
+	require.NoError(t, err)
+
+	// Make sure the package can be decompressed from a stream with short reads.
+	archives, err := unpack.DecompressPackage(iotest.OneByteReader(bytes.NewReader(packageData)), tempDir, "base-passwd_3.6.1_amd64.deb", nil)
+	require.NoError(t, err)
+
+	// The data archive is stored as it is in the package.
+	require.Equal(t, filepath.Join(tempDir, "base-passwd_3.6.1_amd64_data.tar.xz"), archives.DataArchivePath)
+
+	dataFS := openDataArchive(t, archives.DataArchivePath)
+
+	_, err = fs.Stat(dataFS, "usr/sbin/update-passwd")
+	require.NoError(t, err)
+
+	// Nothing else is written to disk.
+	dirEntries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Len(t, dirEntries, 1)
+
+	t.Run("Checksum Mismatch", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		var written int
+		_, err := unpack.DecompressPackage(bytes.NewReader(packageData), tempDir, "base-passwd_3.6.1_amd64.deb", func() error {
+			dirEntries, err := os.ReadDir(tempDir)
+			require.NoError(t, err)
+			written = len(dirEntries)
+
+			return errors.New("checksum mismatch")
+		})
+		require.ErrorContains(t, err, "checksum mismatch")
+
+		// The package had been fully written (under a temporary name) before it
+		// was verified.
+		require.Equal(t, 1, written)
+
+		dirEntries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Empty(t, dirEntries)
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		_, err := unpack.DecompressPackage(bytes.NewReader(packageData[:len(packageData)/2]), tempDir, "truncated.deb", nil)
+		require.Error(t, err)
+
+		dirEntries, err := os.ReadDir(tempDir)
+		require.NoError(t, err)
+		require.Empty(t, dirEntries)
+	})
+
+	// Ubuntu compresses package members with zstd.
+	t.Run("Ubuntu", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		packageData := testutil.BuildDeb(t, testutil.Deb{
+			Control: `Package: hello
+Version: 2.10-3build1
+Architecture: amd64
+Maintainer: Ubuntu Developers <ubuntu-devel-discuss@lists.ubuntu.com>
+Description: example package based on GNU hello
+`,
+			Files: []testutil.DebFile{
+				{Name: "/usr", Dir: true},
+				{Name: "/usr/bin", Dir: true},
+				{Name: "/usr/bin/hello", Content: "#!/bin/sh\necho hello\n", Mode: 0o755},
+			},
+			Compression: "zst",
+		})
+
+		archives, err := unpack.DecompressPackage(bytes.NewReader(packageData), tempDir, "hello_2.10-3build1_amd64.deb", nil)
+		require.NoError(t, err)
+
+		dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(context.Background(), tempDir, []unpack.Archives{*archives}, unpack.Options{})
+		require.NoError(t, err)
+
+		require.Equal(t, []string{archives.DataArchivePath}, dataArchivePaths)
+
+		dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgDatabaseArchiveFile.Close())
+		})
+
+		dpkgDatabaseFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+		require.NoError(t, err)
+
+		status, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/status")
+		require.NoError(t, err)
+		require.Contains(t, string(status), "Package: hello")
+
+		filesList, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/hello.list")
+		require.NoError(t, err)
+		require.Equal(t, "/usr\n/usr/bin\n/usr/bin/hello\n", string(filesList))
+	})
+}
+
+// BenchmarkDecompressPackage compares the previous approach of writing a
+// downloaded package to disk, splitting it with arfs, writing out the
+// decompressed control and data archives and then reading them back, with
+// decompressing the package in a single pass as it is streamed. The bytes
+// read and written are measured using /proc/self/io (where available).
+func BenchmarkDecompressPackage(b *testing.B) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	packageData, err := os.ReadFile(filepath.Join(testutil.Root(), "testdata/debs/base-files_12.4+deb12u5_amd64.deb"))
+	require.NoError(b, err)
+
+	b.Run("TwoPass", func(b *testing.B) {
+		tempDir := b.TempDir()
+
+		measureIO(b, func() {
+			for i := 0; i < b.N; i++ {
+				packagePath := filepath.Join(tempDir, "base-files.deb")
+				require.NoError(b, os.WriteFile(packagePath, packageData, 0o644))
+
+				packageFile, err := os.Open(packagePath)
+				require.NoError(b, err)
+
+				debFS, err := arfs.Open(packageFile)
+				require.NoError(b, err)
+
+				for _, member := range []string{"control.tar.xz", "data.tar.xz"} {
+					archivePath := filepath.Join(tempDir, "base-files_"+strings.TrimSuffix(member, ".xz"))
+					decompressFile(b, debFS, member, archivePath)
+
+					// Read the decompressed archive back (eg. to generate the file list).
+					archiveFile, err := os.Open(archivePath)
+					require.NoError(b, err)
+
+					tr := tar.NewReader(archiveFile)
+					for {
+						_, err := tr.Next()
+						if errors.Is(err, io.EOF) {
+							break
+						}
+						require.NoError(b, err)
+
+						_, err = io.Copy(md5.New(), tr)
+						require.NoError(b, err)
+					}
+
+					require.NoError(b, archiveFile.Close())
+				}
+
+				require.NoError(b, packageFile.Close())
+			}
+		})
+	})
+
+	b.Run("Streaming", func(b *testing.B) {
+		tempDir := b.TempDir()
+
+		measureIO(b, func() {
+			for i := 0; i < b.N; i++ {
+				_, err := unpack.DecompressPackage(bytes.NewReader(packageData), tempDir, "base-files.deb", nil)
+				require.NoError(b, err)
+			}
+		})
+	})
+}
+
+func decompressFile(b *testing.B, fsys fs.FS, name, dstPath string) {
+	f, err := fsys.Open(name)
+	require.NoError(b, err)
+	defer f.Close()
+
+	dr, err := uncompr.NewReader(f)
+	require.NoError(b, err)
+	defer dr.Close()
+
+	dst, err := os.Create(dstPath)
+	require.NoError(b, err)
+	defer dst.Close()
+
+	_, err = io.Copy(dst, dr)
+	require.NoError(b, err)
+}
+
+// measureIO runs fn and reports the number of bytes read and written (through
+// read and write system calls) per operation.
+func measureIO(b *testing.B, fn func()) {
+	before, ok := readProcIO(b)
+
+	b.ResetTimer()
+	fn()
+	b.StopTimer()
+
+	if !ok {
+		return
+	}
+
+	after, _ := readProcIO(b)
+	b.ReportMetric(float64(after["rchar"]-before["rchar"])/float64(b.N), "read-B/op")
+	b.ReportMetric(float64(after["wchar"]-before["wchar"])/float64(b.N), "written-B/op")
+}
+
+func readProcIO(b *testing.B) (map[string]int64, bool) {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return nil, false
+	}
+
+	counters := make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(value, 10, 64)
+		require.NoError(b, err)
+
+		counters[key] = n
+	}
+
+	return counters, true
+}
+
+func openDataArchive(t *testing.T, path string) fs.FS {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, f.Close())
+	})
+
+	dr, err := uncompr.NewReader(f)
+	require.NoError(t, err)
+
+	data, err := io.ReadAll(dr)
+	require.NoError(t, err)
+
+	dataFS, err := tarfs.Open(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	return dataFS
+}
+
+func TestCreateDatabase(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	// The fields are deliberately not in the order that dpkg writes them.
+	packageData := testutil.BuildDeb(t, testutil.Deb{
+		Control: `Package: hello
+Version: 0:2.10-3
+Architecture: amd64
+Multi-Arch: same
+Maintainer: Test <test@example.com>
+Installed-Size: 12
+Depends: libc6 (>= 2.34)
+Section: devel
+Priority: optional
+Essential: no
+Homepage: https://example.com
+Description: example package
+ Long description.
+ .
+ More.
+`,
+		ControlFiles: map[string]string{
+			"conffiles": "/etc/hello.conf\nremove-on-upgrade /etc/hello.d/old.conf\n",
+		},
+		Files: []testutil.DebFile{
+			{Name: "/", Dir: true},
+			{Name: "/etc", Dir: true},
+			{Name: "/etc/hello.conf", Content: "greeting=hi\n"},
+			{Name: "/usr", Dir: true},
+			{Name: "/usr/bin", Dir: true},
+			{Name: "/usr/bin/hello", Content: "#!/bin/sh\necho hi\n", Mode: 0o755},
+			{Name: "/usr/bin/hi", Linkname: "hello"},
+		},
+		Compression: "gz",
+	})
+
+	archives, err := unpack.DecompressPackage(bytes.NewReader(packageData), tempDir, "hello_2.10-3_amd64.deb", nil)
+	require.NoError(t, err)
+
+	var events bytes.Buffer
+	progress.SetOutput(&events)
+	progress.SetMode(progress.ModeJSON)
+	t.Cleanup(func() {
+		progress.SetOutput(os.Stdout)
+		progress.SetMode(progress.ModeAuto)
+	})
+
+	dpkgDatabaseArchivePath, _, err := unpack.CreateDatabase(context.Background(), tempDir, []unpack.Archives{*archives}, unpack.Options{})
+	require.NoError(t, err)
+
+	// Builds report the unpack phase even without --merge-archives.
+	var phases []progress.Status
+	dec := json.NewDecoder(&events)
+	for dec.More() {
+		var e progress.Event
+		require.NoError(t, dec.Decode(&e))
+
+		if e.Phase == progress.PhaseUnpack {
+			phases = append(phases, e.Status)
+		}
+	}
+	require.Equal(t, []progress.Status{progress.StatusStarted, progress.StatusCompleted}, phases)
+
+	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgDatabaseArchiveFile.Close())
+	})
+
+	dpkgDatabaseFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+	require.NoError(t, err)
+
+	// As written by dpkg --unpack.
+	expectedStatus := `Package: hello
+Status: install ok unpacked
+Priority: optional
+Section: devel
+Installed-Size: 12
+Maintainer: Test <test@example.com>
+Architecture: amd64
+Multi-Arch: same
+Version: 2.10-3
+Depends: libc6 (>= 2.34)
+Conffiles:
+ /etc/hello.conf newconffile
+ /etc/hello.d/old.conf newconffile remove-on-upgrade
+Description: example package
+ Long description.
+ .
+ More.
+Homepage: https://example.com
+
+`
+
+	status, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/status")
+	require.NoError(t, err)
+	require.Equal(t, expectedStatus, string(status))
+
+	filesList, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/hello:amd64.list")
+	require.NoError(t, err)
+	require.Equal(t, "/.\n/etc\n/etc/hello.conf\n/usr\n/usr/bin\n/usr/bin/hello\n/usr/bin/hi\n", string(filesList))
+
+	// The package doesn't provide md5sums, so they should be generated.
+	md5sums, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/hello:amd64.md5sums")
+	require.NoError(t, err)
+	require.Equal(t, "196bdbd60cbe13cc013f592941f52f52  etc/hello.conf\n46bbbe8aa98cc0714426e948474eaaf4  usr/bin/hello\n", string(md5sums))
+
+	_, err = fs.Stat(dpkgDatabaseFS, "var/lib/dpkg/info/hello:amd64.conffiles")
+	require.NoError(t, err)
+}
+
+func TestFileConflicts(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	t.Run("Replaces", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:         "new-tool",
+				Version:      "2.0",
+				ExtraControl: "Replaces: old-tool (<< 2.0)\n",
+				Files:        []testutil.DebFile{{Name: "/usr/bin/tool", Content: "new"}},
+			}),
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name: "old-tool",
+				Files: []testutil.DebFile{
+					{Name: "/usr/bin/tool", Content: "old"},
+					{Name: "/usr/bin/other", Content: "other"},
+				},
+			}),
+		}
+
+		dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		require.NoError(t, err)
+
+		// The replacing package needs to be unpacked last.
+		require.Equal(t, []string{archives[1].DataArchivePath, archives[0].DataArchivePath}, dataArchivePaths)
+
+		dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgDatabaseArchiveFile.Close())
+		})
+
+		dpkgDatabaseFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+		require.NoError(t, err)
+
+		filesList, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/old-tool.list")
+		require.NoError(t, err)
+		require.Equal(t, "/usr\n/usr/bin\n/usr/bin/other\n", string(filesList))
+
+		filesList, err = fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/new-tool.list")
+		require.NoError(t, err)
+		require.Equal(t, "/usr\n/usr/bin\n/usr/bin/tool\n", string(filesList))
+	})
+
+	t.Run("Versioned Replaces Not Satisfied", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:         "new-tool",
+				Version:      "2.0",
+				ExtraControl: "Replaces: old-tool (<< 1.0)\n",
+				Files:        []testutil.DebFile{{Name: "/usr/bin/tool", Content: "new"}},
+			}),
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:  "old-tool",
+				Files: []testutil.DebFile{{Name: "/usr/bin/tool", Content: "old"}},
+			}),
+		}
+
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		require.Error(t, err)
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:  "foo",
+				Files: []testutil.DebFile{{Name: "/usr/bin/tool", Content: "foo"}},
+			}),
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:  "bar",
+				Files: []testutil.DebFile{{Name: "/usr/bin/tool", Content: "bar"}},
+			}),
+		}
+
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		var conflictErr *unpack.FileConflictError
+		require.ErrorAs(t, err, &conflictErr)
+		require.Equal(t, []unpack.FileConflict{{Path: "/usr/bin/tool", Packages: []string{"foo", "bar"}}}, conflictErr.Conflicts)
+
+		// The last package wins.
+		_, dataArchivePaths, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{
+			FileConflicts: unpack.ConflictPolicyWarn,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{archives[0].DataArchivePath, archives[1].DataArchivePath}, dataArchivePaths)
+	})
+
+	// Merged /usr systems ship /bin as a symlink, whereas older packages ship
+	// it as a directory.
+	t.Run("Directory And Symlink", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:  "base-files",
+				Files: []testutil.DebFile{{Name: "/bin", Linkname: "usr/bin"}},
+			}),
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name: "dash",
+				Files: []testutil.DebFile{
+					{Name: "/bin", Dir: true},
+					{Name: "/bin/sh", Linkname: "dash"},
+				},
+			}),
+		}
+
+		dpkgDatabaseArchivePath, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		require.NoError(t, err)
+
+		dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dpkgDatabaseArchiveFile.Close())
+		})
+
+		dpkgDatabaseFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+		require.NoError(t, err)
+
+		// Both packages keep the path.
+		filesList, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/base-files.list")
+		require.NoError(t, err)
+		require.Equal(t, "/usr\n/usr/bin\n/bin\n", string(filesList))
+
+		filesList, err = fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/dash.list")
+		require.NoError(t, err)
+		require.Equal(t, "/usr\n/usr/bin\n/bin\n/bin/sh\n", string(filesList))
+	})
+
+	t.Run("Directory And File", func(t *testing.T) {
+		tempDir := t.TempDir()
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:  "foo",
+				Files: []testutil.DebFile{{Name: "/usr/bin/tool", Dir: true}},
+			}),
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:  "bar",
+				Files: []testutil.DebFile{{Name: "/usr/bin/tool", Content: "bar"}},
+			}),
+		}
+
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		var conflictErr *unpack.FileConflictError
+		require.ErrorAs(t, err, &conflictErr)
+		require.Equal(t, []unpack.FileConflict{{Path: "/usr/bin/tool", Packages: []string{"foo", "bar"}}}, conflictErr.Conflicts)
+	})
+}
+
+func TestDiversions(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	preinst := `#!/bin/sh
+set -e
+
+if [ "$1" = install ] || [ "$1" = upgrade ]; then
+	dpkg-divert --package diverter --add --rename \
+		--divert /usr/bin/tool.real /usr/bin/tool
+	dpkg-divert --quiet --add --divert=/usr/bin/other.distrib --no-rename /usr/bin/other >/dev/null
+	dpkg-divert --local --rename /usr/bin/local; echo done
+	dpkg-divert --remove /usr/bin/removed
+	dpkg-divert --add --divert "$DIVERT" /usr/bin/variable
+fi
+`
+
+	archives := []unpack.Archives{
+		testutil.DecompressPackage(t, tempDir, testutil.Package{
+			Name:         "diverter",
+			ControlFiles: map[string]string{"preinst": preinst},
+			Files:        []testutil.DebFile{{Name: "/usr/bin/tool", Content: "wrapper"}},
+		}),
+		testutil.DecompressPackage(t, tempDir, testutil.Package{
+			Name: "tools",
+			Files: []testutil.DebFile{
+				{Name: "/usr/bin/tool", Content: "tool"},
+				{Name: "/usr/bin/other", Content: "other"},
+				{Name: "/usr/bin/variable", Content: "variable"},
+			},
+		}),
+	}
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+	require.NoError(t, err)
+
+	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgDatabaseArchiveFile.Close())
+	})
+
+	dpkgDatabaseFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+	require.NoError(t, err)
+
+	diversions, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/diversions")
+	require.NoError(t, err)
+	require.Equal(t, "/usr/bin/tool\n/usr/bin/tool.real\ndiverter\n"+
+		"/usr/bin/other\n/usr/bin/other.distrib\ndiverter\n"+
+		"/usr/bin/local\n/usr/bin/local.distrib\n:\n", string(diversions))
+
+	// The files list records the original paths.
+	filesList, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/tools.list")
+	require.NoError(t, err)
+	require.Equal(t, "/usr\n/usr/bin\n/usr/bin/tool\n/usr/bin/other\n/usr/bin/variable\n", string(filesList))
+
+	// But the files are installed at their diverted locations.
+	readFiles := func(t *testing.T, dataArchivePath string) map[string]string {
+		dataArchiveFile, err := os.Open(dataArchivePath)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, dataArchiveFile.Close())
+		})
+
+		dataFS, err := tarfs.Open(dataArchiveFile)
+		require.NoError(t, err)
+
+		files := make(map[string]string)
+		require.NoError(t, fs.WalkDir(dataFS, ".", func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			content, err := fs.ReadFile(dataFS, path)
+			files[path] = string(content)
+			return err
+		}))
+
+		return files
+	}
+
+	require.Equal(t, map[string]string{"usr/bin/tool": "wrapper"}, readFiles(t, dataArchivePaths[0]))
+	require.Equal(t, map[string]string{
+		"usr/bin/tool.real":     "tool",
+		"usr/bin/other.distrib": "other",
+		"usr/bin/variable":      "variable",
+	}, readFiles(t, dataArchivePaths[1]))
+
+	// Real maintainer scripts generally build the dpkg-divert arguments from
+	// variables, which can't be evaluated offline (eg. the preinst of dash in
+	// Debian bullseye, which this is based on).
+	t.Run("Unsupported", func(t *testing.T) {
+		logger := slog.Default()
+		t.Cleanup(func() {
+			slog.SetDefault(logger)
+		})
+
+		var logs bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+		preinst := `#!/bin/sh
+set -e
+
+divert() {
+	dfile=$1
+	ltarget=$2
+	div=$(dpkg-divert --list $dfile)
+	distrib=${3:-$dfile.distrib}
+	temp=$dfile.tmp
+	if [ -z "$div" ]; then
+		# This differs from dpkg-divert's --rename because we
+		# first make a copy of $dfile (the file being diverted)
+		# in $distrib. Then, a symlink to $ltarget is forcibly created
+		# from $dfile; this is performed in two stages with an
+		# intermediate temporary file as ln -sf is not atomic.
+		# dpkg-divert's --rename direct equivalent would be:
+		#    mv $dfile $distrib; ln -s $ltarget $dfile
+		# which is non-atomic, but slightly faster.
+		if [ -e $dfile ]; then
+			cp -dp $dfile $distrib
+		fi
+		ln -sf $ltarget $temp
+		mv -f $temp $dfile
+		dpkg-divert --package dash --divert $distrib --add $dfile
+	fi
+}
+
+if [ "$1" = "install" ]; then
+	divert /bin/sh dash
+	divert /usr/share/man/man1/sh.1.gz dash.1.gz \
+		/usr/share/man/man1/sh.distrib.1.gz
+fi
+
+`
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:         "dash",
+				ControlFiles: map[string]string{"preinst": preinst},
+				Files:        []testutil.DebFile{{Name: "/usr/bin/dash", Content: "dash"}},
+			}),
+		}
+
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		require.NoError(t, err)
+
+		require.Contains(t, logs.String(), "Unable to apply diversion offline")
+		require.Contains(t, logs.String(), "package=dash")
+		require.Contains(t, logs.String(), `dpkg-divert --package dash --divert $distrib --add $dfile`)
+
+		// Querying diversions is not a problem.
+		require.NotContains(t, logs.String(), "--list")
+	})
+}
+
+func TestMaintscriptHelper(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	t.Run("Rejected", func(t *testing.T) {
+		preinst := `#!/bin/sh
+set -e
+
+dpkg-maintscript-helper dir_to_symlink /usr/share/doc/foo bar 1.0~ -- "$@"
+`
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:         "foo",
+				ControlFiles: map[string]string{"preinst": preinst},
+				Files:        []testutil.DebFile{{Name: "/usr/bin/foo", Content: "foo"}},
+			}),
+		}
+
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		require.ErrorContains(t, err, "package foo is not supported")
+	})
+
+	t.Run("Comment", func(t *testing.T) {
+		preinst := `#!/bin/sh
+set -e
+
+# Previously used dpkg-maintscript-helper.
+`
+
+		archives := []unpack.Archives{
+			testutil.DecompressPackage(t, tempDir, testutil.Package{
+				Name:         "bar",
+				ControlFiles: map[string]string{"preinst": preinst},
+				Files:        []testutil.DebFile{{Name: "/usr/bin/bar", Content: "bar"}},
+			}),
+		}
+
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, archives, unpack.Options{})
+		require.NoError(t, err)
+	})
+}
+
+func TestMergeArchives(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	sourceDateEpoch := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type entry struct {
+		hdr     tar.Header
+		content string
+	}
+
+	writeArchive := func(t *testing.T, path string, entries ...entry) {
+		f, err := os.Create(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		tw := tar.NewWriter(f)
+		for _, e := range entries {
+			e.hdr.Size = int64(len(e.content))
+			e.hdr.ModTime = sourceDateEpoch.Add(time.Hour)
+			require.NoError(t, tw.WriteHeader(&e.hdr))
+
+			_, err := tw.Write([]byte(e.content))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+	}
+
+	tempDir := t.TempDir()
+
+	firstArchivePath := filepath.Join(tempDir, "first.tar")
+	writeArchive(t, firstArchivePath,
+		entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0o755}},
+		entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./usr/", Mode: 0o755}},
+		entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./usr/bin/", Mode: 0o755}},
+		entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/bin/tool", Mode: 0o755, Uname: "root"}, content: "old"},
+		entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./usr/bin/alias", Linkname: "./usr/bin/tool"}},
+		entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./lib/", Mode: 0o755}},
+		entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./lib/libfoo.so", Mode: 0o644}, content: "foo"},
+	)
+
+	secondArchivePath := filepath.Join(tempDir, "second.tar")
+	writeArchive(t, secondArchivePath,
+		entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/bin/tool", Mode: 0o755, Gid: 42, Gname: "shadow"}, content: "new"},
+		entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./lib", Linkname: "usr/lib"}},
+		entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/bin/ping", Mode: 0o755, PAXRecords: map[string]string{
+			"SCHILY.xattr.security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00",
+		}}, content: "ping"},
+	)
+
+	rootFSArchivePath := filepath.Join(tempDir, "rootfs.tar")
+	require.NoError(t, unpack.MergeArchives(context.Background(), rootFSArchivePath,
+		[]string{firstArchivePath, secondArchivePath}, sourceDateEpoch))
+
+	rootFSArchiveFile, err := os.Open(rootFSArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, rootFSArchiveFile.Close())
+	})
+
+	var names []string
+	tr := tar.NewReader(rootFSArchiveFile)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		names = append(names, hdr.Name)
+
+		require.Equal(t, sourceDateEpoch, hdr.ModTime.UTC())
+		require.Empty(t, hdr.Uname)
+		require.Empty(t, hdr.Gname)
+
+		switch hdr.Name {
+		case "usr/bin/tool":
+			content, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			require.Equal(t, "new", string(content))
+			require.Equal(t, 42, hdr.Gid)
+		case "usr/bin/alias":
+			require.Equal(t, "usr/bin/tool", hdr.Linkname)
+		case "usr/bin/ping":
+			require.Equal(t, "\x01\x00\x00\x02\x00\x20\x00\x00", hdr.PAXRecords["SCHILY.xattr.security.capability"])
+		}
+	}
+
+	// The library directory was replaced by a symlink, and hard links come last.
+	require.Equal(t, []string{"lib", "usr/", "usr/bin/", "usr/bin/ping", "usr/bin/tool", "usr/bin/alias"}, names)
+
+	t.Run("Extract", func(t *testing.T) {
+		rootDir := filepath.Join(tempDir, "rootfs")
+		require.NoError(t, unpack.ExtractArchive(context.Background(), rootFSArchivePath, rootDir))
+
+		content, err := os.ReadFile(filepath.Join(rootDir, "usr/bin/tool"))
+		require.NoError(t, err)
+		require.Equal(t, "new", string(content))
+
+		toolInfo, err := os.Stat(filepath.Join(rootDir, "usr/bin/tool"))
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o755), toolInfo.Mode().Perm())
+		require.Equal(t, sourceDateEpoch, toolInfo.ModTime().UTC())
+
+		aliasInfo, err := os.Stat(filepath.Join(rootDir, "usr/bin/alias"))
+		require.NoError(t, err)
+		require.True(t, os.SameFile(toolInfo, aliasInfo))
+
+		target, err := os.Readlink(filepath.Join(rootDir, "lib"))
+		require.NoError(t, err)
+		require.Equal(t, "usr/lib", target)
+
+		dirInfo, err := os.Stat(filepath.Join(rootDir, "usr/bin"))
+		require.NoError(t, err)
+		require.Equal(t, sourceDateEpoch, dirInfo.ModTime().UTC())
+	})
+
+	t.Run("Order Independent", func(t *testing.T) {
+		aArchivePath := filepath.Join(tempDir, "a.tar")
+		writeArchive(t, aArchivePath,
+			entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./usr/", Mode: 0o755}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/a", Mode: 0o644}, content: "a"},
+		)
+
+		bArchivePath := filepath.Join(tempDir, "b.tar")
+		writeArchive(t, bArchivePath,
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/b", Mode: 0o644}, content: "b"},
+			entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./usr/", Mode: 0o755}},
+		)
+
+		abArchivePath := filepath.Join(tempDir, "ab.tar")
+		require.NoError(t, unpack.MergeArchives(context.Background(), abArchivePath,
+			[]string{aArchivePath, bArchivePath}, sourceDateEpoch))
+
+		baArchivePath := filepath.Join(tempDir, "ba.tar")
+		require.NoError(t, unpack.MergeArchives(context.Background(), baArchivePath,
+			[]string{bArchivePath, aArchivePath}, sourceDateEpoch))
+
+		expected, err := os.ReadFile(abArchivePath)
+		require.NoError(t, err)
+
+		actual, err := os.ReadFile(baArchivePath)
+		require.NoError(t, err)
+
+		require.Equal(t, expected, actual)
+	})
+
+	readHeaders := func(t *testing.T, path string) map[string]*tar.Header {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		hdrs := make(map[string]*tar.Header)
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+
+			hdrs[hdr.Name] = hdr
+		}
+
+		return hdrs
+	}
+
+	t.Run("Symlinked Parents", func(t *testing.T) {
+		baseArchivePath := filepath.Join(tempDir, "base.tar")
+		writeArchive(t, baseArchivePath,
+			entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "./bin", Linkname: "usr/bin"}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./usr/bin/", Mode: 0o755}},
+		)
+
+		pkgArchivePath := filepath.Join(tempDir, "pkg.tar")
+		writeArchive(t, pkgArchivePath,
+			entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./bin/", Mode: 0o755}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./bin/foo", Mode: 0o755}, content: "foo"},
+			entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "./bin/bar", Linkname: "./bin/foo"}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./opt/baz/qux", Mode: 0o644}, content: "qux"},
+		)
+
+		mergedArchivePath := filepath.Join(tempDir, "merged.tar")
+		require.NoError(t, unpack.MergeArchives(context.Background(), mergedArchivePath,
+			[]string{baseArchivePath, pkgArchivePath}, sourceDateEpoch))
+
+		hdrs := readHeaders(t, mergedArchivePath)
+
+		// The symlink is kept, and its children are installed in the target.
+		require.Equal(t, byte(tar.TypeSymlink), hdrs["bin"].Typeflag)
+		require.Contains(t, hdrs, "usr/bin/foo")
+		require.Equal(t, "usr/bin/foo", hdrs["usr/bin/bar"].Linkname)
+		require.NotContains(t, hdrs, "bin/foo")
+
+		// Implicit parent directories are created at the source date epoch.
+		require.Contains(t, hdrs, "opt/baz/")
+		require.Equal(t, sourceDateEpoch, hdrs["opt/"].ModTime.UTC())
+		require.Equal(t, sourceDateEpoch, hdrs["opt/baz/"].ModTime.UTC())
+	})
+
+	t.Run("Not A Directory", func(t *testing.T) {
+		badArchivePath := filepath.Join(tempDir, "bad.tar")
+		writeArchive(t, badArchivePath,
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./etc", Mode: 0o644}, content: "etc"},
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./etc/passwd", Mode: 0o644}, content: "root"},
+		)
+
+		err := unpack.MergeArchives(context.Background(), filepath.Join(tempDir, "bad-rootfs.tar"),
+			[]string{badArchivePath}, sourceDateEpoch)
+		require.ErrorContains(t, err, "not a directory")
+	})
+
+	t.Run("Canonical Owners", func(t *testing.T) {
+		basePasswdArchivePath := filepath.Join(tempDir, "base-passwd.tar")
+		writeArchive(t, basePasswdArchivePath,
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/base-passwd/passwd.master", Mode: 0o644},
+				content: "root:*:0:0:root:/root:/bin/bash\nman:*:6:12:man:/var/cache/man:/usr/sbin/nologin\n"},
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./usr/share/base-passwd/group.master", Mode: 0o644},
+				content: "root:*:0:\nman:*:12:\nstaff:*:50:\n"},
+		)
+
+		ownedArchivePath := filepath.Join(tempDir, "owned.tar")
+		writeArchive(t, ownedArchivePath,
+			// Ids from the machine the package was built on.
+			entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./usr/local/", Mode: 0o2775, Uid: 1000, Uname: "root", Gid: 1000, Gname: "staff"}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: "./var/cache/man/", Mode: 0o755, Uid: 1001, Uname: "man", Gid: 1001, Gname: "root"}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "./var/lib/foo", Mode: 0o644, Uid: 100, Uname: "foo", Gid: 101, Gname: "foo"}},
+		)
+
+		ownedRootFSArchivePath := filepath.Join(tempDir, "owned-rootfs.tar")
+		require.NoError(t, unpack.MergeArchives(context.Background(), ownedRootFSArchivePath,
+			[]string{basePasswdArchivePath, ownedArchivePath}, sourceDateEpoch))
+
+		hdrs := readHeaders(t, ownedRootFSArchivePath)
+
+		require.Equal(t, 0, hdrs["usr/local/"].Uid)
+		require.Equal(t, 50, hdrs["usr/local/"].Gid)
+		require.Equal(t, 6, hdrs["var/cache/man/"].Uid)
+		require.Equal(t, 0, hdrs["var/cache/man/"].Gid)
+
+		// Dynamically allocated users and groups keep their ids.
+		require.Equal(t, 100, hdrs["var/lib/foo"].Uid)
+		require.Equal(t, 101, hdrs["var/lib/foo"].Gid)
+	})
+}
+
+func TestPathFilters(t *testing.T) {
+	testutil.SetupGlobals(t)
+
+	tempDir := t.TempDir()
+
+	packageData := testutil.BuildDeb(t, testutil.Deb{
+		Control: "Package: fx\nVersion: 1.0\nArchitecture: all\n" +
+			"Maintainer: Test <test@example.com>\nDescription: test package\n",
+		ControlFiles: map[string]string{
+			"conffiles": "/etc/fx.conf\n",
+		},
+		Files: []testutil.DebFile{
+			{Name: "/etc", Dir: true},
+			{Name: "/etc/fx.conf", Content: "conf"},
+			{Name: "/usr", Dir: true},
+			{Name: "/usr/share", Dir: true},
+			{Name: "/usr/share/doc", Dir: true},
+			{Name: "/usr/share/doc/fx", Dir: true},
+			{Name: "/usr/share/doc/fx/README", Content: "readme"},
+			{Name: "/usr/share/doc/fx/copyright", Content: "copyright"},
+			{Name: "/usr/share/locale", Dir: true},
+			{Name: "/usr/share/locale/de", Dir: true},
+			{Name: "/usr/share/locale/de/fx.mo", Content: "de"},
+			{Name: "/usr/share/locale/en", Dir: true},
+			{Name: "/usr/share/locale/en/fx.mo", Content: "en"},
+		},
+	})
+
+	archives, err := unpack.DecompressPackage(bytes.NewReader(packageData), tempDir, "fx_1.0_all.deb", nil)
+	require.NoError(t, err)
+
+	filters := []unpack.PathFilter{
+		{Pattern: "/usr/share/doc/*"},
+		{Include: true, Pattern: "/usr/share/doc/*/copyright"},
+		{Pattern: "/usr/share/locale/*"},
+		{Include: true, Pattern: "/usr/share/locale/[e-z]*"},
+		{Pattern: "/etc/fx.conf"},
+	}
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(context.Background(), tempDir, []unpack.Archives{*archives}, unpack.Options{
+		PathFilters: filters,
+	})
+	require.NoError(t, err)
+
+	dpkgDatabaseArchiveFile, err := os.Open(dpkgDatabaseArchivePath)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dpkgDatabaseArchiveFile.Close())
+	})
+
+	dpkgDatabaseFS, err := tarfs.Open(dpkgDatabaseArchiveFile)
+	require.NoError(t, err)
+
+	// Excluded files are omitted from the files list (directories are kept if
+	// an include filter could match files beneath them).
+	filesList, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/info/fx.list")
+	require.NoError(t, err)
+	require.Equal(t, "/etc\n/usr\n/usr/share\n/usr/share/doc\n/usr/share/doc/fx\n/usr/share/doc/fx/copyright\n"+
+		"/usr/share/locale\n/usr/share/locale/de\n/usr/share/locale/en\n/usr/share/locale/en/fx.mo\n", string(filesList))
+
+	// Excluded conffiles are recorded as dpkg does.
+	status, err := fs.ReadFile(dpkgDatabaseFS, "var/lib/dpkg/status")
+	require.NoError(t, err)
+	require.Contains(t, string(status), "Conffiles:\n /etc/fx.conf newconffile\n")
+
+	// The filters are kept for packages installed later on.
+	dpkgConfig, err := fs.ReadFile(dpkgDatabaseFS, "etc/dpkg/dpkg.cfg.d/debco")
+	require.NoError(t, err)
+	require.Equal(t, "path-exclude=/usr/share/doc/*\npath-include=/usr/share/doc/*/copyright\n"+
+		"path-exclude=/usr/share/locale/*\npath-include=/usr/share/locale/[e-z]*\npath-exclude=/etc/fx.conf\n", string(dpkgConfig))
+
+	// And the excluded files are not installed.
+	dataArchiveFile, err := os.Open(dataArchivePaths[0])
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		require.NoError(t, dataArchiveFile.Close())
+	})
+
+	var names []string
+	tr := tar.NewReader(dataArchiveFile)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+
+		names = append(names, hdr.Name)
+	}
+
+	require.Equal(t, []string{"./etc/", "./usr/", "./usr/share/", "./usr/share/doc/", "./usr/share/doc/fx/", "./usr/share/doc/fx/copyright",
+		"./usr/share/locale/", "./usr/share/locale/de/", "./usr/share/locale/en/", "./usr/share/locale/en/fx.mo"}, names)
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, _, err := unpack.CreateDatabase(context.Background(), tempDir, []unpack.Archives{*archives}, unpack.Options{
+			PathFilters: []unpack.PathFilter{{Pattern: "/usr/share/[doc"}},
+		})
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package unpack
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+)
+
+const (
+	// The PAX record prefix used by GNU tar and Go for extended attributes,
+	// this is the only format understood by BuildKit.
+	schilyXattrPrefix = "SCHILY.xattr."
+	// The PAX record prefix used by libarchive (eg. bsdtar) for extended
+	// attributes. The name is URL encoded and the value is base64 encoded.
+	libarchiveXattrPrefix = "LIBARCHIVE.xattr."
+)
+
+// hasLibarchiveXattrs returns true if the PAX records contain any extended
+// attributes in the libarchive format.
+func hasLibarchiveXattrs(records map[string]string) bool {
+	for key := range records {
+		if strings.HasPrefix(key, libarchiveXattrPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normaliseXattrs converts any extended attributes (eg. file capabilities)
+// stored in the libarchive format to the SCHILY format, so that they are
+// preserved when the archive is unpacked. Records that can't be decoded are
+// left as is.
+func normaliseXattrs(records map[string]string) map[string]string {
+	if !hasLibarchiveXattrs(records) {
+		return records
+	}
+
+	normalised := make(map[string]string, len(records))
+	for key, value := range records {
+		if !strings.HasPrefix(key, libarchiveXattrPrefix) {
+			normalised[key] = value
+			continue
+		}
+
+		name, err := url.QueryUnescape(strings.TrimPrefix(key, libarchiveXattrPrefix))
+		if err != nil {
+			normalised[key] = value
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			// libarchive omits the base64 padding.
+			decoded, err = base64.RawStdEncoding.DecodeString(value)
+			if err != nil {
+				normalised[key] = value
+				continue
+			}
+		}
+
+		// SCHILY records take precedence, as they are what other tools read.
+		if _, ok := records[schilyXattrPrefix+name]; !ok {
+			normalised[schilyXattrPrefix+name] = string(decoded)
+		}
+	}
+
+	return normalised
+}
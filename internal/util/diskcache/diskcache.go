@@ -19,10 +19,12 @@
 package diskcache
 
 import (
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"path/filepath"
 
 	"github.com/rogpeppe/go-internal/cache"
 )
@@ -30,6 +32,7 @@ import (
 // DiskCache is a cache that stores http responses on disk.
 type DiskCache struct {
 	*cache.Cache
+	dir       string
 	namespace string
 }
 
@@ -45,6 +48,7 @@ func NewDiskCache(dir, namespace string) (*DiskCache, error) {
 
 	return &DiskCache{
 		Cache:     c,
+		dir:       dir,
 		namespace: namespace,
 	}, nil
 }
@@ -70,15 +74,106 @@ func (c *DiskCache) Get(key string) ([]byte, bool) {
 func (c *DiskCache) Set(key string, responseBytes []byte) {
 	slog.Debug("Storing cached response", slog.String("key", key))
 
-	if err := c.Cache.PutBytes(c.getActionID(key), responseBytes); err != nil {
+	actionID := c.getActionID(key)
+
+	// Record the reference before the output is written, so that a concurrent
+	// Delete of another entry with the same response won't remove it.
+	outputID := fmt.Sprintf("%x", sha256.Sum256(responseBytes))
+	if err := c.addRef(outputID, actionID); err != nil {
+		slog.Warn("Error setting cached response", slog.Any("error", err))
+	}
+
+	if err := c.Cache.PutBytes(actionID, responseBytes); err != nil {
 		slog.Warn("Error setting cached response", slog.Any("error", err))
 	}
 }
 
-func (c *DiskCache) Delete(key string) {}
+func (c *DiskCache) Delete(key string) {
+	slog.Debug("Deleting cached response", slog.String("key", key))
+
+	actionFile := c.actionFile(c.getActionID(key))
+
+	outputID, err := readActionEntry(actionFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Error reading cached response",
+			slog.String("key", key), slog.Any("error", err))
+	}
+
+	if err := os.Remove(actionFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Error deleting cached response",
+			slog.String("key", key), slog.Any("error", err))
+		return
+	}
+
+	if outputID == "" {
+		return
+	}
+
+	// The output file may be shared with other entries (with the same
+	// response), so is only removed once nothing else references it.
+	unreferenced, err := c.removeRef(outputID, c.getActionID(key))
+	if err != nil {
+		slog.Warn("Error deleting cached response",
+			slog.String("key", key), slog.Any("error", err))
+		return
+	}
+
+	if unreferenced {
+		if err := os.Remove(c.outputFile(outputID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Error deleting cached response",
+				slog.String("key", key), slog.Any("error", err))
+		}
+	}
+}
+
+// addRef records that the action references the output.
+func (c *DiskCache) addRef(outputID string, actionID cache.ActionID) error {
+	refDir := c.refDir(outputID)
+	if err := os.MkdirAll(refDir, 0o777); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(refDir, fmt.Sprintf("%x", actionID)), nil, 0o666)
+}
+
+// removeRef removes the reference of the action to the output, and reports
+// whether the output is no longer referenced. Outputs written without
+// references (eg. by older versions) are never reported as unreferenced, they
+// are left for Prune to remove.
+func (c *DiskCache) removeRef(outputID string, actionID cache.ActionID) (bool, error) {
+	refDir := c.refDir(outputID)
+	if err := os.Remove(filepath.Join(refDir, fmt.Sprintf("%x", actionID))); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	// Only succeeds if there are no other references.
+	if err := os.Remove(refDir); err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
 
 func (c *DiskCache) getActionID(key string) cache.ActionID {
 	h := cache.NewHash(c.namespace)
 	_, _ = h.Write([]byte(key))
 	return h.Sum()
 }
+
+func (c *DiskCache) actionFile(id cache.ActionID) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%02x", id[0]), fmt.Sprintf("%x-a", id))
+}
+
+func (c *DiskCache) outputFile(outputID string) string {
+	return filepath.Join(c.dir, outputID[:2], outputID+"-d")
+}
+
+// refDir is the directory containing a file for each action that references
+// the output.
+func (c *DiskCache) refDir(outputID string) string {
+	return filepath.Join(c.dir, outputID[:2], outputID+"-r")
+}
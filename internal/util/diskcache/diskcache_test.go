@@ -19,7 +19,11 @@
 package diskcache_test
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/immutos/debco/internal/testutil"
 	"github.com/immutos/debco/internal/util/diskcache"
@@ -46,4 +50,142 @@ func TestDiskCache(t *testing.T) {
 		_, ok := cache.Get("non-exist")
 		require.False(t, ok)
 	})
+
+	t.Run("Delete", func(t *testing.T) {
+		before, err := cache.Stats()
+		require.NoError(t, err)
+
+		cache.Set("delete", []byte("deleted"))
+
+		cache.Delete("delete")
+
+		_, ok := cache.Get("delete")
+		require.False(t, ok)
+
+		// The output file is removed along with the entry.
+		stats, err := cache.Stats()
+		require.NoError(t, err)
+		require.Equal(t, before.Size, stats.Size)
+	})
+
+	t.Run("Delete Shared", func(t *testing.T) {
+		before, err := cache.Stats()
+		require.NoError(t, err)
+
+		cache.Set("shared-1", []byte("shared"))
+		cache.Set("shared-2", []byte("shared"))
+
+		cache.Delete("shared-1")
+
+		data, ok := cache.Get("shared-2")
+		require.True(t, ok)
+		require.Equal(t, []byte("shared"), data)
+
+		cache.Delete("shared-2")
+
+		stats, err := cache.Stats()
+		require.NoError(t, err)
+		require.Equal(t, before.Size, stats.Size)
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		_, err := cache.Clear()
+		require.NoError(t, err)
+
+		cache.Set("first", bytes.Repeat([]byte("a"), 1024))
+		cache.Set("second", bytes.Repeat([]byte("b"), 1024))
+		cache.Set("third", bytes.Repeat([]byte("c"), 1024))
+
+		stats, err := cache.Stats()
+		require.NoError(t, err)
+		require.Equal(t, 3, stats.Entries)
+		require.Equal(t, int64(3*1024), stats.Size)
+
+		// Nothing has expired yet.
+		result, err := cache.Prune(0, time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, 0, result.Entries)
+
+		result, err = cache.Prune(2*1024, 0)
+		require.NoError(t, err)
+		require.Equal(t, 1, result.Entries)
+		require.Equal(t, int64(1024), result.Size)
+
+		entries, err := cache.Entries()
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+	})
+
+	t.Run("Prune Shared", func(t *testing.T) {
+		_, err := cache.Clear()
+		require.NoError(t, err)
+
+		// Entries with the same response share an output file.
+		cache.Set("first", bytes.Repeat([]byte("a"), 1024))
+		cache.Set("second", bytes.Repeat([]byte("a"), 1024))
+		cache.Set("third", bytes.Repeat([]byte("b"), 1024))
+
+		stats, err := cache.Stats()
+		require.NoError(t, err)
+		require.Equal(t, 3, stats.Entries)
+		require.Equal(t, int64(2*1024), stats.Size)
+
+		result, err := cache.Prune(2*1024, 0)
+		require.NoError(t, err)
+		require.Zero(t, result.Entries)
+
+		result, err = cache.Prune(1024, 0)
+		require.NoError(t, err)
+		require.Equal(t, 2, result.Entries)
+		require.Equal(t, int64(1024), result.Size)
+
+		entries, err := cache.Entries()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+	})
+
+	t.Run("Prune Orphans", func(t *testing.T) {
+		_, err := cache.Clear()
+		require.NoError(t, err)
+
+		cache.Set("orphan", bytes.Repeat([]byte("o"), 1024))
+
+		// Leave the output without an action, as if a concurrent writer has
+		// only written the output so far.
+		actionFiles, err := filepath.Glob(filepath.Join(cacheDir, "*", "*-a"))
+		require.NoError(t, err)
+		require.Len(t, actionFiles, 1)
+		require.NoError(t, os.Remove(actionFiles[0]))
+
+		result, err := cache.Prune(0, time.Hour)
+		require.NoError(t, err)
+		require.Zero(t, result.Size)
+
+		outputFiles, err := filepath.Glob(filepath.Join(cacheDir, "*", "*-d"))
+		require.NoError(t, err)
+		require.Len(t, outputFiles, 1)
+
+		// Once the grace period has passed, the output is removed.
+		old := time.Now().Add(-time.Hour)
+		require.NoError(t, os.Chtimes(outputFiles[0], old, old))
+
+		result, err = cache.Prune(0, time.Hour)
+		require.NoError(t, err)
+		require.Equal(t, int64(1024), result.Size)
+		require.NoFileExists(t, outputFiles[0])
+	})
+
+	t.Run("Clear", func(t *testing.T) {
+		cache.Set("clear", []byte("data"))
+
+		_, err := cache.Clear()
+		require.NoError(t, err)
+
+		_, ok := cache.Get("clear")
+		require.False(t, ok)
+
+		stats, err := cache.Stats()
+		require.NoError(t, err)
+		require.Zero(t, stats.Entries)
+	})
 }
@@ -0,0 +1,345 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package diskcache
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output files written within this period are not treated as orphaned, as
+// their actions may not have been written yet.
+const orphanGracePeriod = 10 * time.Minute
+
+// Entry is a single entry in the disk cache.
+type Entry struct {
+	// ID is the hex encoded action ID of the entry.
+	ID string
+	// Size is the size of the cached response in bytes.
+	Size int64
+	// LastUsed is the approximate time the entry was last used. The underlying
+	// cache only updates access times once an hour, so this may be up to an
+	// hour out of date.
+	LastUsed time.Time
+	// Internal fields.
+	actionFile string
+	outputFile string
+}
+
+// Stats contains summary statistics about the disk cache.
+type Stats struct {
+	// Dir is the directory the cache is stored in.
+	Dir string
+	// Entries is the number of entries in the cache.
+	Entries int
+	// Size is the total size of the cache on disk in bytes.
+	Size int64
+	// Oldest is the last used time of the least recently used entry.
+	Oldest time.Time
+	// Newest is the last used time of the most recently used entry.
+	Newest time.Time
+}
+
+// PruneResult describes what was removed by a prune operation.
+type PruneResult struct {
+	// Entries is the number of entries removed.
+	Entries int
+	// Size is the number of bytes reclaimed.
+	Size int64
+}
+
+// Entries returns all entries in the cache, ordered from least to most
+// recently used. Entries are not separated by namespace.
+func (c *DiskCache) Entries() ([]Entry, error) {
+	entries, _, err := c.scan()
+	return entries, err
+}
+
+// Stats returns summary statistics about the cache.
+func (c *DiskCache) Stats() (*Stats, error) {
+	entries, orphans, err := c.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := Stats{
+		Dir:     c.dir,
+		Entries: len(entries),
+	}
+
+	// Entries with the same response share an output file.
+	counted := make(map[string]bool)
+	for _, e := range entries {
+		if !counted[e.outputFile] {
+			counted[e.outputFile] = true
+			stats.Size += e.Size
+		}
+	}
+
+	for _, orphan := range orphans {
+		if fi, err := os.Stat(orphan); err == nil {
+			stats.Size += fi.Size()
+		}
+	}
+
+	if len(entries) > 0 {
+		stats.Oldest = entries[0].LastUsed
+		stats.Newest = entries[len(entries)-1].LastUsed
+	}
+
+	return &stats, nil
+}
+
+// Prune evicts entries from the cache. Entries not used within maxAge are
+// removed, then the least recently used entries are removed until the cache
+// is no larger than maxSize. A zero maxSize or maxAge disables that limit.
+func (c *DiskCache) Prune(maxSize int64, maxAge time.Duration) (*PruneResult, error) {
+	entries, orphans, err := c.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	var result PruneResult
+
+	// Output files that are no longer referenced by any action are unreachable.
+	// Outputs are written before their actions, so recently written outputs
+	// may be about to be referenced by a concurrent writer.
+	orphanCutoff := time.Now().Add(-orphanGracePeriod)
+	for _, orphan := range orphans {
+		fi, err := os.Stat(orphan)
+		if err != nil || fi.ModTime().After(orphanCutoff) {
+			continue
+		}
+
+		if err := os.Remove(orphan); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &result, fmt.Errorf("failed to remove orphaned cache file: %w", err)
+		}
+
+		if err := os.RemoveAll(strings.TrimSuffix(orphan, "-d") + "-r"); err != nil {
+			return &result, fmt.Errorf("failed to remove orphaned cache file: %w", err)
+		}
+
+		result.Size += fi.Size()
+	}
+
+	// Keep track of how many entries share each output file, each output file
+	// only takes up space once.
+	refs := make(map[string]int)
+	var totalSize int64
+	for _, e := range entries {
+		if refs[e.outputFile] == 0 {
+			totalSize += e.Size
+		}
+		refs[e.outputFile]++
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+
+	for _, e := range entries {
+		expired := maxAge > 0 && e.LastUsed.Before(cutoff)
+		oversized := maxSize > 0 && totalSize > maxSize
+		if !expired && !oversized {
+			// Entries are ordered by last use, so nothing newer will be evicted either.
+			break
+		}
+
+		slog.Debug("Evicting cache entry", slog.String("id", e.ID),
+			slog.Int64("size", e.Size), slog.Time("lastUsed", e.LastUsed))
+
+		if err := os.Remove(e.actionFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &result, fmt.Errorf("failed to remove cache entry: %w", err)
+		}
+
+		result.Entries++
+
+		refDir := strings.TrimSuffix(e.outputFile, "-d") + "-r"
+		if err := os.Remove(filepath.Join(refDir, e.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return &result, fmt.Errorf("failed to remove cache entry: %w", err)
+		}
+
+		refs[e.outputFile]--
+		if refs[e.outputFile] == 0 {
+			if err := os.Remove(e.outputFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return &result, fmt.Errorf("failed to remove cache entry: %w", err)
+			}
+
+			if err := os.RemoveAll(refDir); err != nil {
+				return &result, fmt.Errorf("failed to remove cache entry: %w", err)
+			}
+
+			totalSize -= e.Size
+			result.Size += e.Size
+		}
+	}
+
+	return &result, nil
+}
+
+// Clear removes every entry from the cache.
+func (c *DiskCache) Clear() (*PruneResult, error) {
+	var result PruneResult
+
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(c.dir, fmt.Sprintf("%02x", i))
+
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return &result, fmt.Errorf("failed to read cache directory: %w", err)
+		}
+
+		for _, de := range dirEntries {
+			name := de.Name()
+
+			if strings.HasSuffix(name, "-r") {
+				if err := os.RemoveAll(filepath.Join(subdir, name)); err != nil {
+					return &result, fmt.Errorf("failed to remove cache file: %w", err)
+				}
+				continue
+			}
+
+			if !strings.HasSuffix(name, "-a") && !strings.HasSuffix(name, "-d") {
+				continue
+			}
+
+			if fi, err := de.Info(); err == nil && strings.HasSuffix(name, "-d") {
+				result.Size += fi.Size()
+			}
+
+			if strings.HasSuffix(name, "-a") {
+				result.Entries++
+			}
+
+			if err := os.Remove(filepath.Join(subdir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return &result, fmt.Errorf("failed to remove cache file: %w", err)
+			}
+		}
+	}
+
+	// The cache log is only useful for debugging and grows without bound.
+	if err := os.Truncate(filepath.Join(c.dir, "log.txt"), 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return &result, fmt.Errorf("failed to truncate cache log: %w", err)
+	}
+
+	return &result, nil
+}
+
+// scan walks the cache directory and returns all entries (sorted from least
+// to most recently used) along with any output files no longer referenced
+// by an entry.
+func (c *DiskCache) scan() ([]Entry, []string, error) {
+	var entries []Entry
+	outputFiles := make(map[string]os.FileInfo)
+
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(c.dir, fmt.Sprintf("%02x", i))
+
+		dirEntries, err := os.ReadDir(subdir)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, nil, fmt.Errorf("failed to read cache directory: %w", err)
+		}
+
+		for _, de := range dirEntries {
+			name := de.Name()
+
+			fi, err := de.Info()
+			if err != nil {
+				// The file was removed concurrently.
+				continue
+			}
+
+			switch {
+			case strings.HasSuffix(name, "-d"):
+				outputFiles[filepath.Join(subdir, name)] = fi
+			case strings.HasSuffix(name, "-a"):
+				actionFile := filepath.Join(subdir, name)
+
+				outputID, err := readActionEntry(actionFile)
+				if err != nil {
+					slog.Debug("Skipping malformed cache entry",
+						slog.String("path", actionFile), slog.Any("error", err))
+					continue
+				}
+
+				entries = append(entries, Entry{
+					ID:         strings.TrimSuffix(name, "-a"),
+					LastUsed:   fi.ModTime(),
+					actionFile: actionFile,
+					outputFile: filepath.Join(c.dir, outputID[:2], outputID+"-d"),
+				})
+			}
+		}
+	}
+
+	referenced := make(map[string]bool)
+	for i := range entries {
+		referenced[entries[i].outputFile] = true
+
+		if fi, ok := outputFiles[entries[i].outputFile]; ok {
+			entries[i].Size = fi.Size()
+
+			if fi.ModTime().After(entries[i].LastUsed) {
+				entries[i].LastUsed = fi.ModTime()
+			}
+		}
+	}
+
+	var orphans []string
+	for outputFile := range outputFiles {
+		if !referenced[outputFile] {
+			orphans = append(orphans, outputFile)
+		}
+	}
+	sort.Strings(orphans)
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	return entries, orphans, nil
+}
+
+// readActionEntry returns the hex encoded output ID referenced by an action
+// entry file. The format is "v1 <hex id> <hex out> <size> <unixnano>\n".
+func readActionEntry(actionFile string) (string, error) {
+	data, err := os.ReadFile(actionFile)
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 5 || fields[0] != "v1" || len(fields[2]) < 2 {
+		return "", errors.New("invalid cache entry")
+	}
+
+	return fields[2], nil
+}
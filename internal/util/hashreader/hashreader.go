@@ -20,36 +20,128 @@ package hashreader
 
 import (
 	"crypto/hmac"
+	"crypto/md5"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 )
 
-// HashReader is a wrapper around an io.Reader that calculates the SHA-256 hash of the read data.
+// Algorithm is a hash algorithm used by Debian repositories. The value is the
+// name of the corresponding field in Release and Packages files.
+type Algorithm string
+
+const (
+	SHA512 Algorithm = "SHA512"
+	SHA256 Algorithm = "SHA256"
+	// MD5 is considered weak and is only used if explicitly allowed.
+	MD5 Algorithm = "MD5Sum"
+)
+
+// Algorithms lists the supported hash algorithms, from strongest to weakest.
+var Algorithms = []Algorithm{SHA512, SHA256, MD5}
+
+// Weak returns true if the algorithm is not collision resistant.
+func (a Algorithm) Weak() bool {
+	return a == MD5
+}
+
+func (a Algorithm) new() (hash.Hash, error) {
+	switch a {
+	case SHA512:
+		return sha512.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	case MD5:
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm: %s", a)
+	}
+}
+
+// Checksum is the expected hash and size of a file.
+type Checksum struct {
+	// Algorithm is the hash algorithm.
+	Algorithm Algorithm
+	// Hash is the hex encoded hash of the file.
+	Hash string
+	// Size is the size of the file in bytes, a negative size is not checked.
+	Size int64
+}
+
+// Strongest returns the strongest of the given checksums. Weak checksums are
+// only considered if allowWeak is true.
+func Strongest(checksums []Checksum, allowWeak bool) (*Checksum, error) {
+	var weakOnly bool
+	for _, algorithm := range Algorithms {
+		for _, checksum := range checksums {
+			if checksum.Algorithm != algorithm || checksum.Hash == "" {
+				continue
+			}
+
+			if algorithm.Weak() && !allowWeak {
+				weakOnly = true
+				continue
+			}
+
+			return &checksum, nil
+		}
+	}
+
+	if weakOnly {
+		return nil, errors.New("only weak hashes are available")
+	}
+
+	return nil, errors.New("no hashes are available")
+}
+
+// HashReader is a wrapper around an io.Reader that calculates the hash and
+// size of the read data.
 type HashReader struct {
-	reader io.Reader
-	hasher hash.Hash
+	reader   io.Reader
+	hasher   hash.Hash
+	checksum Checksum
+	n        int64
 }
 
-// NewReader creates a new HashReader.
-func NewReader(r io.Reader) *HashReader {
-	hasher := sha256.New()
-	return &HashReader{
-		reader: io.TeeReader(r, hasher),
-		hasher: hasher,
+// NewReader creates a new HashReader that will verify the read data against
+// the expected checksum.
+func NewReader(r io.Reader, checksum Checksum) (*HashReader, error) {
+	hasher, err := checksum.Algorithm.new()
+	if err != nil {
+		return nil, err
 	}
+
+	return &HashReader{
+		reader:   io.TeeReader(r, hasher),
+		hasher:   hasher,
+		checksum: checksum,
+	}, nil
 }
 
 // Read reads from the underlying reader and updates the hash.
 func (hr *HashReader) Read(p []byte) (int, error) {
-	return hr.reader.Read(p)
+	n, err := hr.reader.Read(p)
+	hr.n += int64(n)
+
+	// Don't let a misbehaving server feed us an endless stream of data.
+	if hr.checksum.Size >= 0 && hr.n > hr.checksum.Size {
+		return n, errors.New("size mismatch")
+	}
+
+	return n, err
 }
 
-// Verify returns true if the calculated hash matches the expected hash.
-func (hr *HashReader) Verify(expected string) error {
-	expectedHash, err := hex.DecodeString(expected)
+// Verify returns an error if the read data does not match the expected checksum.
+func (hr *HashReader) Verify() error {
+	if hr.checksum.Size >= 0 && hr.n != hr.checksum.Size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", hr.checksum.Size, hr.n)
+	}
+
+	expectedHash, err := hex.DecodeString(hr.checksum.Hash)
 	if err != nil {
 		return err
 	}
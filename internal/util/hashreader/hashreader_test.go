@@ -33,16 +33,98 @@ func TestHashReader(t *testing.T) {
 
 	data := []byte("The quick brown fox jumps over the lazy dog")
 
-	// Create a HashReader
-	reader := bytes.NewReader(data)
-	hashReader := hashreader.NewReader(reader)
+	t.Run("SHA256", func(t *testing.T) {
+		hashReader, err := hashreader.NewReader(bytes.NewReader(data), hashreader.Checksum{
+			Algorithm: hashreader.SHA256,
+			Hash:      "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+			Size:      int64(len(data)),
+		})
+		require.NoError(t, err)
 
-	// Read the data
-	readData, err := io.ReadAll(hashReader)
+		readData, err := io.ReadAll(hashReader)
+		require.NoError(t, err)
+		require.Equal(t, data, readData)
+
+		require.NoError(t, hashReader.Verify())
+	})
+
+	t.Run("SHA512", func(t *testing.T) {
+		hashReader, err := hashreader.NewReader(bytes.NewReader(data), hashreader.Checksum{
+			Algorithm: hashreader.SHA512,
+			Hash:      "07e547d9586f6a73f73fbac0435ed76951218fb7d0c8d788a309d785436bbb642e93a252a954f23912547d1e8a3b5ed6e1bfd7097821233fa0538f3db854fee6",
+			Size:      -1,
+		})
+		require.NoError(t, err)
+
+		_, err = io.Copy(io.Discard, hashReader)
+		require.NoError(t, err)
+
+		require.NoError(t, hashReader.Verify())
+	})
+
+	t.Run("Hash Mismatch", func(t *testing.T) {
+		hashReader, err := hashreader.NewReader(bytes.NewReader(data), hashreader.Checksum{
+			Algorithm: hashreader.MD5,
+			Hash:      "d41d8cd98f00b204e9800998ecf8427e",
+			Size:      int64(len(data)),
+		})
+		require.NoError(t, err)
+
+		_, err = io.Copy(io.Discard, hashReader)
+		require.NoError(t, err)
+
+		require.Error(t, hashReader.Verify())
+	})
+
+	t.Run("Too Short", func(t *testing.T) {
+		hashReader, err := hashreader.NewReader(bytes.NewReader(data), hashreader.Checksum{
+			Algorithm: hashreader.SHA256,
+			Hash:      "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+			Size:      int64(len(data)) + 1,
+		})
+		require.NoError(t, err)
+
+		_, err = io.Copy(io.Discard, hashReader)
+		require.NoError(t, err)
+
+		require.ErrorContains(t, hashReader.Verify(), "size mismatch")
+	})
+
+	t.Run("Too Long", func(t *testing.T) {
+		hashReader, err := hashreader.NewReader(bytes.NewReader(data), hashreader.Checksum{
+			Algorithm: hashreader.SHA256,
+			Hash:      "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+			Size:      10,
+		})
+		require.NoError(t, err)
+
+		_, err = io.Copy(io.Discard, hashReader)
+		require.ErrorContains(t, err, "size mismatch")
+	})
+}
+
+func TestStrongest(t *testing.T) {
+	checksums := []hashreader.Checksum{
+		{Algorithm: hashreader.MD5, Hash: "md5"},
+		{Algorithm: hashreader.SHA256, Hash: "sha256"},
+		{Algorithm: hashreader.SHA512, Hash: "sha512"},
+	}
+
+	checksum, err := hashreader.Strongest(checksums, false)
+	require.NoError(t, err)
+	require.Equal(t, hashreader.SHA512, checksum.Algorithm)
+
+	checksum, err = hashreader.Strongest(checksums[:2], false)
+	require.NoError(t, err)
+	require.Equal(t, hashreader.SHA256, checksum.Algorithm)
+
+	_, err = hashreader.Strongest(checksums[:1], false)
+	require.ErrorContains(t, err, "only weak hashes")
+
+	checksum, err = hashreader.Strongest(checksums[:1], true)
 	require.NoError(t, err)
-	require.Equal(t, data, readData)
+	require.Equal(t, hashreader.MD5, checksum.Algorithm)
 
-	// Verify the checksum
-	expected := "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592"
-	require.NoError(t, hashReader.Verify(expected))
+	_, err = hashreader.Strongest(nil, true)
+	require.Error(t, err)
 }
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+/*
+ * Copyright (C) 2024 Damian Peckett <damian@pecke.tt>.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program. If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// CopySparse copies at most n bytes from src to dst, skipping over blocks of
+// zeros (which are left as holes in the destination file). The destination
+// must be truncated to its final size by the caller, as trailing holes are
+// not written.
+func CopySparse(dst io.WriteSeeker, src io.Reader, n int64) error {
+	buf := make([]byte, 64*1024)
+	zeros := make([]byte, len(buf))
+
+	r := io.LimitReader(src, n)
+	for {
+		nr, err := io.ReadFull(r, buf)
+		if nr > 0 {
+			if bytes.Equal(buf[:nr], zeros[:nr]) {
+				if _, err := dst.Seek(int64(nr), io.SeekCurrent); err != nil {
+					return err
+				}
+			} else if _, err := dst.Write(buf[:nr]); err != nil {
+				return err
+			}
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
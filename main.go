@@ -19,7 +19,10 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -32,21 +35,29 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/adrg/xdg"
 	"github.com/containerd/containerd/platforms"
+	"github.com/docker/go-units"
 	"github.com/dpeckett/deb822/types/arch"
 	"github.com/dpeckett/telemetry"
 	"github.com/dpeckett/telemetry/v1alpha1"
 	"github.com/gregjones/httpcache"
 	"github.com/immutos/debco/internal/buildkit"
+	"github.com/immutos/debco/internal/config"
 	"github.com/immutos/debco/internal/constants"
 	"github.com/immutos/debco/internal/database"
+	"github.com/immutos/debco/internal/oci"
+	"github.com/immutos/debco/internal/progress"
+	"github.com/immutos/debco/internal/provenance"
 	"github.com/immutos/debco/internal/recipe"
 	latestrecipe "github.com/immutos/debco/internal/recipe/v1alpha1"
 	"github.com/immutos/debco/internal/resolve"
+	"github.com/immutos/debco/internal/sbom"
 	"github.com/immutos/debco/internal/secondstage"
+	"github.com/immutos/debco/internal/secondstage/disk"
 	"github.com/immutos/debco/internal/source"
 	"github.com/immutos/debco/internal/types"
 	"github.com/immutos/debco/internal/unpack"
@@ -55,14 +66,13 @@ import (
 	"github.com/immutos/debco/internal/util/hashreader"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli/v2"
-	"github.com/vbauerster/mpb/v8"
-	"github.com/vbauerster/mpb/v8/decor"
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
 	defaultCacheDir, _ := xdg.CacheFile("debco")
 	defaultStateDir, _ := xdg.StateFile("debco")
+	defaultConfigPath := filepath.Join(xdg.ConfigHome, "debco", "config.yaml")
 
 	persistentFlags := []cli.Flag{
 		&cli.GenericFlag{
@@ -82,6 +92,58 @@ func main() {
 			Value:  defaultStateDir,
 			Hidden: true,
 		},
+		&cli.StringFlag{
+			Name:  "config",
+			Usage: "Configuration file with default values for flags (eg. buildkit-addr)",
+			Value: defaultConfigPath,
+		},
+	}
+
+	buildkitFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "buildkit-addr",
+			Usage: "Address of an existing BuildKit daemon to use (unix://, tcp:// or docker-container://), instead of starting one in Docker",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-ca-cert",
+			Usage: "CA certificate used to verify a tcp:// BuildKit daemon",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-cert",
+			Usage: "Client certificate used to connect to a tcp:// BuildKit daemon",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-key",
+			Usage: "Client key used to connect to a tcp:// BuildKit daemon",
+		},
+		&cli.StringFlag{
+			Name:  "buildkit-gc-keep-storage",
+			Usage: "Amount of build cache (eg. 20GB) kept by the BuildKit daemon started by debco",
+		},
+		&cli.DurationFlag{
+			Name:  "buildkit-gc-keep-duration",
+			Usage: "How long unused build cache is kept by the BuildKit daemon started by debco",
+		},
+	}
+
+	cacheLimitFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "cache-max-size",
+			Usage: "Maximum size of the download cache (eg. 10GB), least recently used entries are evicted first",
+		},
+		&cli.DurationFlag{
+			Name:  "cache-max-age",
+			Usage: "Evict download cache entries that have not been used within this duration",
+		},
+	}
+
+	initConfig := func(c *cli.Context) error {
+		conf, err := config.Load(c.String("config"))
+		if err != nil {
+			return err
+		}
+
+		return conf.Apply(c)
 	}
 
 	initLogger := func(c *cli.Context) error {
@@ -92,6 +154,17 @@ func main() {
 		return nil
 	}
 
+	initProgress := func(c *cli.Context) error {
+		mode, err := progress.ParseMode(c.String("progress"))
+		if err != nil {
+			return err
+		}
+
+		progress.SetMode(mode)
+
+		return nil
+	}
+
 	initCacheDir := func(c *cli.Context) error {
 		cacheDir := c.String("cache-dir")
 		if cacheDir == "" {
@@ -173,7 +246,7 @@ func main() {
 			{
 				Name:  "build",
 				Usage: "Build a Debian base system image",
-				Flags: append([]cli.Flag{
+				Flags: append(append([]cli.Flag{
 					&cli.StringFlag{
 						Name:     "filename",
 						Aliases:  []string{"f"},
@@ -183,7 +256,7 @@ func main() {
 					&cli.StringFlag{
 						Name:    "output",
 						Aliases: []string{"o"},
-						Usage:   "Output OCI image archive",
+						Usage:   "Output OCI image archive, or 'type=oci|tar|local|disk,dest=<path>' to write the root filesystem as a tarball or directory, or a bootable disk image",
 						Value:   "debian-image.tar",
 					},
 					&cli.StringFlag{
@@ -198,20 +271,89 @@ func main() {
 						Usage:   "Name and optionally a tag for the image in the 'name:tag' format",
 						Value:   cli.NewStringSlice(),
 					},
+					&cli.StringFlag{
+						Name:  "progress",
+						Usage: "Set the type of progress output (auto, plain, json)",
+						Value: string(progress.ModeAuto),
+					},
+					&cli.BoolFlag{
+						Name:  "push",
+						Usage: "Push the image to a registry (using the --tag references) instead of writing an OCI image archive",
+					},
+					&cli.BoolFlag{
+						Name:  "load",
+						Usage: "Load the image into the local Docker daemon instead of writing an OCI image archive",
+					},
+					&cli.BoolFlag{
+						Name:  "merge-archives",
+						Usage: "Merge the package archives into a single normalised archive before building (faster for large images)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cache-to",
+						Usage: "Export the BuildKit cache, eg. 'type=local,dest=<path>', 'type=registry,ref=<ref>' or 'type=inline'",
+					},
+					&cli.StringFlag{
+						Name:  "provenance-key",
+						Usage: "PEM encoded private key (ECDSA, Ed25519 or RSA) used to sign the provenance attached to OCI images (unsigned if not set)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "cache-from",
+						Usage: "Import the BuildKit cache, eg. 'type=local,src=<path>' or 'type=registry,ref=<ref>'",
+					},
 					&cli.BoolFlag{
 						Name:  "dev",
 						Usage: "Enable development mode",
 					},
-				}, persistentFlags...),
-				Before: util.BeforeAll(initLogger, initCacheDir, initStateDir, initTelemetry),
+				}, append(cacheLimitFlags, buildkitFlags...)...), persistentFlags...),
+				Before: util.BeforeAll(initConfig, initLogger, initProgress, initCacheDir, initStateDir, initTelemetry),
 				After:  shutdownTelemetry,
 				Action: func(c *cli.Context) error {
+					if c.Bool("push") && len(c.StringSlice("tag")) == 0 {
+						return errors.New("at least one --tag is required when pushing")
+					}
+
+					if c.Bool("push") && c.Bool("load") {
+						return errors.New("--push and --load are mutually exclusive")
+					}
+
+					output, err := buildkit.ParseOutput(c.String("output"))
+					if err != nil {
+						return fmt.Errorf("failed to parse output: %w", err)
+					}
+
+					if (c.Bool("push") || c.Bool("load")) && output.Type != buildkit.OutputOCI {
+						return fmt.Errorf("--push and --load are not supported with %s outputs", output.Type)
+					}
+
+					cacheExports, err := buildkit.ParseCacheExports(c.StringSlice("cache-to"))
+					if err != nil {
+						return fmt.Errorf("failed to parse cache exports: %w", err)
+					}
+
+					cacheImports, err := buildkit.ParseCacheImports(c.StringSlice("cache-from"))
+					if err != nil {
+						return fmt.Errorf("failed to parse cache imports: %w", err)
+					}
+
+					var provenanceSigner *provenance.Signer
+					if c.String("provenance-key") != "" {
+						provenanceSigner, err = provenance.LoadSigner(c.String("provenance-key"))
+						if err != nil {
+							return err
+						}
+					}
+
 					// Cache all HTTP responses on disk.
 					cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
 					if err != nil {
 						return fmt.Errorf("failed to create disk cache: %w", err)
 					}
 
+					// Keep the cache within the configured bounds.
+					if err := pruneCache(c, cache); err != nil {
+						return err
+					}
+
 					// Use the disk cache for all HTTP requests.
 					http.DefaultClient = &http.Client{
 						Transport: httpcache.NewTransport(cache),
@@ -233,21 +375,58 @@ func main() {
 					}
 
 					// Load the recipe file.
-					recipeFile, err := os.Open(c.String("filename"))
+					recipeData, err := os.ReadFile(c.String("filename"))
 					if err != nil {
-						return fmt.Errorf("failed to open recipe file: %w", err)
+						return fmt.Errorf("failed to read recipe file: %w", err)
 					}
-					defer recipeFile.Close()
 
-					rx, err := recipe.FromYAML(recipeFile)
+					rx, err := recipe.FromYAML(bytes.NewReader(recipeData))
 					if err != nil {
 						return fmt.Errorf("failed to read recipe: %w", err)
 					}
 
-					// Start the BuildKit daemon.
-					b := buildkit.New("debco", certsDir)
-					if err := b.StartDaemon(c.Context); err != nil {
-						return fmt.Errorf("failed to start buildkit daemon: %w", err)
+					if output.Type == buildkit.OutputDisk {
+						if rx.Disk == nil {
+							return errors.New("disk outputs require a disk section in the recipe")
+						}
+
+						if rx.Options.DownloadOnly {
+							return errors.New("disk outputs are not supported for download only images")
+						}
+					}
+
+					if rx.Options.DownloadOnly && (len(cacheExports) > 0 || len(cacheImports) > 0) {
+						return errors.New("--cache-to and --cache-from are not supported for download only images")
+					}
+
+					fileConflictPolicy, err := unpack.ParseConflictPolicy(rx.Options.FileConflicts)
+					if err != nil {
+						return err
+					}
+
+					pathFilters, err := toPathFilters(rx.Options.PathFilters)
+					if err != nil {
+						return err
+					}
+
+					unpackOpts := unpack.Options{
+						FileConflicts: fileConflictPolicy,
+						PathFilters:   pathFilters,
+					}
+
+					layering, err := buildkit.ParseLayeringStrategy(rx.Options.Layering)
+					if err != nil {
+						return err
+					}
+
+					// Download only images don't need to run any commands, so can be
+					// written natively without BuildKit.
+					var b *buildkit.BuildKit
+					if !rx.Options.DownloadOnly {
+						b, err = newBuildKit(c, certsDir)
+						if err != nil {
+							return err
+						}
 					}
 
 					// If running in development mode, use the current debco binary as the
@@ -261,14 +440,29 @@ func main() {
 					}
 
 					buildOpts := buildkit.BuildOptions{
-						OCIArchivePath:        c.String("output"),
+						Output:                output,
 						RecipePath:            c.String("filename"),
 						SecondStageBinaryPath: secondStageBinaryPath,
 						DownloadOnly:          rx.Options.DownloadOnly,
 						ImageConf:             toOCIImageConfig(rx),
 						Tags:                  c.StringSlice("tag"),
+						Layering:              layering,
+						CacheExports:          cacheExports,
+						CacheImports:          cacheImports,
 					}
 
+					// The packages installed in the image of each platform, and the
+					// repositories they are from (for the SBOMs and provenance).
+					var (
+						platformPackages [][]types.Package
+						platformReleases [][]source.InRelease
+
+						// For the provenance, all the packages resolved for the image
+						// (including any not left in it), and those used to build it.
+						platformSelectedPackages [][]types.Package
+						platformBuildPackages    [][]types.Package
+					)
+
 					for _, platformStr := range strings.Split(c.String("platform"), ",") {
 						platform, err := platforms.Parse(platformStr)
 						if err != nil {
@@ -284,7 +478,7 @@ func main() {
 						slog.Info("Loading packages")
 
 						var packageDB *database.PackageDB
-						packageDB, sourceDateEpoch, err := loadPackageDB(c.Context, rx, platform)
+						packageDB, sourceDateEpoch, releases, err := loadPackageDB(c.Context, rx, platform)
 						if err != nil {
 							return err
 						}
@@ -311,11 +505,25 @@ func main() {
 							})
 						}
 
+						includeNameVersions := append(requiredNameVersions, rx.Packages.Include...)
+
+						// Bootable images need a kernel (container images built from a
+						// recipe with a disk section don't).
+						var diskLayout *disk.Layout
+						if buildOpts.Output.Type == buildkit.OutputDisk {
+							diskLayout, err = disk.NewLayout(*rx.Disk, platform.Architecture)
+							if err != nil {
+								return fmt.Errorf("invalid disk configuration: %w", err)
+							}
+
+							includeNameVersions = append(includeNameVersions, disk.KernelPackage(*rx.Disk, platform.Architecture))
+						}
+
 						slog.Info("Resolving selected packages")
 
-						selectedDB, err := resolve.Resolve(packageDB,
-							append(requiredNameVersions, rx.Packages.Include...),
-							rx.Packages.Exclude)
+						op := progress.Start(progress.PhaseResolve, platforms.Format(platform))
+						selectedDB, err := resolve.Resolve(packageDB, includeNameVersions, rx.Packages.Exclude)
+						op.Done(err)
 						if err != nil {
 							return err
 						}
@@ -325,37 +533,287 @@ func main() {
 							return fmt.Errorf("failed to create platform temp directory: %w", err)
 						}
 
-						slog.Info("Downloading selected packages")
-
-						packagePaths, err := downloadSelectedPackages(c.Context, platformTempDir, selectedDB)
+						packageArchives, packageArchivesByID, err := downloadSelectedPackages(c.Context, platformTempDir, selectedDB)
 						if err != nil {
 							return err
 						}
 
 						slog.Info("Unpacking packages")
 
-						dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.Unpack(c.Context, platformTempDir, packagePaths)
+						dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(c.Context, platformTempDir, packageArchives, unpackOpts)
 						if err != nil {
 							return err
 						}
 
-						buildOpts.PlatformOpts = append(buildOpts.PlatformOpts, buildkit.PlatformBuildOptions{
+						platformOpts := buildkit.PlatformBuildOptions{
 							Platform:                platform,
 							BuildContextDir:         platformTempDir,
 							DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
 							DataArchivePaths:        dataArchivePaths,
+							PreinstPackages:         preinstPackages(selectedDB),
+						}
+
+						// The native OCI writer requires a single layer archive.
+						if c.Bool("merge-archives") || buildOpts.DownloadOnly {
+							slog.Info("Merging package archives")
+
+							platformOpts.RootFSArchivePath = filepath.Join(platformTempDir, "rootfs.tar")
+							if err := unpack.MergeArchives(c.Context, platformOpts.RootFSArchivePath,
+								append([]string{dpkgDatabaseArchivePath}, dataArchivePaths...), sourceDateEpoch); err != nil {
+								return fmt.Errorf("failed to merge package archives: %w", err)
+							}
+						}
+
+						if buildOpts.Layering == buildkit.LayeringPackages && !buildOpts.DownloadOnly {
+							slog.Info("Unpacking base packages")
+
+							// The base layer only depends on the base packages, debco is
+							// copied into it from its package while it is installed.
+							baseNameVersions := slices.DeleteFunc(slices.Clone(requiredNameVersions), func(nameVersion string) bool {
+								return nameVersion == "debco"
+							})
+
+							baseLayer, err := createBaseLayer(c.Context, platformTempDir, packageDB, baseNameVersions, rx.Packages.Exclude, packageArchivesByID, unpackOpts)
+							if err != nil {
+								return err
+							}
+
+							if baseLayer != nil && !c.Bool("dev") {
+								baseLayer.SecondStageArchivePath, err = secondStageArchivePath(selectedDB, packageArchivesByID)
+								if err != nil {
+									return err
+								}
+							}
+
+							if baseLayer != nil && c.Bool("merge-archives") {
+								baseLayer.RootFSArchivePath = filepath.Join(filepath.Dir(baseLayer.DpkgDatabaseArchivePath), "rootfs.tar")
+								if err := unpack.MergeArchives(c.Context, baseLayer.RootFSArchivePath,
+									append([]string{baseLayer.DpkgDatabaseArchivePath}, baseLayer.DataArchivePaths...), sourceDateEpoch); err != nil {
+									return fmt.Errorf("failed to merge base package archives: %w", err)
+								}
+							}
+
+							platformOpts.BaseLayer = baseLayer
+						}
+
+						var diskToolsPackages []types.Package
+						if buildOpts.Output.Type == buildkit.OutputDisk {
+							slog.Info("Unpacking disk build tools")
+
+							platformOpts.DiskTools, diskToolsPackages, err = createDiskToolsLayer(c.Context, platformTempDir, packageDB, diskLayout, platform.Architecture, !c.Bool("dev"), fileConflictPolicy)
+							if err != nil {
+								return err
+							}
+						}
+
+						buildOpts.PlatformOpts = append(buildOpts.PlatformOpts, platformOpts)
+
+						// Only the packages left in the final image are recorded in the
+						// SBOM, the second-stage package is removed once the image has
+						// been provisioned. The provenance records every package used.
+						var packages, selectedPackages []types.Package
+						_ = selectedDB.ForEach(func(pkg types.Package) error {
+							selectedPackages = append(selectedPackages, pkg)
+
+							if pkg.Package.Name == "debco" && !c.Bool("dev") && !buildOpts.DownloadOnly {
+								return nil
+							}
+
+							packages = append(packages, pkg)
+							return nil
 						})
+
+						platformPackages = append(platformPackages, packages)
+						platformSelectedPackages = append(platformSelectedPackages, selectedPackages)
+						platformBuildPackages = append(platformBuildPackages, diskToolsPackages)
+						platformReleases = append(platformReleases, releases)
 					}
 
-					slog.Info("Building multi-platform image", slog.String("output", c.String("output")))
+					// Images that are pushed or loaded are only written to disk temporarily.
+					if c.Bool("push") || c.Bool("load") {
+						buildOpts.Output = buildkit.Output{
+							Type: buildkit.OutputOCI,
+							Dest: filepath.Join(tempDir, "image.tar"),
+						}
+					}
+
+					switch {
+					case buildOpts.DownloadOnly && buildOpts.Output.Type != buildkit.OutputOCI:
+						if err := writeRootFS(c.Context, buildOpts); err != nil {
+							return err
+						}
+					case buildOpts.DownloadOnly:
+						if err := writeOCIImage(c.Context, buildOpts.Output.Dest, buildOpts); err != nil {
+							return err
+						}
+					default:
+						slog.Info("Building multi-platform image", slog.String("output", buildOpts.Output.Dest))
 
-					if err := b.Build(c.Context, buildOpts); err != nil {
-						return fmt.Errorf("failed to build OCI image: %w", err)
+						if err := b.Build(c.Context, buildOpts); err != nil {
+							return fmt.Errorf("failed to build OCI image: %w", err)
+						}
+					}
+
+					// Images that are pushed or loaded don't have an output to write the
+					// SBOMs next to, so they are only attached to the image.
+					attestations, err := writeSBOMs(buildOpts, platformPackages, !(c.Bool("push") || c.Bool("load")))
+					if err != nil {
+						return err
+					}
+
+					if buildOpts.Output.Type == buildkit.OutputOCI {
+						// Download only images aren't built by BuildKit.
+						var buildkitVersion string
+						if b != nil {
+							buildkitVersion = b.Version()
+						}
+
+						// Signing is opt-in, as it needs a key.
+						if provenanceSigner == nil {
+							slog.Warn("Provenance is not signed, pass --provenance-key to sign it")
+						}
+
+						provenanceAttestations, err := newProvenanceAttestations(buildOpts, recipeData, buildkitVersion,
+							platformSelectedPackages, platformBuildPackages, platformReleases, provenanceSigner)
+						if err != nil {
+							return err
+						}
+
+						attestations = append(attestations, provenanceAttestations...)
+
+						slog.Info("Attaching attestations to image", slog.String("output", buildOpts.Output.Dest))
+
+						if err := oci.Attest(c.Context, filepath.Clean(buildOpts.Output.Dest), buildOpts.SourceDateEpoch, attestations); err != nil {
+							return fmt.Errorf("failed to attach attestations to image: %w", err)
+						}
+					}
+
+					// The attestations are attached before the image is pushed, which is
+					// why the image is pushed from the OCI archive rather than by
+					// BuildKit's image exporter.
+					if c.Bool("push") {
+						return oci.Push(c.Context, buildOpts.Output.Dest, buildOpts.Tags)
+					}
+
+					if c.Bool("load") {
+						return buildkit.LoadImage(c.Context, buildOpts.Output.Dest, buildOpts.Tags)
 					}
 
 					return nil
 				},
 			},
+			{
+				Name:      "push",
+				Usage:     "Push an already built OCI image archive to a registry",
+				ArgsUsage: "<image.tar> <registry/ref>...",
+				Flags:     persistentFlags,
+				Before:    util.BeforeAll(initConfig, initLogger),
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 2 {
+						return errors.New("an OCI image archive and at least one reference are required")
+					}
+
+					return oci.Push(c.Context, c.Args().First(), c.Args().Tail())
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "Manage the package download cache",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "info",
+						Usage:  "Show download cache usage",
+						Flags:  persistentFlags,
+						Before: util.BeforeAll(initConfig, initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+							if err != nil {
+								return fmt.Errorf("failed to open disk cache: %w", err)
+							}
+
+							stats, err := cache.Stats()
+							if err != nil {
+								return fmt.Errorf("failed to get cache stats: %w", err)
+							}
+
+							fmt.Printf("Directory: %s\n", stats.Dir)
+							fmt.Printf("Entries:   %d\n", stats.Entries)
+							fmt.Printf("Size:      %s\n", units.HumanSize(float64(stats.Size)))
+							if stats.Entries > 0 {
+								fmt.Printf("Oldest:    %s\n", stats.Oldest.Format(time.RFC3339))
+								fmt.Printf("Newest:    %s\n", stats.Newest.Format(time.RFC3339))
+							}
+
+							return nil
+						},
+					},
+					{
+						Name:   "list",
+						Usage:  "List download cache entries, least recently used first",
+						Flags:  persistentFlags,
+						Before: util.BeforeAll(initConfig, initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+							if err != nil {
+								return fmt.Errorf("failed to open disk cache: %w", err)
+							}
+
+							entries, err := cache.Entries()
+							if err != nil {
+								return fmt.Errorf("failed to list cache entries: %w", err)
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+							fmt.Fprintln(w, "ID\tSIZE\tLAST USED")
+							for _, e := range entries {
+								fmt.Fprintf(w, "%s\t%s\t%s\n", e.ID[:12], units.HumanSize(float64(e.Size)), e.LastUsed.Format(time.RFC3339))
+							}
+
+							return w.Flush()
+						},
+					},
+					{
+						Name:   "prune",
+						Usage:  "Evict download cache entries exceeding the configured size and age",
+						Flags:  append(cacheLimitFlags, persistentFlags...),
+						Before: util.BeforeAll(initConfig, initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							if c.String("cache-max-size") == "" && c.Duration("cache-max-age") == 0 {
+								return fmt.Errorf("at least one of --cache-max-size or --cache-max-age must be specified")
+							}
+
+							cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+							if err != nil {
+								return fmt.Errorf("failed to open disk cache: %w", err)
+							}
+
+							return pruneCache(c, cache)
+						},
+					},
+					{
+						Name:   "clear",
+						Usage:  "Remove all download cache entries",
+						Flags:  persistentFlags,
+						Before: util.BeforeAll(initConfig, initLogger, initCacheDir),
+						Action: func(c *cli.Context) error {
+							cache, err := diskcache.NewDiskCache(c.String("cache-dir"), "http")
+							if err != nil {
+								return fmt.Errorf("failed to open disk cache: %w", err)
+							}
+
+							result, err := cache.Clear()
+							if err != nil {
+								return fmt.Errorf("failed to clear cache: %w", err)
+							}
+
+							slog.Info("Cleared cache", slog.Int("entries", result.Entries),
+								slog.String("reclaimed", units.HumanSize(float64(result.Size))))
+
+							return nil
+						},
+					},
+				},
+			},
 			{
 				Name:        "second-stage",
 				Description: "Operations that will be run after the image is built",
@@ -369,7 +827,87 @@ func main() {
 						Flags:       persistentFlags,
 						Before:      util.BeforeAll(initLogger),
 						Action: func(_ *cli.Context) error {
-							return secondstage.MergeUsr()
+							return secondstage.MergeUsr("/")
+						},
+					},
+					{
+						// Preinst scripts are run before packages are configured.
+						Name:        "preinst",
+						Description: "Run the preinst scripts of packages as dpkg would during a fresh install",
+						Flags: append([]cli.Flag{
+							&cli.StringSliceFlag{
+								Name:  "package",
+								Usage: "Package to run the preinst script of (name:arch), in order",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							return secondstage.RunPreinst(c.Context, secondstage.DpkgAdminDir, c.StringSlice("package"))
+						},
+					},
+					{
+						Name:        "sync-rootfs",
+						Description: "Make the root filesystem identical to another root filesystem",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "source",
+								Usage:    "Root filesystem to synchronize from",
+								Required: true,
+							},
+							&cli.StringSliceFlag{
+								Name:  "exclude",
+								Usage: "Paths to leave untouched",
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							return secondstage.SyncRootFS(c.String("source"), "/", c.StringSlice("exclude"))
+						},
+					},
+					{
+						Name:        "build-disk",
+						Description: "Build a bootable disk image from a root filesystem",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "filename",
+								Aliases:  []string{"f"},
+								Usage:    "Recipe file to use",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "arch",
+								Usage:    "Architecture of the root filesystem",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "rootfs",
+								Usage:    "Root filesystem to build the disk image from",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "output",
+								Usage:    "Path to write the disk image to",
+								Required: true,
+							},
+						}, persistentFlags...),
+						Before: util.BeforeAll(initLogger),
+						Action: func(c *cli.Context) error {
+							recipeFile, err := os.Open(c.String("filename"))
+							if err != nil {
+								return fmt.Errorf("failed to open recipe file: %w", err)
+							}
+							defer recipeFile.Close()
+
+							rx, err := recipe.FromYAML(recipeFile)
+							if err != nil {
+								return fmt.Errorf("failed to read recipe: %w", err)
+							}
+
+							if rx.Disk == nil {
+								return errors.New("recipe has no disk section")
+							}
+
+							return disk.Build(c.Context, *rx.Disk, c.String("arch"), c.String("rootfs"), c.String("output"))
 						},
 					},
 					{
@@ -411,39 +949,34 @@ func main() {
 	}
 }
 
-func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispecs.Platform) (*database.PackageDB, time.Time, error) {
+// loadPackageDB loads the packages available for the platform from each of the
+// recipe's sources. It also returns the latest modification time of the
+// package indices, and the InRelease files of the sources.
+func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispecs.Platform) (*database.PackageDB, time.Time, []source.InRelease, error) {
 	var componentsMu sync.Mutex
 	var components []source.Component
 
-	var progressOutput io.Writer = os.Stdout
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
-		progressOutput = io.Discard
-	}
-
-	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
-	defer progress.Shutdown()
+	progressBars := progress.New(ctx)
+	defer progressBars.Shutdown()
 
 	{
 		sourceConfs := append([]latestrecipe.SourceConfig{}, rx.Sources...)
 
 		g, ctx := errgroup.WithContext(ctx)
 
-		bar := progress.AddBar(int64(len(sourceConfs)),
-			mpb.PrependDecorators(
-				decor.Name("Source: "),
-				decor.CountersNoUnit("%d / %d"),
-			),
-			mpb.AppendDecorators(
-				decor.Percentage(),
-			),
-		)
+		bar := progressBars.AddBar(progress.PhaseSource, "Source", int64(len(sourceConfs)))
 
 		for _, sourceConf := range sourceConfs {
 			sourceConf := sourceConf
 
-			g.Go(func() error {
+			g.Go(func() (err error) {
 				defer bar.Increment()
 
+				op := progress.Start(progress.PhaseSource, sourceConf.URL)
+				defer func() {
+					op.Done(err)
+				}()
+
 				s, err := source.NewSource(ctx, sourceConf)
 				if err != nil {
 					return fmt.Errorf("failed to create source: %w", err)
@@ -468,16 +1001,10 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 		}
 
 		err := g.Wait()
+		bar.Done(err)
 
 		if err != nil {
-			bar.Abort(true)
-		} else {
-			bar.SetTotal(bar.Current(), true)
-		}
-		bar.Wait()
-
-		if err != nil {
-			return nil, time.Time{}, fmt.Errorf("failed to get components: %w", err)
+			return nil, time.Time{}, nil, fmt.Errorf("failed to get components: %w", err)
 		}
 	}
 
@@ -487,22 +1014,19 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 	{
 		g, ctx := errgroup.WithContext(ctx)
 
-		bar := progress.AddBar(int64(len(components)),
-			mpb.PrependDecorators(
-				decor.Name("Repository: "),
-				decor.CountersNoUnit("%d / %d"),
-			),
-			mpb.AppendDecorators(
-				decor.Percentage(),
-			),
-		)
+		bar := progressBars.AddBar(progress.PhaseIndex, "Repository", int64(len(components)))
 
 		for _, component := range components {
 			component := component
 
-			g.Go(func() error {
+			g.Go(func() (err error) {
 				defer bar.Increment()
 
+				op := progress.Start(progress.PhaseIndex, component.URL.String())
+				defer func() {
+					op.Done(err)
+				}()
+
 				componentPackages, lastUpdated, err := component.Packages(ctx)
 				if err != nil {
 					return fmt.Errorf("failed to get packages: %w", err)
@@ -519,61 +1043,266 @@ func loadPackageDB(ctx context.Context, rx *latestrecipe.Recipe, platform ocispe
 		}
 
 		err := g.Wait()
+		bar.Done(err)
 
 		if err != nil {
-			bar.Abort(true)
-		} else {
-			bar.SetTotal(bar.Current(), true)
+			return nil, time.Time{}, nil, fmt.Errorf("failed to get packages: %w", err)
 		}
-		bar.Wait()
+	}
 
-		if err != nil {
-			return nil, time.Time{}, fmt.Errorf("failed to get packages: %w", err)
+	// Each source has a single InRelease file, shared by its components.
+	var releases []source.InRelease
+	for _, component := range components {
+		if !slices.Contains(releases, component.InRelease) {
+			releases = append(releases, component.InRelease)
+		}
+	}
+
+	slices.SortFunc(releases, func(a, b source.InRelease) int {
+		return strings.Compare(a.URL, b.URL)
+	})
+
+	return packageDB, sourceDateEpoch, releases, nil
+}
+
+// newBuildKit returns a client for the BuildKit daemon, either an existing
+// daemon (when --buildkit-addr is set) or one started in Docker.
+func newBuildKit(c *cli.Context, certsDir string) (*buildkit.BuildKit, error) {
+	if c.String("buildkit-addr") == "" {
+		daemonOpts := buildkit.DaemonOptions{
+			GCKeepDuration: c.Duration("buildkit-gc-keep-duration"),
+		}
+
+		if c.String("buildkit-gc-keep-storage") != "" {
+			var err error
+			daemonOpts.GCKeepStorage, err = units.FromHumanSize(c.String("buildkit-gc-keep-storage"))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse buildkit gc keep storage: %w", err)
+			}
 		}
+
+		// Start the BuildKit daemon.
+		b := buildkit.New("debco", certsDir, daemonOpts)
+		if err := b.StartDaemon(c.Context); err != nil {
+			return nil, fmt.Errorf("failed to start buildkit daemon: %w", err)
+		}
+
+		return b, nil
+	}
+
+	var tlsOpts *buildkit.TLSOptions
+	if c.String("buildkit-ca-cert") != "" {
+		tlsOpts = &buildkit.TLSOptions{
+			CACertPath: c.String("buildkit-ca-cert"),
+			CertPath:   c.String("buildkit-cert"),
+			KeyPath:    c.String("buildkit-key"),
+		}
+	} else if c.String("buildkit-cert") != "" || c.String("buildkit-key") != "" {
+		return nil, errors.New("--buildkit-ca-cert is required when using a client certificate")
 	}
 
-	return packageDB, sourceDateEpoch, nil
+	slog.Info("Using existing BuildKit daemon", slog.String("address", c.String("buildkit-addr")))
+
+	return buildkit.NewWithAddress(c.String("buildkit-addr"), tlsOpts)
 }
 
-func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *database.PackageDB) ([]string, error) {
-	var progressOutput io.Writer = os.Stdout
-	if slog.Default().Enabled(ctx, slog.LevelDebug) {
-		progressOutput = io.Discard
+// createBaseLayer unpacks the base packages (those selected by default,
+// without any of the recipe's additions) into their own dpkg database. It
+// returns nil if the base packages are not a subset of the selected packages,
+// in which case the image can't be split into layers.
+func createBaseLayer(ctx context.Context, platformTempDir string, packageDB *database.PackageDB, requiredNameVersions, excludeNameVersions []string, packageArchivesByID map[string]unpack.Archives, opts unpack.Options) (*buildkit.LayerOptions, error) {
+	if len(requiredNameVersions) == 0 {
+		slog.Warn("No base packages (eg. omitRequired is set), building a single layer image")
+		return nil, nil
 	}
 
-	progress := mpb.NewWithContext(ctx, mpb.WithOutput(progressOutput))
-	defer progress.Shutdown()
+	baseDB, err := resolve.Resolve(packageDB, requiredNameVersions, excludeNameVersions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve base packages: %w", err)
+	}
+
+	var baseArchives []unpack.Archives
+	err = baseDB.ForEach(func(pkg types.Package) error {
+		archives, ok := packageArchivesByID[pkg.ID()]
+		if !ok {
+			return fmt.Errorf("base package %s is not selected", pkg.ID())
+		}
 
-	bar := progress.AddBar(int64(selectedDB.Len()),
-		mpb.PrependDecorators(
-			decor.Name("Downloading: "),
-			decor.CountersNoUnit("%d / %d"),
-		),
-		mpb.AppendDecorators(
-			decor.Percentage(),
-		),
-	)
+		baseArchives = append(baseArchives, archives)
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Base packages differ from the selected packages, building a single layer image",
+			slog.Any("error", err))
+		return nil, nil
+	}
+
+	slices.SortFunc(baseArchives, func(a, b unpack.Archives) int {
+		return strings.Compare(a.DataArchivePath, b.DataArchivePath)
+	})
+
+	// The base layer has its own dpkg database.
+	baseTempDir := filepath.Join(platformTempDir, "base")
+	if err := os.MkdirAll(baseTempDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create base temp directory: %w", err)
+	}
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(ctx, baseTempDir, baseArchives, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unpack base packages: %w", err)
+	}
+
+	return &buildkit.LayerOptions{
+		DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
+		DataArchivePaths:        dataArchivePaths,
+		PreinstPackages:         preinstPackages(baseDB),
+	}, nil
+}
+
+// createDiskToolsLayer resolves, downloads and unpacks the packages needed to
+// build a disk image (eg. mkfs and the bootloader) into their own dpkg
+// database. These packages are installed into a separate root filesystem,
+// they are not part of the image. It also returns the resolved packages.
+func createDiskToolsLayer(ctx context.Context, platformTempDir string, packageDB *database.PackageDB, layout *disk.Layout, arch string, withDebco bool, fileConflictPolicy unpack.ConflictPolicy) (*buildkit.LayerOptions, []types.Package, error) {
+	toolNameVersions, err := disk.ToolPackages(layout, arch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if withDebco {
+		toolNameVersions = append(toolNameVersions, "debco")
+	}
+
+	_ = packageDB.ForEach(func(pkg types.Package) error {
+		if pkg.Priority == "required" {
+			toolNameVersions = append(toolNameVersions, pkg.Package.Name)
+		}
+
+		return nil
+	})
+
+	toolsDB, err := resolve.Resolve(packageDB, toolNameVersions, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve disk build tools: %w", err)
+	}
+
+	toolsTempDir := filepath.Join(platformTempDir, "disk-tools")
+	if err := os.MkdirAll(toolsTempDir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create disk tools temp directory: %w", err)
+	}
+
+	toolsArchives, _, err := downloadSelectedPackages(ctx, toolsTempDir, toolsDB)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dpkgDatabaseArchivePath, dataArchivePaths, err := unpack.CreateDatabase(ctx, toolsTempDir, toolsArchives, unpack.Options{
+		FileConflicts: fileConflictPolicy,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unpack disk build tools: %w", err)
+	}
+
+	var toolsPackages []types.Package
+	_ = toolsDB.ForEach(func(pkg types.Package) error {
+		toolsPackages = append(toolsPackages, pkg)
+		return nil
+	})
+
+	return &buildkit.LayerOptions{
+		DpkgDatabaseArchivePath: dpkgDatabaseArchivePath,
+		DataArchivePaths:        dataArchivePaths,
+		PreinstPackages:         preinstPackages(toolsDB),
+	}, toolsPackages, nil
+}
+
+// secondStageArchivePath returns the path to the data archive of the
+// selected debco package.
+func secondStageArchivePath(selectedDB *database.PackageDB, packageArchivesByID map[string]unpack.Archives) (string, error) {
+	var path string
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		if pkg.Package.Name == "debco" {
+			path = packageArchivesByID[pkg.ID()].DataArchivePath
+		}
+
+		return nil
+	})
+
+	if path == "" {
+		return "", errors.New("the debco package is not selected")
+	}
+
+	return path, nil
+}
+
+// preinstPackages returns the selected packages (in the form name:arch) in
+// the order their preinst scripts should be run, which is the order dpkg
+// would unpack them in during a fresh install.
+func preinstPackages(selectedDB *database.PackageDB) []string {
+	var pkgs []string
+	for _, pkg := range resolve.PreDependsOrder(selectedDB) {
+		pkgs = append(pkgs, pkg.Name+":"+pkg.Architecture.String())
+	}
+
+	slog.Debug("Planned preinst order", slog.Any("packages", pkgs))
+
+	return pkgs
+}
+
+// downloadSelectedPackages downloads and decompresses the selected packages.
+// Packages are decompressed as they are downloaded, so that the package
+// archive itself never needs to be written to disk. It returns the archives of
+// each package (in a deterministic order), and the same archives keyed by
+// package ID.
+func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *database.PackageDB) ([]unpack.Archives, map[string]unpack.Archives, error) {
+	progressBars := progress.New(ctx)
+	defer progressBars.Shutdown()
+
+	var downloadSize, installedSize int64
+	_ = selectedDB.ForEach(func(pkg types.Package) error {
+		downloadSize += int64(pkg.Size)
+		installedSize += int64(pkg.InstalledSize) * 1024
+		return nil
+	})
+
+	slog.Info("Downloading selected packages",
+		slog.Int("packages", selectedDB.Len()),
+		slog.String("downloadSize", units.HumanSize(float64(downloadSize))),
+		slog.String("installedSize", units.HumanSize(float64(installedSize))))
+
+	bar := progressBars.AddBytesBar(progress.PhaseDownload, "Downloading", downloadSize)
 
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(10)
 
-	var packagePathsMu sync.Mutex
-	var packagePaths []string
+	var packageArchivesMu sync.Mutex
+	var packageArchives []unpack.Archives
+	packageArchivesByID := make(map[string]unpack.Archives)
 
 	_ = selectedDB.ForEach(func(pkg types.Package) error {
 		g.Go(func() error {
-			defer bar.Increment()
+			// Weak checksums have already been rejected (unless allowed) when
+			// the package index was retrieved.
+			checksum, err := hashreader.Strongest(pkg.Checksums(), true)
+			if err != nil {
+				return fmt.Errorf("failed to verify package %s: %w", pkg.ID(), err)
+			}
 
 			var errs error
-			for _, pkgURL := range util.Shuffle(pkg.URLs) {
+			pkgURLs := util.Shuffle(pkg.URLs)
+			for i, pkgURL := range pkgURLs {
 				slog.Debug("Downloading package", slog.String("url", pkgURL))
 
-				packagePath, err := downloadPackage(ctx, tempDir, pkgURL, pkg.SHA256)
+				// If the download fails it is retried from the next mirror.
+				retry := i < len(pkgURLs)-1
+
+				archives, err := downloadPackage(ctx, bar, tempDir, pkgURL, *checksum, retry)
 				errs = errors.Join(errs, err)
 				if err == nil {
-					packagePathsMu.Lock()
-					packagePaths = append(packagePaths, packagePath)
-					packagePathsMu.Unlock()
+					packageArchivesMu.Lock()
+					packageArchives = append(packageArchives, *archives)
+					packageArchivesByID[pkg.ID()] = *archives
+					packageArchivesMu.Unlock()
 					errs = nil
 					break
 				}
@@ -589,61 +1318,92 @@ func downloadSelectedPackages(ctx context.Context, tempDir string, selectedDB *d
 	})
 
 	err := g.Wait()
+	bar.Done(err)
 
 	if err != nil {
-		bar.Abort(true)
-	} else {
-		bar.SetTotal(bar.Current(), true)
+		return nil, nil, fmt.Errorf("failed to download packages: %w", err)
 	}
-	bar.Wait()
 
-	if err != nil {
-		return nil, fmt.Errorf("failed to download packages: %w", err)
-	}
-
-	// Sort the package filenames so that they are in a deterministic order.
-	slices.Sort(packagePaths)
+	// Sort the packages by filename so that they are in a deterministic order.
+	slices.SortFunc(packageArchives, func(a, b unpack.Archives) int {
+		return strings.Compare(a.DataArchivePath, b.DataArchivePath)
+	})
 
-	return packagePaths, nil
+	return packageArchives, packageArchivesByID, nil
 }
 
-func downloadPackage(ctx context.Context, downloadDir, pkgURL, sha256 string) (string, error) {
+func downloadPackage(ctx context.Context, bar *progress.Bar, downloadDir, pkgURL string, checksum hashreader.Checksum, retry bool) (_ *unpack.Archives, err error) {
+	op := progress.Start(progress.PhaseDownload, pkgURL)
+	defer func() {
+		// The package will be downloaded again, so account for the wasted bytes.
+		if err != nil && retry {
+			bar.ExtendTotal(op.Bytes())
+		}
+
+		op.Done(err)
+	}()
+
 	url, err := url.Parse(pkgURL)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse package URL: %w", err)
+		return nil, fmt.Errorf("failed to parse package URL: %w", err)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to download package: %w", err)
+		return nil, fmt.Errorf("failed to download package: %w", err)
 	}
 	defer resp.Body.Close()
 
-	// Read the package completely so the cache can be populated.
-	hr := hashreader.NewReader(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download package: %s", resp.Status)
+	}
 
-	packageFile, err := os.Create(filepath.Join(downloadDir, filepath.Base(url.Path)))
+	hr, err := hashreader.NewReader(bar.Reader(op.Reader(resp.Body)), checksum)
 	if err != nil {
-		return "", fmt.Errorf("failed to create package file: %w", err)
+		return nil, fmt.Errorf("failed to create hash reader: %w", err)
 	}
-	defer packageFile.Close()
 
-	if _, err := io.Copy(packageFile, hr); err != nil {
-		_ = packageFile.Close()
-		return "", fmt.Errorf("failed to read package: %w", err)
+	// Decompress the package while it is being downloaded, nothing is kept
+	// unless the package matches the checksum.
+	archives, err := unpack.DecompressPackage(hr, downloadDir, filepath.Base(url.Path), hr.Verify)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress package: %w", err)
 	}
 
-	if err := hr.Verify(sha256); err != nil {
-		_ = packageFile.Close()
-		return "", fmt.Errorf("failed to verify package: %w", err)
+	return archives, nil
+}
+
+func pruneCache(c *cli.Context, cache *diskcache.DiskCache) error {
+	var maxSize int64
+	if c.String("cache-max-size") != "" {
+		var err error
+		maxSize, err = units.FromHumanSize(c.String("cache-max-size"))
+		if err != nil {
+			return fmt.Errorf("failed to parse cache max size: %w", err)
+		}
+	}
+
+	maxAge := c.Duration("cache-max-age")
+	if maxSize == 0 && maxAge == 0 {
+		return nil
+	}
+
+	result, err := cache.Prune(maxSize, maxAge)
+	if err != nil {
+		return fmt.Errorf("failed to prune cache: %w", err)
+	}
+
+	if result.Entries > 0 {
+		slog.Info("Pruned cache", slog.Int("entries", result.Entries),
+			slog.String("reclaimed", units.HumanSize(float64(result.Size))))
 	}
 
-	return packageFile.Name(), nil
+	return nil
 }
 
 func toOCIImageConfig(rx *latestrecipe.Recipe) ocispecs.ImageConfig {
@@ -663,3 +1423,203 @@ func toOCIImageConfig(rx *latestrecipe.Recipe) ocispecs.ImageConfig {
 		StopSignal:   rx.Container.StopSignal,
 	}
 }
+
+// writeOCIImage writes a download only image without BuildKit. If the output
+// path is a directory (or ends with a path separator) an OCI image layout is
+// written, otherwise an OCI image archive.
+func writeOCIImage(ctx context.Context, outputPath string, buildOpts buildkit.BuildOptions) error {
+	opts := oci.Options{
+		Tags:            buildOpts.Tags,
+		ImageConf:       buildOpts.ImageConf,
+		SourceDateEpoch: buildOpts.SourceDateEpoch,
+	}
+
+	for _, platformOpt := range buildOpts.PlatformOpts {
+		opts.Images = append(opts.Images, oci.PlatformImage{
+			Platform:   platformOpt.Platform,
+			LayerPaths: []string{platformOpt.RootFSArchivePath},
+		})
+	}
+
+	if fi, err := os.Stat(outputPath); (err == nil && fi.IsDir()) || strings.HasSuffix(outputPath, string(filepath.Separator)) {
+		slog.Info("Writing OCI image layout", slog.String("output", outputPath))
+
+		if err := oci.WriteLayout(ctx, outputPath, opts); err != nil {
+			return fmt.Errorf("failed to write OCI image layout: %w", err)
+		}
+
+		return nil
+	}
+
+	slog.Info("Writing OCI image archive", slog.String("output", outputPath))
+
+	if err := oci.WriteArchive(ctx, outputPath, opts); err != nil {
+		return fmt.Errorf("failed to write OCI image archive: %w", err)
+	}
+
+	return nil
+}
+
+// writeSBOMs generates SPDX and CycloneDX SBOMs for the image of each
+// platform, from the packages installed in it. The SBOMs are written next to
+// the output (if writeFiles is set), and are returned as attestations (to be
+// attached to OCI images).
+func writeSBOMs(buildOpts buildkit.BuildOptions, platformPackages [][]types.Package, writeFiles bool) ([]oci.Attestation, error) {
+	isMultiPlatform := len(buildOpts.PlatformOpts) > 1
+
+	output := buildkit.Output{Type: buildOpts.Output.Type, Dest: filepath.Clean(buildOpts.Output.Dest)}
+
+	name := strings.TrimSuffix(filepath.Base(output.Dest), filepath.Ext(output.Dest))
+	if len(buildOpts.Tags) > 0 {
+		name = buildOpts.Tags[0]
+	}
+
+	var attestations []oci.Attestation
+	for i, platformOpt := range buildOpts.PlatformOpts {
+		opts := sbom.Options{
+			Name:        name,
+			Platform:    platformOpt.Platform,
+			Created:     buildOpts.SourceDateEpoch,
+			ToolVersion: constants.Version,
+			Packages:    platformPackages[i],
+		}
+
+		dest := output.PlatformDest(platformOpt.Platform, isMultiPlatform)
+		basePath := strings.TrimSuffix(dest, filepath.Ext(dest))
+		if output.Type == buildkit.OutputLocal {
+			basePath = dest
+		}
+
+		for _, format := range []struct {
+			ext           string
+			predicateType string
+			write         func(io.Writer, sbom.Options) error
+		}{
+			{".spdx.json", sbom.PredicateTypeSPDX, sbom.WriteSPDX},
+			{".cdx.json", sbom.PredicateTypeCycloneDX, sbom.WriteCycloneDX},
+		} {
+			var buf bytes.Buffer
+			if err := format.write(&buf, opts); err != nil {
+				return nil, fmt.Errorf("failed to generate SBOM: %w", err)
+			}
+
+			if writeFiles {
+				slog.Info("Writing SBOM", slog.String("output", basePath+format.ext))
+
+				if err := os.WriteFile(basePath+format.ext, buf.Bytes(), 0o644); err != nil {
+					return nil, fmt.Errorf("failed to write SBOM: %w", err)
+				}
+			}
+
+			attestations = append(attestations, oci.Attestation{
+				Platform:      platformOpt.Platform,
+				PredicateType: format.predicateType,
+				Predicate:     buf.Bytes(),
+			})
+		}
+	}
+
+	return attestations, nil
+}
+
+// newProvenanceAttestations generates SLSA provenance for the image of each
+// platform. The provenance is signed if a signer is given.
+func newProvenanceAttestations(buildOpts buildkit.BuildOptions, recipeData []byte, buildkitVersion string, platformPackages, platformBuildPackages [][]types.Package, platformReleases [][]source.InRelease, signer *provenance.Signer) ([]oci.Attestation, error) {
+	recipeSHA256 := sha256.Sum256(recipeData)
+
+	var attestations []oci.Attestation
+	for i, platformOpt := range buildOpts.PlatformOpts {
+		predicate, err := provenance.Predicate(provenance.Options{
+			RecipePath:      buildOpts.RecipePath,
+			RecipeSHA256:    hex.EncodeToString(recipeSHA256[:]),
+			Platform:        platformOpt.Platform,
+			ToolVersion:     constants.Version,
+			BuildKitVersion: buildkitVersion,
+			Releases:        platformReleases[i],
+			Packages:        platformPackages[i],
+			BuildPackages:   platformBuildPackages[i],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate provenance: %w", err)
+		}
+
+		attestation := oci.Attestation{
+			Platform:      platformOpt.Platform,
+			PredicateType: provenance.PredicateType,
+			Predicate:     predicate,
+		}
+
+		if signer != nil {
+			attestation.Signer = signer
+		}
+
+		attestations = append(attestations, attestation)
+	}
+
+	return attestations, nil
+}
+
+// writeRootFS writes the root filesystem of a download only image without
+// BuildKit, as a tarball or directory for each platform.
+func writeRootFS(ctx context.Context, buildOpts buildkit.BuildOptions) error {
+	isMultiPlatform := len(buildOpts.PlatformOpts) > 1
+
+	for _, platformOpt := range buildOpts.PlatformOpts {
+		dest := buildOpts.Output.PlatformDest(platformOpt.Platform, isMultiPlatform)
+
+		switch buildOpts.Output.Type {
+		case buildkit.OutputTar:
+			slog.Info("Writing root filesystem archive", slog.String("output", dest))
+
+			if err := copyFile(platformOpt.RootFSArchivePath, dest); err != nil {
+				return fmt.Errorf("failed to write root filesystem archive: %w", err)
+			}
+		case buildkit.OutputLocal:
+			slog.Info("Writing root filesystem directory", slog.String("output", dest))
+
+			if err := unpack.ExtractArchive(ctx, platformOpt.RootFSArchivePath, dest); err != nil {
+				return fmt.Errorf("failed to write root filesystem directory: %w", err)
+			}
+		default:
+			return fmt.Errorf("unsupported output type: %s", buildOpts.Output.Type)
+		}
+	}
+
+	return nil
+}
+
+func copyFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+func toPathFilters(filterConfs []latestrecipe.PathFilterConfig) ([]unpack.PathFilter, error) {
+	var filters []unpack.PathFilter
+	for _, filterConf := range filterConfs {
+		switch {
+		case filterConf.Exclude != "" && filterConf.Include == "":
+			filters = append(filters, unpack.PathFilter{Pattern: filterConf.Exclude})
+		case filterConf.Include != "" && filterConf.Exclude == "":
+			filters = append(filters, unpack.PathFilter{Include: true, Pattern: filterConf.Include})
+		default:
+			return nil, fmt.Errorf("path filter must specify exactly one of exclude or include")
+		}
+	}
+
+	return filters, nil
+}